@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/warriorguo/gopy/pkg/coverage"
+)
+
+func main() {
+	var htmlFile = flag.String("html", "", "write an annotated HTML report to this file")
+	var output = flag.String("o", "", "write the merged profile to this file")
+	var quiet = flag.Bool("q", false, "do not print the text report")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] coverage.json...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Merges coverage profiles written by py2vm -coverage and reports on them.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	profile := coverage.NewProfile()
+	for _, path := range flag.Args() {
+		p, err := coverage.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading coverage: %v\n", err)
+			os.Exit(1)
+		}
+		profile.Merge(p)
+	}
+
+	if !*quiet {
+		profile.WriteText(os.Stdout)
+	}
+	if *output != "" {
+		if err := profile.WriteFile(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing coverage: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *htmlFile != "" {
+		out, err := os.Create(*htmlFile)
+		if err == nil {
+			err = profile.WriteHTML(out, nil)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing HTML report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/warriorguo/gopy/pkg/lsp"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Speaks the Language Server Protocol on stdin and stdout.\n")
+	}
+	flag.Parse()
+
+	server := lsp.NewServer(os.Stdin, os.Stdout)
+	if err := server.Serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "gopy-lsp: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/lint"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func main() {
+	var jsonOutput = flag.Bool("json", false, "print the problems as a JSON array")
+	var enable = flag.String("enable", "", "comma-separated rules to check (default: all)")
+	var disable = flag.String("disable", "", "comma-separated rules not to check")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] source.py...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Reports likely mistakes in Python scripts without running them.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "Rules:\n%s", lint.RuleList())
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	linter := lint.NewLinter(vm.NewVM().BuiltinNames())
+	if *enable != "" {
+		for _, rule := range lint.Rules {
+			linter.SetEnabled(rule, false)
+		}
+		setRules(linter, *enable, true)
+	}
+	setRules(linter, *disable, false)
+
+	problems := []lint.Problem{}
+	for _, path := range flag.Args() {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+			os.Exit(1)
+		}
+		problems = append(problems, linter.CheckSource(path, string(source))...)
+	}
+
+	if *jsonOutput {
+		out, err := json.MarshalIndent(problems, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding problems: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	} else {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func setRules(linter *lint.Linter, list string, enabled bool) {
+	if list == "" {
+		return
+	}
+	for _, name := range strings.Split(list, ",") {
+		rule, err := lint.ParseRule(strings.TrimSpace(name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		linter.SetEnabled(rule, enabled)
+	}
+}
@@ -6,16 +6,22 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/warriorguo/gopy/pkg/compiler"
 	"github.com/warriorguo/gopy/pkg/lexer"
 	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/transpiler"
 )
 
 func main() {
-	var outputFile = flag.String("o", "", "output bytecode file")
+	var outputFile = flag.String("o", "", "output file (default: source name with .pyc, or .c for -target c)")
 	var verbose = flag.Bool("v", false, "verbose output")
 	var disasm = flag.Bool("d", false, "disassemble bytecode")
+	var disasmFormat = flag.String("dformat", "text", "format of -d output: text or json")
+	var optLevel = flag.Int("O", compiler.OptNone, "optimization level: 0 none, 1 peephole, 2 also remove dead code")
+	var backendName = flag.String("backend", compiler.DefaultBackend.String(), "code to generate: stack, or register to also generate register code (experimental)")
+	var target = flag.String("target", "bytecode", "output to generate: bytecode, or c for a C99 program that includes "+transpiler.CRuntimeHeader+", written next to it")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] source.py\n", os.Args[0])
@@ -32,10 +38,28 @@ func main() {
 
 	sourceFile := flag.Arg(0)
 
+	if *target != "bytecode" && *target != "c" {
+		fmt.Fprintf(os.Stderr, "Error: unknown target %q (want bytecode or c)\n", *target)
+		os.Exit(1)
+	}
+
 	if *outputFile == "" {
 		ext := filepath.Ext(sourceFile)
 		base := strings.TrimSuffix(sourceFile, ext)
 		*outputFile = base + ".pyc"
+		if *target == "c" {
+			*outputFile = base + ".c"
+		}
+	}
+
+	backend, err := compiler.ParseBackend(*backendName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	// C is generated from the register code.
+	if *target == "c" {
+		backend = compiler.BackendRegister
 	}
 
 	if *verbose {
@@ -48,16 +72,9 @@ func main() {
 		os.Exit(1)
 	}
 
-	l := lexer.NewLexer(string(source))
-	tokens := l.AllTokens()
-
-	if *verbose {
-		fmt.Printf("Lexed %d tokens\n", len(tokens))
-	}
-
-	module, err := parser.Parse(tokens)
+	module, err := parser.ParseFile(sourceFile, string(source))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+		printSyntaxErrors(err)
 		os.Exit(1)
 	}
 
@@ -65,18 +82,40 @@ func main() {
 		fmt.Printf("Parsed AST with %d statements\n", len(module.Body))
 	}
 
-	code, err := compiler.Compile(module)
+	c := compiler.NewCompiler()
+	c.SetFilename(sourceFile)
+	c.SetBackend(backend)
+	code, err := c.Compile(module)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Compile error: %v\n", err)
 		os.Exit(1)
 	}
 
+	if err := compiler.Optimize(code, *optLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "Optimize error: %v\n", err)
+		os.Exit(1)
+	}
+
 	if *verbose {
 		fmt.Printf("Generated %d instructions\n", len(code.Instructions))
+		if code.Registers != nil {
+			fmt.Printf("Generated %d register instructions\n", len(code.Registers.Instructions))
+		}
 	}
 
 	if *disasm {
-		fmt.Println(code.Disassemble())
+		if err := compiler.WriteDisassembly(os.Stdout, code, *disasmFormat, string(source)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error disassembling: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *target == "c" {
+		writeC(code, string(source), *outputFile)
+		if *verbose {
+			fmt.Printf("Successfully compiled to %s\n", *outputFile)
+		}
+		return
 	}
 
 	file, err := os.Create(*outputFile)
@@ -86,7 +125,8 @@ func main() {
 	}
 	defer file.Close()
 
-	err = code.Serialize(file)
+	header := compiler.NewFileHeader(source, modTime(sourceFile))
+	err = compiler.WriteBytecode(file, code, header)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing bytecode: %v\n", err)
 		os.Exit(1)
@@ -96,3 +136,47 @@ func main() {
 		fmt.Printf("Successfully compiled to %s\n", *outputFile)
 	}
 }
+
+// writeC writes the C program of code to outputFile and the runtime header
+// it includes next to it.
+func writeC(code *compiler.CodeObject, source, outputFile string) {
+	program, err := transpiler.GenerateC(code, transpiler.COptions{Source: source})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating C: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(outputFile, program, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", outputFile, err)
+		os.Exit(1)
+	}
+	header := filepath.Join(filepath.Dir(outputFile), transpiler.CRuntimeHeader)
+	if err := os.WriteFile(header, []byte(transpiler.CRuntime), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", header, err)
+		os.Exit(1)
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func printSyntaxErrors(err error) {
+	errs, ok := err.(parser.ErrorList)
+	if !ok {
+		errs = parser.ErrorList{err}
+	}
+	for _, err := range errs {
+		switch e := err.(type) {
+		case *lexer.IndentationError:
+			fmt.Fprintln(os.Stderr, e.Detailed())
+		case *lexer.SyntaxError:
+			fmt.Fprintln(os.Stderr, e.Detailed())
+		default:
+			fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+		}
+	}
+}
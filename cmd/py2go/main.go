@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/transpiler"
+)
+
+func main() {
+	var outputFile = flag.String("o", "", "output Go file (default: source name with .go)")
+	var packageName = flag.String("package", "", "name of the generated package (default: from the output file name)")
+	var optLevel = flag.Int("O", compiler.OptNone, "optimization level of the embedded stack code: 0 none, 1 peephole, 2 also remove dead code")
+	var verbose = flag.Bool("v", false, "list which code objects were translated")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] source.py|prog.pyc\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Translates a module to a Go package whose Run(vm) runs it natively. Code that\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "cannot be translated, such as bytecode without register code, runs from the\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "bytecode embedded in the package.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	path := flag.Arg(0)
+
+	if *outputFile == "" {
+		*outputFile = strings.TrimSuffix(path, filepath.Ext(path)) + ".go"
+	}
+	if *packageName == "" {
+		*packageName = defaultPackage(*outputFile)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+
+	var code *compiler.CodeObject
+	if filepath.Ext(path) == ".pyc" {
+		code, err = compiler.DeserializeCodeObject(bytes.NewReader(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading bytecode %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	} else {
+		module, err := parser.ParseFile(path, string(data))
+		if err != nil {
+			printSyntaxErrors(err)
+			os.Exit(1)
+		}
+		c := compiler.NewCompiler()
+		c.SetFilename(path)
+		c.SetBackend(compiler.BackendRegister)
+		code, err = c.Compile(module)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Compile error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := compiler.Optimize(code, *optLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "Optimize error: %v\n", err)
+		os.Exit(1)
+	}
+
+	result, err := transpiler.Generate(code, transpiler.Options{Package: *packageName, Source: path})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating Go: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *verbose {
+		for _, name := range result.Native {
+			fmt.Printf("native      %s\n", name)
+		}
+		for _, name := range result.Interpreted {
+			fmt.Printf("interpreted %s\n", name)
+		}
+	}
+
+	if err := os.WriteFile(*outputFile, result.Source, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *outputFile, err)
+		os.Exit(1)
+	}
+}
+
+// defaultPackage derives a package name from the name of the output file.
+func defaultPackage(outputFile string) string {
+	base := strings.TrimSuffix(filepath.Base(outputFile), filepath.Ext(outputFile))
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, base)
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "py" + name
+	}
+	return name
+}
+
+func printSyntaxErrors(err error) {
+	errs, ok := err.(parser.ErrorList)
+	if !ok {
+		errs = parser.ErrorList{err}
+	}
+	for _, err := range errs {
+		switch e := err.(type) {
+		case *lexer.IndentationError:
+			fmt.Fprintln(os.Stderr, e.Detailed())
+		case *lexer.SyntaxError:
+			fmt.Fprintln(os.Stderr, e.Detailed())
+		default:
+			fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+		}
+	}
+}
@@ -2,20 +2,33 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/coverage"
+	"github.com/warriorguo/gopy/pkg/debugger"
 	"github.com/warriorguo/gopy/pkg/lexer"
 	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/profiler"
 	"github.com/warriorguo/gopy/pkg/vm"
 )
 
 func main() {
 	var verbose = flag.Bool("v", false, "verbose output")
 	var disasm = flag.Bool("d", false, "disassemble bytecode before execution")
+	var disasmFormat = flag.String("dformat", "text", "format of -d output: text or json")
+	var timeout = flag.Duration("timeout", 0, "abort execution after this duration (0 = no limit)")
+	var maxInstructions = flag.Int64("max-instructions", 0, "abort execution after this many instructions (0 = no limit)")
+	var maxDepth = flag.Int("max-depth", vm.DefaultMaxRecursionDepth, "maximum call depth")
+	var memoryLimit = flag.Int64("memory-limit", 0, "approximate allocation budget in bytes (0 = no limit)")
+	var debug = flag.Bool("debug", false, "run under the interactive debugger")
+	var profile = flag.Bool("profile", false, "print a profile of functions, lines and opcodes to stderr")
+	var pprofFile = flag.String("pprof", "", "write a pprof profile of the run to this file")
+	var coverageFile = flag.String("coverage", "", "merge line and branch coverage of the run into this JSON file")
 	
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [bytecode.pyc]\n", os.Args[0])
@@ -45,24 +58,64 @@ func main() {
 	}
 	defer file.Close()
 	
-	code, err := compiler.DeserializeCodeObject(file)
+	code, header, err := compiler.ReadBytecode(file)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading bytecode: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error reading bytecode %s: %v\n", bytecodeFile, err)
 		os.Exit(1)
 	}
+	source, _ := os.ReadFile(code.Filename)
+	if source != nil && header.HasSource() && !header.Matches(source) {
+		fmt.Fprintf(os.Stderr, "Warning: %s is out of date with %s; recompile it\n", bytecodeFile, code.Filename)
+		source = nil
+	}
 	
 	if *verbose {
 		fmt.Printf("Loaded code object: %s\n", code.Name)
 	}
 	
 	if *disasm {
-		fmt.Println(code.Disassemble())
+		if err := compiler.WriteDisassembly(os.Stdout, code, *disasmFormat, string(source)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error disassembling: %v\n", err)
+			os.Exit(1)
+		}
 	}
 	
 	vm := vm.NewVM()
+	vm.SetTimeout(*timeout)
+	vm.SetMaxInstructions(*maxInstructions)
+	vm.SetMaxRecursionDepth(*maxDepth)
+	vm.SetMemoryLimit(*memoryLimit)
+	if *debug {
+		console := debugger.NewConsole(os.Stdin, os.Stdout)
+		d := debugger.New(vm, console.Handle)
+		d.SetStopOnEntry(true)
+		fmt.Println("Debugging", code.Filename, "- type help for a list of commands")
+	}
+	var prof *profiler.Profiler
+	if *profile || *pprofFile != "" {
+		prof = profiler.Start(vm)
+	}
+	var cover *coverage.Collector
+	if *coverageFile != "" {
+		cover = coverage.Start(vm)
+	}
 	result, err := vm.Run(code)
+	if cover != nil {
+		cover.Stop()
+		if err := cover.Profile().MergeFile(*coverageFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing coverage: %v\n", err)
+		}
+	}
+	if prof != nil {
+		prof.Stop()
+		writeProfile(prof, *profile, *pprofFile)
+	}
+	if errors.Is(err, debugger.ErrAborted) {
+		// The user quit the debugger.
+		return
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Runtime error: %v\n", err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 	
@@ -71,6 +124,25 @@ func main() {
 	}
 }
 
+func writeProfile(prof *profiler.Profiler, text bool, pprofFile string) {
+	if text {
+		prof.WriteText(os.Stderr, 20)
+	}
+	if pprofFile == "" {
+		return
+	}
+	out, err := os.Create(pprofFile)
+	if err == nil {
+		err = prof.WritePprof(out)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing profile: %v\n", err)
+	}
+}
+
 func runREPL(verbose bool) {
 	fmt.Println("GoPy REPL - Python 2 Interpreter")
 	fmt.Println("Type 'exit' or 'quit' to exit")
@@ -94,7 +166,7 @@ func runREPL(verbose bool) {
 		}
 		
 		if err := executeREPLLine(line, vm, verbose); err != nil {
-			fmt.Printf("Error: %v\n", err)
+			fmt.Println(err)
 		}
 	}
 	
@@ -116,7 +188,7 @@ func executeREPLLine(source string, vm *vm.VM, verbose bool) error {
 		return fmt.Errorf("parse error: %v", err)
 	}
 	
-	code, err := compiler.Compile(module)
+	code, err := compiler.CompileFile(module, "<stdin>")
 	if err != nil {
 		return fmt.Errorf("compile error: %v", err)
 	}
@@ -125,9 +197,10 @@ func executeREPLLine(source string, vm *vm.VM, verbose bool) error {
 		fmt.Printf("Instructions: %d\n", len(code.Instructions))
 	}
 	
+	vm.SetSource("<stdin>", source)
 	result, err := vm.Run(code)
 	if err != nil {
-		return fmt.Errorf("runtime error: %v", err)
+		return err
 	}
 	
 	if verbose && result != nil && result.String() != "None" {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+)
+
+func main() {
+	var outputFile = flag.String("o", "", "output bytecode file")
+	var disasm = flag.Bool("d", false, "disassemble a bytecode file instead")
+	var disasmFormat = flag.String("dformat", "text", "format of -d output: text or json")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-o out.pyc] source.s\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -d prog.pyc\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Assembles gopy bytecode assembly, as printed by py2c -d, into a .pyc file.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	path := flag.Arg(0)
+
+	if *disasm {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		code, err := compiler.DeserializeCodeObject(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading bytecode %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		if err := compiler.WriteDisassembly(os.Stdout, code, *disasmFormat, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error disassembling: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+	code, err := compiler.Assemble(string(source))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	// The VM only loads verified bytecode, so reject bad code now.
+	if err := compiler.Verify(code); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+
+	if *outputFile == "" {
+		*outputFile = strings.TrimSuffix(path, filepath.Ext(path)) + ".pyc"
+	}
+	file, err := os.Create(*outputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	if err := code.Serialize(file); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing bytecode: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -7,6 +7,7 @@ type Position struct {
 
 type Node interface {
 	Pos() Position
+	End() Position // position just past the node's last character
 	String() string
 }
 
@@ -23,18 +24,22 @@ type Expr interface {
 type Module struct {
 	Body []Stmt
 	Position Position
+	EndPosition Position
 }
 
 func (m *Module) Pos() Position { return m.Position }
+func (m *Module) End() Position { return m.EndPosition }
 func (m *Module) String() string { return "Module" }
 
 type AssignStmt struct {
 	Target Expr
 	Value  Expr
 	Position    Position
+	EndPosition Position
 }
 
 func (a *AssignStmt) Pos() Position { return a.Position }
+func (a *AssignStmt) End() Position { return a.EndPosition }
 func (a *AssignStmt) String() string { return "AssignStmt" }
 func (a *AssignStmt) stmtNode() {}
 
@@ -43,27 +48,34 @@ type AugAssignStmt struct {
 	Op     string // "+=", "-=", etc.
 	Value  Expr
 	Position Position
+	EndPosition Position
 }
 
 func (a *AugAssignStmt) Pos() Position { return a.Position }
+func (a *AugAssignStmt) End() Position { return a.EndPosition }
 func (a *AugAssignStmt) String() string { return "AugAssignStmt" }
 func (a *AugAssignStmt) stmtNode() {}
 
 type ExprStmt struct {
 	Expr Expr
 	Position  Position
+	EndPosition Position
 }
 
 func (e *ExprStmt) Pos() Position { return e.Position }
+func (e *ExprStmt) End() Position { return e.EndPosition }
 func (e *ExprStmt) String() string { return "ExprStmt" }
 func (e *ExprStmt) stmtNode() {}
 
 type PrintStmt struct {
+	Dest Expr // optional "print >>dest, ..." target
 	Values []Expr
 	Position    Position
+	EndPosition Position
 }
 
 func (p *PrintStmt) Pos() Position { return p.Position }
+func (p *PrintStmt) End() Position { return p.EndPosition }
 func (p *PrintStmt) String() string { return "PrintStmt" }
 func (p *PrintStmt) stmtNode() {}
 
@@ -72,9 +84,11 @@ type IfStmt struct {
 	Body   []Stmt
 	Orelse []Stmt
 	Position    Position
+	EndPosition Position
 }
 
 func (i *IfStmt) Pos() Position { return i.Position }
+func (i *IfStmt) End() Position { return i.EndPosition }
 func (i *IfStmt) String() string { return "IfStmt" }
 func (i *IfStmt) stmtNode() {}
 
@@ -82,9 +96,11 @@ type WhileStmt struct {
 	Test Expr
 	Body []Stmt
 	Position  Position
+	EndPosition Position
 }
 
 func (w *WhileStmt) Pos() Position { return w.Position }
+func (w *WhileStmt) End() Position { return w.EndPosition }
 func (w *WhileStmt) String() string { return "WhileStmt" }
 func (w *WhileStmt) stmtNode() {}
 
@@ -93,37 +109,59 @@ type ForStmt struct {
 	Iter   Expr
 	Body   []Stmt
 	Position    Position
+	EndPosition Position
 }
 
 func (f *ForStmt) Pos() Position { return f.Position }
+func (f *ForStmt) End() Position { return f.EndPosition }
 func (f *ForStmt) String() string { return "ForStmt" }
 func (f *ForStmt) stmtNode() {}
 
 type FuncDef struct {
 	Name string
 	Args []string
+	NamePosition Position // position of Name
+	ArgPositions []Position // positions of Args
 	Body []Stmt
 	Position  Position
+	EndPosition Position
 }
 
 func (f *FuncDef) Pos() Position { return f.Position }
+func (f *FuncDef) End() Position { return f.EndPosition }
 func (f *FuncDef) String() string { return "FuncDef" }
 func (f *FuncDef) stmtNode() {}
 
 type ReturnStmt struct {
 	Value Expr
 	Position   Position
+	EndPosition Position
 }
 
 func (r *ReturnStmt) Pos() Position { return r.Position }
+func (r *ReturnStmt) End() Position { return r.EndPosition }
 func (r *ReturnStmt) String() string { return "ReturnStmt" }
 func (r *ReturnStmt) stmtNode() {}
 
+type ImportStmt struct {
+	Names []string
+	NamePositions []Position
+	Position Position
+	EndPosition Position
+}
+
+func (i *ImportStmt) Pos() Position { return i.Position }
+func (i *ImportStmt) End() Position { return i.EndPosition }
+func (i *ImportStmt) String() string { return "ImportStmt" }
+func (i *ImportStmt) stmtNode() {}
+
 type PassStmt struct {
 	Position Position
+	EndPosition Position
 }
 
 func (p *PassStmt) Pos() Position { return p.Position }
+func (p *PassStmt) End() Position { return p.EndPosition }
 func (p *PassStmt) String() string { return "PassStmt" }
 func (p *PassStmt) stmtNode() {}
 
@@ -132,9 +170,11 @@ type BinaryOp struct {
 	Op    string
 	Right Expr
 	Position   Position
+	EndPosition Position
 }
 
 func (b *BinaryOp) Pos() Position { return b.Position }
+func (b *BinaryOp) End() Position { return b.EndPosition }
 func (b *BinaryOp) String() string { return "BinaryOp" }
 func (b *BinaryOp) exprNode() {}
 
@@ -142,9 +182,11 @@ type UnaryOp struct {
 	Op   string
 	Expr Expr
 	Position  Position
+	EndPosition Position
 }
 
 func (u *UnaryOp) Pos() Position { return u.Position }
+func (u *UnaryOp) End() Position { return u.EndPosition }
 func (u *UnaryOp) String() string { return "UnaryOp" }
 func (u *UnaryOp) exprNode() {}
 
@@ -152,9 +194,11 @@ type BoolOp struct {
 	Op     string
 	Values []Expr
 	Position    Position
+	EndPosition Position
 }
 
 func (b *BoolOp) Pos() Position { return b.Position }
+func (b *BoolOp) End() Position { return b.EndPosition }
 func (b *BoolOp) String() string { return "BoolOp" }
 func (b *BoolOp) exprNode() {}
 
@@ -163,9 +207,11 @@ type Compare struct {
 	Ops   []string
 	Right []Expr
 	Position   Position
+	EndPosition Position
 }
 
 func (c *Compare) Pos() Position { return c.Position }
+func (c *Compare) End() Position { return c.EndPosition }
 func (c *Compare) String() string { return "Compare" }
 func (c *Compare) exprNode() {}
 
@@ -173,9 +219,11 @@ type Call struct {
 	Func Expr
 	Args []Expr
 	Position  Position
+	EndPosition Position
 }
 
 func (c *Call) Pos() Position { return c.Position }
+func (c *Call) End() Position { return c.EndPosition }
 func (c *Call) String() string { return "Call" }
 func (c *Call) exprNode() {}
 
@@ -183,54 +231,78 @@ type Subscript struct {
 	Value Expr
 	Slice Expr
 	Position   Position
+	EndPosition Position
 }
 
 func (s *Subscript) Pos() Position { return s.Position }
+func (s *Subscript) End() Position { return s.EndPosition }
 func (s *Subscript) String() string { return "Subscript" }
 func (s *Subscript) exprNode() {}
 
+type Attribute struct {
+	Value Expr
+	Attr string
+	Position Position
+	EndPosition Position
+}
+
+func (a *Attribute) Pos() Position { return a.Position }
+func (a *Attribute) End() Position { return a.EndPosition }
+func (a *Attribute) String() string { return "Attribute" }
+func (a *Attribute) exprNode() {}
+
 type Name struct {
 	Id  string
 	Position Position
+	EndPosition Position
 }
 
 func (n *Name) Pos() Position { return n.Position }
+func (n *Name) End() Position { return n.EndPosition }
 func (n *Name) String() string { return "Name" }
 func (n *Name) exprNode() {}
 
 type Num struct {
 	N   interface{}
 	Position Position
+	EndPosition Position
 }
 
 func (n *Num) Pos() Position { return n.Position }
+func (n *Num) End() Position { return n.EndPosition }
 func (n *Num) String() string { return "Num" }
 func (n *Num) exprNode() {}
 
 type Str struct {
 	S   string
 	Position Position
+	EndPosition Position
 }
 
 func (s *Str) Pos() Position { return s.Position }
+func (s *Str) End() Position { return s.EndPosition }
 func (s *Str) String() string { return "Str" }
 func (s *Str) exprNode() {}
 
 type NameConstant struct {
 	Value interface{}
 	Position   Position
+	EndPosition Position
 }
 
 func (n *NameConstant) Pos() Position { return n.Position }
+func (n *NameConstant) End() Position { return n.EndPosition }
 func (n *NameConstant) String() string { return "NameConstant" }
 func (n *NameConstant) exprNode() {}
 
 type List struct {
 	Elts []Expr
 	Position  Position
+	EndPosition Position
 }
 
 func (l *List) Pos() Position { return l.Position }
+func (l *List) End() Position { return l.EndPosition }
 func (l *List) String() string { return "List" }
 func (l *List) exprNode() {}
 
@@ -238,8 +310,10 @@ type Dict struct {
 	Keys   []Expr
 	Values []Expr
 	Position    Position
+	EndPosition Position
 }
 
 func (d *Dict) Pos() Position { return d.Position }
+func (d *Dict) End() Position { return d.EndPosition }
 func (d *Dict) String() string { return "Dict" }
 func (d *Dict) exprNode() {}
\ No newline at end of file
@@ -69,6 +69,8 @@ func (f *ASTFormatter) formatNode(node Node) string {
 		return f.formatReturnStmt(n)
 	case *PassStmt:
 		return f.formatPassStmt(n)
+	case *ImportStmt:
+		return f.formatImportStmt(n)
 	
 	// Expressions
 	case *BinaryOp:
@@ -83,6 +85,8 @@ func (f *ASTFormatter) formatNode(node Node) string {
 		return f.formatCall(n)
 	case *Subscript:
 		return f.formatSubscript(n)
+	case *Attribute:
+		return f.formatAttribute(n)
 	case *Name:
 		return f.formatName(n)
 	case *Num:
@@ -165,6 +169,10 @@ func (f *ASTFormatter) formatPrintStmt(p *PrintStmt) string {
 	result := fmt.Sprintf("PrintStmt (pos: %d:%d)\n", p.Position.Line, p.Position.Column)
 	f.currentLevel++
 	
+	if p.Dest != nil {
+		result += f.getIndent() + "Dest: " + f.formatNode(p.Dest) + "\n"
+	}
+	
 	if len(p.Values) == 0 {
 		result += f.getIndent() + "Values: <none>"
 	} else {
@@ -300,6 +308,11 @@ func (f *ASTFormatter) formatPassStmt(p *PassStmt) string {
 	return fmt.Sprintf("PassStmt (pos: %d:%d)", p.Position.Line, p.Position.Column)
 }
 
+// formatImportStmt formats an import statement
+func (f *ASTFormatter) formatImportStmt(i *ImportStmt) string {
+	return fmt.Sprintf("ImportStmt (pos: %d:%d) Names: %v", i.Position.Line, i.Position.Column, i.Names)
+}
+
 // formatBinaryOp formats a binary operation
 func (f *ASTFormatter) formatBinaryOp(b *BinaryOp) string {
 	result := fmt.Sprintf("BinaryOp (pos: %d:%d)\n", b.Position.Line, b.Position.Column)
@@ -402,6 +415,18 @@ func (f *ASTFormatter) formatSubscript(s *Subscript) string {
 	return result
 }
 
+// formatAttribute formats an attribute reference
+func (f *ASTFormatter) formatAttribute(a *Attribute) string {
+	result := fmt.Sprintf("Attribute (pos: %d:%d)\n", a.Position.Line, a.Position.Column)
+	f.currentLevel++
+	
+	result += f.getIndent() + "Value: " + f.formatNode(a.Value) + "\n"
+	result += f.getIndent() + fmt.Sprintf("Attr: %q", a.Attr)
+	
+	f.currentLevel--
+	return result
+}
+
 // formatName formats a name (identifier)
 func (f *ASTFormatter) formatName(n *Name) string {
 	return fmt.Sprintf("Name (pos: %d:%d) Id: %q", n.Position.Line, n.Position.Column, n.Id)
@@ -0,0 +1,81 @@
+package ast
+
+// Inspect traverses the tree rooted at node in source order, calling f for
+// each node. If f returns false, the children of that node are skipped.
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Module:
+		inspectStmts(n.Body, f)
+	case *AssignStmt:
+		Inspect(n.Target, f)
+		Inspect(n.Value, f)
+	case *AugAssignStmt:
+		Inspect(n.Target, f)
+		Inspect(n.Value, f)
+	case *ExprStmt:
+		Inspect(n.Expr, f)
+	case *PrintStmt:
+		if n.Dest != nil {
+			Inspect(n.Dest, f)
+		}
+		inspectExprs(n.Values, f)
+	case *IfStmt:
+		Inspect(n.Test, f)
+		inspectStmts(n.Body, f)
+		inspectStmts(n.Orelse, f)
+	case *WhileStmt:
+		Inspect(n.Test, f)
+		inspectStmts(n.Body, f)
+	case *ForStmt:
+		Inspect(n.Target, f)
+		Inspect(n.Iter, f)
+		inspectStmts(n.Body, f)
+	case *FuncDef:
+		inspectStmts(n.Body, f)
+	case *ReturnStmt:
+		if n.Value != nil {
+			Inspect(n.Value, f)
+		}
+	case *BinaryOp:
+		Inspect(n.Left, f)
+		Inspect(n.Right, f)
+	case *UnaryOp:
+		Inspect(n.Expr, f)
+	case *BoolOp:
+		inspectExprs(n.Values, f)
+	case *Compare:
+		Inspect(n.Left, f)
+		inspectExprs(n.Right, f)
+	case *Call:
+		Inspect(n.Func, f)
+		inspectExprs(n.Args, f)
+	case *Subscript:
+		Inspect(n.Value, f)
+		Inspect(n.Slice, f)
+	case *Attribute:
+		Inspect(n.Value, f)
+	case *List:
+		inspectExprs(n.Elts, f)
+	case *Dict:
+		for i := range n.Keys {
+			Inspect(n.Keys[i], f)
+			Inspect(n.Values[i], f)
+		}
+	}
+}
+
+func inspectStmts(stmts []Stmt, f func(Node) bool) {
+	for _, stmt := range stmts {
+		Inspect(stmt, f)
+	}
+}
+
+func inspectExprs(exprs []Expr, f func(Node) bool) {
+	for _, expr := range exprs {
+		Inspect(expr, f)
+	}
+}
@@ -0,0 +1,570 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// Assembly format. Disassemble writes it and Assemble reads it back:
+//
+//	.code <module>
+//	.filename "prog.py"
+//	.firstlineno 1
+//	.argcount 0
+//	.consts
+//	    0: .code square           ; function constant, ends at its .end
+//	        .argcount 1
+//	        ...
+//	        .end
+//	    1: None
+//	    2: [1, 2.5, "three", {"k": True}]
+//	.names
+//	    0: square
+//	.varnames
+//	.instructions
+//	    .line 1                   ; following instructions come from line 1
+//	    0: LOAD_CONST 0
+//	loop:                         ; a label, usable as a jump operand
+//	    1: JUMP_ABSOLUTE loop
+//	.end
+//
+// Everything after ';' is a comment. The "N:" indexes are optional; when
+// present they must match the position of the entry. Instructions without
+// an operand have argument 0. A label operand of JUMP_FORWARD is converted
+// to the relative offset the VM expects; numeric operands are used as is.
+// Superinstructions take their two indexes as separate operands, as in
+// "LOAD_FAST_LOAD_CONST 0 1".
+//
+// Register code follows the instructions in a ".registers N" section for
+// N registers, with its own .line markers and labels. Its operands are
+// registers r0, r1, ..., constants k0, k1, ..., names n0, n1, ..., labels
+// and plain integers, as in "ADD r1 r1 k0".
+
+// hasArg reports whether the VM uses the argument of op.
+func (op OpCode) hasArg() bool {
+	switch op {
+	case OpLoadConst, OpLoadName, OpStoreName, OpLoadGlobal, OpStoreGlobal, OpLoadFast, OpStoreFast,
+		OpJumpForward, OpJumpIfFalse, OpJumpIfTrue, OpJumpAbsolute, OpPopJumpIfFalse, OpPopJumpIfTrue,
+		OpBuildList, OpBuildDict, OpBuildTuple, OpCallFunction, OpSetupLoop, OpContinueLoop,
+		OpForIter, OpLoadAttr, OpImportName:
+		return true
+	}
+	return op.isPacked()
+}
+
+// isJump reports whether the argument of op is a jump target.
+func (op OpCode) isJump() bool {
+	switch op {
+	case OpJumpForward, OpJumpIfFalse, OpJumpIfTrue, OpJumpAbsolute, OpPopJumpIfFalse, OpPopJumpIfTrue,
+		OpSetupLoop, OpContinueLoop, OpForIter:
+		return true
+	}
+	return false
+}
+
+func asmName(name string) string {
+	if name == "" || name[0] == '.' || strings.ContainsAny(name, asmSpecial) || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		return strconv.Quote(name)
+	}
+	return name
+}
+
+// AsmError is a syntax error in assembly source.
+type AsmError struct {
+	Line int
+	Msg  string
+}
+
+func (e *AsmError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Assemble parses an assembly listing, as written by Disassemble, into a
+// code object. The result is not verified, so that tests can build invalid
+// bytecode; run Verify before executing untrusted code.
+func Assemble(source string) (*CodeObject, error) {
+	lines, err := tokenizeAsm(source)
+	if err != nil {
+		return nil, err
+	}
+	a := &assembler{lines: lines}
+	line := a.next()
+	if line == nil || !line.is(0, ".code") {
+		return nil, a.errorf(line, "expected .code")
+	}
+	co, err := a.code(line, 1)
+	if err != nil {
+		return nil, err
+	}
+	if extra := a.next(); extra != nil {
+		return nil, a.errorf(extra, "unexpected %q after .end", extra.toks[0].text)
+	}
+	return co, nil
+}
+
+const asmSpecial = "[]{},:;\""
+
+type asmToken struct {
+	text   string
+	quoted bool
+}
+
+type asmLine struct {
+	num  int
+	toks []asmToken
+}
+
+func (l *asmLine) is(i int, text string) bool {
+	return i < len(l.toks) && !l.toks[i].quoted && l.toks[i].text == text
+}
+
+func tokenizeAsm(source string) ([]*asmLine, error) {
+	var lines []*asmLine
+	for n, text := range strings.Split(source, "\n") {
+		line := &asmLine{num: n + 1}
+		for text != "" {
+			r := rune(text[0])
+			switch {
+			case unicode.IsSpace(r):
+				text = text[1:]
+			case r == ';':
+				text = ""
+			case r == '"':
+				q, err := strconv.QuotedPrefix(text)
+				if err != nil {
+					return nil, &AsmError{Line: line.num, Msg: "unterminated string"}
+				}
+				s, _ := strconv.Unquote(q)
+				line.toks = append(line.toks, asmToken{text: s, quoted: true})
+				text = text[len(q):]
+			case strings.ContainsRune(asmSpecial, r):
+				line.toks = append(line.toks, asmToken{text: text[:1]})
+				text = text[1:]
+			default:
+				end := strings.IndexFunc(text, func(r rune) bool {
+					return unicode.IsSpace(r) || strings.ContainsRune(asmSpecial, r)
+				})
+				if end < 0 {
+					end = len(text)
+				}
+				line.toks = append(line.toks, asmToken{text: text[:end]})
+				text = text[end:]
+			}
+		}
+		if len(line.toks) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+type assembler struct {
+	lines []*asmLine
+	pos   int
+}
+
+func (a *assembler) next() *asmLine {
+	if a.pos >= len(a.lines) {
+		return nil
+	}
+	a.pos++
+	return a.lines[a.pos-1]
+}
+
+func (a *assembler) errorf(line *asmLine, format string, args ...interface{}) error {
+	num := 0
+	if line != nil {
+		num = line.num
+	} else if len(a.lines) > 0 {
+		num = a.lines[len(a.lines)-1].num
+	}
+	return &AsmError{Line: num, Msg: fmt.Sprintf(format, args...)}
+}
+
+type labelRef struct {
+	line   *asmLine
+	offset int
+	label  string
+}
+
+// code parses a code object whose ".code NAME" header starts at token
+// start of line, up to and including its .end.
+func (a *assembler) code(header *asmLine, start int) (*CodeObject, error) {
+	if len(header.toks) != start+1 {
+		return nil, a.errorf(header, ".code takes a name")
+	}
+	co := &CodeObject{
+		Name:         header.toks[start].text,
+		Instructions: []Instruction{},
+		Consts:       []object.Object{},
+		Names:        []string{},
+		Varnames:     []string{},
+	}
+	labels := make(map[string]int)
+	regLabels := make(map[string]int)
+	var refs, regRefs []labelRef
+	section := ""
+
+	for {
+		line := a.next()
+		if line == nil {
+			return nil, a.errorf(nil, "missing .end for %s", co.Name)
+		}
+		first := line.toks[0]
+		if !first.quoted && strings.HasPrefix(first.text, ".") {
+			var err error
+			switch first.text {
+			case ".end":
+				if len(line.toks) != 1 {
+					return nil, a.errorf(line, ".end takes no arguments")
+				}
+				for _, ref := range refs {
+					target, ok := labels[ref.label]
+					if !ok {
+						return nil, a.errorf(ref.line, "undefined label %q", ref.label)
+					}
+					instr := &co.Instructions[ref.offset]
+					instr.Arg = target
+					if instr.Op == OpJumpForward {
+						instr.Arg = target - ref.offset - 1
+					}
+				}
+				for _, ref := range regRefs {
+					target, ok := regLabels[ref.label]
+					if !ok {
+						return nil, a.errorf(ref.line, "undefined label %q", ref.label)
+					}
+					instr := &co.Registers.Instructions[ref.offset]
+					*instr.operandPtr(instr.Op.JumpOperand()) = int32(target)
+				}
+				return co, nil
+			case ".filename":
+				if len(line.toks) != 2 || !line.toks[1].quoted {
+					return nil, a.errorf(line, ".filename takes a quoted string")
+				}
+				co.Filename = line.toks[1].text
+			case ".firstlineno":
+				co.Firstlineno, err = a.intArg(line)
+			case ".argcount":
+				co.Argcount, err = a.intArg(line)
+			case ".stacksize":
+				co.StackSize, err = a.intArg(line)
+			case ".consts", ".names", ".varnames", ".instructions":
+				if len(line.toks) != 1 {
+					return nil, a.errorf(line, "%s takes no arguments", first.text)
+				}
+				section = first.text
+			case ".registers":
+				var n int
+				n, err = a.intArg(line)
+				co.Registers = &RegisterCode{NumRegisters: n}
+				section = first.text
+			case ".line":
+				var n int
+				n, err = a.intArg(line)
+				switch section {
+				case ".instructions":
+					co.LineTable = append(co.LineTable, LineEntry{Offset: len(co.Instructions), Line: n})
+				case ".registers":
+					rc := co.Registers
+					rc.LineTable = append(rc.LineTable, LineEntry{Offset: len(rc.Instructions), Line: n})
+				default:
+					return nil, a.errorf(line, ".line outside .instructions")
+				}
+			default:
+				return nil, a.errorf(line, "unknown directive %s", first.text)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		toks := line.toks
+		switch section {
+		case ".consts":
+			toks, err := a.index(line, toks, len(co.Consts))
+			if err != nil {
+				return nil, err
+			}
+			if len(toks) > 0 && toks[0].text == ".code" && !toks[0].quoted {
+				fn, err := a.code(line, len(line.toks)-len(toks)+1)
+				if err != nil {
+					return nil, err
+				}
+				co.Consts = append(co.Consts, &PyFunction{Code: fn, Name: fn.Name})
+				continue
+			}
+			value, rest, err := a.value(line, toks)
+			if err != nil {
+				return nil, err
+			}
+			if len(rest) > 0 {
+				return nil, a.errorf(line, "unexpected %q after constant", rest[0].text)
+			}
+			co.Consts = append(co.Consts, value)
+		case ".names", ".varnames":
+			list := &co.Names
+			if section == ".varnames" {
+				list = &co.Varnames
+			}
+			toks, err := a.index(line, toks, len(*list))
+			if err != nil {
+				return nil, err
+			}
+			if len(toks) != 1 {
+				return nil, a.errorf(line, "expected one name")
+			}
+			*list = append(*list, toks[0].text)
+		case ".instructions":
+			if len(toks) >= 2 && toks[1].text == ":" && !toks[0].quoted && !isInt(toks[0].text) {
+				if _, dup := labels[toks[0].text]; dup {
+					return nil, a.errorf(line, "label %q defined twice", toks[0].text)
+				}
+				labels[toks[0].text] = len(co.Instructions)
+				if toks = toks[2:]; len(toks) == 0 {
+					continue
+				}
+			}
+			toks, err := a.index(line, toks, len(co.Instructions))
+			if err != nil {
+				return nil, err
+			}
+			if len(toks) == 0 {
+				return nil, a.errorf(line, "expected an opcode")
+			}
+			op, ok := opcodeByName(toks[0].text)
+			if !ok || toks[0].quoted {
+				return nil, a.errorf(line, "unknown opcode %q", toks[0].text)
+			}
+			instr := Instruction{Op: op}
+			if len(toks) == 3 && op.isPacked() {
+				first, ferr := strconv.Atoi(toks[1].text)
+				second, serr := strconv.Atoi(toks[2].text)
+				if ferr != nil || serr != nil || toks[1].quoted || toks[2].quoted ||
+					first < 0 || first > MaxPackedIndex || second < 0 {
+					return nil, a.errorf(line, "invalid operands %q %q for %s", toks[1].text, toks[2].text, op)
+				}
+				instr.Arg = PackOperands(first, second)
+			} else if len(toks) > 2 {
+				return nil, a.errorf(line, "expected an opcode and at most one operand")
+			} else if len(toks) == 2 {
+				arg := toks[1]
+				if n, err := strconv.Atoi(arg.text); err == nil && !arg.quoted {
+					instr.Arg = n
+				} else if op.isJump() && !arg.quoted && isLabel(arg.text) {
+					refs = append(refs, labelRef{line: line, offset: len(co.Instructions), label: arg.text})
+				} else {
+					return nil, a.errorf(line, "invalid operand %q for %s", arg.text, op)
+				}
+			}
+			co.Instructions = append(co.Instructions, instr)
+		case ".registers":
+			rc := co.Registers
+			if len(toks) >= 2 && toks[1].text == ":" && !toks[0].quoted && !isInt(toks[0].text) {
+				if _, dup := regLabels[toks[0].text]; dup {
+					return nil, a.errorf(line, "label %q defined twice", toks[0].text)
+				}
+				regLabels[toks[0].text] = len(rc.Instructions)
+				if toks = toks[2:]; len(toks) == 0 {
+					continue
+				}
+			}
+			toks, err := a.index(line, toks, len(rc.Instructions))
+			if err != nil {
+				return nil, err
+			}
+			instr, label, err := a.regInstruction(line, toks)
+			if err != nil {
+				return nil, err
+			}
+			if label != "" {
+				regRefs = append(regRefs, labelRef{line: line, offset: len(rc.Instructions), label: label})
+			}
+			rc.Instructions = append(rc.Instructions, instr)
+		default:
+			return nil, a.errorf(line, "expected a section directive such as .instructions")
+		}
+	}
+}
+
+// regInstruction parses a register instruction. Registers are written rN,
+// constants kN and names nN; label is the jump target if it is a label.
+func (a *assembler) regInstruction(line *asmLine, toks []asmToken) (instr RegInstruction, label string, err error) {
+	if len(toks) == 0 {
+		return instr, "", a.errorf(line, "expected an opcode")
+	}
+	op, ok := regOpsByName[toks[0].text]
+	if !ok || toks[0].quoted {
+		return instr, "", a.errorf(line, "unknown register opcode %q", toks[0].text)
+	}
+	instr.Op = op
+	kinds := strings.TrimRight(op.Operands(), "-")
+	if len(toks) != len(kinds)+1 {
+		return instr, "", a.errorf(line, "%s takes %d operands", op, len(kinds))
+	}
+	for i, kind := range kinds {
+		tok := toks[i+1]
+		var x int
+		ok := false
+		switch kind {
+		case 'r':
+			x, ok = asmOperand(tok.text, "r")
+		case 'k':
+			if x, ok = asmOperand(tok.text, "k"); ok {
+				x = int(ConstOperand(x))
+			} else {
+				x, ok = asmOperand(tok.text, "r")
+			}
+		case 'c':
+			x, ok = asmOperand(tok.text, "k")
+		case 'n':
+			x, ok = asmOperand(tok.text, "n")
+		case 'i':
+			x, ok = asmOperand(tok.text, "")
+		case 'j':
+			if x, ok = asmOperand(tok.text, ""); !ok && isLabel(tok.text) {
+				label, ok = tok.text, true
+			}
+		}
+		if !ok || tok.quoted {
+			return instr, "", a.errorf(line, "invalid operand %q for %s", tok.text, op)
+		}
+		*instr.operandPtr(i) = int32(x)
+	}
+	return instr, label, nil
+}
+
+// asmOperand parses a register operand: prefix followed by a number.
+func asmOperand(text, prefix string) (int, bool) {
+	digits, ok := strings.CutPrefix(text, prefix)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	return n, err == nil && n >= 0 && n <= math.MaxInt32
+}
+
+func (a *assembler) intArg(line *asmLine) (int, error) {
+	if len(line.toks) == 2 && !line.toks[1].quoted {
+		if n, err := strconv.Atoi(line.toks[1].text); err == nil {
+			return n, nil
+		}
+	}
+	return 0, a.errorf(line, "%s takes an integer", line.toks[0].text)
+}
+
+// index strips an optional "N:" prefix from toks, checking that N is want.
+func (a *assembler) index(line *asmLine, toks []asmToken, want int) ([]asmToken, error) {
+	if len(toks) < 2 || toks[1].text != ":" || toks[1].quoted || toks[0].quoted || !isInt(toks[0].text) {
+		return toks, nil
+	}
+	if n, _ := strconv.Atoi(toks[0].text); n != want {
+		return nil, a.errorf(line, "index %s out of sequence, expected %d", toks[0].text, want)
+	}
+	return toks[2:], nil
+}
+
+// value parses a constant from the start of toks and returns the rest.
+func (a *assembler) value(line *asmLine, toks []asmToken) (object.Object, []asmToken, error) {
+	if len(toks) == 0 {
+		return nil, nil, a.errorf(line, "expected a constant")
+	}
+	tok, rest := toks[0], toks[1:]
+	if tok.quoted {
+		return &runtime.PyString{Value: tok.text}, rest, nil
+	}
+	switch tok.text {
+	case "None":
+		return runtime.None, rest, nil
+	case "True", "False":
+		return runtime.NewBool(tok.text == "True"), rest, nil
+	case "[":
+		list := &runtime.PyList{Elements: []object.Object{}}
+		for len(rest) > 0 && rest[0].text != "]" {
+			elem, more, err := a.value(line, rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			list.Elements = append(list.Elements, elem)
+			if rest, err = a.separator(line, more, "]"); err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(rest) == 0 {
+			return nil, nil, a.errorf(line, "unterminated list")
+		}
+		return list, rest[1:], nil
+	case "{":
+		dict := runtime.NewPyDict()
+		for len(rest) > 0 && rest[0].text != "}" {
+			if !rest[0].quoted || len(rest) < 2 || rest[1].text != ":" {
+				return nil, nil, a.errorf(line, "dict keys must be quoted strings followed by ':'")
+			}
+			key := rest[0].text
+			elem, more, err := a.value(line, rest[2:])
+			if err != nil {
+				return nil, nil, err
+			}
+			dict.Set(&runtime.PyString{Value: key}, elem)
+			if rest, err = a.separator(line, more, "}"); err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(rest) == 0 {
+			return nil, nil, a.errorf(line, "unterminated dict")
+		}
+		return dict, rest[1:], nil
+	}
+	if n, err := strconv.Atoi(tok.text); err == nil {
+		return runtime.NewInt(n), rest, nil
+	}
+	if f, err := strconv.ParseFloat(tok.text, 64); err == nil {
+		return &runtime.PyFloat{Value: f}, rest, nil
+	}
+	return nil, nil, a.errorf(line, "invalid constant %q", tok.text)
+}
+
+// separator consumes the ',' between elements, or stops before close.
+func (a *assembler) separator(line *asmLine, toks []asmToken, close string) ([]asmToken, error) {
+	switch {
+	case len(toks) > 0 && toks[0].text == "," && !toks[0].quoted:
+		return toks[1:], nil
+	case len(toks) > 0 && toks[0].text == close && !toks[0].quoted:
+		return toks, nil
+	}
+	return nil, a.errorf(line, "expected ',' or '%s'", close)
+}
+
+func isInt(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func isLabel(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+var opcodesByName = func() map[string]OpCode {
+	m := make(map[string]OpCode)
+	for op := 0; op < 256; op++ {
+		m[OpCode(op).String()] = OpCode(op)
+	}
+	return m
+}()
+
+func opcodeByName(name string) (OpCode, bool) {
+	op, ok := opcodesByName[name]
+	return op, ok
+}
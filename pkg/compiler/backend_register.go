@@ -0,0 +1,7 @@
+//go:build regvm
+
+package compiler
+
+// DefaultBackend is the backend of new compilers. Building without the
+// regvm tag makes it BackendStack.
+const DefaultBackend = BackendRegister
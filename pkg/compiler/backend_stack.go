@@ -0,0 +1,7 @@
+//go:build !regvm
+
+package compiler
+
+// DefaultBackend is the backend of new compilers. Building with the regvm
+// tag makes it BackendRegister.
+const DefaultBackend = BackendStack
@@ -1,16 +1,20 @@
 package compiler
 
 import (
-	"encoding/gob"
 	"fmt"
 	"io"
+	"sort"
 
 	"github.com/warriorguo/gopy/pkg/object"
-	"github.com/warriorguo/gopy/pkg/runtime"
 )
 
 type OpCode byte
 
+// OpcodeVersion identifies the opcode table below. It is recorded in
+// bytecode files and must be incremented whenever opcodes are added,
+// removed, renumbered or change meaning.
+const OpcodeVersion = 4
+
 const (
 	OpLoadConst OpCode = iota
 	OpLoadName
@@ -71,8 +75,51 @@ const (
 	OpForIter
 	
 	OpNop
+	
+	OpLoadAttr
+	OpImportName
+	OpPrintItemTo
+	OpPrintNewlineTo
+	OpMakeFunction
+
+	// Superinstructions, formed by Optimize from common sequences. Their
+	// operand packs two indexes; see PackOperands.
+	OpLoadFastLoadFast
+	OpLoadFastLoadConst
+	OpStoreFastLoadFast
+	OpBinaryAddFastConst
+	OpBinarySubFastConst
+
+	OpCompareIs
+	OpCompareIsNot
 )
 
+// operandBits is the width of the first index of a packed operand.
+const operandBits = 16
+
+// MaxPackedIndex bounds the first index of a packed operand.
+const MaxPackedIndex = 1<<operandBits - 1
+
+// PackOperands packs the indexes a and b into the operand of a
+// superinstruction; a must not exceed MaxPackedIndex.
+func PackOperands(a, b int) int {
+	return b<<operandBits | a
+}
+
+// UnpackOperands splits the operand of a superinstruction into its indexes.
+func UnpackOperands(arg int) (int, int) {
+	return arg & MaxPackedIndex, arg >> operandBits
+}
+
+// isPacked reports whether the operand of op packs two indexes.
+func (op OpCode) isPacked() bool {
+	switch op {
+	case OpLoadFastLoadFast, OpLoadFastLoadConst, OpStoreFastLoadFast, OpBinaryAddFastConst, OpBinarySubFastConst:
+		return true
+	}
+	return false
+}
+
 type Instruction struct {
 	Op  OpCode
 	Arg int
@@ -178,12 +225,40 @@ func (op OpCode) String() string {
 		return "FOR_ITER"
 	case OpNop:
 		return "NOP"
+	case OpLoadAttr:
+		return "LOAD_ATTR"
+	case OpImportName:
+		return "IMPORT_NAME"
+	case OpPrintItemTo:
+		return "PRINT_ITEM_TO"
+	case OpPrintNewlineTo:
+		return "PRINT_NEWLINE_TO"
+	case OpMakeFunction:
+		return "MAKE_FUNCTION"
+	case OpLoadFastLoadFast:
+		return "LOAD_FAST_LOAD_FAST"
+	case OpLoadFastLoadConst:
+		return "LOAD_FAST_LOAD_CONST"
+	case OpStoreFastLoadFast:
+		return "STORE_FAST_LOAD_FAST"
+	case OpBinaryAddFastConst:
+		return "BINARY_ADD_FAST_CONST"
+	case OpBinarySubFastConst:
+		return "BINARY_SUB_FAST_CONST"
+	case OpCompareIs:
+		return "COMPARE_IS"
+	case OpCompareIsNot:
+		return "COMPARE_IS_NOT"
 	default:
 		return fmt.Sprintf("UNKNOWN_OP_%d", op)
 	}
 }
 
 
+// CodeObject is the compiled form of a module or function. It is never
+// modified after compilation, so a single CodeObject may be executed by many
+// VMs concurrently. Consts holds only immutable values; function constants
+// are templates that MAKE_FUNCTION instantiates per execution.
 type CodeObject struct {
 	Instructions []Instruction
 	Consts       []object.Object
@@ -193,56 +268,49 @@ type CodeObject struct {
 	Filename     string
 	Name         string
 	Firstlineno  int
+	LineTable    []LineEntry
+
+	// StackSize is the maximum operand stack depth, computed by Verify.
+	StackSize int
+
+	// Registers is the register machine form of the code, generated by
+	// the register backend, or nil.
+	Registers *RegisterCode
 }
 
-func (co *CodeObject) String() string {
-	return fmt.Sprintf("CodeObject{name=%s, argcount=%d, instructions=%d, consts=%d, names=%d}",
-		co.Name, co.Argcount, len(co.Instructions), len(co.Consts), len(co.Names))
+// LineEntry marks that the instructions from Offset up to the next entry
+// were compiled from source line Line. Entries are sorted by Offset.
+type LineEntry struct {
+	Offset int
+	Line   int
 }
 
-func (co *CodeObject) Disassemble() string {
-	result := fmt.Sprintf("Code object: %s\n", co.Name)
-	result += fmt.Sprintf("Args: %d, Consts: %d, Names: %d, Vars: %d\n", 
-		co.Argcount, len(co.Consts), len(co.Names), len(co.Varnames))
-	result += "\nConstants:\n"
-	for i, c := range co.Consts {
-		result += fmt.Sprintf("  %d: %s\n", i, c)
-	}
-	result += "\nNames:\n"
-	for i, n := range co.Names {
-		result += fmt.Sprintf("  %d: %s\n", i, n)
-	}
-	result += "\nVarnames:\n"
-	for i, v := range co.Varnames {
-		result += fmt.Sprintf("  %d: %s\n", i, v)
+// LineForOffset returns the source line of the instruction at offset, or 0
+// if the code object carries no line information.
+func (co *CodeObject) LineForOffset(offset int) int {
+	i := sort.Search(len(co.LineTable), func(i int) bool {
+		return co.LineTable[i].Offset > offset
+	})
+	if i == 0 {
+		return 0
 	}
-	result += "\nInstructions:\n"
-	for i, instr := range co.Instructions {
-		result += fmt.Sprintf("  %3d: %s\n", i, instr)
-	}
-	return result
+	return co.LineTable[i-1].Line
 }
 
+func (co *CodeObject) String() string {
+	return fmt.Sprintf("CodeObject{name=%s, argcount=%d, instructions=%d, consts=%d, names=%d}",
+		co.Name, co.Argcount, len(co.Instructions), len(co.Consts), len(co.Names))
+}
+
+// Serialize writes co in the bytecode file format without recording the
+// source it was compiled from.
 func (co *CodeObject) Serialize(w io.Writer) error {
-	encoder := gob.NewEncoder(w)
-	return encoder.Encode(co)
+	return WriteBytecode(w, co, FileHeader{})
 }
 
+// DeserializeCodeObject reads a code object written by Serialize or
+// WriteBytecode.
 func DeserializeCodeObject(r io.Reader) (*CodeObject, error) {
-	decoder := gob.NewDecoder(r)
-	var co CodeObject
-	err := decoder.Decode(&co)
-	return &co, err
+	co, _, err := ReadBytecode(r)
+	return co, err
 }
-
-func init() {
-	gob.Register(&runtime.PyInt{})
-	gob.Register(&runtime.PyFloat{})
-	gob.Register(&runtime.PyString{})
-	gob.Register(&runtime.PyBool{})
-	gob.Register(&runtime.PyNone{})
-	gob.Register(&PyFunction{})
-	gob.Register(&runtime.PyList{})
-	gob.Register(&runtime.PyDict{})
-	gob.Register(&PyBuiltin{})
-}
\ No newline at end of file
@@ -18,6 +18,10 @@ type Compiler struct {
 	varnameMap   map[string]int
 	loopStack    []int
 	scopeDepth   int
+	filename     string
+	line         int
+	lineTable    []LineEntry
+	backend      Backend
 }
 
 func NewCompiler() *Compiler {
@@ -31,21 +35,48 @@ func NewCompiler() *Compiler {
 		varnameMap:   make(map[string]int),
 		loopStack:    []int{},
 		scopeDepth:   0,
+		filename:     "<module>",
+		backend:      DefaultBackend,
 	}
 }
 
+// SetFilename sets the source file name recorded in the compiled code.
+func (c *Compiler) SetFilename(filename string) {
+	c.filename = filename
+}
+
+// SetBackend selects the code the compiler generates.
+func (c *Compiler) SetBackend(backend Backend) {
+	c.backend = backend
+}
+
 func (c *Compiler) emit(op OpCode, arg int) int {
 	pos := len(c.instructions)
+	if c.line > 0 && (len(c.lineTable) == 0 || c.lineTable[len(c.lineTable)-1].Line != c.line) {
+		c.lineTable = append(c.lineTable, LineEntry{Offset: pos, Line: c.line})
+	}
 	c.instructions = append(c.instructions, Instruction{Op: op, Arg: arg})
 	return pos
 }
 
+// setLine attributes subsequently emitted instructions to the line of node.
+func (c *Compiler) setLine(node ast.Node) {
+	if line := node.Pos().Line; line > 0 {
+		c.line = line
+	}
+}
+
 func (c *Compiler) changeOperand(pos int, arg int) {
 	c.instructions[pos].Arg = arg
 }
 
+// constantKey identifies equal constants, which share a slot in Consts.
+func constantKey(obj object.Object) string {
+	return fmt.Sprintf("%T:%s", obj, obj.String())
+}
+
 func (c *Compiler) addConstant(obj object.Object) int {
-	key := fmt.Sprintf("%T:%s", obj, obj.String())
+	key := constantKey(obj)
 	if idx, exists := c.constMap[key]; exists {
 		return idx
 	}
@@ -76,14 +107,28 @@ func (c *Compiler) addVarname(name string) int {
 }
 
 func (c *Compiler) Compile(node ast.Node) (*CodeObject, error) {
+	var code *CodeObject
+	var err error
 	switch n := node.(type) {
 	case *ast.Module:
-		return c.compileModule(n)
+		code, err = c.compileModule(n)
 	case *ast.FuncDef:
-		return c.compileFuncDef(n)
+		code, err = c.compileFuncDef(n)
 	default:
 		return nil, fmt.Errorf("cannot compile node type %T", node)
 	}
+	if err != nil {
+		return nil, err
+	}
+	if c.backend == BackendRegister {
+		if err := compileRegisters(code, node); err != nil {
+			return nil, err
+		}
+	}
+	if err := Verify(code); err != nil {
+		return nil, err
+	}
+	return code, nil
 }
 
 func (c *Compiler) compileModule(module *ast.Module) (*CodeObject, error) {
@@ -93,6 +138,7 @@ func (c *Compiler) compileModule(module *ast.Module) (*CodeObject, error) {
 		// Special handling for the last statement if it's an expression
 		if isLastStmt {
 			if exprStmt, ok := stmt.(*ast.ExprStmt); ok {
+				c.setLine(exprStmt)
 				// Compile the expression but don't pop it - return its value
 				if err := c.compileExpr(exprStmt.Expr); err != nil {
 					return nil, err
@@ -105,9 +151,10 @@ func (c *Compiler) compileModule(module *ast.Module) (*CodeObject, error) {
 					Names:        c.names,
 					Varnames:     c.varnames,
 					Argcount:     0,
-					Filename:     "<module>",
+					Filename:     c.filename,
 					Name:         "<module>",
 					Firstlineno:  1,
+					LineTable:    c.lineTable,
 				}, nil
 			}
 		}
@@ -117,7 +164,7 @@ func (c *Compiler) compileModule(module *ast.Module) (*CodeObject, error) {
 		}
 	}
 
-	c.emit(OpLoadConst, c.addConstant(&runtime.PyNone{}))
+	c.emit(OpLoadConst, c.addConstant(runtime.None))
 	c.emit(OpReturnValue, 0)
 
 	return &CodeObject{
@@ -126,9 +173,10 @@ func (c *Compiler) compileModule(module *ast.Module) (*CodeObject, error) {
 		Names:        c.names,
 		Varnames:     c.varnames,
 		Argcount:     0,
-		Filename:     "<module>",
+		Filename:     c.filename,
 		Name:         "<module>",
 		Firstlineno:  1,
+		LineTable:    c.lineTable,
 	}, nil
 }
 
@@ -143,7 +191,7 @@ func (c *Compiler) compileFuncDef(funcDef *ast.FuncDef) (*CodeObject, error) {
 		}
 	}
 
-	c.emit(OpLoadConst, c.addConstant(&runtime.PyNone{}))
+	c.emit(OpLoadConst, c.addConstant(runtime.None))
 	c.emit(OpReturnValue, 0)
 
 	return &CodeObject{
@@ -152,13 +200,22 @@ func (c *Compiler) compileFuncDef(funcDef *ast.FuncDef) (*CodeObject, error) {
 		Names:        c.names,
 		Varnames:     c.varnames,
 		Argcount:     len(funcDef.Args),
-		Filename:     "<function>",
+		Filename:     c.filename,
 		Name:         funcDef.Name,
 		Firstlineno:  funcDef.Position.Line,
+		LineTable:    c.lineTable,
 	}, nil
 }
 
 func (c *Compiler) compileStmt(stmt ast.Stmt) error {
+	c.setLine(stmt)
+	if err := c.compileStmtNode(stmt); err != nil {
+		return c.errorAt(stmt, err)
+	}
+	return nil
+}
+
+func (c *Compiler) compileStmtNode(stmt ast.Stmt) error {
 	switch s := stmt.(type) {
 	case *ast.AssignStmt:
 		return c.compileAssignStmt(s)
@@ -180,6 +237,8 @@ func (c *Compiler) compileStmt(stmt ast.Stmt) error {
 		return c.compileReturnStmt(s)
 	case *ast.PassStmt:
 		return c.compilePassStmt(s)
+	case *ast.ImportStmt:
+		return c.compileImportStmt(s)
 	default:
 		return fmt.Errorf("unsupported statement type: %T", stmt)
 	}
@@ -268,6 +327,10 @@ func (c *Compiler) compileExprStmt(stmt *ast.ExprStmt) error {
 }
 
 func (c *Compiler) compilePrintStmt(stmt *ast.PrintStmt) error {
+	if stmt.Dest != nil {
+		return c.compilePrintToStmt(stmt)
+	}
+
 	for i, value := range stmt.Values {
 		if err := c.compileExpr(value); err != nil {
 			return err
@@ -282,6 +345,31 @@ func (c *Compiler) compilePrintStmt(stmt *ast.PrintStmt) error {
 	return nil
 }
 
+func (c *Compiler) compilePrintToStmt(stmt *ast.PrintStmt) error {
+	// The destination stays on the stack for the whole statement; every item
+	// is printed with [dest, value] rotated so that dest is on top.
+	if err := c.compileExpr(stmt.Dest); err != nil {
+		return err
+	}
+
+	for i, value := range stmt.Values {
+		c.emit(OpDupTop, 0)
+		if err := c.compileExpr(value); err != nil {
+			return err
+		}
+		c.emit(OpRotTwo, 0)
+		c.emit(OpPrintItemTo, 0)
+		if i < len(stmt.Values)-1 {
+			c.emit(OpDupTop, 0)
+			c.emit(OpLoadConst, c.addConstant(&runtime.PyString{Value: " "}))
+			c.emit(OpRotTwo, 0)
+			c.emit(OpPrintItemTo, 0)
+		}
+	}
+	c.emit(OpPrintNewlineTo, 0)
+	return nil
+}
+
 func (c *Compiler) compileIfStmt(stmt *ast.IfStmt) error {
 	if err := c.compileExpr(stmt.Test); err != nil {
 		return err
@@ -308,7 +396,7 @@ func (c *Compiler) compileIfStmt(stmt *ast.IfStmt) error {
 				return err
 			}
 		}
-		c.changeOperand(jumpEnd, len(c.instructions))
+		c.changeOperand(jumpEnd, len(c.instructions)-jumpEnd-1)
 	}
 
 	return nil
@@ -330,6 +418,7 @@ func (c *Compiler) compileWhileStmt(stmt *ast.WhileStmt) error {
 		}
 	}
 
+	c.setLine(stmt)
 	c.emit(OpJumpAbsolute, loopStart)
 	c.changeOperand(jumpIfFalse, len(c.instructions))
 
@@ -365,6 +454,7 @@ func (c *Compiler) compileForStmt(stmt *ast.ForStmt) error {
 		}
 	}
 
+	c.setLine(stmt)
 	c.emit(OpJumpAbsolute, loopStart)
 	c.changeOperand(forIter, len(c.instructions))
 
@@ -375,6 +465,7 @@ func (c *Compiler) compileForStmt(stmt *ast.ForStmt) error {
 func (c *Compiler) compileFuncDefStmt(stmt *ast.FuncDef) error {
 	compiler := NewCompiler()
 	compiler.scopeDepth = c.scopeDepth + 1
+	compiler.filename = c.filename
 
 	codeObj, err := compiler.compileFuncDef(stmt)
 	if err != nil {
@@ -382,13 +473,13 @@ func (c *Compiler) compileFuncDefStmt(stmt *ast.FuncDef) error {
 	}
 
 	pyFunc := &PyFunction{
-		Code:    codeObj,
-		Name:    stmt.Name,
-		Globals: nil, // Will be set by VM at runtime
+		Code: codeObj,
+		Name: stmt.Name,
 	}
 	constIdx := c.addConstant(pyFunc)
 
 	c.emit(OpLoadConst, constIdx)
+	c.emit(OpMakeFunction, 0)
 	c.emit(OpStoreName, c.addName(stmt.Name))
 
 	return nil
@@ -400,12 +491,24 @@ func (c *Compiler) compileReturnStmt(stmt *ast.ReturnStmt) error {
 			return err
 		}
 	} else {
-		c.emit(OpLoadConst, c.addConstant(&runtime.PyNone{}))
+		c.emit(OpLoadConst, c.addConstant(runtime.None))
 	}
 	c.emit(OpReturnValue, 0)
 	return nil
 }
 
+func (c *Compiler) compileImportStmt(stmt *ast.ImportStmt) error {
+	for _, name := range stmt.Names {
+		c.emit(OpImportName, c.addName(name))
+		if c.scopeDepth == 0 {
+			c.emit(OpStoreName, c.addName(name))
+		} else {
+			c.emit(OpStoreFast, c.addVarname(name))
+		}
+	}
+	return nil
+}
+
 func (c *Compiler) compilePassStmt(stmt *ast.PassStmt) error {
 	// Pass statement is a no-op, emit nothing
 	return nil
@@ -425,6 +528,8 @@ func (c *Compiler) compileExpr(expr ast.Expr) error {
 		return c.compileCall(e)
 	case *ast.Subscript:
 		return c.compileSubscript(e)
+	case *ast.Attribute:
+		return c.compileAttribute(e)
 	case *ast.Name:
 		return c.compileName(e)
 	case *ast.Num:
@@ -546,6 +651,10 @@ func (c *Compiler) compileCompare(expr *ast.Compare) error {
 			c.emit(OpCompareGe, 0)
 		case "in":
 			c.emit(OpCompareIn, 0)
+		case "is":
+			c.emit(OpCompareIs, 0)
+		case "is not":
+			c.emit(OpCompareIsNot, 0)
 		default:
 			return fmt.Errorf("unsupported comparison operator: %s", op)
 		}
@@ -580,6 +689,14 @@ func (c *Compiler) compileSubscript(expr *ast.Subscript) error {
 	return nil
 }
 
+func (c *Compiler) compileAttribute(expr *ast.Attribute) error {
+	if err := c.compileExpr(expr.Value); err != nil {
+		return err
+	}
+	c.emit(OpLoadAttr, c.addName(expr.Attr))
+	return nil
+}
+
 func (c *Compiler) compileName(expr *ast.Name) error {
 	if c.scopeDepth == 0 {
 		c.emit(OpLoadName, c.addName(expr.Id))
@@ -637,4 +754,11 @@ func (c *Compiler) compileDict(expr *ast.Dict) error {
 func Compile(module *ast.Module) (*CodeObject, error) {
 	compiler := NewCompiler()
 	return compiler.Compile(module)
+}
+
+// CompileFile compiles module, recording filename as its source path.
+func CompileFile(module *ast.Module, filename string) (*CodeObject, error) {
+	compiler := NewCompiler()
+	compiler.SetFilename(filename)
+	return compiler.Compile(module)
 }
\ No newline at end of file
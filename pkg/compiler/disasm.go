@@ -0,0 +1,329 @@
+package compiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// Disassemble returns the assembly listing of co and its nested functions.
+// Instructions are grouped by source line, jump targets are labels and each
+// operand is resolved in a comment. Register code, if any, follows the
+// instructions in a .registers section. Assemble reads the listing back.
+func (co *CodeObject) Disassemble() string {
+	return co.DisassembleSource("")
+}
+
+// DisassembleSource is like Disassemble, and also shows the text of each
+// source line, taken from source, next to its .line marker.
+func (co *CodeObject) DisassembleSource(source string) string {
+	d := &disassembler{}
+	if source != "" {
+		d.source = strings.Split(source, "\n")
+	}
+	d.code(co, "")
+	return d.b.String()
+}
+
+type disassembler struct {
+	b      strings.Builder
+	source []string
+}
+
+// commentColumn is where operand comments start, relative to the indent.
+const commentColumn = 36
+
+func (d *disassembler) code(co *CodeObject, indent string) {
+	b := &d.b
+	fmt.Fprintf(b, ".code %s\n", asmName(co.Name))
+	fmt.Fprintf(b, "%s.filename %s\n", indent, strconv.Quote(co.Filename))
+	fmt.Fprintf(b, "%s.firstlineno %d\n", indent, co.Firstlineno)
+	fmt.Fprintf(b, "%s.argcount %d\n", indent, co.Argcount)
+	if co.StackSize > 0 {
+		fmt.Fprintf(b, "%s.stacksize %d\n", indent, co.StackSize)
+	}
+
+	fmt.Fprintf(b, "%s.consts\n", indent)
+	for i, c := range co.Consts {
+		fmt.Fprintf(b, "%s    %d: ", indent, i)
+		if fn, ok := c.(*PyFunction); ok && fn.Code != nil {
+			d.code(fn.Code, indent+"        ")
+			continue
+		}
+		b.WriteString(asmValue(c))
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(b, "%s.names\n", indent)
+	for i, name := range co.Names {
+		fmt.Fprintf(b, "%s    %d: %s\n", indent, i, asmName(name))
+	}
+	fmt.Fprintf(b, "%s.varnames\n", indent)
+	for i, name := range co.Varnames {
+		fmt.Fprintf(b, "%s    %d: %s\n", indent, i, asmName(name))
+	}
+
+	fmt.Fprintf(b, "%s.instructions\n", indent)
+	targets := jumpTargets(co)
+	lines := co.LineTable
+	for i := 0; i <= len(co.Instructions); i++ {
+		for len(lines) > 0 && lines[0].Offset <= i {
+			if i > 0 {
+				b.WriteByte('\n')
+			}
+			d.line(indent, lines[0].Line)
+			lines = lines[1:]
+		}
+		if targets[i] {
+			fmt.Fprintf(b, "%sL%d:\n", indent, i)
+		}
+		if i == len(co.Instructions) {
+			break
+		}
+
+		instr := co.Instructions[i]
+		text := fmt.Sprintf("%d: %s", i, instr.Op)
+		if target, ok := jumpTarget(co, i); ok {
+			text += fmt.Sprintf(" L%d", target)
+		} else if instr.Op.isPacked() && instr.Arg >= 0 {
+			first, second := UnpackOperands(instr.Arg)
+			text += fmt.Sprintf(" %d %d", first, second)
+		} else if instr.Op.hasArg() || instr.Arg != 0 {
+			text += fmt.Sprintf(" %d", instr.Arg)
+		}
+		if comment := operandComment(co, instr); comment != "" {
+			text = fmt.Sprintf("%-*s ; %s", commentColumn, text, comment)
+		}
+		fmt.Fprintf(b, "%s    %s\n", indent, text)
+	}
+	if co.Registers != nil {
+		d.registers(co, indent)
+	}
+	fmt.Fprintf(b, "%s.end\n", indent)
+}
+
+func (d *disassembler) line(indent string, line int) {
+	if line >= 1 && line <= len(d.source) {
+		if text := strings.TrimSpace(d.source[line-1]); text != "" {
+			fmt.Fprintf(&d.b, "%s    %-*s ; %s\n", indent, commentColumn, fmt.Sprintf(".line %d", line), text)
+			return
+		}
+	}
+	fmt.Fprintf(&d.b, "%s    .line %d\n", indent, line)
+}
+
+// jumpTarget returns the offset the instruction at offset may jump to, if
+// it is a jump whose target is inside the code.
+func jumpTarget(co *CodeObject, offset int) (int, bool) {
+	instr := co.Instructions[offset]
+	if !instr.Op.isJump() {
+		return 0, false
+	}
+	target := instr.Arg
+	if instr.Op == OpJumpForward {
+		target = offset + 1 + instr.Arg
+	}
+	return target, target >= 0 && target <= len(co.Instructions)
+}
+
+func jumpTargets(co *CodeObject) map[int]bool {
+	targets := make(map[int]bool)
+	for i := range co.Instructions {
+		if target, ok := jumpTarget(co, i); ok {
+			targets[target] = true
+		}
+	}
+	return targets
+}
+
+// maxCommentValue bounds how much of a constant an operand comment shows.
+const maxCommentValue = 40
+
+// operandComment describes what the operand of instr refers to.
+func operandComment(co *CodeObject, instr Instruction) string {
+	arg := instr.Arg
+	if instr.Op.isPacked() {
+		if arg < 0 {
+			return "out of range"
+		}
+		first, second := UnpackOperands(arg)
+		op := OpLoadConst
+		if instr.Op == OpLoadFastLoadFast || instr.Op == OpStoreFastLoadFast {
+			op = OpLoadFast
+		}
+		return operandComment(co, Instruction{Op: OpLoadFast, Arg: first}) + ", " +
+			operandComment(co, Instruction{Op: op, Arg: second})
+	}
+	switch instr.Op {
+	case OpLoadConst:
+		if arg >= 0 && arg < len(co.Consts) {
+			if fn, ok := co.Consts[arg].(*PyFunction); ok {
+				return fmt.Sprintf("<code %s>", fn.Name)
+			}
+			s := asmValue(co.Consts[arg])
+			if len(s) > maxCommentValue {
+				s = s[:maxCommentValue-3] + "..."
+			}
+			return s
+		}
+	case OpLoadName, OpStoreName, OpLoadGlobal, OpStoreGlobal, OpLoadAttr, OpImportName:
+		if arg >= 0 && arg < len(co.Names) {
+			return co.Names[arg]
+		}
+	case OpLoadFast, OpStoreFast:
+		if arg >= 0 && arg < len(co.Varnames) {
+			return co.Varnames[arg]
+		}
+	case OpCallFunction:
+		if arg == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", arg)
+	default:
+		return ""
+	}
+	return "out of range"
+}
+
+func asmValue(obj object.Object) string {
+	switch v := obj.(type) {
+	case *runtime.PyNone:
+		return "None"
+	case *runtime.PyBool:
+		return v.String()
+	case *runtime.PyInt:
+		return strconv.Itoa(v.Value)
+	case *runtime.PyFloat:
+		s := strconv.FormatFloat(v.Value, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		return s
+	case *runtime.PyString:
+		return strconv.Quote(v.Value)
+	case *runtime.PyList:
+		parts := make([]string, len(v.Elements))
+		for i, elem := range v.Elements {
+			parts[i] = asmValue(elem)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case *runtime.PyDict:
+		parts := make([]string, len(v.Keys))
+		for i, key := range v.Keys {
+			parts[i] = strconv.Quote(key) + ": " + asmValue(v.Pairs[key])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	// Not representable; Assemble rejects it.
+	return fmt.Sprintf("<%s>", obj.Type())
+}
+
+// CodeListing is the disassembly of a code object in a form meant for
+// tools. DisassembleJSON encodes it.
+type CodeListing struct {
+	Name         string               `json:"name"`
+	Filename     string               `json:"filename"`
+	Firstlineno  int                  `json:"firstlineno"`
+	Argcount     int                  `json:"argcount"`
+	StackSize    int                  `json:"stacksize"`
+	Consts       []ConstListing       `json:"consts"`
+	Names        []string             `json:"names"`
+	Varnames     []string             `json:"varnames"`
+	Instructions []InstructionListing `json:"instructions"`
+}
+
+// ConstListing is a constant; Code is set for function code objects.
+type ConstListing struct {
+	Type string       `json:"type"`
+	Repr string       `json:"repr"`
+	Code *CodeListing `json:"code,omitempty"`
+}
+
+// InstructionListing is a single instruction. Argrepr resolves the operand
+// and Target is the absolute offset a jump goes to.
+type InstructionListing struct {
+	Offset       int    `json:"offset"`
+	Opname       string `json:"opname"`
+	Opcode       int    `json:"opcode"`
+	Arg          int    `json:"arg"`
+	Argrepr      string `json:"argrepr,omitempty"`
+	Target       *int   `json:"target,omitempty"`
+	Line         int    `json:"line,omitempty"`
+	StartsLine   bool   `json:"starts_line,omitempty"`
+	IsJumpTarget bool   `json:"is_jump_target,omitempty"`
+}
+
+// Listing returns the disassembly of co and its nested functions.
+func (co *CodeObject) Listing() *CodeListing {
+	l := &CodeListing{
+		Name:         co.Name,
+		Filename:     co.Filename,
+		Firstlineno:  co.Firstlineno,
+		Argcount:     co.Argcount,
+		StackSize:    co.StackSize,
+		Consts:       make([]ConstListing, len(co.Consts)),
+		Names:        append([]string{}, co.Names...),
+		Varnames:     append([]string{}, co.Varnames...),
+		Instructions: make([]InstructionListing, len(co.Instructions)),
+	}
+	for i, c := range co.Consts {
+		l.Consts[i] = ConstListing{Type: c.Type(), Repr: asmValue(c)}
+		if fn, ok := c.(*PyFunction); ok && fn.Code != nil {
+			l.Consts[i].Repr = fmt.Sprintf("<code %s>", fn.Name)
+			l.Consts[i].Code = fn.Code.Listing()
+		}
+	}
+
+	targets := jumpTargets(co)
+	starts := make(map[int]bool)
+	for _, entry := range co.LineTable {
+		starts[entry.Offset] = true
+	}
+	for i, instr := range co.Instructions {
+		il := InstructionListing{
+			Offset:       i,
+			Opname:       instr.Op.String(),
+			Opcode:       int(instr.Op),
+			Arg:          instr.Arg,
+			Argrepr:      operandComment(co, instr),
+			Line:         co.LineForOffset(i),
+			StartsLine:   starts[i],
+			IsJumpTarget: targets[i],
+		}
+		if target, ok := jumpTarget(co, i); ok {
+			il.Target = &target
+			il.Argrepr = fmt.Sprintf("to %d", target)
+		}
+		l.Instructions[i] = il
+	}
+	return l
+}
+
+// DisassembleJSON returns the Listing of co as indented JSON.
+func (co *CodeObject) DisassembleJSON() ([]byte, error) {
+	return json.MarshalIndent(co.Listing(), "", "  ")
+}
+
+// WriteDisassembly writes the disassembly of co to w in format "text" or
+// "json". The text format shows lines of source, if it is not empty.
+func WriteDisassembly(w io.Writer, co *CodeObject, format, source string) error {
+	var out []byte
+	switch format {
+	case "text":
+		out = []byte(co.DisassembleSource(source))
+	case "json":
+		data, err := co.DisassembleJSON()
+		if err != nil {
+			return err
+		}
+		out = append(data, '\n')
+	default:
+		return fmt.Errorf("unknown disassembly format %q (want text or json)", format)
+	}
+	_, err := w.Write(out)
+	return err
+}
@@ -0,0 +1,26 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+)
+
+// Error is a compile error located at the statement that caused it.
+type Error struct {
+	Filename string
+	Pos      ast.Position
+	End      ast.Position
+	Msg      string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Pos.Line, e.Pos.Column, e.Msg)
+}
+
+func (c *Compiler) errorAt(node ast.Node, err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{Filename: c.filename, Pos: node.Pos(), End: node.End(), Msg: err.Error()}
+}
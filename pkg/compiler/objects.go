@@ -3,12 +3,13 @@ package compiler
 import (
 	"fmt"
 	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
 )
 
 type PyFunction struct {
 	Code    *CodeObject
 	Name    string
-	Globals map[string]object.Object
+	Globals *runtime.Namespace
 }
 
 func (p *PyFunction) String() string {
@@ -0,0 +1,859 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// Optimization levels accepted by Optimize.
+const (
+	// OptNone leaves the compiled code unchanged.
+	OptNone = 0
+	// OptPeephole folds constant expressions, fuses "not" into the
+	// conditional jump that follows it, threads jumps to unconditional
+	// jumps, removes NOPs and combines common sequences of local variable
+	// and constant accesses into superinstructions.
+	OptPeephole = 1
+	// OptFull also resolves conditional jumps on constants ("if True",
+	// "while 1") and removes unreachable code. Lines whose code is removed
+	// no longer produce line events or coverage.
+	OptFull = 2
+)
+
+// MaxOptLevel is the highest level Optimize accepts.
+const MaxOptLevel = OptFull
+
+// Optimize rewrites co and the code of the functions it defines at the
+// given level, then verifies the result. Optimized code has the same
+// observable behaviour as the original, except for the line events noted
+// for OptFull. Register code only has operations on constants folded and
+// its constants renumbered. Optimize modifies co in place, so it must run
+// before the code is shared.
+func Optimize(co *CodeObject, level int) error {
+	if level < OptNone || level > MaxOptLevel {
+		return fmt.Errorf("invalid optimization level %d (want %d to %d)", level, OptNone, MaxOptLevel)
+	}
+	if err := Verify(co); err != nil || level == OptNone {
+		return err
+	}
+	optimize(co, level)
+	return Verify(co)
+}
+
+// maxOptPasses bounds how many times the passes are repeated; each pass
+// usually exposes only a few new opportunities.
+const maxOptPasses = 10
+
+func optimize(co *CodeObject, level int) {
+	for _, c := range co.Consts {
+		if fn, ok := c.(*PyFunction); ok && fn.Code != nil {
+			optimize(fn.Code, level)
+		}
+	}
+
+	if !wellFormed(co) {
+		return
+	}
+	o := newOptimizer(co)
+	for pass := 0; pass < maxOptPasses; pass++ {
+		changed := o.foldConstants()
+		changed = o.fuseNot() || changed
+		if level >= OptFull {
+			changed = o.constantJumps() || changed
+		}
+		changed = o.threadJumps() || changed
+		if level >= OptFull {
+			changed = o.removeUnreachable() || changed
+		}
+		if !o.compact() && !changed {
+			break
+		}
+	}
+	// Superinstructions hide their parts from the other passes, so they
+	// are formed last.
+	o.superinstructions()
+	o.compact()
+	if co.Registers != nil {
+		o.foldRegisters()
+	}
+	o.finish()
+}
+
+// wellFormed reports whether every instruction of co, reachable or not,
+// has a valid operand. Verify only checks reachable ones, and the passes
+// rely on all of them; code that is not well formed is left alone.
+func wellFormed(co *CodeObject) bool {
+	for i, instr := range co.Instructions {
+		if checkOperand(co, instr) != nil {
+			return false
+		}
+		if _, err := effectOf(instr); err != nil {
+			return false
+		}
+		if _, ok := jumpTarget(co, i); instr.Op.isJump() && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// optimizer works on a copy of the instructions in which every jump
+// operand is an absolute offset, with the source line of each instruction
+// kept alongside so the line table can be rebuilt.
+type optimizer struct {
+	co     *CodeObject
+	code   []Instruction
+	lines  []int
+	consts map[string]int
+}
+
+func newOptimizer(co *CodeObject) *optimizer {
+	o := &optimizer{
+		co:     co,
+		code:   make([]Instruction, len(co.Instructions)),
+		lines:  make([]int, len(co.Instructions)),
+		consts: make(map[string]int),
+	}
+	for i, instr := range co.Instructions {
+		if target, ok := jumpTarget(co, i); ok {
+			instr.Arg = target
+		}
+		o.code[i] = instr
+		o.lines[i] = co.LineForOffset(i)
+	}
+	for i, c := range co.Consts {
+		if key, ok := constKey(c); ok {
+			if _, dup := o.consts[key]; !dup {
+				o.consts[key] = i
+			}
+		}
+	}
+	return o
+}
+
+// constKey identifies foldable constants the same way the compiler's
+// constant table does.
+func constKey(obj object.Object) (string, bool) {
+	switch obj.(type) {
+	case *runtime.PyNone, *runtime.PyBool, *runtime.PyInt, *runtime.PyFloat, *runtime.PyString:
+		return constantKey(obj), true
+	}
+	return "", false
+}
+
+func (o *optimizer) addConstant(obj object.Object) int {
+	key, _ := constKey(obj)
+	if idx, ok := o.consts[key]; ok {
+		return idx
+	}
+	idx := len(o.co.Consts)
+	o.co.Consts = append(o.co.Consts, obj)
+	o.consts[key] = idx
+	return idx
+}
+
+// constant returns the value loaded by the instruction at i, if it loads a
+// foldable constant.
+func (o *optimizer) constant(i int) (object.Object, bool) {
+	if o.code[i].Op != OpLoadConst {
+		return nil, false
+	}
+	c := o.co.Consts[o.code[i].Arg]
+	_, ok := constKey(c)
+	return c, ok
+}
+
+func (o *optimizer) targets() map[int]bool {
+	targets := make(map[int]bool)
+	for _, instr := range o.code {
+		if instr.Op.isJump() {
+			targets[instr.Arg] = true
+		}
+	}
+	return targets
+}
+
+// nop turns the instructions from i up to j into NOPs for compact to drop.
+func (o *optimizer) nop(i, j int) {
+	for ; i < j; i++ {
+		o.code[i] = Instruction{Op: OpNop}
+	}
+}
+
+// foldConstants replaces operators applied to constants by their result.
+// Operations that would raise, such as division by zero, are left for the
+// VM so the error is reported when and where it happens.
+func (o *optimizer) foldConstants() bool {
+	changed := false
+	targets := o.targets()
+	for i := 0; i < len(o.code); i++ {
+		left, ok := o.constant(i)
+		if !ok {
+			continue
+		}
+		if i+1 < len(o.code) && !targets[i+1] {
+			if result, ok := foldUnary(o.code[i+1].Op, left); ok {
+				o.code[i] = Instruction{Op: OpLoadConst, Arg: o.addConstant(result)}
+				o.nop(i+1, i+2)
+				changed = true
+				continue
+			}
+		}
+		if i+2 < len(o.code) && !targets[i+1] && !targets[i+2] {
+			right, ok := o.constant(i + 1)
+			if !ok {
+				continue
+			}
+			if result, ok := foldBinary(o.code[i+2].Op, left, right); ok {
+				o.code[i] = Instruction{Op: OpLoadConst, Arg: o.addConstant(result)}
+				o.nop(i+1, i+3)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// maxFoldedString bounds the length of strings built by constant folding.
+const maxFoldedString = 4096
+
+func foldUnary(op OpCode, operand object.Object) (object.Object, bool) {
+	switch op {
+	case OpUnaryNot:
+		return runtime.NewBool(!operand.IsTruthy()), true
+	case OpUnaryPos:
+		switch operand.(type) {
+		case *runtime.PyInt, *runtime.PyFloat:
+			return operand, true
+		}
+	case OpUnaryNeg:
+		switch v := operand.(type) {
+		case *runtime.PyInt:
+			return runtime.NewInt(-v.Value), true
+		case *runtime.PyFloat:
+			return &runtime.PyFloat{Value: -v.Value}, true
+		}
+	}
+	return nil, false
+}
+
+// foldBinary computes left op right exactly as the VM does, for the
+// operand types where the result cannot depend on anything but the values.
+func foldBinary(op OpCode, left, right object.Object) (object.Object, bool) {
+	switch op {
+	case OpCompareEq:
+		return runtime.NewBool(left.Equal(right)), true
+	case OpCompareNe:
+		return runtime.NewBool(!left.Equal(right)), true
+	}
+
+	if l, ok := left.(*runtime.PyString); ok {
+		r, ok := right.(*runtime.PyString)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case OpBinaryAdd:
+			if len(l.Value)+len(r.Value) > maxFoldedString {
+				return nil, false
+			}
+			return &runtime.PyString{Value: l.Value + r.Value}, true
+		case OpCompareLt:
+			return runtime.NewBool(l.Value < r.Value), true
+		case OpCompareLe:
+			return runtime.NewBool(l.Value <= r.Value), true
+		case OpCompareGt:
+			return runtime.NewBool(l.Value > r.Value), true
+		case OpCompareGe:
+			return runtime.NewBool(l.Value >= r.Value), true
+		}
+		return nil, false
+	}
+
+	l, lok := left.(*runtime.PyInt)
+	r, rok := right.(*runtime.PyInt)
+	if lok && rok {
+		switch op {
+		case OpBinaryAdd:
+			return runtime.NewInt(l.Value + r.Value), true
+		case OpBinarySub:
+			return runtime.NewInt(l.Value - r.Value), true
+		case OpBinaryMul:
+			return runtime.NewInt(l.Value * r.Value), true
+		case OpBinaryDiv:
+			if r.Value != 0 {
+				return runtime.NewInt(l.Value / r.Value), true
+			}
+		case OpBinaryMod:
+			if r.Value != 0 {
+				return runtime.NewInt(l.Value % r.Value), true
+			}
+		case OpCompareLt:
+			return runtime.NewBool(l.Value < r.Value), true
+		case OpCompareLe:
+			return runtime.NewBool(l.Value <= r.Value), true
+		case OpCompareGt:
+			return runtime.NewBool(l.Value > r.Value), true
+		case OpCompareGe:
+			return runtime.NewBool(l.Value >= r.Value), true
+		}
+		return nil, false
+	}
+
+	lf, lok := numberValue(left)
+	rf, rok := numberValue(right)
+	if !lok || !rok {
+		return nil, false
+	}
+	switch op {
+	case OpBinaryAdd:
+		return &runtime.PyFloat{Value: lf + rf}, true
+	case OpBinarySub:
+		return &runtime.PyFloat{Value: lf - rf}, true
+	case OpBinaryMul:
+		return &runtime.PyFloat{Value: lf * rf}, true
+	case OpBinaryDiv:
+		if rf != 0 {
+			return &runtime.PyFloat{Value: lf / rf}, true
+		}
+	case OpCompareLt:
+		return runtime.NewBool(lf < rf), true
+	case OpCompareLe:
+		return runtime.NewBool(lf <= rf), true
+	case OpCompareGt:
+		return runtime.NewBool(lf > rf), true
+	case OpCompareGe:
+		return runtime.NewBool(lf >= rf), true
+	}
+	return nil, false
+}
+
+// numberValue converts an int or float constant to float64.
+func numberValue(obj object.Object) (float64, bool) {
+	switch v := obj.(type) {
+	case *runtime.PyInt:
+		return float64(v.Value), true
+	case *runtime.PyFloat:
+		return v.Value, true
+	}
+	return 0, false
+}
+
+// fuseNot turns "UNARY_NOT; POP_JUMP_IF_FALSE" into "POP_JUMP_IF_TRUE"
+// and vice versa, and "COMPARE_EQ; UNARY_NOT" into "COMPARE_NE".
+func (o *optimizer) fuseNot() bool {
+	changed := false
+	targets := o.targets()
+	for i := 0; i+1 < len(o.code); i++ {
+		if targets[i+1] {
+			continue
+		}
+		next := o.code[i+1]
+		switch {
+		case o.code[i].Op == OpUnaryNot && next.Op == OpPopJumpIfFalse:
+			o.code[i] = Instruction{Op: OpPopJumpIfTrue, Arg: next.Arg}
+		case o.code[i].Op == OpUnaryNot && next.Op == OpPopJumpIfTrue:
+			o.code[i] = Instruction{Op: OpPopJumpIfFalse, Arg: next.Arg}
+		case o.code[i].Op == OpCompareEq && next.Op == OpUnaryNot:
+			o.code[i] = Instruction{Op: OpCompareNe}
+		case o.code[i].Op == OpCompareNe && next.Op == OpUnaryNot:
+			o.code[i] = Instruction{Op: OpCompareEq}
+		case o.code[i].Op == OpCompareIs && next.Op == OpUnaryNot:
+			o.code[i] = Instruction{Op: OpCompareIsNot}
+		case o.code[i].Op == OpCompareIsNot && next.Op == OpUnaryNot:
+			o.code[i] = Instruction{Op: OpCompareIs}
+		default:
+			continue
+		}
+		o.nop(i+1, i+2)
+		changed = true
+	}
+	return changed
+}
+
+// superinstruction is a sequence of instructions replaced by a single one.
+type superinstruction struct {
+	seq []OpCode
+	op  OpCode
+}
+
+// superinstructions lists the sequences in order of preference; each
+// packs the operands of its first two instructions.
+var superinstructions = []superinstruction{
+	{[]OpCode{OpLoadFast, OpLoadConst, OpBinaryAdd}, OpBinaryAddFastConst},
+	{[]OpCode{OpLoadFast, OpLoadConst, OpBinarySub}, OpBinarySubFastConst},
+	{[]OpCode{OpLoadFast, OpLoadConst}, OpLoadFastLoadConst},
+	{[]OpCode{OpLoadFast, OpLoadFast}, OpLoadFastLoadFast},
+	{[]OpCode{OpStoreFast, OpLoadFast}, OpStoreFastLoadFast},
+}
+
+// superinstructions replaces sequences from the superinstructions table
+// that are not entered in the middle and come from a single source line.
+func (o *optimizer) superinstructions() {
+	targets := o.targets()
+	for i := range o.code {
+		for _, s := range superinstructions {
+			if o.matches(i, s.seq, targets) && o.code[i].Arg <= MaxPackedIndex {
+				o.code[i] = Instruction{Op: s.op, Arg: PackOperands(o.code[i].Arg, o.code[i+1].Arg)}
+				o.nop(i+1, i+len(s.seq))
+				break
+			}
+		}
+	}
+}
+
+func (o *optimizer) matches(i int, seq []OpCode, targets map[int]bool) bool {
+	if i+len(seq) > len(o.code) {
+		return false
+	}
+	for j, op := range seq {
+		if o.code[i+j].Op != op || j > 0 && (targets[i+j] || o.lines[i+j] != o.lines[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// constantJumps resolves conditional jumps on a constant: the jump is
+// removed if it is never taken and becomes unconditional if it always is.
+func (o *optimizer) constantJumps() bool {
+	changed := false
+	targets := o.targets()
+	for i := 0; i+1 < len(o.code); i++ {
+		c, ok := o.constant(i)
+		if !ok || targets[i+1] {
+			continue
+		}
+		next := o.code[i+1]
+		if next.Op != OpPopJumpIfFalse && next.Op != OpPopJumpIfTrue {
+			continue
+		}
+		if c.IsTruthy() == (next.Op == OpPopJumpIfTrue) {
+			o.code[i] = Instruction{Op: OpJumpAbsolute, Arg: next.Arg}
+			o.nop(i+1, i+2)
+		} else {
+			o.nop(i, i+2)
+		}
+		changed = true
+	}
+	return changed
+}
+
+// threadJumps makes jumps to unconditional jumps go straight to the final
+// target, and drops jumps to the instruction that follows them.
+func (o *optimizer) threadJumps() bool {
+	changed := false
+	for i, instr := range o.code {
+		if !instr.Op.isJump() {
+			continue
+		}
+		target := o.finalTarget(instr.Arg)
+		if target != instr.Arg {
+			o.code[i].Arg = target
+			changed = true
+		}
+		if target != o.next(i) {
+			continue
+		}
+		switch instr.Op {
+		case OpJumpAbsolute, OpJumpForward:
+			o.nop(i, i+1)
+			changed = true
+		case OpPopJumpIfFalse, OpPopJumpIfTrue:
+			o.code[i] = Instruction{Op: OpPopTop}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// finalTarget follows unconditional jumps and NOPs from target.
+func (o *optimizer) finalTarget(target int) int {
+	for steps := 0; steps <= len(o.code); steps++ {
+		target = o.skipNops(target)
+		if target == len(o.code) {
+			return target
+		}
+		instr := o.code[target]
+		if instr.Op != OpJumpAbsolute && instr.Op != OpJumpForward {
+			return target
+		}
+		if instr.Arg == target {
+			return target // a jump to itself
+		}
+		target = instr.Arg
+	}
+	return target // a cycle of jumps
+}
+
+func (o *optimizer) skipNops(i int) int {
+	for i < len(o.code) && o.code[i].Op == OpNop {
+		i++
+	}
+	return i
+}
+
+// next returns the offset of the first instruction after i that compact
+// keeps.
+func (o *optimizer) next(i int) int {
+	return o.skipNops(i + 1)
+}
+
+// removeUnreachable turns instructions that no path from the entry reaches
+// into NOPs.
+func (o *optimizer) removeUnreachable() bool {
+	reached := make([]bool, len(o.code))
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(o.code) || reached[i] {
+			continue
+		}
+		reached[i] = true
+		effect, err := effectOf(o.code[i])
+		if err != nil {
+			return false // verified code never gets here
+		}
+		if effect.next {
+			work = append(work, i+1)
+		}
+		if effect.jumps {
+			work = append(work, o.code[i].Arg)
+		}
+	}
+
+	changed := false
+	for i, ok := range reached {
+		if !ok && o.code[i].Op != OpNop {
+			o.nop(i, i+1)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// compact drops NOPs, moving jumps that targeted them to the instruction
+// that follows. It reports whether anything was dropped.
+func (o *optimizer) compact() bool {
+	offsets := make([]int, len(o.code)+1)
+	n := 0
+	for i, instr := range o.code {
+		offsets[i] = n
+		if instr.Op != OpNop {
+			n++
+		}
+	}
+	offsets[len(o.code)] = n
+	if n == len(o.code) {
+		return false
+	}
+
+	code := make([]Instruction, 0, n)
+	lines := make([]int, 0, n)
+	for i, instr := range o.code {
+		if instr.Op == OpNop {
+			continue
+		}
+		if instr.Op.isJump() {
+			instr.Arg = offsets[instr.Arg]
+		}
+		code = append(code, instr)
+		lines = append(lines, o.lines[i])
+	}
+	o.code, o.lines = code, lines
+	return true
+}
+
+// finish stores the optimized instructions and line table in the code
+// object, making JUMP_FORWARD operands relative again, and drops constants
+// that are no longer used.
+func (o *optimizer) finish() {
+	co := o.co
+	co.Instructions = make([]Instruction, len(o.code))
+	for i, instr := range o.code {
+		switch {
+		case instr.Op == OpJumpForward && instr.Arg > i:
+			instr.Arg -= i + 1
+		case instr.Op == OpJumpForward:
+			instr.Op = OpJumpAbsolute
+		}
+		co.Instructions[i] = instr
+	}
+
+	co.LineTable = nil
+	for i, line := range o.lines {
+		if line > 0 && (len(co.LineTable) == 0 || co.LineTable[len(co.LineTable)-1].Line != line) {
+			co.LineTable = append(co.LineTable, LineEntry{Offset: i, Line: line})
+		}
+	}
+
+	used := make([]bool, len(co.Consts))
+	for _, instr := range co.Instructions {
+		if c, ok := constOperand(instr); ok {
+			used[c] = true
+		}
+	}
+	if co.Registers != nil {
+		for _, instr := range co.Registers.Instructions {
+			forRegConsts(&instr, func(c *int32, k int) { used[k] = true })
+		}
+	}
+	index := make([]int, len(co.Consts))
+	consts := []object.Object{}
+	for i, c := range co.Consts {
+		if used[i] {
+			index[i] = len(consts)
+			consts = append(consts, c)
+		}
+	}
+	co.Consts = consts
+	for i, instr := range co.Instructions {
+		switch c, ok := constOperand(instr); {
+		case !ok:
+		case instr.Op == OpLoadConst:
+			co.Instructions[i].Arg = index[c]
+		default:
+			local, _ := UnpackOperands(instr.Arg)
+			co.Instructions[i].Arg = PackOperands(local, index[c])
+		}
+	}
+	if co.Registers != nil {
+		for i := range co.Registers.Instructions {
+			forRegConsts(&co.Registers.Instructions[i], func(c *int32, k int) {
+				if *c < 0 {
+					*c = ConstOperand(index[k])
+				} else {
+					*c = int32(index[k])
+				}
+			})
+		}
+	}
+}
+
+// foldRegisters replaces register instructions that operate on constants
+// by moves of their result, the register form of foldConstants. A move of
+// a constant into a temporary that is read once, later in the same block,
+// is dropped and the constant used by the reader instead, so that chains
+// such as 2 * 3 + 4 fold completely and their operands are no longer used.
+func (o *optimizer) foldRegisters() {
+	rc := o.co.Registers
+	code := rc.Instructions
+	targets := make(map[int]bool)
+	for _, instr := range code {
+		if j := instr.Op.JumpOperand(); j >= 0 {
+			targets[int(instr.Operand(j))] = true
+		}
+	}
+
+	removed := make([]bool, len(code))
+	// moves maps temporaries to the move that put a constant in them, for
+	// moves earlier in the block whose temporary has not been read since.
+	moves := make(map[int32]int)
+	for i := range code {
+		if targets[i] {
+			moves = make(map[int32]int)
+		}
+		instr := &code[i]
+		for r, move := range moves {
+			if !regReads(*instr, r) {
+				continue
+			}
+			k, _ := IsConstOperand(code[move].B)
+			if regDeadAfter(code, i, r) && substituteRegister(instr, r, k) {
+				removed[move] = true
+			}
+			delete(moves, r)
+		}
+		o.foldRegister(instr)
+
+		if regWrites(*instr, instr.A) {
+			delete(moves, instr.A)
+			if _, isConst := IsConstOperand(instr.B); instr.Op == RegMove && isConst && int(instr.A) >= len(o.co.Varnames) {
+				moves[instr.A] = i
+			}
+		}
+		if instr.Op.JumpOperand() >= 0 || instr.Op == RegReturn {
+			moves = make(map[int32]int)
+		}
+	}
+
+	offsets := make([]int, len(code)+1)
+	n := 0
+	for i := range code {
+		offsets[i] = n
+		if !removed[i] {
+			n++
+		}
+	}
+	offsets[len(code)] = n
+	if n == len(code) {
+		return
+	}
+	kept := make([]RegInstruction, 0, n)
+	for i, instr := range code {
+		if removed[i] {
+			continue
+		}
+		if j := instr.Op.JumpOperand(); j >= 0 {
+			*instr.operandPtr(j) = int32(offsets[instr.Operand(j)])
+		}
+		kept = append(kept, instr)
+	}
+	var lines []LineEntry
+	for _, entry := range rc.LineTable {
+		entry.Offset = offsets[entry.Offset]
+		if entry.Offset == n {
+			break
+		}
+		if len(lines) > 0 && lines[len(lines)-1].Offset == entry.Offset {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) == 0 || lines[len(lines)-1].Line != entry.Line {
+			lines = append(lines, entry)
+		}
+	}
+	rc.Instructions, rc.LineTable = kept, lines
+}
+
+// foldRegister replaces instr by a move of its result if it applies an
+// operator to constants whose result foldUnary or foldBinary can compute.
+func (o *optimizer) foldRegister(instr *RegInstruction) {
+	operator := instr.Op.Operator()
+	if operator == OpNop || instr.Op.JumpOperand() >= 0 {
+		return
+	}
+	left, ok := o.regConstant(instr.B)
+	if !ok {
+		return
+	}
+	var result object.Object
+	if instr.Op >= RegPos && instr.Op <= RegNot {
+		result, ok = foldUnary(operator, left)
+	} else {
+		var right object.Object
+		if right, ok = o.regConstant(instr.C); ok {
+			result, ok = foldBinary(operator, left, right)
+		}
+	}
+	if ok {
+		*instr = RegInstruction{Op: RegMove, A: instr.A, B: ConstOperand(o.addConstant(result))}
+	}
+}
+
+// regConstant returns the constant the RK operand x refers to, if it is a
+// foldable one.
+func (o *optimizer) regConstant(x int32) (object.Object, bool) {
+	k, ok := IsConstOperand(x)
+	if !ok {
+		return nil, false
+	}
+	c := o.co.Consts[k]
+	_, ok = constKey(c)
+	return c, ok
+}
+
+// substituteRegister makes the RK operands of instr that read register r
+// use constant k instead. It fails, leaving instr alone, if instr also
+// reads r through an operand that cannot hold a constant.
+func substituteRegister(instr *RegInstruction, r int32, k int) bool {
+	if lo, n := regRange(*instr); r >= lo && r < lo+n {
+		return false
+	}
+	found := false
+	for i, kind := range instr.Op.Operands() {
+		if kind == 'k' && instr.Operand(i) == r {
+			*instr.operandPtr(i) = ConstOperand(k)
+			found = true
+		}
+	}
+	return found
+}
+
+// regDeadAfter reports whether no instruction run after the one at i,
+// which must not jump, can read register r before it is written again.
+func regDeadAfter(code []RegInstruction, i int, r int32) bool {
+	if code[i].Op.JumpOperand() >= 0 {
+		return false
+	}
+	if regWrites(code[i], r) {
+		return true
+	}
+	for _, instr := range code[i+1:] {
+		if regReads(instr, r) {
+			return false
+		}
+		if regWrites(instr, r) || instr.Op == RegReturn {
+			return true
+		}
+		if instr.Op.JumpOperand() >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// regReads reports whether instr reads register r.
+func regReads(instr RegInstruction, r int32) bool {
+	if lo, n := regRange(instr); r >= lo && r < lo+n {
+		return true
+	}
+	for i, kind := range instr.Op.Operands() {
+		if kind == 'k' && instr.Operand(i) == r {
+			return true
+		}
+	}
+	return false
+}
+
+// regWrites reports whether instr stores into register r.
+func regWrites(instr RegInstruction, r int32) bool {
+	operands := instr.Op.Operands()
+	return operands != "" && operands[0] == 'r' && instr.A == r
+}
+
+// regRange returns the registers that instr reads through its B operand:
+// the elements of BUILD_LIST and BUILD_DICT, the function and arguments
+// of CALL and the iterator of FOR_ITER.
+func regRange(instr RegInstruction) (lo, n int32) {
+	switch instr.Op {
+	case RegBuildList:
+		return instr.B, instr.C
+	case RegBuildDict:
+		return instr.B, 2 * instr.C
+	case RegCall:
+		return instr.B, instr.C + 1
+	case RegForIter:
+		return instr.B, 1
+	}
+	return 0, 0
+}
+
+// forRegConsts calls fn with each operand of instr that refers to a
+// constant and the index of the constant.
+func forRegConsts(instr *RegInstruction, fn func(operand *int32, k int)) {
+	for i, kind := range instr.Op.Operands() {
+		switch x := instr.Operand(i); kind {
+		case 'k':
+			if k, ok := IsConstOperand(x); ok {
+				fn(instr.operandPtr(i), k)
+			}
+		case 'c':
+			fn(instr.operandPtr(i), int(x))
+		}
+	}
+}
+
+// constOperand returns the constant index used by instr, if any.
+func constOperand(instr Instruction) (int, bool) {
+	switch instr.Op {
+	case OpLoadConst:
+		return instr.Arg, true
+	case OpLoadFastLoadConst, OpBinaryAddFastConst, OpBinarySubFastConst:
+		_, c := UnpackOperands(instr.Arg)
+		return c, true
+	}
+	return 0, false
+}
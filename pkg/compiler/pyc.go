@@ -0,0 +1,543 @@
+package compiler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// Bytecode file format. All integers are little-endian.
+//
+//	offset  size  field
+//	0       4     magic "GPYC"
+//	4       2     format version (FormatVersion)
+//	6       2     opcode table version (OpcodeVersion)
+//	8       4     flags, reserved, 0
+//	12      8     source modification time, Unix nanoseconds, 0 if unknown
+//	20      8     source size in bytes
+//	28      32    SHA-256 of the source, zero if unknown
+//	60      4     payload length N
+//	64      N     payload: the module code object
+//	64+N    4     CRC-32 (IEEE) of bytes 0 to 64+N
+//
+// The payload uses unsigned (uvarint) and zigzag signed (varint) varints.
+// A string is a uvarint length followed by UTF-8 bytes. A code object is:
+//
+//	string name, string filename, uvarint argcount, uvarint firstlineno
+//	uvarint count, then per instruction: byte opcode, varint arg
+//	uvarint count, then per constant: a value (below)
+//	uvarint count, then per name: string
+//	uvarint count, then per local variable name: string
+//	uvarint count, then per line table entry: uvarint offset, uvarint line
+//	byte 1 if register code follows, else 0; register code is:
+//	uvarint registers, uvarint count, then per instruction: byte opcode,
+//	varint A, varint B, varint C; then a line table as above
+//
+// A value is a tag byte followed by its data:
+//
+//	'N' None, 'T' True, 'F' False
+//	'i' varint, 'f' 8-byte IEEE 754 float, 's' string
+//	'c' function: string name, code object
+const (
+	FormatVersion = 2
+
+	headerSize = 64
+	maxPayload = 1 << 30
+)
+
+var magic = [4]byte{'G', 'P', 'Y', 'C'}
+
+var (
+	// ErrNotBytecode is returned for files that are not gopy bytecode.
+	ErrNotBytecode = errors.New("not a gopy bytecode file (bad magic number)")
+	// ErrChecksum is returned for bytecode files that are truncated or
+	// corrupted.
+	ErrChecksum = errors.New("bytecode file is corrupted (checksum mismatch)")
+)
+
+// VersionError is returned for bytecode written by an incompatible
+// compiler. Such files must be recompiled from source.
+type VersionError struct {
+	What string // "format" or "opcode table"
+	Got  int
+	Want int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("bytecode %s version %d is not supported (expected %d); recompile the source", e.What, e.Got, e.Want)
+}
+
+// FileHeader describes a bytecode file and the source it was compiled from.
+type FileHeader struct {
+	FormatVersion int
+	OpcodeVersion int
+	SourceModTime time.Time // zero if unknown
+	SourceSize    int64
+	SourceHash    [sha256.Size]byte // zero if unknown
+}
+
+// NewFileHeader returns the header for bytecode compiled from source, which
+// was last modified at modTime.
+func NewFileHeader(source []byte, modTime time.Time) FileHeader {
+	return FileHeader{
+		FormatVersion: FormatVersion,
+		OpcodeVersion: OpcodeVersion,
+		SourceModTime: modTime,
+		SourceSize:    int64(len(source)),
+		SourceHash:    sha256.Sum256(source),
+	}
+}
+
+// HasSource reports whether the header records the source it came from.
+func (h *FileHeader) HasSource() bool {
+	return h.SourceHash != [sha256.Size]byte{}
+}
+
+// Matches reports whether the bytecode was compiled from source. Bytecode
+// without source information matches nothing.
+func (h *FileHeader) Matches(source []byte) bool {
+	return h.HasSource() && int64(len(source)) == h.SourceSize && sha256.Sum256(source) == h.SourceHash
+}
+
+// WriteBytecode writes co to w in the bytecode file format. The versions in
+// header are ignored; the current ones are always written.
+func WriteBytecode(w io.Writer, co *CodeObject, header FileHeader) error {
+	var payload encoder
+	if err := payload.code(co); err != nil {
+		return err
+	}
+
+	buf := make([]byte, headerSize, headerSize+len(payload.buf)+4)
+	copy(buf[0:4], magic[:])
+	binary.LittleEndian.PutUint16(buf[4:6], FormatVersion)
+	binary.LittleEndian.PutUint16(buf[6:8], OpcodeVersion)
+	if !header.SourceModTime.IsZero() {
+		binary.LittleEndian.PutUint64(buf[12:20], uint64(header.SourceModTime.UnixNano()))
+	}
+	binary.LittleEndian.PutUint64(buf[20:28], uint64(header.SourceSize))
+	copy(buf[28:60], header.SourceHash[:])
+	binary.LittleEndian.PutUint32(buf[60:64], uint32(len(payload.buf)))
+	buf = append(buf, payload.buf...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadBytecode reads a bytecode file, rejecting files that are not
+// bytecode, were written by an incompatible compiler, are corrupted, or
+// fail Verify.
+func ReadBytecode(r io.Reader) (*CodeObject, *FileHeader, error) {
+	head := make([]byte, headerSize)
+	n, err := io.ReadFull(r, head)
+	if !bytes.HasPrefix(magic[:], head[:min(n, len(magic))]) || n == 0 && err == io.EOF {
+		return nil, nil, ErrNotBytecode
+	}
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrChecksum
+		}
+		return nil, nil, err
+	}
+
+	header := &FileHeader{
+		FormatVersion: int(binary.LittleEndian.Uint16(head[4:6])),
+		OpcodeVersion: int(binary.LittleEndian.Uint16(head[6:8])),
+		SourceSize:    int64(binary.LittleEndian.Uint64(head[20:28])),
+	}
+	if header.FormatVersion != FormatVersion {
+		return nil, header, &VersionError{What: "format", Got: header.FormatVersion, Want: FormatVersion}
+	}
+	if header.OpcodeVersion != OpcodeVersion {
+		return nil, header, &VersionError{What: "opcode table", Got: header.OpcodeVersion, Want: OpcodeVersion}
+	}
+	if nanos := int64(binary.LittleEndian.Uint64(head[12:20])); nanos != 0 {
+		header.SourceModTime = time.Unix(0, nanos)
+	}
+	copy(header.SourceHash[:], head[28:60])
+
+	length := binary.LittleEndian.Uint32(head[60:64])
+	if length > maxPayload {
+		return nil, header, ErrChecksum
+	}
+	rest := make([]byte, int(length)+4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, header, ErrChecksum
+		}
+		return nil, header, err
+	}
+	payload, sum := rest[:length], binary.LittleEndian.Uint32(rest[length:])
+	crc := crc32.Update(crc32.ChecksumIEEE(head), crc32.IEEETable, payload)
+	if crc != sum {
+		return nil, header, ErrChecksum
+	}
+
+	d := decoder{buf: payload}
+	co, err := d.code()
+	if err == nil && len(d.buf) != 0 {
+		err = errors.New("trailing data")
+	}
+	if err != nil {
+		return nil, header, fmt.Errorf("invalid bytecode payload: %v", err)
+	}
+	if err := Verify(co); err != nil {
+		return nil, header, err
+	}
+	return co, header, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uvarint(x uint64) { e.buf = binary.AppendUvarint(e.buf, x) }
+func (e *encoder) varint(x int64)   { e.buf = binary.AppendVarint(e.buf, x) }
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) code(co *CodeObject) error {
+	e.string(co.Name)
+	e.string(co.Filename)
+	e.uvarint(uint64(co.Argcount))
+	e.uvarint(uint64(co.Firstlineno))
+
+	e.uvarint(uint64(len(co.Instructions)))
+	for _, instr := range co.Instructions {
+		e.buf = append(e.buf, byte(instr.Op))
+		e.varint(int64(instr.Arg))
+	}
+	e.uvarint(uint64(len(co.Consts)))
+	for _, c := range co.Consts {
+		if err := e.value(c); err != nil {
+			return err
+		}
+	}
+	e.uvarint(uint64(len(co.Names)))
+	for _, name := range co.Names {
+		e.string(name)
+	}
+	e.uvarint(uint64(len(co.Varnames)))
+	for _, name := range co.Varnames {
+		e.string(name)
+	}
+	e.lineTable(co.LineTable)
+
+	rc := co.Registers
+	if rc == nil {
+		e.buf = append(e.buf, 0)
+		return nil
+	}
+	e.buf = append(e.buf, 1)
+	e.uvarint(uint64(rc.NumRegisters))
+	e.uvarint(uint64(len(rc.Instructions)))
+	for _, instr := range rc.Instructions {
+		e.buf = append(e.buf, byte(instr.Op))
+		e.varint(int64(instr.A))
+		e.varint(int64(instr.B))
+		e.varint(int64(instr.C))
+	}
+	e.lineTable(rc.LineTable)
+	return nil
+}
+
+func (e *encoder) lineTable(table []LineEntry) {
+	e.uvarint(uint64(len(table)))
+	for _, entry := range table {
+		e.uvarint(uint64(entry.Offset))
+		e.uvarint(uint64(entry.Line))
+	}
+}
+
+func (e *encoder) value(obj object.Object) error {
+	switch v := obj.(type) {
+	case *runtime.PyNone:
+		e.buf = append(e.buf, 'N')
+	case *runtime.PyBool:
+		if v.Value {
+			e.buf = append(e.buf, 'T')
+		} else {
+			e.buf = append(e.buf, 'F')
+		}
+	case *runtime.PyInt:
+		e.buf = append(e.buf, 'i')
+		e.varint(int64(v.Value))
+	case *runtime.PyFloat:
+		e.buf = append(e.buf, 'f')
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v.Value))
+	case *runtime.PyString:
+		e.buf = append(e.buf, 's')
+		e.string(v.Value)
+	case *PyFunction:
+		e.buf = append(e.buf, 'c')
+		e.string(v.Name)
+		return e.code(v.Code)
+	default:
+		return fmt.Errorf("cannot serialize constant of type %s", obj.Type())
+	}
+	return nil
+}
+
+type decoder struct {
+	buf   []byte
+	depth int
+}
+
+// maxNesting bounds how deeply constants and code objects may nest, so
+// that hostile files cannot exhaust the stack of the decoder.
+const maxNesting = 200
+
+var errTruncated = errors.New("unexpected end of data")
+
+func (d *decoder) byte() (byte, error) {
+	if len(d.buf) == 0 {
+		return 0, errTruncated
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b, nil
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.buf = d.buf[n:]
+	return x, nil
+}
+
+func (d *decoder) varint() (int64, error) {
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.buf = d.buf[n:]
+	return x, nil
+}
+
+func (d *decoder) int() (int, error) {
+	x, err := d.uvarint()
+	if err == nil && x > math.MaxInt32 {
+		err = fmt.Errorf("value %d out of range", x)
+	}
+	return int(x), err
+}
+
+// count reads a length, which cannot exceed the bytes left since every
+// element takes at least one byte.
+func (d *decoder) count() (int, error) {
+	n, err := d.int()
+	if err == nil && n > len(d.buf) {
+		err = errTruncated
+	}
+	return n, err
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.count()
+	if err != nil {
+		return "", err
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s, nil
+}
+
+func (d *decoder) strings() ([]string, error) {
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, n)
+	for i := range list {
+		if list[i], err = d.string(); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (d *decoder) code() (*CodeObject, error) {
+	co := &CodeObject{}
+	var err error
+	if co.Name, err = d.string(); err != nil {
+		return nil, err
+	}
+	if co.Filename, err = d.string(); err != nil {
+		return nil, err
+	}
+	if co.Argcount, err = d.int(); err != nil {
+		return nil, err
+	}
+	if co.Firstlineno, err = d.int(); err != nil {
+		return nil, err
+	}
+
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	co.Instructions = make([]Instruction, n)
+	for i := range co.Instructions {
+		op, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		arg, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		if arg < math.MinInt32 || arg > math.MaxInt32 {
+			return nil, fmt.Errorf("instruction argument %d out of range", arg)
+		}
+		co.Instructions[i] = Instruction{Op: OpCode(op), Arg: int(arg)}
+	}
+
+	if n, err = d.count(); err != nil {
+		return nil, err
+	}
+	co.Consts = make([]object.Object, n)
+	for i := range co.Consts {
+		if co.Consts[i], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	if co.Names, err = d.strings(); err != nil {
+		return nil, err
+	}
+	if co.Varnames, err = d.strings(); err != nil {
+		return nil, err
+	}
+
+	if co.LineTable, err = d.lineTable(); err != nil {
+		return nil, err
+	}
+
+	switch flag, err := d.byte(); {
+	case err != nil:
+		return nil, err
+	case flag == 1:
+		if co.Registers, err = d.registers(); err != nil {
+			return nil, err
+		}
+	case flag != 0:
+		return nil, fmt.Errorf("invalid register code flag %d", flag)
+	}
+	return co, nil
+}
+
+func (d *decoder) registers() (*RegisterCode, error) {
+	rc := &RegisterCode{}
+	var err error
+	if rc.NumRegisters, err = d.int(); err != nil {
+		return nil, err
+	}
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	rc.Instructions = make([]RegInstruction, n)
+	for i := range rc.Instructions {
+		op, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		var operands [3]int32
+		for j := range operands {
+			x, err := d.varint()
+			if err != nil {
+				return nil, err
+			}
+			if x < math.MinInt32 || x > math.MaxInt32 {
+				return nil, fmt.Errorf("register instruction operand %d out of range", x)
+			}
+			operands[j] = int32(x)
+		}
+		rc.Instructions[i] = RegInstruction{Op: RegOp(op), A: operands[0], B: operands[1], C: operands[2]}
+	}
+	if rc.LineTable, err = d.lineTable(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (d *decoder) lineTable() ([]LineEntry, error) {
+	n, err := d.count()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	table := make([]LineEntry, n)
+	for i := range table {
+		if table[i].Offset, err = d.int(); err != nil {
+			return nil, err
+		}
+		if table[i].Line, err = d.int(); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+func (d *decoder) value() (object.Object, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxNesting {
+		return nil, errors.New("constants nested too deeply")
+	}
+
+	tag, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case 'N':
+		return runtime.None, nil
+	case 'T':
+		return runtime.True, nil
+	case 'F':
+		return runtime.False, nil
+	case 'i':
+		x, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		return runtime.NewInt(int(x)), nil
+	case 'f':
+		if len(d.buf) < 8 {
+			return nil, errTruncated
+		}
+		bits := binary.LittleEndian.Uint64(d.buf)
+		d.buf = d.buf[8:]
+		return &runtime.PyFloat{Value: math.Float64frombits(bits)}, nil
+	case 's':
+		s, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		return &runtime.PyString{Value: s}, nil
+	case 'c':
+		name, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		code, err := d.code()
+		if err != nil {
+			return nil, err
+		}
+		return &PyFunction{Code: code, Name: name}, nil
+	}
+	return nil, fmt.Errorf("unknown constant tag %q", tag)
+}
@@ -0,0 +1,759 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// regCompiler generates the register code of a code object that the stack
+// compiler produced from the same syntax tree. It resolves names exactly
+// as the stack compiler did, so both forms of the code behave the same.
+type regCompiler struct {
+	co       *CodeObject
+	function bool
+	locals   map[string]int  // register of each local variable
+	assigned map[string]bool // locals the stack compiler had seen so far
+	consts   map[string]int
+	names    map[string]int
+
+	code      []RegInstruction
+	lineTable []LineEntry
+	line      int
+	top, max  int // next free register and the number used
+}
+
+// compileRegisters sets co.Registers to the register code for node, the
+// module or function definition co was compiled from, and does the same
+// for the functions it defines.
+func compileRegisters(co *CodeObject, node ast.Node) error {
+	c := &regCompiler{
+		co:       co,
+		locals:   make(map[string]int),
+		assigned: make(map[string]bool),
+		consts:   make(map[string]int),
+		names:    make(map[string]int),
+	}
+	for i, name := range co.Varnames {
+		c.locals[name] = i
+	}
+	for i, obj := range co.Consts {
+		if _, exists := c.consts[constantKey(obj)]; !exists {
+			c.consts[constantKey(obj)] = i
+		}
+	}
+	for i, name := range co.Names {
+		c.names[name] = i
+	}
+	c.top = len(co.Varnames)
+	c.max = c.top
+
+	var err error
+	switch n := node.(type) {
+	case *ast.Module:
+		err = c.module(n)
+	case *ast.FuncDef:
+		c.function = true
+		for _, arg := range n.Args {
+			c.assigned[arg] = true
+		}
+		if err = c.block(n.Body); err == nil && !returns(n.Body) {
+			c.emit(RegReturn, c.constant(runtime.None), 0, 0)
+		}
+	default:
+		err = fmt.Errorf("cannot compile node type %T", node)
+	}
+	if err != nil {
+		return err
+	}
+	co.Registers = &RegisterCode{
+		Instructions: c.code,
+		NumRegisters: c.max,
+		LineTable:    c.lineTable,
+	}
+	return nil
+}
+
+func (c *regCompiler) module(module *ast.Module) error {
+	for i, stmt := range module.Body {
+		if exprStmt, ok := stmt.(*ast.ExprStmt); ok && i == len(module.Body)-1 {
+			c.setLine(exprStmt)
+			value, err := c.operand(exprStmt.Expr)
+			if err != nil {
+				return err
+			}
+			c.emit(RegReturn, value, 0, 0)
+			return nil
+		}
+		if err := c.stmt(stmt); err != nil {
+			return err
+		}
+	}
+	c.emit(RegReturn, c.constant(runtime.None), 0, 0)
+	return nil
+}
+
+func (c *regCompiler) emit(op RegOp, a, b, cc int32) int {
+	pos := len(c.code)
+	if c.line > 0 && (len(c.lineTable) == 0 || c.lineTable[len(c.lineTable)-1].Line != c.line) {
+		c.lineTable = append(c.lineTable, LineEntry{Offset: pos, Line: c.line})
+	}
+	c.code = append(c.code, RegInstruction{Op: op, A: a, B: b, C: cc})
+	return pos
+}
+
+func (c *regCompiler) setLine(node ast.Node) {
+	if line := node.Pos().Line; line > 0 {
+		c.line = line
+	}
+}
+
+// patch makes the jumps at positions go to the next instruction.
+func (c *regCompiler) patch(positions []int) {
+	for _, pos := range positions {
+		if c.code[pos].Op == RegForIter {
+			c.code[pos].C = int32(len(c.code))
+		} else {
+			c.code[pos].A = int32(len(c.code))
+		}
+	}
+}
+
+func (c *regCompiler) alloc() int32 {
+	r := c.top
+	c.top++
+	if c.top > c.max {
+		c.max = c.top
+	}
+	return int32(r)
+}
+
+func (c *regCompiler) constant(obj object.Object) int32 {
+	key := constantKey(obj)
+	idx, exists := c.consts[key]
+	if !exists {
+		idx = len(c.co.Consts)
+		c.co.Consts = append(c.co.Consts, obj)
+		c.consts[key] = idx
+	}
+	return ConstOperand(idx)
+}
+
+func (c *regCompiler) name(name string) int32 {
+	idx, exists := c.names[name]
+	if !exists {
+		idx = len(c.co.Names)
+		c.co.Names = append(c.co.Names, name)
+		c.names[name] = idx
+	}
+	return int32(idx)
+}
+
+// local returns the register of name if it is a local variable at this
+// point of the function.
+func (c *regCompiler) local(name string) (int32, bool) {
+	if !c.function || !c.assigned[name] {
+		return 0, false
+	}
+	return int32(c.locals[name]), true
+}
+
+// assign marks name as a local variable from now on and returns its
+// register.
+func (c *regCompiler) assign(name string) int32 {
+	c.assigned[name] = true
+	return int32(c.locals[name])
+}
+
+// block compiles stmts. Statements after a return cannot run and only
+// declare the locals they assign.
+func (c *regCompiler) block(stmts []ast.Stmt) error {
+	for i, stmt := range stmts {
+		if err := c.stmt(stmt); err != nil {
+			return err
+		}
+		if _, ok := stmt.(*ast.ReturnStmt); ok {
+			for _, dead := range stmts[i+1:] {
+				c.declare(dead)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// returns reports whether one of stmts is a return, so that control never
+// reaches their end.
+func returns(stmts []ast.Stmt) bool {
+	for _, stmt := range stmts {
+		if _, ok := stmt.(*ast.ReturnStmt); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// declare records the locals that compiling stmt would assign.
+func (c *regCompiler) declare(stmt ast.Stmt) {
+	if !c.function {
+		return
+	}
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		if target, ok := s.Target.(*ast.Name); ok {
+			c.assign(target.Id)
+		}
+	case *ast.AugAssignStmt:
+		if target, ok := s.Target.(*ast.Name); ok {
+			c.assign(target.Id)
+		}
+	case *ast.ForStmt:
+		if target, ok := s.Target.(*ast.Name); ok {
+			c.assign(target.Id)
+		}
+		for _, body := range s.Body {
+			c.declare(body)
+		}
+	case *ast.WhileStmt:
+		for _, body := range s.Body {
+			c.declare(body)
+		}
+	case *ast.IfStmt:
+		for _, body := range s.Body {
+			c.declare(body)
+		}
+		for _, body := range s.Orelse {
+			c.declare(body)
+		}
+	case *ast.ImportStmt:
+		for _, name := range s.Names {
+			c.assign(name)
+		}
+	}
+}
+
+func (c *regCompiler) stmt(stmt ast.Stmt) error {
+	c.setLine(stmt)
+	mark := c.top
+	defer func() { c.top = mark }()
+
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		return c.assignStmt(s)
+	case *ast.AugAssignStmt:
+		return c.augAssignStmt(s)
+	case *ast.ExprStmt:
+		return c.exprStmt(s)
+	case *ast.PrintStmt:
+		return c.printStmt(s)
+	case *ast.IfStmt:
+		return c.ifStmt(s)
+	case *ast.WhileStmt:
+		return c.whileStmt(s)
+	case *ast.ForStmt:
+		return c.forStmt(s)
+	case *ast.FuncDef:
+		return c.funcDefStmt(s)
+	case *ast.ReturnStmt:
+		value := c.constant(runtime.None)
+		if s.Value != nil {
+			var err error
+			if value, err = c.operand(s.Value); err != nil {
+				return err
+			}
+		}
+		c.emit(RegReturn, value, 0, 0)
+		return nil
+	case *ast.PassStmt:
+		return nil
+	case *ast.ImportStmt:
+		for _, name := range s.Names {
+			if c.function {
+				c.emit(RegImport, c.assign(name), c.name(name), 0)
+				continue
+			}
+			r := c.alloc()
+			c.emit(RegImport, r, c.name(name), 0)
+			c.emit(RegStoreGlobal, c.name(name), r, 0)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported statement type: %T", stmt)
+	}
+}
+
+func (c *regCompiler) assignStmt(stmt *ast.AssignStmt) error {
+	switch target := stmt.Target.(type) {
+	case *ast.Name:
+		if !c.function {
+			value, err := c.operand(stmt.Value)
+			if err != nil {
+				return err
+			}
+			c.emit(RegStoreGlobal, c.name(target.Id), value, 0)
+			return nil
+		}
+		// Expressions that write their register before reading all of
+		// their operands must not write the variable they may read.
+		if writesEarly(stmt.Value) {
+			r := c.alloc()
+			if err := c.expr(stmt.Value, r); err != nil {
+				return err
+			}
+			c.emit(RegMove, c.assign(target.Id), r, 0)
+			return nil
+		}
+		dst := int32(c.locals[target.Id])
+		if err := c.expr(stmt.Value, dst); err != nil {
+			return err
+		}
+		c.assign(target.Id)
+		return nil
+	case *ast.Subscript:
+		value, err := c.operand(stmt.Value)
+		if err != nil {
+			return err
+		}
+		container, err := c.operand(target.Value)
+		if err != nil {
+			return err
+		}
+		index, err := c.operand(target.Slice)
+		if err != nil {
+			return err
+		}
+		c.emit(RegSetItem, container, index, value)
+		return nil
+	default:
+		return fmt.Errorf("unsupported assignment target: %T", target)
+	}
+}
+
+// writesEarly reports whether compiling e into a register writes it before
+// all of e has been evaluated.
+func writesEarly(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.BoolOp:
+		return true
+	case *ast.Compare:
+		return len(e.Ops) > 1
+	}
+	return false
+}
+
+func (c *regCompiler) augAssignStmt(stmt *ast.AugAssignStmt) error {
+	target, ok := stmt.Target.(*ast.Name)
+	if !ok {
+		return fmt.Errorf("unsupported augmented assignment target: %T", stmt.Target)
+	}
+	var op RegOp
+	switch stmt.Op {
+	case "+=":
+		op = RegAdd
+	case "-=":
+		op = RegSub
+	default:
+		return fmt.Errorf("unsupported augmented assignment operator: %s", stmt.Op)
+	}
+
+	if c.function {
+		r := c.assign(target.Id)
+		value, err := c.operand(stmt.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(op, r, r, value)
+		return nil
+	}
+	r := c.alloc()
+	c.emit(RegLoadName, r, c.name(target.Id), 0)
+	value, err := c.operand(stmt.Value)
+	if err != nil {
+		return err
+	}
+	c.emit(op, r, r, value)
+	c.emit(RegStoreGlobal, c.name(target.Id), r, 0)
+	return nil
+}
+
+func (c *regCompiler) exprStmt(stmt *ast.ExprStmt) error {
+	if _, ok := c.simpleOperand(stmt.Expr); ok {
+		return nil
+	}
+	return c.expr(stmt.Expr, c.alloc())
+}
+
+func (c *regCompiler) printStmt(stmt *ast.PrintStmt) error {
+	if stmt.Dest == nil {
+		for i, value := range stmt.Values {
+			mark := c.top
+			operand, err := c.operand(value)
+			if err != nil {
+				return err
+			}
+			c.emit(RegPrint, operand, boolOperand(i < len(stmt.Values)-1), 0)
+			c.top = mark
+		}
+		c.emit(RegPrintNewline, 0, 0, 0)
+		return nil
+	}
+
+	dest, err := c.operand(stmt.Dest)
+	if err != nil {
+		return err
+	}
+	for i, value := range stmt.Values {
+		mark := c.top
+		operand, err := c.operand(value)
+		if err != nil {
+			return err
+		}
+		c.emit(RegPrintTo, dest, operand, boolOperand(i < len(stmt.Values)-1))
+		c.top = mark
+	}
+	c.emit(RegPrintNewlineTo, dest, 0, 0)
+	return nil
+}
+
+func boolOperand(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *regCompiler) ifStmt(stmt *ast.IfStmt) error {
+	jumps, err := c.jumpIf(stmt.Test, false)
+	if err != nil {
+		return err
+	}
+	if err := c.block(stmt.Body); err != nil {
+		return err
+	}
+	if len(stmt.Orelse) == 0 {
+		c.patch(jumps)
+		return nil
+	}
+	end := c.emit(RegJump, 0, 0, 0)
+	c.patch(jumps)
+	if err := c.block(stmt.Orelse); err != nil {
+		return err
+	}
+	c.patch([]int{end})
+	return nil
+}
+
+func (c *regCompiler) whileStmt(stmt *ast.WhileStmt) error {
+	start := int32(len(c.code))
+	jumps, err := c.jumpIf(stmt.Test, false)
+	if err != nil {
+		return err
+	}
+	if err := c.block(stmt.Body); err != nil {
+		return err
+	}
+	c.setLine(stmt)
+	c.emit(RegJump, start, 0, 0)
+	c.patch(jumps)
+	return nil
+}
+
+func (c *regCompiler) forStmt(stmt *ast.ForStmt) error {
+	target, ok := stmt.Target.(*ast.Name)
+	if !ok {
+		return fmt.Errorf("unsupported for target: %T", stmt.Target)
+	}
+	iterator := c.alloc()
+	iterable, err := c.operand(stmt.Iter)
+	if err != nil {
+		return err
+	}
+	c.emit(RegGetIter, iterator, iterable, 0)
+	c.top = int(iterator) + 1
+
+	start := int32(len(c.code))
+	var loop int
+	if c.function {
+		loop = c.emit(RegForIter, c.assign(target.Id), iterator, 0)
+	} else {
+		r := c.alloc()
+		loop = c.emit(RegForIter, r, iterator, 0)
+		c.emit(RegStoreGlobal, c.name(target.Id), r, 0)
+		c.top--
+	}
+	if err := c.block(stmt.Body); err != nil {
+		return err
+	}
+	c.setLine(stmt)
+	c.emit(RegJump, start, 0, 0)
+	c.patch([]int{loop})
+	return nil
+}
+
+func (c *regCompiler) funcDefStmt(stmt *ast.FuncDef) error {
+	// The stack compiler already made the template; constants are shared
+	// by key, so this finds the one its code loads.
+	k, ok := c.consts[constantKey(&PyFunction{Name: stmt.Name})]
+	if !ok {
+		return fmt.Errorf("no code for function %s", stmt.Name)
+	}
+	template := c.co.Consts[k].(*PyFunction)
+	if template.Code.Registers == nil {
+		if err := compileRegisters(template.Code, stmt); err != nil {
+			return err
+		}
+	}
+	r := c.alloc()
+	c.emit(RegMakeFunction, r, int32(k), 0)
+	c.emit(RegStoreGlobal, c.name(stmt.Name), r, 0)
+	return nil
+}
+
+// jumpIf compiles a test of e and returns the positions of the jumps it
+// takes when the truth of e is sense, for the caller to patch.
+func (c *regCompiler) jumpIf(e ast.Expr, sense bool) ([]int, error) {
+	mark := c.top
+	defer func() { c.top = mark }()
+
+	switch e := e.(type) {
+	case *ast.UnaryOp:
+		if e.Op == "not" {
+			return c.jumpIf(e.Expr, !sense)
+		}
+	case *ast.BoolOp:
+		if len(e.Values) < 2 {
+			return nil, fmt.Errorf("boolean operation needs at least 2 values")
+		}
+		// Each value but the last either decides the test or falls
+		// through to the next one.
+		decides := e.Op == "and" && !sense || e.Op == "or" && sense
+		var jumps, skips []int
+		for i, value := range e.Values {
+			valueSense := sense
+			if i < len(e.Values)-1 && !decides {
+				valueSense = !sense
+			}
+			positions, err := c.jumpIf(value, valueSense)
+			if err != nil {
+				return nil, err
+			}
+			if valueSense == sense {
+				jumps = append(jumps, positions...)
+			} else {
+				skips = append(skips, positions...)
+			}
+		}
+		c.patch(skips)
+		return jumps, nil
+	case *ast.Compare:
+		if op, ok := fusedJumps[e.Ops[0]]; ok && len(e.Ops) == 1 && !sense {
+			left, err := c.operand(e.Left)
+			if err != nil {
+				return nil, err
+			}
+			right, err := c.operand(e.Right[0])
+			if err != nil {
+				return nil, err
+			}
+			return []int{c.emit(op, 0, left, right)}, nil
+		}
+	}
+
+	value, err := c.operand(e)
+	if err != nil {
+		return nil, err
+	}
+	op := RegJumpIfFalse
+	if sense {
+		op = RegJumpIfTrue
+	}
+	return []int{c.emit(op, 0, value, 0)}, nil
+}
+
+var fusedJumps = map[string]RegOp{
+	"==": RegJumpIfNotEq,
+	"!=": RegJumpIfNotNe,
+	"<":  RegJumpIfNotLt,
+	"<=": RegJumpIfNotLe,
+	">":  RegJumpIfNotGt,
+	">=": RegJumpIfNotGe,
+}
+
+// listBase returns the first register of a list of n values, which the
+// caller allocates next. An empty list uses register 0.
+func (c *regCompiler) listBase(n int) int32 {
+	if n == 0 {
+		return 0
+	}
+	return int32(c.top)
+}
+
+// simpleOperand returns the operand of constants and local variables,
+// which need no instructions.
+func (c *regCompiler) simpleOperand(e ast.Expr) (int32, bool) {
+	switch e := e.(type) {
+	case *ast.Num:
+		return c.constant(runtime.ToPyObject(e.N)), true
+	case *ast.Str:
+		return c.constant(&runtime.PyString{Value: e.S}), true
+	case *ast.NameConstant:
+		return c.constant(runtime.ToPyObject(e.Value)), true
+	case *ast.Name:
+		return c.local(e.Id)
+	}
+	return 0, false
+}
+
+// operand compiles e and returns an RK operand holding its value. It uses
+// a new temporary register unless e is a constant or local variable.
+func (c *regCompiler) operand(e ast.Expr) (int32, error) {
+	if operand, ok := c.simpleOperand(e); ok {
+		return operand, nil
+	}
+	r := c.alloc()
+	return r, c.expr(e, r)
+}
+
+var regBinaryOps = map[string]RegOp{"+": RegAdd, "-": RegSub, "*": RegMul, "/": RegDiv, "%": RegMod}
+
+var regUnaryOps = map[string]RegOp{"+": RegPos, "-": RegNeg, "not": RegNot}
+
+var regCompareOps = map[string]RegOp{
+	"==": RegEq, "!=": RegNe, "<": RegLt, "<=": RegLe, ">": RegGt, ">=": RegGe,
+	"in": RegIn, "is": RegIs, "is not": RegIsNot,
+}
+
+// expr compiles e so that its value ends up in register dst. Temporaries
+// it allocates are free again afterwards.
+func (c *regCompiler) expr(e ast.Expr, dst int32) error {
+	mark := c.top
+	defer func() { c.top = mark }()
+
+	if operand, ok := c.simpleOperand(e); ok {
+		if operand != dst {
+			c.emit(RegMove, dst, operand, 0)
+		}
+		return nil
+	}
+
+	switch e := e.(type) {
+	case *ast.Name:
+		if c.function {
+			c.emit(RegLoadGlobal, dst, c.name(e.Id), 0)
+		} else {
+			c.emit(RegLoadName, dst, c.name(e.Id), 0)
+		}
+	case *ast.BinaryOp:
+		op, ok := regBinaryOps[e.Op]
+		if !ok {
+			return fmt.Errorf("unsupported binary operator: %s", e.Op)
+		}
+		left, err := c.operand(e.Left)
+		if err != nil {
+			return err
+		}
+		right, err := c.operand(e.Right)
+		if err != nil {
+			return err
+		}
+		c.emit(op, dst, left, right)
+	case *ast.UnaryOp:
+		op, ok := regUnaryOps[e.Op]
+		if !ok {
+			return fmt.Errorf("unsupported unary operator: %s", e.Op)
+		}
+		operand, err := c.operand(e.Expr)
+		if err != nil {
+			return err
+		}
+		c.emit(op, dst, operand, 0)
+	case *ast.BoolOp:
+		if len(e.Values) < 2 {
+			return fmt.Errorf("boolean operation needs at least 2 values")
+		}
+		jump := RegJumpIfTrue
+		if e.Op == "and" {
+			jump = RegJumpIfFalse
+		}
+		var jumps []int
+		for i, value := range e.Values {
+			if i > 0 {
+				jumps = append(jumps, c.emit(jump, 0, dst, 0))
+			}
+			if err := c.expr(value, dst); err != nil {
+				return err
+			}
+		}
+		c.patch(jumps)
+	case *ast.Compare:
+		// Like the stack code, a < b < c compares the result of a < b
+		// with c.
+		left, err := c.operand(e.Left)
+		if err != nil {
+			return err
+		}
+		for i, name := range e.Ops {
+			op, ok := regCompareOps[name]
+			if !ok {
+				return fmt.Errorf("unsupported comparison operator: %s", name)
+			}
+			right, err := c.operand(e.Right[i])
+			if err != nil {
+				return err
+			}
+			c.emit(op, dst, left, right)
+			left = dst
+		}
+	case *ast.Call:
+		base := c.alloc()
+		if err := c.expr(e.Func, base); err != nil {
+			return err
+		}
+		for _, arg := range e.Args {
+			if err := c.expr(arg, c.alloc()); err != nil {
+				return err
+			}
+		}
+		c.emit(RegCall, dst, base, int32(len(e.Args)))
+	case *ast.Subscript:
+		container, err := c.operand(e.Value)
+		if err != nil {
+			return err
+		}
+		index, err := c.operand(e.Slice)
+		if err != nil {
+			return err
+		}
+		c.emit(RegGetItem, dst, container, index)
+	case *ast.Attribute:
+		obj, err := c.operand(e.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(RegLoadAttr, dst, obj, c.name(e.Attr))
+	case *ast.List:
+		base := c.listBase(len(e.Elts))
+		for _, elt := range e.Elts {
+			if err := c.expr(elt, c.alloc()); err != nil {
+				return err
+			}
+		}
+		c.emit(RegBuildList, dst, base, int32(len(e.Elts)))
+	case *ast.Dict:
+		base := c.listBase(len(e.Keys))
+		for i := range e.Keys {
+			if err := c.expr(e.Keys[i], c.alloc()); err != nil {
+				return err
+			}
+			if err := c.expr(e.Values[i], c.alloc()); err != nil {
+				return err
+			}
+		}
+		c.emit(RegBuildDict, dst, base, int32(len(e.Keys)))
+	default:
+		return fmt.Errorf("unsupported expression type: %T", e)
+	}
+	return nil
+}
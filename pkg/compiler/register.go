@@ -0,0 +1,320 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The register machine is an alternative instruction set for the same code
+// objects. A frame holds NumRegisters registers instead of an operand
+// stack; registers 0 to len(Varnames)-1 are the local variables and the
+// rest hold temporaries. Most operands are RK operands, which name either
+// a register (>= 0) or a constant (< 0, see ConstOperand), so statements
+// such as x = x + 1 in a function compile to a single instruction.
+
+type RegOp byte
+
+const (
+	RegMove        RegOp = iota // A = RK(B)
+	RegLoadName                 // A = name B, looked up in globals then builtins
+	RegLoadGlobal               // as RegLoadName, in function code
+	RegStoreGlobal              // name A = RK(B)
+
+	RegAdd // A = RK(B) + RK(C)
+	RegSub
+	RegMul
+	RegDiv
+	RegMod
+
+	RegPos // A = +RK(B)
+	RegNeg
+	RegNot
+
+	RegEq // A = RK(B) == RK(C)
+	RegNe
+	RegLt
+	RegLe
+	RegGt
+	RegGe
+	RegIn
+	RegIs
+	RegIsNot
+
+	RegJump        // goto A
+	RegJumpIfFalse // if not RK(B): goto A
+	RegJumpIfTrue  // if RK(B): goto A
+	RegJumpIfNotEq // if not RK(B) == RK(C): goto A
+	RegJumpIfNotNe
+	RegJumpIfNotLt
+	RegJumpIfNotLe
+	RegJumpIfNotGt
+	RegJumpIfNotGe
+
+	RegBuildList    // A = [B, ..., B+C-1]
+	RegBuildDict    // A = {B: B+1, ...} with C pairs
+	RegGetItem      // A = RK(B)[RK(C)]
+	RegSetItem      // RK(A)[RK(B)] = RK(C)
+	RegCall         // A = B(B+1, ..., B+C)
+	RegReturn       // return RK(A)
+	RegPrint        // print RK(A), then a space if B is 1
+	RegPrintNewline // print a newline
+	RegPrintTo      // print RK(B) to RK(A), then a space if C is 1
+	RegPrintNewlineTo
+	RegMakeFunction // A = function from the template in constant B
+	RegLoadAttr     // A = RK(B).name C
+	RegImport       // A = module name B
+	RegGetIter      // A = iter(RK(B))
+	RegForIter      // A = next(B), or goto C when B is exhausted
+)
+
+// regOps holds the name and operand kinds of each register opcode.
+var regOps = [...]struct {
+	name     string
+	operands string
+}{
+	RegMove:           {"MOVE", "rk-"},
+	RegLoadName:       {"LOAD_NAME", "rn-"},
+	RegLoadGlobal:     {"LOAD_GLOBAL", "rn-"},
+	RegStoreGlobal:    {"STORE_GLOBAL", "nk-"},
+	RegAdd:            {"ADD", "rkk"},
+	RegSub:            {"SUB", "rkk"},
+	RegMul:            {"MUL", "rkk"},
+	RegDiv:            {"DIV", "rkk"},
+	RegMod:            {"MOD", "rkk"},
+	RegPos:            {"POS", "rk-"},
+	RegNeg:            {"NEG", "rk-"},
+	RegNot:            {"NOT", "rk-"},
+	RegEq:             {"EQ", "rkk"},
+	RegNe:             {"NE", "rkk"},
+	RegLt:             {"LT", "rkk"},
+	RegLe:             {"LE", "rkk"},
+	RegGt:             {"GT", "rkk"},
+	RegGe:             {"GE", "rkk"},
+	RegIn:             {"IN", "rkk"},
+	RegIs:             {"IS", "rkk"},
+	RegIsNot:          {"IS_NOT", "rkk"},
+	RegJump:           {"JUMP", "j--"},
+	RegJumpIfFalse:    {"JUMP_IF_FALSE", "jk-"},
+	RegJumpIfTrue:     {"JUMP_IF_TRUE", "jk-"},
+	RegJumpIfNotEq:    {"JUMP_IF_NOT_EQ", "jkk"},
+	RegJumpIfNotNe:    {"JUMP_IF_NOT_NE", "jkk"},
+	RegJumpIfNotLt:    {"JUMP_IF_NOT_LT", "jkk"},
+	RegJumpIfNotLe:    {"JUMP_IF_NOT_LE", "jkk"},
+	RegJumpIfNotGt:    {"JUMP_IF_NOT_GT", "jkk"},
+	RegJumpIfNotGe:    {"JUMP_IF_NOT_GE", "jkk"},
+	RegBuildList:      {"BUILD_LIST", "rri"},
+	RegBuildDict:      {"BUILD_DICT", "rri"},
+	RegGetItem:        {"GET_ITEM", "rkk"},
+	RegSetItem:        {"SET_ITEM", "kkk"},
+	RegCall:           {"CALL", "rri"},
+	RegReturn:         {"RETURN", "k--"},
+	RegPrint:          {"PRINT", "ki-"},
+	RegPrintNewline:   {"PRINT_NEWLINE", "---"},
+	RegPrintTo:        {"PRINT_TO", "kki"},
+	RegPrintNewlineTo: {"PRINT_NEWLINE_TO", "k--"},
+	RegMakeFunction:   {"MAKE_FUNCTION", "rc-"},
+	RegLoadAttr:       {"LOAD_ATTR", "rkn"},
+	RegImport:         {"IMPORT", "rn-"},
+	RegGetIter:        {"GET_ITER", "rk-"},
+	RegForIter:        {"FOR_ITER", "rrj"},
+}
+
+func (op RegOp) String() string {
+	if int(op) < len(regOps) {
+		return regOps[op].name
+	}
+	return fmt.Sprintf("UNKNOWN_REG_OP_%d", op)
+}
+
+// Operands returns the kinds of the operands A, B and C of op: r register,
+// k RK operand, c constant index, n name index, j jump target, i integer
+// and - unused.
+func (op RegOp) Operands() string {
+	if int(op) < len(regOps) {
+		return regOps[op].operands
+	}
+	return ""
+}
+
+// JumpOperand returns which operand of op is a jump target, or -1.
+func (op RegOp) JumpOperand() int {
+	return strings.IndexByte(op.Operands(), 'j')
+}
+
+var regOpsByName = func() map[string]RegOp {
+	m := make(map[string]RegOp)
+	for op := range regOps {
+		m[regOps[op].name] = RegOp(op)
+	}
+	return m
+}()
+
+// Operator returns the stack opcode that performs the same operation as
+// an arithmetic, unary or comparison opcode, or as the comparison of a
+// conditional jump, and OpNop for other opcodes.
+func (op RegOp) Operator() OpCode {
+	switch {
+	case op >= RegAdd && op <= RegMod:
+		return OpBinaryAdd + OpCode(op-RegAdd)
+	case op >= RegPos && op <= RegNot:
+		return OpUnaryPos + OpCode(op-RegPos)
+	case op >= RegEq && op <= RegIn:
+		return OpCompareEq + OpCode(op-RegEq)
+	case op == RegIs:
+		return OpCompareIs
+	case op == RegIsNot:
+		return OpCompareIsNot
+	case op >= RegJumpIfNotEq && op <= RegJumpIfNotGe:
+		return OpCompareEq + OpCode(op-RegJumpIfNotEq)
+	}
+	return OpNop
+}
+
+// RegInstruction is a register machine instruction. The meaning of the
+// operands depends on Op.
+type RegInstruction struct {
+	Op      RegOp
+	A, B, C int32
+}
+
+// Operand returns operand i: A, B or C.
+func (instr *RegInstruction) Operand(i int) int32 {
+	return *instr.operandPtr(i)
+}
+
+func (instr *RegInstruction) operandPtr(i int) *int32 {
+	return [3]*int32{&instr.A, &instr.B, &instr.C}[i]
+}
+
+// ConstOperand returns the RK operand that refers to constant k.
+func ConstOperand(k int) int32 {
+	return int32(-1 - k)
+}
+
+// IsConstOperand reports whether the RK operand x refers to a constant,
+// and if so which.
+func IsConstOperand(x int32) (int, bool) {
+	return int(-1 - x), x < 0
+}
+
+// RegisterCode is the register machine form of a code object. It shares
+// the constants, names and local variables of the code object.
+type RegisterCode struct {
+	Instructions []RegInstruction
+	NumRegisters int
+	LineTable    []LineEntry
+}
+
+// LineForOffset returns the source line of the instruction at offset, or 0
+// if there is no line information.
+func (rc *RegisterCode) LineForOffset(offset int) int {
+	i := sort.Search(len(rc.LineTable), func(i int) bool {
+		return rc.LineTable[i].Offset > offset
+	})
+	if i == 0 {
+		return 0
+	}
+	return rc.LineTable[i-1].Line
+}
+
+// Backend selects the code a Compiler generates.
+type Backend int
+
+const (
+	// BackendStack generates stack machine code.
+	BackendStack Backend = iota
+	// BackendRegister also generates register machine code for every code
+	// object, which the VM runs in place of the stack code.
+	BackendRegister
+)
+
+func (b Backend) String() string {
+	if b == BackendRegister {
+		return "register"
+	}
+	return "stack"
+}
+
+// ParseBackend returns the backend called name.
+func ParseBackend(name string) (Backend, error) {
+	switch name {
+	case "stack":
+		return BackendStack, nil
+	case "register":
+		return BackendRegister, nil
+	}
+	return 0, fmt.Errorf("unknown backend %q (want stack or register)", name)
+}
+
+// registers lists the register code of co as a .registers section.
+func (d *disassembler) registers(co *CodeObject, indent string) {
+	b := &d.b
+	rc := co.Registers
+	fmt.Fprintf(b, "%s.registers %d\n", indent, rc.NumRegisters)
+	targets := make(map[int]bool)
+	for _, instr := range rc.Instructions {
+		if i := instr.Op.JumpOperand(); i >= 0 {
+			targets[int(instr.Operand(i))] = true
+		}
+	}
+	lines := rc.LineTable
+	for i, instr := range rc.Instructions {
+		for len(lines) > 0 && lines[0].Offset <= i {
+			if i > 0 {
+				b.WriteByte('\n')
+			}
+			d.line(indent, lines[0].Line)
+			lines = lines[1:]
+		}
+		if targets[i] {
+			fmt.Fprintf(b, "%sL%d:\n", indent, i)
+		}
+		operands, comment := regOperandText(co, instr)
+		text := fmt.Sprintf("%d: %s%s", i, instr.Op, operands)
+		if comment != "" {
+			text = fmt.Sprintf("%-*s ; %s", commentColumn, text, comment)
+		}
+		fmt.Fprintf(b, "%s    %s\n", indent, text)
+	}
+}
+
+// regOperandText formats the operands of instr and a comment resolving
+// its constants, names and local variables.
+func regOperandText(co *CodeObject, instr RegInstruction) (string, string) {
+	var text, comments []string
+	for i, kind := range instr.Op.Operands() {
+		x := instr.Operand(i)
+		switch kind {
+		case 'r':
+			text = append(text, fmt.Sprintf("r%d", x))
+			if int(x) < len(co.Varnames) && x >= 0 {
+				comments = append(comments, co.Varnames[x])
+			}
+		case 'k':
+			if k, ok := IsConstOperand(x); ok {
+				text = append(text, fmt.Sprintf("k%d", k))
+				comments = append(comments, operandComment(co, Instruction{Op: OpLoadConst, Arg: k}))
+			} else {
+				text = append(text, fmt.Sprintf("r%d", x))
+				if int(x) < len(co.Varnames) {
+					comments = append(comments, co.Varnames[x])
+				}
+			}
+		case 'c':
+			text = append(text, fmt.Sprintf("k%d", x))
+			comments = append(comments, operandComment(co, Instruction{Op: OpLoadConst, Arg: int(x)}))
+		case 'n':
+			text = append(text, fmt.Sprintf("n%d", x))
+			comments = append(comments, operandComment(co, Instruction{Op: OpLoadName, Arg: int(x)}))
+		case 'j':
+			text = append(text, fmt.Sprintf("L%d", x))
+		case 'i':
+			text = append(text, fmt.Sprint(x))
+		}
+	}
+	if len(text) == 0 {
+		return "", ""
+	}
+	return " " + strings.Join(text, " "), strings.Join(comments, ", ")
+}
@@ -0,0 +1,372 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// VerifyError describes bytecode that the VM must not execute.
+type VerifyError struct {
+	Code   string // name of the code object
+	Offset int    // instruction offset, or -1 for the code object itself
+	Op     OpCode
+	Msg    string
+}
+
+func (e *VerifyError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("invalid bytecode in %s: %s", e.Code, e.Msg)
+	}
+	return fmt.Sprintf("invalid bytecode in %s at offset %d (%s): %s", e.Code, e.Offset, e.Op, e.Msg)
+}
+
+// Verify checks that co and the code of every function it defines can be
+// executed safely: operands index existing constants, names and locals,
+// jumps land on instructions, the stack never underflows and has the same
+// depth whichever path reaches an instruction. It records the maximum stack
+// depth of each code object in StackSize. Verify is run on every code
+// object the compiler produces and every bytecode file that is read. Register
+// code is checked as well when the code object has it.
+func Verify(co *CodeObject) error {
+	return verify(co, 0)
+}
+
+// maxCodeNesting bounds how deeply function definitions may nest.
+const maxCodeNesting = 100
+
+func verify(co *CodeObject, depth int) error {
+	if depth > maxCodeNesting {
+		return &VerifyError{Code: co.Name, Offset: -1, Msg: "functions nested too deeply"}
+	}
+	if err := verifyHeader(co); err != nil {
+		return err
+	}
+	size, err := stackDepths(co)
+	if err != nil {
+		return err
+	}
+	co.StackSize = size
+	if err := verifyRegisters(co); err != nil {
+		return err
+	}
+
+	// Constants are shared by every VM that runs co, so only the immutable
+	// kinds the compiler emits are allowed.
+	for _, c := range co.Consts {
+		switch v := c.(type) {
+		case *runtime.PyNone, *runtime.PyBool, *runtime.PyInt, *runtime.PyFloat, *runtime.PyString:
+		case *PyFunction:
+			if v.Code == nil {
+				return &VerifyError{Code: co.Name, Offset: -1, Msg: fmt.Sprintf("function %s has no code", v.Name)}
+			}
+			// MAKE_FUNCTION binds a template to the globals of the frame.
+			if v.Globals != nil {
+				return &VerifyError{Code: co.Name, Offset: -1, Msg: fmt.Sprintf("function %s is bound to globals", v.Name)}
+			}
+			if err := verify(v.Code, depth+1); err != nil {
+				return err
+			}
+		case nil:
+			return &VerifyError{Code: co.Name, Offset: -1, Msg: "nil constant"}
+		default:
+			return &VerifyError{Code: co.Name, Offset: -1, Msg: fmt.Sprintf("%s cannot be a constant", c.Type())}
+		}
+	}
+	return nil
+}
+
+func verifyHeader(co *CodeObject) error {
+	fail := func(format string, args ...interface{}) error {
+		return &VerifyError{Code: co.Name, Offset: -1, Msg: fmt.Sprintf(format, args...)}
+	}
+	if co.Argcount < 0 || co.Argcount > len(co.Varnames) {
+		return fail("argument count %d does not fit %d local variables", co.Argcount, len(co.Varnames))
+	}
+	prev := 0
+	for _, entry := range co.LineTable {
+		if entry.Offset < prev || entry.Offset > len(co.Instructions) || entry.Line < 0 {
+			return fail("line table entry {%d %d} out of order or range", entry.Offset, entry.Line)
+		}
+		prev = entry.Offset
+	}
+	return nil
+}
+
+// maxRegisters bounds the registers of a register code frame.
+const maxRegisters = 1 << 16
+
+// verifyRegisters checks the register code of co, if any: every operand
+// is in range, register spans fit the frame and control cannot run off
+// the end.
+func verifyRegisters(co *CodeObject) error {
+	rc := co.Registers
+	if rc == nil {
+		return nil
+	}
+	fail := func(format string, args ...interface{}) error {
+		return &VerifyError{Code: co.Name, Offset: -1, Msg: fmt.Sprintf(format, args...)}
+	}
+	if rc.NumRegisters < len(co.Varnames) || rc.NumRegisters > maxRegisters {
+		return fail("%d registers do not fit %d local variables", rc.NumRegisters, len(co.Varnames))
+	}
+	n := len(rc.Instructions)
+	if n == 0 {
+		return fail("no register instructions")
+	}
+	if last := rc.Instructions[n-1].Op; last != RegReturn && last != RegJump {
+		return fail("register code ends with %s", last)
+	}
+	prev := 0
+	for _, entry := range rc.LineTable {
+		if entry.Offset < prev || entry.Offset > n || entry.Line < 0 {
+			return fail("register line table entry {%d %d} out of order or range", entry.Offset, entry.Line)
+		}
+		prev = entry.Offset
+	}
+	for i, instr := range rc.Instructions {
+		if err := checkRegInstruction(co, instr); err != nil {
+			return fail("register instruction %d (%s): %v", i, instr.Op, err)
+		}
+	}
+	return nil
+}
+
+func checkRegInstruction(co *CodeObject, instr RegInstruction) error {
+	rc := co.Registers
+	if int(instr.Op) >= len(regOps) {
+		return fmt.Errorf("unknown opcode")
+	}
+	for i, kind := range instr.Op.Operands() {
+		x := int(instr.Operand(i))
+		var err error
+		switch kind {
+		case 'r':
+			err = checkIndex(x, rc.NumRegisters, "register")
+		case 'k':
+			if k, ok := IsConstOperand(int32(x)); ok {
+				err = checkIndex(k, len(co.Consts), "constant")
+			} else {
+				err = checkIndex(x, rc.NumRegisters, "register")
+			}
+		case 'c':
+			err = checkIndex(x, len(co.Consts), "constant")
+		case 'n':
+			err = checkIndex(x, len(co.Names), "name")
+		case 'j':
+			err = checkIndex(x, len(rc.Instructions), "instruction")
+		case 'i':
+			if x < 0 {
+				err = fmt.Errorf("negative operand %d", x)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	span := 0
+	switch instr.Op {
+	case RegBuildList:
+		span = int(instr.C)
+	case RegBuildDict:
+		span = 2 * int(instr.C)
+	case RegCall:
+		span = int(instr.C) + 1
+	case RegMakeFunction:
+		if _, ok := co.Consts[instr.B].(*PyFunction); !ok {
+			return fmt.Errorf("constant %d is not a function", instr.B)
+		}
+	}
+	if span > 0 && int(instr.B)+span > rc.NumRegisters {
+		return fmt.Errorf("registers %d to %d out of range (%d registers)", instr.B, int(instr.B)+span-1, rc.NumRegisters)
+	}
+	return nil
+}
+
+// stackEffect describes how an instruction changes the stack: it needs
+// pops values, leaves the depth changed by delta when it falls through and
+// by jumpDelta when it jumps.
+type stackEffect struct {
+	pops      int
+	delta     int
+	jumpDelta int
+	jumps     bool // may transfer control to Arg
+	relative  bool // the jump target is relative to the next instruction
+	next      bool // may fall through to the next instruction
+}
+
+func effectOf(instr Instruction) (stackEffect, error) {
+	switch instr.Op {
+	case OpLoadConst, OpLoadName, OpLoadGlobal, OpLoadFast, OpImportName,
+		OpBinaryAddFastConst, OpBinarySubFastConst:
+		return stackEffect{delta: 1, next: true}, nil
+	case OpLoadFastLoadFast, OpLoadFastLoadConst:
+		return stackEffect{delta: 2, next: true}, nil
+	case OpStoreFastLoadFast:
+		return stackEffect{pops: 1, next: true}, nil
+	case OpStoreName, OpStoreGlobal, OpStoreFast, OpPopTop, OpPrintExpr, OpPrintNewlineTo:
+		return stackEffect{pops: 1, delta: -1, next: true}, nil
+	case OpBinaryAdd, OpBinarySub, OpBinaryMul, OpBinaryDiv, OpBinaryMod, OpBinarySubscr,
+		OpCompareEq, OpCompareNe, OpCompareLt, OpCompareLe, OpCompareGt, OpCompareGe, OpCompareIn,
+		OpCompareIs, OpCompareIsNot:
+		return stackEffect{pops: 2, delta: -1, next: true}, nil
+	case OpUnaryPos, OpUnaryNeg, OpUnaryNot, OpMakeFunction, OpLoadAttr, OpGetIter:
+		return stackEffect{pops: 1, next: true}, nil
+	case OpStoreSubscr:
+		return stackEffect{pops: 3, delta: -3, next: true}, nil
+	case OpPrintItemTo:
+		return stackEffect{pops: 2, delta: -2, next: true}, nil
+	case OpPrintNewline, OpNop:
+		return stackEffect{next: true}, nil
+	case OpRotTwo:
+		return stackEffect{pops: 2, next: true}, nil
+	case OpRotThree:
+		return stackEffect{pops: 3, next: true}, nil
+	case OpDupTop:
+		return stackEffect{pops: 1, delta: 1, next: true}, nil
+	case OpReturnValue:
+		return stackEffect{pops: 1}, nil
+	case OpJumpForward:
+		if instr.Arg < 0 {
+			return stackEffect{}, fmt.Errorf("negative jump %d", instr.Arg)
+		}
+		return stackEffect{jumps: true, relative: true}, nil
+	case OpJumpAbsolute:
+		return stackEffect{jumps: true}, nil
+	case OpJumpIfFalse, OpJumpIfTrue:
+		return stackEffect{pops: 1, jumps: true, next: true}, nil
+	case OpPopJumpIfFalse, OpPopJumpIfTrue:
+		return stackEffect{pops: 1, delta: -1, jumpDelta: -1, jumps: true, next: true}, nil
+	case OpForIter:
+		// Pushes the next item, or pops the exhausted iterator and jumps.
+		return stackEffect{pops: 1, delta: 1, jumpDelta: -1, jumps: true, next: true}, nil
+	case OpBuildList, OpCallFunction:
+		if instr.Arg < 0 || instr.Arg > maxOperand {
+			return stackEffect{}, fmt.Errorf("count %d out of range", instr.Arg)
+		}
+		pops := instr.Arg
+		if instr.Op == OpCallFunction {
+			pops++
+		}
+		return stackEffect{pops: pops, delta: 1 - pops, next: true}, nil
+	case OpBuildDict:
+		if instr.Arg < 0 || instr.Arg > maxOperand {
+			return stackEffect{}, fmt.Errorf("count %d out of range", instr.Arg)
+		}
+		return stackEffect{pops: 2 * instr.Arg, delta: 1 - 2*instr.Arg, next: true}, nil
+	}
+	return stackEffect{}, fmt.Errorf("opcode is not supported by the VM")
+}
+
+// maxOperand bounds counts so that stack arithmetic cannot overflow.
+const maxOperand = 1 << 24
+
+// stackDepths checks every instruction's operands and returns the maximum
+// stack depth of co.
+func stackDepths(co *CodeObject) (int, error) {
+	n := len(co.Instructions)
+	depths := make([]int, n)
+	for i := range depths {
+		depths[i] = -1
+	}
+
+	maxDepth := 0
+	var work []int
+	reach := func(target, depth int) error {
+		if target == n {
+			return nil // running off the end returns None
+		}
+		switch {
+		case depths[target] < 0:
+			depths[target] = depth
+			work = append(work, target)
+		case depths[target] != depth:
+			return &VerifyError{Code: co.Name, Offset: target, Op: co.Instructions[target].Op,
+				Msg: fmt.Sprintf("reached with stack depths %d and %d", depths[target], depth)}
+		}
+		return nil
+	}
+
+	if n > 0 {
+		reach(0, 0)
+	}
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+		instr := co.Instructions[offset]
+		depth := depths[offset]
+		fail := func(format string, args ...interface{}) error {
+			return &VerifyError{Code: co.Name, Offset: offset, Op: instr.Op, Msg: fmt.Sprintf(format, args...)}
+		}
+
+		if err := checkOperand(co, instr); err != nil {
+			return 0, fail("%v", err)
+		}
+		effect, err := effectOf(instr)
+		if err != nil {
+			return 0, fail("%v", err)
+		}
+		if depth < effect.pops {
+			return 0, fail("stack underflow: needs %d values, has %d", effect.pops, depth)
+		}
+		if effect.next {
+			if depth+effect.delta > maxDepth {
+				maxDepth = depth + effect.delta
+			}
+			if err := reach(offset+1, depth+effect.delta); err != nil {
+				return 0, err
+			}
+		}
+		if effect.jumps {
+			target := instr.Arg
+			if effect.relative {
+				target = offset + 1 + instr.Arg
+			}
+			if target < 0 || target > n {
+				return 0, fail("jump target %d out of range", target)
+			}
+			if err := reach(target, depth+effect.jumpDelta); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return maxDepth, nil
+}
+
+func checkOperand(co *CodeObject, instr Instruction) error {
+	if instr.Op.isPacked() {
+		if instr.Arg < 0 {
+			return fmt.Errorf("packed operand %d out of range", instr.Arg)
+		}
+		first, second := UnpackOperands(instr.Arg)
+		if err := checkIndex(first, len(co.Varnames), "local variable"); err != nil {
+			return err
+		}
+		if instr.Op == OpLoadFastLoadFast || instr.Op == OpStoreFastLoadFast {
+			return checkIndex(second, len(co.Varnames), "local variable")
+		}
+		return checkIndex(second, len(co.Consts), "constant")
+	}
+
+	var limit int
+	var what string
+	switch instr.Op {
+	case OpLoadConst:
+		limit, what = len(co.Consts), "constant"
+	case OpLoadName, OpStoreName, OpLoadGlobal, OpStoreGlobal, OpLoadAttr, OpImportName:
+		limit, what = len(co.Names), "name"
+	case OpLoadFast, OpStoreFast:
+		limit, what = len(co.Varnames), "local variable"
+	default:
+		return nil
+	}
+	return checkIndex(instr.Arg, limit, what)
+}
+
+func checkIndex(index, limit int, what string) error {
+	if index < 0 || index >= limit {
+		return fmt.Errorf("%s index %d out of range (%d %ss)", what, index, limit, what)
+	}
+	return nil
+}
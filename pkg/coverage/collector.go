@@ -0,0 +1,100 @@
+package coverage
+
+import (
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// Collector records coverage of the code a VM runs into a Profile.
+type Collector struct {
+	remove   func()
+	profile  *Profile
+	files    map[*compiler.CodeObject]*File
+	branches map[branchKey]*Branch
+}
+
+type branchKey struct {
+	code   *compiler.CodeObject
+	offset int
+}
+
+// Start attaches a new collector to machine. Code is registered as it
+// starts running, along with the functions it defines.
+func Start(machine *vm.VM) *Collector {
+	c := &Collector{
+		profile:  NewProfile(),
+		files:    make(map[*compiler.CodeObject]*File),
+		branches: make(map[branchKey]*Branch),
+	}
+	c.remove = machine.AddHook(c)
+	return c
+}
+
+// Stop detaches the collector.
+func (c *Collector) Stop() {
+	if c.remove != nil {
+		c.remove()
+		c.remove = nil
+	}
+}
+
+// Profile returns the coverage recorded so far.
+func (c *Collector) Profile() *Profile {
+	return c.profile
+}
+
+func (c *Collector) register(code *compiler.CodeObject) *File {
+	if f, ok := c.files[code]; ok {
+		return f
+	}
+	c.profile.AddCode(code)
+	c.index(code)
+	return c.files[code]
+}
+
+func (c *Collector) index(code *compiler.CodeObject) {
+	f := c.profile.file(code.Filename)
+	c.files[code] = f
+	for offset, instruction := range code.Instructions {
+		if isBranch(instruction.Op) {
+			c.branches[branchKey{code, offset}] = f.branch(code.Name, code.LineForOffset(offset), offset)
+		}
+	}
+	for _, k := range code.Consts {
+		if fn, ok := k.(*compiler.PyFunction); ok && fn.Code != nil {
+			if _, seen := c.files[fn.Code]; !seen {
+				c.index(fn.Code)
+			}
+		}
+	}
+}
+
+// Trace implements vm.Hook.
+func (c *Collector) Trace(event vm.Event, frame *vm.Frame, arg object.Object) error {
+	switch event {
+	case vm.EventCall:
+		c.register(frame.Code)
+	case vm.EventLine:
+		c.register(frame.Code).Lines[frame.Line()]++
+	}
+	return nil
+}
+
+// Instruction implements vm.InstructionHook. The condition of a jump is
+// still on the stack when the hook runs, so its outcome is read directly.
+func (c *Collector) Instruction(frame *vm.Frame, offset int) error {
+	if !isBranch(frame.Code.Instructions[offset].Op) || frame.SP == 0 {
+		return nil
+	}
+	b := c.branches[branchKey{frame.Code, offset}]
+	if b == nil {
+		return nil
+	}
+	if frame.Stack[frame.SP-1].IsTruthy() {
+		b.True++
+	} else {
+		b.False++
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package coverage records which lines and branch outcomes of a Python
+// script a VM executes, keyed on the compiler's line table.
+package coverage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+)
+
+// Profile is the coverage of one or more runs, by source file.
+type Profile struct {
+	Files map[string]*File `json:"files"`
+}
+
+// File is the coverage of one source file.
+type File struct {
+	// Lines maps every executable line to the number of times it ran.
+	Lines map[int]int64 `json:"lines"`
+	// Branches lists the conditional jumps, sorted by line.
+	Branches []*Branch `json:"branches,omitempty"`
+}
+
+// Branch counts the outcomes of one conditional jump, such as the test of
+// an if, elif or while.
+type Branch struct {
+	Line     int    `json:"line"`
+	Function string `json:"function"`
+	Offset   int    `json:"offset"`
+	True     int64  `json:"true"`
+	False    int64  `json:"false"`
+}
+
+// Partial reports whether the branch ran but not both ways.
+func (b *Branch) Partial() bool {
+	return (b.True == 0) != (b.False == 0)
+}
+
+// NewProfile returns an empty profile.
+func NewProfile() *Profile {
+	return &Profile{Files: make(map[string]*File)}
+}
+
+func (p *Profile) file(filename string) *File {
+	f, ok := p.Files[filename]
+	if !ok {
+		f = &File{Lines: make(map[int]int64)}
+		p.Files[filename] = f
+	}
+	return f
+}
+
+// AddCode registers the lines and conditional jumps of code and of the
+// functions defined in it, so that code that never runs is reported.
+func (p *Profile) AddCode(code *compiler.CodeObject) {
+	p.addCode(code)
+	for _, f := range p.Files {
+		f.sortBranches()
+	}
+}
+
+func (p *Profile) addCode(code *compiler.CodeObject) {
+	f := p.file(code.Filename)
+	for _, entry := range code.LineTable {
+		if entry.Line > 0 {
+			if _, ok := f.Lines[entry.Line]; !ok {
+				f.Lines[entry.Line] = 0
+			}
+		}
+	}
+	for offset, instruction := range code.Instructions {
+		if isBranch(instruction.Op) {
+			f.branch(code.Name, code.LineForOffset(offset), offset)
+		}
+	}
+	for _, c := range code.Consts {
+		if fn, ok := c.(*compiler.PyFunction); ok && fn.Code != nil {
+			p.addCode(fn.Code)
+		}
+	}
+}
+
+func isBranch(op compiler.OpCode) bool {
+	switch op {
+	case compiler.OpPopJumpIfFalse, compiler.OpPopJumpIfTrue, compiler.OpJumpIfFalse, compiler.OpJumpIfTrue:
+		return true
+	}
+	return false
+}
+
+func (f *File) branch(function string, line, offset int) *Branch {
+	for _, b := range f.Branches {
+		if b.Function == function && b.Offset == offset {
+			return b
+		}
+	}
+	b := &Branch{Line: line, Function: function, Offset: offset}
+	f.Branches = append(f.Branches, b)
+	return b
+}
+
+func (f *File) sortBranches() {
+	sort.SliceStable(f.Branches, func(i, j int) bool {
+		a, b := f.Branches[i], f.Branches[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Offset < b.Offset
+	})
+}
+
+// Merge adds the counts of other to p.
+func (p *Profile) Merge(other *Profile) {
+	for filename, of := range other.Files {
+		f := p.file(filename)
+		for line, hits := range of.Lines {
+			f.Lines[line] += hits
+		}
+		for _, ob := range of.Branches {
+			b := f.branch(ob.Function, ob.Line, ob.Offset)
+			b.True += ob.True
+			b.False += ob.False
+		}
+		f.sortBranches()
+	}
+}
+
+// Filenames returns the files of the profile in sorted order.
+func (p *Profile) Filenames() []string {
+	names := make([]string, 0, len(p.Files))
+	for name := range p.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReadFile loads a profile written by WriteFile.
+func ReadFile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := NewProfile()
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.Files == nil {
+		p.Files = make(map[string]*File)
+	}
+	for _, f := range p.Files {
+		if f.Lines == nil {
+			f.Lines = make(map[int]int64)
+		}
+	}
+	return p, nil
+}
+
+// WriteFile saves p as JSON.
+func (p *Profile) WriteFile(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// MergeFile merges p into the profile stored at path, creating it if it
+// does not exist, so that coverage accumulates across runs.
+func (p *Profile) MergeFile(path string) error {
+	merged, err := ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		merged = NewProfile()
+	} else if err != nil {
+		return err
+	}
+	merged.Merge(p)
+	return merged.WriteFile(path)
+}
@@ -0,0 +1,278 @@
+package coverage
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Summary counts what a file, or a whole profile, covers. Each branch has
+// two outcomes.
+type Summary struct {
+	Lines           int
+	CoveredLines    int
+	Branches        int
+	CoveredBranches int
+}
+
+func (s Summary) LinePercent() float64 {
+	return percent(s.CoveredLines, s.Lines)
+}
+
+func (s Summary) BranchPercent() float64 {
+	return percent(s.CoveredBranches, s.Branches)
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+func (s *Summary) add(other Summary) {
+	s.Lines += other.Lines
+	s.CoveredLines += other.CoveredLines
+	s.Branches += other.Branches
+	s.CoveredBranches += other.CoveredBranches
+}
+
+// Summary counts the covered lines and branch outcomes of f.
+func (f *File) Summary() Summary {
+	var s Summary
+	for _, hits := range f.Lines {
+		s.Lines++
+		if hits > 0 {
+			s.CoveredLines++
+		}
+	}
+	for _, b := range f.Branches {
+		s.Branches += 2
+		if b.True > 0 {
+			s.CoveredBranches++
+		}
+		if b.False > 0 {
+			s.CoveredBranches++
+		}
+	}
+	return s
+}
+
+// Missing returns the executable lines that never ran, in order.
+func (f *File) Missing() []int {
+	var missing []int
+	for line, hits := range f.Lines {
+		if hits == 0 {
+			missing = append(missing, line)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
+
+// Summary totals the coverage of every file.
+func (p *Profile) Summary() Summary {
+	var s Summary
+	for _, f := range p.Files {
+		s.add(f.Summary())
+	}
+	return s
+}
+
+// WriteText writes a per-file summary with the lines that never ran,
+// followed by the branches that only went one way.
+func (p *Profile) WriteText(w io.Writer) error {
+	pw := &printer{w: w}
+	pw.printf("%-30s %12s %7s %12s %7s  %s\n", "File", "Lines", "", "Branches", "", "Missing")
+	for _, name := range p.Filenames() {
+		f := p.Files[name]
+		s := f.Summary()
+		pw.printf("%-30s %12s %6.1f%% %12s %6.1f%%  %s\n", name,
+			fmt.Sprintf("%d/%d", s.CoveredLines, s.Lines), s.LinePercent(),
+			fmt.Sprintf("%d/%d", s.CoveredBranches, s.Branches), s.BranchPercent(),
+			lineRanges(f.Lines, f.Missing()))
+	}
+	s := p.Summary()
+	pw.printf("%-30s %12s %6.1f%% %12s %6.1f%%\n", "TOTAL",
+		fmt.Sprintf("%d/%d", s.CoveredLines, s.Lines), s.LinePercent(),
+		fmt.Sprintf("%d/%d", s.CoveredBranches, s.Branches), s.BranchPercent())
+
+	header := false
+	for _, name := range p.Filenames() {
+		for _, b := range p.Files[name].Branches {
+			if b.True > 0 && b.False > 0 {
+				continue
+			}
+			if !header {
+				pw.printf("\nPartial branches:\n")
+				header = true
+			}
+			pw.printf("%s:%d: %s\n", name, b.Line, b.describe())
+		}
+	}
+	return pw.err
+}
+
+func (b *Branch) describe() string {
+	switch {
+	case b.True == 0 && b.False == 0:
+		return fmt.Sprintf("condition in %s() never ran", b.Function)
+	case b.True == 0:
+		return fmt.Sprintf("condition in %s() was never true", b.Function)
+	default:
+		return fmt.Sprintf("condition in %s() was never false", b.Function)
+	}
+}
+
+// lineRanges formats missing lines as ranges such as "3-5, 9", where a
+// range spans lines that are consecutive among the executable lines.
+func lineRanges(executable map[int]int64, missing []int) string {
+	if len(missing) == 0 {
+		return ""
+	}
+	lines := make([]int, 0, len(executable))
+	for line := range executable {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	index := make(map[int]int, len(lines))
+	for i, line := range lines {
+		index[line] = i
+	}
+
+	var parts []string
+	start, prev := missing[0], missing[0]
+	flush := func() {
+		if start == prev {
+			parts = append(parts, fmt.Sprint(start))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", start, prev))
+		}
+	}
+	for _, line := range missing[1:] {
+		if index[line] == index[prev]+1 {
+			prev = line
+			continue
+		}
+		flush()
+		start, prev = line, line
+	}
+	flush()
+	return strings.Join(parts, ", ")
+}
+
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+type htmlFile struct {
+	Name    string
+	Summary Summary
+	Lines   []htmlLine
+	Error   string
+}
+
+type htmlLine struct {
+	Number int
+	Text   string
+	Class  string
+	Hits   string
+	Title  string
+}
+
+// WriteHTML writes the source of every file annotated with its coverage.
+// load returns the source of a file; if nil, files are read from disk.
+func (p *Profile) WriteHTML(w io.Writer, load func(filename string) (string, error)) error {
+	if load == nil {
+		load = func(filename string) (string, error) {
+			data, err := os.ReadFile(filename)
+			return string(data), err
+		}
+	}
+
+	var files []htmlFile
+	for _, name := range p.Filenames() {
+		f := p.Files[name]
+		hf := htmlFile{Name: name, Summary: f.Summary()}
+		source, err := load(name)
+		if err != nil {
+			hf.Error = err.Error()
+			files = append(files, hf)
+			continue
+		}
+
+		branches := make(map[int][]*Branch)
+		for _, b := range f.Branches {
+			branches[b.Line] = append(branches[b.Line], b)
+		}
+		for i, text := range strings.Split(strings.TrimSuffix(source, "\n"), "\n") {
+			line := htmlLine{Number: i + 1, Text: text}
+			if hits, ok := f.Lines[line.Number]; ok {
+				line.Hits = fmt.Sprint(hits)
+				line.Class = "hit"
+				if hits == 0 {
+					line.Class = "miss"
+				}
+			}
+			var notes []string
+			for _, b := range branches[line.Number] {
+				if b.Partial() {
+					notes = append(notes, b.describe())
+				}
+			}
+			if len(notes) > 0 && line.Class == "hit" {
+				line.Class = "partial"
+				line.Title = strings.Join(notes, "; ")
+			}
+			hf.Lines = append(hf.Lines, line)
+		}
+		files = append(files, hf)
+	}
+
+	return htmlTemplate.Execute(w, struct {
+		Total Summary
+		Files []htmlFile
+	}{p.Summary(), files})
+}
+
+var htmlTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gopy coverage</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table.source { border-collapse: collapse; font-family: monospace; white-space: pre; }
+table.source td { padding: 0 0.5em; }
+td.num, td.hits { color: #888; text-align: right; }
+tr.hit { background: #dfd; }
+tr.miss { background: #fdd; }
+tr.partial { background: #ffc; }
+</style>
+</head>
+<body>
+<h1>Coverage</h1>
+<p>Lines {{.Total.CoveredLines}}/{{.Total.Lines}} ({{printf "%.1f" .Total.LinePercent}}%),
+branches {{.Total.CoveredBranches}}/{{.Total.Branches}} ({{printf "%.1f" .Total.BranchPercent}}%)</p>
+{{range .Files}}
+<h2 id="{{.Name}}">{{.Name}}</h2>
+<p>Lines {{.Summary.CoveredLines}}/{{.Summary.Lines}} ({{printf "%.1f" .Summary.LinePercent}}%),
+branches {{.Summary.CoveredBranches}}/{{.Summary.Branches}} ({{printf "%.1f" .Summary.BranchPercent}}%)</p>
+{{if .Error}}<p>Source unavailable: {{.Error}}</p>{{end}}
+<table class="source">
+{{range .Lines}}<tr class="{{.Class}}"{{if .Title}} title="{{.Title}}"{{end}}><td class="num">{{.Number}}</td><td class="hits">{{.Hits}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,662 @@
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/debugger"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// threadID is the only thread the VM has.
+const threadID = 1
+
+// Server serves one debug session over a pair of streams, usually the
+// process's stdin and stdout.
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	writeMu sync.Mutex
+	seq     int
+
+	// Owned by the request loop.
+	launch          launchArguments
+	code            *compiler.CodeObject
+	machine         *vm.VM
+	debugger        *debugger.Debugger
+	started         bool
+	cancel          context.CancelFunc
+	lineBreakpoints map[string][]int
+	funcBreakpoints []int
+
+	mu          sync.Mutex
+	stopped     bool
+	terminating bool
+	commands    chan command
+	done        chan struct{}
+
+	// Owned by the VM goroutine and only valid while it is stopped.
+	frames []debugger.FrameInfo
+	refs   []func() []debugger.Variable
+}
+
+// command is run on the VM goroutine while the program is stopped. A
+// command without fn resumes the program with action.
+type command struct {
+	fn     func()
+	done   chan struct{}
+	action debugger.Action
+}
+
+// NewServer creates a server reading requests from in and writing
+// responses and events to out.
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:              bufio.NewReader(in),
+		out:             out,
+		lineBreakpoints: make(map[string][]int),
+		commands:        make(chan command),
+		done:            make(chan struct{}),
+	}
+}
+
+// Serve handles requests until the client disconnects or in is closed.
+func (s *Server) Serve() error {
+	for {
+		data, err := ReadMessage(s.in)
+		if err != nil {
+			if err == io.EOF {
+				s.terminate()
+				return nil
+			}
+			return err
+		}
+		var req Request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return fmt.Errorf("dap: invalid message: %v", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+
+		body, err := s.dispatch(&req)
+		if err != nil {
+			s.respond(&req, nil, err)
+			continue
+		}
+		if req.Command == "disconnect" {
+			s.respond(&req, nil, nil)
+			return nil
+		}
+		s.respond(&req, body, nil)
+		s.afterResponse(&req)
+	}
+}
+
+func (s *Server) dispatch(req *Request) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch":
+		return nil, s.onLaunch(req)
+	case "setBreakpoints":
+		return s.onSetBreakpoints(req)
+	case "setFunctionBreakpoints":
+		return s.onSetFunctionBreakpoints(req)
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{"breakpoints": []breakpoint{}}, nil
+	case "configurationDone":
+		return nil, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": threadID, "name": "main"}},
+		}, nil
+	case "stackTrace":
+		return s.onStackTrace(req)
+	case "scopes":
+		return s.onScopes(req)
+	case "variables":
+		return s.onVariables(req)
+	case "evaluate":
+		return s.onEvaluate(req)
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, s.resume(debugger.Continue)
+	case "next":
+		return nil, s.resume(debugger.StepOver)
+	case "stepIn":
+		return nil, s.resume(debugger.StepIn)
+	case "stepOut":
+		return nil, s.resume(debugger.StepOut)
+	case "pause":
+		if s.debugger == nil {
+			return nil, errors.New("no program is running")
+		}
+		s.debugger.Pause()
+		return nil, nil
+	case "disconnect", "terminate":
+		s.terminate()
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported request %q", req.Command)
+	}
+}
+
+// afterResponse sends the events that must follow a response.
+func (s *Server) afterResponse(req *Request) {
+	switch req.Command {
+	case "launch":
+		// Configuration requests are accepted once the program is loaded,
+		// so that breakpoints can be checked against its line table.
+		s.sendEvent("initialized", nil)
+	case "configurationDone":
+		s.start()
+	}
+}
+
+func (s *Server) onLaunch(req *Request) error {
+	if err := json.Unmarshal(req.Arguments, &s.launch); err != nil {
+		return err
+	}
+	if s.launch.Program == "" {
+		return errors.New("launch: missing program")
+	}
+	code, err := loadProgram(s.launch.Program)
+	if err != nil {
+		return err
+	}
+	s.code = code
+
+	s.machine = vm.NewVM()
+	s.machine.SetStdout(&outputWriter{server: s, category: "stdout"})
+	s.machine.SetStderr(&outputWriter{server: s, category: "stderr"})
+	// The protocol owns stdin, so the script sees end of input.
+	s.machine.SetStdin(strings.NewReader(""))
+
+	if !s.launch.NoDebug {
+		s.debugger = debugger.New(s.machine, s.handleStop)
+		s.debugger.SetStopOnEntry(s.launch.StopOnEntry)
+	}
+	return nil
+}
+
+func loadProgram(path string) (*compiler.CodeObject, error) {
+	if filepath.Ext(path) == ".pyc" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return compiler.DeserializeCodeObject(file)
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	module, err := parser.ParseFile(path, string(src))
+	if err != nil {
+		return nil, err
+	}
+	return compiler.CompileFile(module, path)
+}
+
+func (s *Server) start() {
+	if s.code == nil || s.started {
+		return
+	}
+	s.started = true
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		defer close(s.done)
+		defer cancel()
+		exitCode := 0
+		if _, err := s.machine.RunContext(ctx, s.code); err != nil {
+			exitCode = 1
+			if !errors.Is(err, debugger.ErrAborted) && ctx.Err() == nil {
+				s.sendEvent("output", map[string]interface{}{"category": "stderr", "output": err.Error() + "\n"})
+			}
+		}
+		s.sendEvent("exited", map[string]interface{}{"exitCode": exitCode})
+		s.sendEvent("terminated", nil)
+	}()
+}
+
+// terminate aborts a running program and waits for it to finish.
+func (s *Server) terminate() {
+	if !s.started {
+		return
+	}
+	s.mu.Lock()
+	s.terminating = true
+	stopped := s.stopped
+	s.stopped = false
+	s.mu.Unlock()
+
+	// Cancelling stops a program that never reaches another stop, such
+	// as one launched with noDebug.
+	s.cancel()
+	if stopped {
+		s.commands <- command{action: debugger.Abort}
+	} else if s.debugger != nil {
+		// The next stop sees terminating and aborts.
+		s.debugger.Pause()
+	}
+	<-s.done
+}
+
+func (s *Server) onSetBreakpoints(req *Request) (interface{}, error) {
+	var args setBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	path := args.Source.Path
+	if path == "" {
+		path = args.Source.Name
+	}
+
+	if s.debugger != nil {
+		for _, id := range s.lineBreakpoints[path] {
+			s.debugger.Clear(id)
+		}
+	}
+	delete(s.lineBreakpoints, path)
+
+	lines := codeLines(s.code)
+	result := make([]breakpoint, 0, len(args.Breakpoints))
+	for _, sbp := range args.Breakpoints {
+		bp := breakpoint{Line: sbp.Line, Source: &args.Source}
+		switch {
+		case s.debugger == nil:
+			bp.Message = "no program is loaded"
+		case !lines[sbp.Line]:
+			bp.Message = fmt.Sprintf("no code at line %d", sbp.Line)
+		default:
+			b := s.debugger.Break(path, sbp.Line)
+			s.lineBreakpoints[path] = append(s.lineBreakpoints[path], b.ID)
+			bp.ID = b.ID
+			bp.Verified = true
+		}
+		result = append(result, bp)
+	}
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+// codeLines returns the lines of code and its nested functions that have
+// instructions.
+func codeLines(code *compiler.CodeObject) map[int]bool {
+	lines := make(map[int]bool)
+	var walk func(code *compiler.CodeObject)
+	walk = func(code *compiler.CodeObject) {
+		for _, entry := range code.LineTable {
+			lines[entry.Line] = true
+		}
+		for _, c := range code.Consts {
+			if fn, ok := c.(*compiler.PyFunction); ok {
+				walk(fn.Code)
+			}
+		}
+	}
+	if code != nil {
+		walk(code)
+	}
+	return lines
+}
+
+func (s *Server) onSetFunctionBreakpoints(req *Request) (interface{}, error) {
+	var args setFunctionBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	if s.debugger == nil {
+		return nil, errors.New("no program is loaded")
+	}
+	for _, id := range s.funcBreakpoints {
+		s.debugger.Clear(id)
+	}
+	s.funcBreakpoints = nil
+
+	result := make([]breakpoint, 0, len(args.Breakpoints))
+	for _, fbp := range args.Breakpoints {
+		b := s.debugger.BreakFunction(fbp.Name)
+		s.funcBreakpoints = append(s.funcBreakpoints, b.ID)
+		result = append(result, breakpoint{ID: b.ID, Verified: true})
+	}
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+// handleStop runs on the VM goroutine each time the program stops and
+// serves inspection commands until the client resumes it.
+func (s *Server) handleStop(d *debugger.Debugger, stop *debugger.Stop) debugger.Action {
+	s.frames = d.Backtrace()
+	s.refs = nil
+
+	body := map[string]interface{}{
+		"reason":            stopReason(stop.Reason),
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	}
+	switch stop.Reason {
+	case debugger.StopBreakpoint:
+		body["hitBreakpointIds"] = []int{stop.Breakpoint.ID}
+	case debugger.StopException:
+		body["text"] = stop.Value.String()
+	}
+
+	s.mu.Lock()
+	if s.terminating {
+		s.mu.Unlock()
+		return debugger.Abort
+	}
+	s.stopped = true
+	s.mu.Unlock()
+	s.sendEvent("stopped", body)
+
+	for cmd := range s.commands {
+		if cmd.fn == nil {
+			return cmd.action
+		}
+		cmd.fn()
+		close(cmd.done)
+	}
+	return debugger.Abort
+}
+
+func stopReason(reason debugger.Reason) string {
+	switch reason {
+	case debugger.StopBreakpoint:
+		return "breakpoint"
+	case debugger.StopEntry:
+		return "entry"
+	case debugger.StopException:
+		return "exception"
+	case debugger.StopPause:
+		return "pause"
+	default:
+		return "step"
+	}
+}
+
+var errNotStopped = errors.New("the program is not stopped")
+
+func (s *Server) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// inspect runs fn on the VM goroutine while the program is stopped.
+func (s *Server) inspect(fn func()) error {
+	if !s.isStopped() {
+		return errNotStopped
+	}
+	done := make(chan struct{})
+	s.commands <- command{fn: fn, done: done}
+	<-done
+	return nil
+}
+
+func (s *Server) resume(action debugger.Action) error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.mu.Unlock()
+		return errNotStopped
+	}
+	s.stopped = false
+	s.mu.Unlock()
+	s.commands <- command{action: action}
+	return nil
+}
+
+func (s *Server) onStackTrace(req *Request) (interface{}, error) {
+	var args stackTraceArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	var frames []stackFrame
+	err := s.inspect(func() {
+		for i, info := range s.frames {
+			frames = append(frames, stackFrame{
+				ID:     i + 1,
+				Name:   info.Function,
+				Source: &source{Name: filepath.Base(info.Filename), Path: info.Filename},
+				Line:   info.Line,
+				Column: 1,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(frames)
+	if args.StartFrame > 0 && args.StartFrame < len(frames) {
+		frames = frames[args.StartFrame:]
+	} else if args.StartFrame >= len(frames) {
+		frames = nil
+	}
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+	if frames == nil {
+		frames = []stackFrame{}
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": total}, nil
+}
+
+// frame returns the frame with the given stack trace ID. It must be called
+// on the VM goroutine.
+func (s *Server) frame(id int) (*vm.Frame, error) {
+	if id < 1 || id > len(s.frames) {
+		return nil, fmt.Errorf("unknown frame %d", id)
+	}
+	return s.frames[id-1].Frame, nil
+}
+
+func (s *Server) onScopes(req *Request) (interface{}, error) {
+	var args scopesArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	var scopes []scope
+	var frameErr error
+	err := s.inspect(func() {
+		frame, err := s.frame(args.FrameID)
+		if err != nil {
+			frameErr = err
+			return
+		}
+		d := s.debugger
+		scopes = []scope{
+			{Name: "Locals", VariablesReference: s.newRef(func() []debugger.Variable { return d.Locals(frame) })},
+			{Name: "Globals", VariablesReference: s.newRef(func() []debugger.Variable { return debugger.Globals(frame) })},
+			{Name: "Builtins", VariablesReference: s.newRef(func() []debugger.Variable { return sortedVariables(frame.Builtins.Map()) }), Expensive: true},
+		}
+	})
+	if err == nil {
+		err = frameErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+func sortedVariables(values map[string]object.Object) []debugger.Variable {
+	vars := make([]debugger.Variable, 0, len(values))
+	for name, value := range values {
+		vars = append(vars, debugger.Variable{Name: name, Value: value})
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
+
+// newRef registers a variables reference valid until the program resumes.
+func (s *Server) newRef(vars func() []debugger.Variable) int {
+	s.refs = append(s.refs, vars)
+	return len(s.refs)
+}
+
+// containerRef returns a reference for expanding lists and dicts, or 0.
+func (s *Server) containerRef(obj object.Object) int {
+	switch o := obj.(type) {
+	case *runtime.PyList:
+		if len(o.Elements) == 0 {
+			return 0
+		}
+		return s.newRef(func() []debugger.Variable {
+			vars := make([]debugger.Variable, len(o.Elements))
+			for i, elem := range o.Elements {
+				vars[i] = debugger.Variable{Name: strconv.Itoa(i), Value: elem}
+			}
+			return vars
+		})
+	case *runtime.PyDict:
+		if len(o.Keys) == 0 {
+			return 0
+		}
+		return s.newRef(func() []debugger.Variable {
+			vars := make([]debugger.Variable, len(o.Keys))
+			for i, key := range o.Keys {
+				vars[i] = debugger.Variable{Name: key, Value: o.Pairs[key]}
+			}
+			return vars
+		})
+	}
+	return 0
+}
+
+func (s *Server) onVariables(req *Request) (interface{}, error) {
+	var args variablesArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	var result []variable
+	var refErr error
+	err := s.inspect(func() {
+		ref := args.VariablesReference
+		if ref < 1 || ref > len(s.refs) {
+			refErr = fmt.Errorf("unknown variables reference %d", ref)
+			return
+		}
+		result = []variable{}
+		for _, v := range s.refs[ref-1]() {
+			result = append(result, variable{
+				Name:               v.Name,
+				Value:              repr(v.Value),
+				Type:               v.Value.Type(),
+				VariablesReference: s.containerRef(v.Value),
+			})
+		}
+	})
+	if err == nil {
+		err = refErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"variables": result}, nil
+}
+
+func (s *Server) onEvaluate(req *Request) (interface{}, error) {
+	var args evaluateArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	var evalErr error
+	err := s.inspect(func() {
+		id := args.FrameID
+		if id == 0 {
+			id = 1
+		}
+		frame, err := s.frame(id)
+		if err != nil {
+			evalErr = err
+			return
+		}
+		value, err := s.debugger.Eval(frame, args.Expression)
+		if err != nil {
+			evalErr = err
+			return
+		}
+		body = map[string]interface{}{
+			"result":             repr(value),
+			"type":               value.Type(),
+			"variablesReference": s.containerRef(value),
+		}
+	})
+	if err == nil {
+		err = evalErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// repr formats values the way Python's repr does for the types that differ
+// from str.
+func repr(obj object.Object) string {
+	if str, ok := obj.(*runtime.PyString); ok {
+		return "'" + strings.ReplaceAll(strings.ReplaceAll(str.Value, `\`, `\\`), "'", `\'`) + "'"
+	}
+	return obj.String()
+}
+
+func (s *Server) respond(req *Request, body interface{}, err error) {
+	resp := &Response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	s.send(func(seq int) interface{} { resp.Seq = seq; return resp })
+}
+
+func (s *Server) sendEvent(name string, body interface{}) {
+	event := &Event{Type: "event", Event: name, Body: body}
+	s.send(func(seq int) interface{} { event.Seq = seq; return event })
+}
+
+func (s *Server) send(message func(seq int) interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.seq++
+	// A client that went away cannot be told about it.
+	_ = WriteMessage(s.out, message(s.seq))
+}
+
+// outputWriter forwards program output to the client as output events.
+type outputWriter struct {
+	server   *Server
+	category string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.server.sendEvent("output", map[string]interface{}{"category": w.category, "output": string(p)})
+	return len(p), nil
+}
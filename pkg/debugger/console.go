@@ -0,0 +1,227 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const consoleHelp = `Commands:
+  break FILE:LINE | LINE | FUNC   set a breakpoint (b)
+  delete ID                       remove a breakpoint (d)
+  info [breakpoints | locals]     list breakpoints or variables (i)
+  step                            step into the next line (s)
+  next                            step over calls (n)
+  finish                          run until the current function returns (f)
+  continue                        run until the next breakpoint (c)
+  backtrace                       show the call stack (bt, where)
+  up, down                        select the caller or callee frame
+  locals                          show variables of the selected frame
+  print EXPR                      evaluate an expression (p)
+  list                            show source around the current line (l)
+  quit                            abort the program (q)
+`
+
+// Console is a line-oriented debugger front-end in the style of pdb.
+type Console struct {
+	in     *bufio.Scanner
+	out    io.Writer
+	prompt string
+
+	selected int // index into the backtrace, 0 is the innermost frame
+}
+
+// NewConsole creates a console that reads commands from in and writes to out.
+func NewConsole(in io.Reader, out io.Writer) *Console {
+	return &Console{in: bufio.NewScanner(in), out: out, prompt: "(gopy-db) "}
+}
+
+// Handle is a Handler that prompts for commands until one resumes the
+// program. End of input aborts the program.
+func (c *Console) Handle(d *Debugger, stop *Stop) Action {
+	c.selected = 0
+	c.printStop(d, stop)
+	if stop.Reason == StopException {
+		// Allow post-mortem inspection before the program ends.
+		c.loop(d)
+		return Abort
+	}
+	return c.loop(d)
+}
+
+func (c *Console) loop(d *Debugger) Action {
+	for {
+		fmt.Fprint(c.out, c.prompt)
+		if !c.in.Scan() {
+			fmt.Fprintln(c.out)
+			return Abort
+		}
+		line := strings.TrimSpace(c.in.Text())
+		if line == "" {
+			continue
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch cmd {
+		case "s", "step":
+			return StepIn
+		case "n", "next":
+			return StepOver
+		case "f", "finish":
+			return StepOut
+		case "c", "continue":
+			return Continue
+		case "q", "quit":
+			return Abort
+		case "b", "break":
+			c.setBreakpoint(d, arg)
+		case "d", "delete":
+			id, err := strconv.Atoi(arg)
+			if err != nil || !d.Clear(id) {
+				fmt.Fprintf(c.out, "No breakpoint %q\n", arg)
+			}
+		case "i", "info":
+			c.info(d, arg)
+		case "bt", "where", "backtrace":
+			c.printBacktrace(d)
+		case "up":
+			c.moveFrame(d, 1)
+		case "down":
+			c.moveFrame(d, -1)
+		case "locals":
+			c.printLocals(d)
+		case "p", "print":
+			value, err := d.Eval(c.frame(d), arg)
+			if err != nil {
+				fmt.Fprintf(c.out, "*** %v\n", err)
+			} else {
+				fmt.Fprintln(c.out, value)
+			}
+		case "l", "list":
+			c.list(d)
+		case "h", "help":
+			fmt.Fprint(c.out, consoleHelp)
+		default:
+			fmt.Fprintf(c.out, "Unknown command %q, type help for a list\n", cmd)
+		}
+	}
+}
+
+func (c *Console) info(d *Debugger, what string) {
+	switch what {
+	case "", "b", "break", "breakpoints":
+		for _, bp := range d.Breakpoints() {
+			fmt.Fprintf(c.out, "%s, hit %d times\n", bp, bp.Hits)
+		}
+	case "locals":
+		c.printLocals(d)
+	default:
+		fmt.Fprintf(c.out, "Unknown info subcommand %q, expected breakpoints or locals\n", what)
+	}
+}
+
+func (c *Console) printLocals(d *Debugger) {
+	for _, v := range d.Locals(c.frame(d)) {
+		fmt.Fprintf(c.out, "%s = %s\n", v.Name, v.Value)
+	}
+}
+
+func (c *Console) setBreakpoint(d *Debugger, arg string) {
+	if arg == "" {
+		fmt.Fprintln(c.out, "Usage: break FILE:LINE | LINE | FUNC")
+		return
+	}
+	var bp *Breakpoint
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		line, err := strconv.Atoi(arg[i+1:])
+		if err != nil {
+			fmt.Fprintf(c.out, "Invalid line number %q\n", arg[i+1:])
+			return
+		}
+		bp = d.Break(arg[:i], line)
+	} else if line, err := strconv.Atoi(arg); err == nil {
+		bp = d.Break(c.frame(d).Code.Filename, line)
+	} else {
+		bp = d.BreakFunction(arg)
+	}
+	fmt.Fprintf(c.out, "Set %s\n", bp)
+}
+
+func (c *Console) frame(d *Debugger) *vm.Frame {
+	frames := d.Backtrace()
+	if c.selected >= len(frames) {
+		c.selected = len(frames) - 1
+	}
+	return frames[c.selected].Frame
+}
+
+func (c *Console) moveFrame(d *Debugger, delta int) {
+	frames := d.Backtrace()
+	selected := c.selected + delta
+	if selected < 0 || selected >= len(frames) {
+		fmt.Fprintln(c.out, "No more frames")
+		return
+	}
+	c.selected = selected
+	c.printLocation(d, frames[selected])
+}
+
+func (c *Console) printStop(d *Debugger, stop *Stop) {
+	switch stop.Reason {
+	case StopBreakpoint:
+		fmt.Fprintf(c.out, "Stopped at %s\n", stop.Breakpoint)
+	case StopReturn:
+		if d.VM().Depth() == 1 {
+			// The module is done, so there is no location left to show.
+			fmt.Fprintf(c.out, "The program finished\n")
+			return
+		}
+		fmt.Fprintf(c.out, "Return from %s() with %s\n", stop.Function(), stop.Value)
+	case StopException:
+		fmt.Fprintf(c.out, "Uncaught exception: %s\n", stop.Value)
+	}
+	c.printLocation(d, d.Backtrace()[0])
+}
+
+func (c *Console) printLocation(d *Debugger, info FrameInfo) {
+	fmt.Fprintf(c.out, "> %s(%d)%s()\n", info.Filename, info.Line, info.Function)
+	if source := d.VM().SourceLine(info.Filename, info.Line); source != "" {
+		fmt.Fprintf(c.out, "-> %s\n", source)
+	}
+}
+
+func (c *Console) printBacktrace(d *Debugger) {
+	for i, info := range d.Backtrace() {
+		marker := "  "
+		if i == c.selected {
+			marker = "->"
+		}
+		fmt.Fprintf(c.out, "%s #%d %s() at %s:%d\n", marker, i, info.Function, info.Filename, info.Line)
+	}
+}
+
+func (c *Console) list(d *Debugger) {
+	info := d.Backtrace()[c.selected]
+	start := info.Line - 5
+	if start < 1 {
+		start = 1
+	}
+	for line := start; line <= info.Line+5; line++ {
+		source := d.VM().SourceLine(info.Filename, line)
+		if source == "" && line > info.Line {
+			continue
+		}
+		marker := "  "
+		if line == info.Line {
+			marker = "->"
+		}
+		fmt.Fprintf(c.out, "%4d %s %s\n", line, marker, source)
+	}
+}
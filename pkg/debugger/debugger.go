@@ -0,0 +1,403 @@
+// Package debugger implements breakpoints, stepping and inspection on top of
+// the VM's execution hooks.
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// ErrAborted is the error a run fails with after a handler returns Abort.
+var ErrAborted = errors.New("debugger: program aborted")
+
+// Action tells the debugger how to resume after a stop.
+type Action int
+
+const (
+	// Continue runs until the next breakpoint.
+	Continue Action = iota
+	// StepIn stops at the next line, entering called functions.
+	StepIn
+	// StepOver stops at the next line of the current function or a caller.
+	StepOver
+	// StepOut stops when the current function returns.
+	StepOut
+	// Abort ends the run with ErrAborted.
+	Abort
+)
+
+// Reason says why the program stopped.
+type Reason int
+
+const (
+	StopEntry Reason = iota
+	StopBreakpoint
+	StopStep
+	StopReturn
+	StopException
+	StopPause
+)
+
+func (r Reason) String() string {
+	switch r {
+	case StopEntry:
+		return "entry"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopStep:
+		return "step"
+	case StopReturn:
+		return "return"
+	case StopException:
+		return "exception"
+	case StopPause:
+		return "pause"
+	default:
+		return "unknown"
+	}
+}
+
+// Stop describes where and why the program is paused.
+type Stop struct {
+	Reason     Reason
+	Frame      *vm.Frame
+	Breakpoint *Breakpoint   // set for StopBreakpoint
+	Value      object.Object // return value for StopReturn, message for StopException
+}
+
+func (s *Stop) Filename() string { return s.Frame.Code.Filename }
+func (s *Stop) Function() string { return s.Frame.Code.Name }
+func (s *Stop) Line() int        { return s.Frame.Line() }
+
+// Handler is called each time the program stops. It runs on the VM's
+// goroutine while the program is paused, so it may call the inspection
+// methods of the Debugger. Its result says how to resume; it is ignored
+// for StopException, since the program cannot continue.
+type Handler func(d *Debugger, stop *Stop) Action
+
+// Breakpoint stops the program at a source line or on entry to a function.
+type Breakpoint struct {
+	ID       int
+	File     string
+	Line     int
+	Function string
+	Hits     int
+}
+
+func (b *Breakpoint) String() string {
+	if b.Function != "" {
+		return fmt.Sprintf("breakpoint %d in %s()", b.ID, b.Function)
+	}
+	return fmt.Sprintf("breakpoint %d at %s:%d", b.ID, b.File, b.Line)
+}
+
+func (b *Breakpoint) matchesLine(filename string, line int) bool {
+	if b.Function != "" || b.Line != line {
+		return false
+	}
+	if b.File == "" || b.File == filename {
+		return true
+	}
+	if !strings.ContainsRune(b.File, filepath.Separator) {
+		return filepath.Base(filename) == b.File
+	}
+	return strings.HasSuffix(filename, string(filepath.Separator)+b.File)
+}
+
+// Debugger controls a VM through its hooks. Create it with New before
+// running code; it stays attached until Detach is called. Breakpoints may
+// be changed and Pause called from any goroutine; everything else must run
+// on the VM's goroutine, typically from the Handler.
+type Debugger struct {
+	vm      *vm.VM
+	handler Handler
+	remove  func()
+
+	mu          sync.Mutex
+	breakpoints []*Breakpoint
+	nextID      int
+	pause       atomic.Bool
+
+	stopOnEntry bool
+	entered     bool
+	pending     *Breakpoint // function breakpoint waiting for its first line
+	pendingAt   *vm.Frame
+	action      Action
+	depth       int // frame depth when the last step started
+	evaluating  bool
+}
+
+// New attaches a debugger to machine. The handler decides what to do at
+// every stop; by default the program only stops at breakpoints.
+func New(machine *vm.VM, handler Handler) *Debugger {
+	d := &Debugger{vm: machine, handler: handler, action: Continue}
+	d.remove = machine.AddHook(d)
+	return d
+}
+
+// Detach removes the debugger's hook from the VM.
+func (d *Debugger) Detach() {
+	if d.remove != nil {
+		d.remove()
+		d.remove = nil
+	}
+}
+
+// SetStopOnEntry makes the debugger stop before the first line runs.
+func (d *Debugger) SetStopOnEntry(stop bool) {
+	d.stopOnEntry = stop
+}
+
+// VM returns the machine the debugger is attached to.
+func (d *Debugger) VM() *vm.VM {
+	return d.vm
+}
+
+// Pause makes the program stop before the next line runs.
+func (d *Debugger) Pause() {
+	d.pause.Store(true)
+}
+
+// Break sets a breakpoint at a line. A file without a directory matches any
+// file with that base name; an empty file matches every file.
+func (d *Debugger) Break(file string, line int) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	bp := &Breakpoint{ID: d.nextID, File: file, Line: line}
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp
+}
+
+// BreakFunction sets a breakpoint on entry to every function named name.
+func (d *Debugger) BreakFunction(name string) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	bp := &Breakpoint{ID: d.nextID, Function: name}
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp
+}
+
+// Clear removes the breakpoint with the given ID and reports whether it
+// existed.
+func (d *Debugger) Clear(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearAll removes every breakpoint.
+func (d *Debugger) ClearAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints = nil
+}
+
+// Breakpoints returns the breakpoints in the order they were set.
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Breakpoint(nil), d.breakpoints...)
+}
+
+func (d *Debugger) functionBreakpoint(name string) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, bp := range d.breakpoints {
+		if bp.Function != "" && bp.Function == name {
+			return bp
+		}
+	}
+	return nil
+}
+
+func (d *Debugger) lineBreakpoint(filename string, line int) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, bp := range d.breakpoints {
+		if bp.matchesLine(filename, line) {
+			bp.Hits++
+			return bp
+		}
+	}
+	return nil
+}
+
+// Trace implements vm.Hook.
+func (d *Debugger) Trace(event vm.Event, frame *vm.Frame, arg object.Object) error {
+	if d.evaluating {
+		return nil
+	}
+
+	switch event {
+	case vm.EventCall:
+		// Function breakpoints stop at the first line of the body, so that
+		// stepping from there does not stop on the same line twice.
+		if bp := d.functionBreakpoint(frame.Code.Name); bp != nil {
+			d.pending, d.pendingAt = bp, frame
+		}
+
+	case vm.EventLine:
+		if !d.entered {
+			d.entered = true
+			if d.stopOnEntry {
+				return d.stop(&Stop{Reason: StopEntry, Frame: frame})
+			}
+		}
+		if d.pendingAt == frame {
+			bp := d.pending
+			d.pending, d.pendingAt = nil, nil
+			d.mu.Lock()
+			bp.Hits++
+			d.mu.Unlock()
+			return d.stop(&Stop{Reason: StopBreakpoint, Frame: frame, Breakpoint: bp})
+		}
+		if bp := d.lineBreakpoint(frame.Code.Filename, frame.Line()); bp != nil {
+			return d.stop(&Stop{Reason: StopBreakpoint, Frame: frame, Breakpoint: bp})
+		}
+		if d.pause.CompareAndSwap(true, false) {
+			return d.stop(&Stop{Reason: StopPause, Frame: frame})
+		}
+		switch d.action {
+		case StepIn:
+			return d.stop(&Stop{Reason: StopStep, Frame: frame})
+		case StepOver:
+			if d.vm.Depth() <= d.depth {
+				return d.stop(&Stop{Reason: StopStep, Frame: frame})
+			}
+		}
+
+	case vm.EventReturn:
+		if d.action == StepOut && d.vm.Depth() <= d.depth {
+			return d.stop(&Stop{Reason: StopReturn, Frame: frame, Value: arg})
+		}
+
+	case vm.EventException:
+		d.handler(d, &Stop{Reason: StopException, Frame: frame, Value: arg})
+	}
+	return nil
+}
+
+func (d *Debugger) stop(stop *Stop) error {
+	d.action = d.handler(d, stop)
+	d.depth = d.vm.Depth()
+	if d.action == Abort {
+		return ErrAborted
+	}
+	return nil
+}
+
+// FrameInfo describes one entry of a backtrace.
+type FrameInfo struct {
+	Frame    *vm.Frame
+	Function string
+	Filename string
+	Line     int
+}
+
+// Backtrace returns the active frames, innermost first.
+func (d *Debugger) Backtrace() []FrameInfo {
+	frames := d.vm.Frames()
+	infos := make([]FrameInfo, 0, len(frames))
+	for i := len(frames) - 1; i >= 0; i-- {
+		frame := frames[i]
+		infos = append(infos, FrameInfo{
+			Frame:    frame,
+			Function: frame.Code.Name,
+			Filename: frame.Code.Filename,
+			Line:     frame.Line(),
+		})
+	}
+	return infos
+}
+
+// Variable is a named value visible in a frame.
+type Variable struct {
+	Name  string
+	Value object.Object
+}
+
+// Locals returns the local variables of frame in declaration order. For
+// module-level code, whose variables live in the globals, it returns the
+// globals sorted by name.
+func (d *Debugger) Locals(frame *vm.Frame) []Variable {
+	if isModuleFrame(frame) {
+		return Globals(frame)
+	}
+	vars := make([]Variable, 0, len(frame.Code.Varnames))
+	for i, name := range frame.Code.Varnames {
+		if i < len(frame.Locals) {
+			vars = append(vars, Variable{Name: name, Value: frame.Locals[i]})
+		}
+	}
+	return vars
+}
+
+// Globals returns the global variables of frame sorted by name.
+func Globals(frame *vm.Frame) []Variable {
+	vars := make([]Variable, 0, frame.Globals.Len())
+	frame.Globals.Range(func(name string, value object.Object) {
+		vars = append(vars, Variable{Name: name, Value: value})
+	})
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
+
+func isModuleFrame(frame *vm.Frame) bool {
+	return frame.Code.Name == "<module>" && len(frame.Code.Varnames) == 0
+}
+
+// Lookup resolves name in frame the way the VM does: locals, then globals,
+// then builtins.
+func (d *Debugger) Lookup(frame *vm.Frame, name string) (object.Object, bool) {
+	for i, varname := range frame.Code.Varnames {
+		if varname == name && i < len(frame.Locals) {
+			return frame.Locals[i], true
+		}
+	}
+	if value, ok := frame.Globals.Get(name); ok {
+		return value, true
+	}
+	return frame.Builtins.Get(name)
+}
+
+// Eval evaluates a Python expression in the scope of frame. Breakpoints
+// are ignored while it runs.
+func (d *Debugger) Eval(frame *vm.Frame, expr string) (object.Object, error) {
+	module, err := parser.ParseFile("<debugger>", expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(module.Body) != 1 {
+		return nil, fmt.Errorf("expected a single expression")
+	}
+	if _, ok := module.Body[0].(*ast.ExprStmt); !ok {
+		return nil, fmt.Errorf("expected an expression, got %s", module.Body[0])
+	}
+	code, err := compiler.CompileFile(module, "<debugger>")
+	if err != nil {
+		return nil, err
+	}
+
+	d.evaluating = true
+	defer func() { d.evaluating = false }()
+	return d.vm.Eval(frame, code)
+}
@@ -0,0 +1,100 @@
+package lexer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyntaxError describes a problem in the source text at a specific position.
+type SyntaxError struct {
+	Filename   string
+	Line       int
+	Column     int
+	Text       string // offending token text, if any
+	Msg        string
+	SourceLine string // full text of the offending line, if known
+}
+
+func (e *SyntaxError) Error() string {
+	return e.format("SyntaxError")
+}
+
+// Excerpt returns the offending source line with a caret under the error
+// column, or an empty string if the source line is unknown.
+func (e *SyntaxError) Excerpt() string {
+	return e.excerpt()
+}
+
+// Detailed renders the error the way CPython reports syntax errors.
+func (e *SyntaxError) Detailed() string {
+	return e.detailed("SyntaxError")
+}
+
+func (e *SyntaxError) filename() string {
+	if e.Filename == "" {
+		return "<input>"
+	}
+	return e.Filename
+}
+
+func (e *SyntaxError) format(kind string) string {
+	msg := e.Msg
+	if e.Text != "" && !strings.Contains(msg, e.Text) {
+		msg = fmt.Sprintf("%s (near %q)", msg, e.Text)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.filename(), e.Line, e.Column, kind, msg)
+}
+
+func (e *SyntaxError) excerpt() string {
+	if e.SourceLine == "" {
+		return ""
+	}
+	line := strings.TrimRight(e.SourceLine, "\r\n")
+	column := e.Column
+	if column < 1 {
+		column = 1
+	}
+	// Keep tabs in the caret line so it lines up with the source.
+	var pad strings.Builder
+	for i, ch := range []rune(line) {
+		if i >= column-1 {
+			break
+		}
+		if ch == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	return line + "\n" + pad.String() + "^"
+}
+
+func (e *SyntaxError) detailed(kind string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "  File \"%s\", line %d\n", e.filename(), e.Line)
+	if excerpt := e.excerpt(); excerpt != "" {
+		for _, line := range strings.Split(excerpt, "\n") {
+			sb.WriteString("    " + line + "\n")
+		}
+	}
+	fmt.Fprintf(&sb, "%s: %s", kind, e.Msg)
+	return sb.String()
+}
+
+// IndentationError is a SyntaxError caused by inconsistent indentation. It
+// unwraps to its SyntaxError, so errors.As matches either type.
+type IndentationError struct {
+	SyntaxError
+}
+
+func (e *IndentationError) Error() string {
+	return e.format("IndentationError")
+}
+
+func (e *IndentationError) Detailed() string {
+	return e.detailed("IndentationError")
+}
+
+func (e *IndentationError) Unwrap() error {
+	return &e.SyntaxError
+}
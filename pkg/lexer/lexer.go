@@ -1,6 +1,8 @@
 package lexer
 
 import (
+	"fmt"
+	"strings"
 	"unicode"
 )
 
@@ -10,9 +12,19 @@ type Lexer struct {
 	line     int
 	column   int
 
-	indentStack    []int
+	indentStack    []indent
 	atLineStart    bool
 	pendingDedents int
+
+	filename string
+	errors   []error
+}
+
+// indent is one level of indentation: its width with tabs counted as eight
+// columns, and the characters that make it up.
+type indent struct {
+	width int
+	chars string
 }
 
 func NewLexer(src string) *Lexer {
@@ -22,11 +34,61 @@ func NewLexer(src string) *Lexer {
 		position:    0,
 		line:        1,
 		column:      1,
-		indentStack: []int{0},
+		indentStack: []indent{{}},
 		atLineStart: true,
 	}
 }
 
+// SetFilename sets the file name reported in syntax errors.
+func (l *Lexer) SetFilename(filename string) {
+	l.filename = filename
+}
+
+// Errors returns the syntax errors found so far, in source order. The lexer
+// keeps going after an error, emitting an ILLEGAL token in its place.
+func (l *Lexer) Errors() []error {
+	return l.errors
+}
+
+// SourceLine returns the text of the given 1-based line.
+func (l *Lexer) SourceLine(line int) string {
+	current := 1
+	start := 0
+	for i, ch := range l.src {
+		if current == line && ch == '\n' {
+			return string(l.src[start:i])
+		}
+		if ch == '\n' {
+			current++
+			start = i + 1
+		}
+	}
+	if current == line {
+		return string(l.src[start:])
+	}
+	return ""
+}
+
+func (l *Lexer) newSyntaxError(line, column int, text, format string, args ...interface{}) SyntaxError {
+	return SyntaxError{
+		Filename:   l.filename,
+		Line:       line,
+		Column:     column,
+		Text:       text,
+		Msg:        fmt.Sprintf(format, args...),
+		SourceLine: l.SourceLine(line),
+	}
+}
+
+func (l *Lexer) syntaxError(line, column int, text, format string, args ...interface{}) {
+	err := l.newSyntaxError(line, column, text, format, args...)
+	l.errors = append(l.errors, &err)
+}
+
+func (l *Lexer) indentationError(line, column int, format string, args ...interface{}) {
+	l.errors = append(l.errors, &IndentationError{SyntaxError: l.newSyntaxError(line, column, "", format, args...)})
+}
+
 func (l *Lexer) peekChar() rune {
 	if l.position >= len(l.src) {
 		return 0
@@ -63,10 +125,15 @@ func (l *Lexer) skipWhitespace() {
 
 func (l *Lexer) readString(quote rune) string {
 	var result []rune
+	line, column := l.line, l.column-1
 
 	for {
 		ch := l.peekChar()
-		if ch == 0 || ch == quote {
+		if ch == 0 {
+			l.syntaxError(line, column, "", "EOF while scanning string literal")
+			break
+		}
+		if ch == quote {
 			break
 		}
 		if ch == '\\' {
@@ -171,15 +238,19 @@ func (l *Lexer) handleIndentation() *Token {
 
 	l.atLineStart = false
 	start := l.column
+	begin := l.position
 	indentLevel := 0
+	sawSpace, sawTab := false, false
 
 	for {
 		ch := l.peekChar()
 		if ch == ' ' {
 			indentLevel++
+			sawSpace = true
 			l.readChar()
 		} else if ch == '\t' {
 			indentLevel += 8
+			sawTab = true
 			l.readChar()
 		} else {
 			break
@@ -190,24 +261,38 @@ func (l *Lexer) handleIndentation() *Token {
 		return nil
 	}
 
-	currentIndent := l.indentStack[len(l.indentStack)-1]
+	chars := string(l.src[begin:l.position])
+	// mixed is reported once per line, even if it also disagrees with the
+	// enclosing blocks.
+	mixed := sawSpace && sawTab
+	if mixed {
+		l.indentationError(l.line, start, "inconsistent use of tabs and spaces in indentation")
+	}
+
+	current := l.indentStack[len(l.indentStack)-1]
 
-	if indentLevel > currentIndent {
-		l.indentStack = append(l.indentStack, indentLevel)
+	if indentLevel > current.width {
+		// A nested block must start with the indentation of its parent.
+		if !mixed && !strings.HasPrefix(chars, current.chars) {
+			l.indentationError(l.line, start, "inconsistent use of tabs and spaces in indentation")
+		}
+		l.indentStack = append(l.indentStack, indent{width: indentLevel, chars: chars})
 		return &Token{
 			Type:   INDENT,
 			Lexeme: "",
 			Line:   l.line,
 			Column: start,
 		}
-	} else if indentLevel < currentIndent {
+	} else if indentLevel < current.width {
 		dedentCount := 0
-		for len(l.indentStack) > 1 && l.indentStack[len(l.indentStack)-1] > indentLevel {
+		for len(l.indentStack) > 1 && l.indentStack[len(l.indentStack)-1].width > indentLevel {
 			l.indentStack = l.indentStack[:len(l.indentStack)-1]
 			dedentCount++
 		}
 
-		if len(l.indentStack) == 0 || l.indentStack[len(l.indentStack)-1] != indentLevel {
+		outer := l.indentStack[len(l.indentStack)-1]
+		if outer.width != indentLevel {
+			l.indentationError(l.line, start, "unindent does not match any outer indentation level")
 			return &Token{
 				Type:   ILLEGAL,
 				Lexeme: "indentation error",
@@ -215,6 +300,9 @@ func (l *Lexer) handleIndentation() *Token {
 				Column: start,
 			}
 		}
+		if !mixed && outer.chars != chars {
+			l.indentationError(l.line, start, "inconsistent use of tabs and spaces in indentation")
+		}
 
 		l.pendingDedents = dedentCount - 1
 		return &Token{
@@ -223,12 +311,29 @@ func (l *Lexer) handleIndentation() *Token {
 			Line:   l.line,
 			Column: start,
 		}
+	} else if !mixed && current.chars != chars {
+		l.indentationError(l.line, start, "inconsistent use of tabs and spaces in indentation")
 	}
 
 	return nil
 }
 
 func (l *Lexer) NextToken() Token {
+	tok := l.nextToken()
+	if tok.EndLine == 0 {
+		switch tok.Type {
+		case INDENT, DEDENT, EOF:
+			tok.EndLine, tok.EndColumn = tok.Line, tok.Column
+		case NEWLINE:
+			tok.EndLine, tok.EndColumn = tok.Line, tok.Column+1
+		default:
+			tok.EndLine, tok.EndColumn = l.line, l.column
+		}
+	}
+	return tok
+}
+
+func (l *Lexer) nextToken() Token {
 	if token := l.handleIndentation(); token != nil {
 		return *token
 	}
@@ -267,6 +372,7 @@ func (l *Lexer) NextToken() Token {
 			l.readChar()
 			return Token{Type: NOT_EQ, Lexeme: "!=", Line: line, Column: column}
 		}
+		l.syntaxError(line, column, "!", "invalid syntax")
 		return Token{Type: ILLEGAL, Lexeme: "!", Line: line, Column: column}
 	case '<':
 		if l.peekChar() == '=' {
@@ -279,6 +385,10 @@ func (l *Lexer) NextToken() Token {
 			l.readChar()
 			return Token{Type: GTE, Lexeme: ">=", Line: line, Column: column}
 		}
+		if l.peekChar() == '>' {
+			l.readChar()
+			return Token{Type: RSHIFT, Lexeme: ">>", Line: line, Column: column}
+		}
 		return Token{Type: GT, Lexeme: ">", Line: line, Column: column}
 	case '+':
 		if l.peekChar() == '=' {
@@ -300,6 +410,8 @@ func (l *Lexer) NextToken() Token {
 		return Token{Type: MODULO, Lexeme: "%", Line: line, Column: column}
 	case ',':
 		return Token{Type: COMMA, Lexeme: ",", Line: line, Column: column}
+	case '.':
+		return Token{Type: DOT, Lexeme: ".", Line: line, Column: column}
 	case ':':
 		return Token{Type: COLON, Lexeme: ":", Line: line, Column: column}
 	case ';':
@@ -332,6 +444,7 @@ func (l *Lexer) NextToken() Token {
 			tokenType := LookupIdent(lexeme)
 			return Token{Type: tokenType, Lexeme: lexeme, Line: line, Column: column}
 		}
+		l.syntaxError(line, column, string(ch), "invalid character %q", ch)
 		return Token{Type: ILLEGAL, Lexeme: string(ch), Line: line, Column: column}
 	}
 }
@@ -1,6 +1,9 @@
 package lexer
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+)
 
 type TokenType int
 
@@ -28,12 +31,14 @@ const (
 	GT
 	LTE
 	GTE
+	RSHIFT
 
 	AND
 	OR
 	NOT
 
 	COMMA
+	DOT
 	COLON
 	SEMICOLON
 	LPAREN
@@ -61,6 +66,8 @@ const (
 	NONE
 	RANGE
 	PASS
+	IMPORT
+	IS
 )
 
 var keywords = map[string]TokenType{
@@ -81,6 +88,8 @@ var keywords = map[string]TokenType{
 	"not":    NOT,
 	"range":  RANGE,
 	"pass":   PASS,
+	"import": IMPORT,
+	"is":     IS,
 }
 
 type Token struct {
@@ -88,6 +97,11 @@ type Token struct {
 	Lexeme string
 	Line   int
 	Column int
+
+	// EndLine and EndColumn give the position just past the token's last
+	// character in the source.
+	EndLine   int
+	EndColumn int
 }
 
 func (t Token) String() string {
@@ -136,6 +150,8 @@ func (tt TokenType) String() string {
 		return "LTE"
 	case GTE:
 		return "GTE"
+	case RSHIFT:
+		return "RSHIFT"
 	case AND:
 		return "AND"
 	case OR:
@@ -144,6 +160,8 @@ func (tt TokenType) String() string {
 		return "NOT"
 	case COMMA:
 		return "COMMA"
+	case DOT:
+		return "DOT"
 	case COLON:
 		return "COLON"
 	case SEMICOLON:
@@ -194,11 +212,25 @@ func (tt TokenType) String() string {
 		return "RANGE"
 	case PASS:
 		return "PASS"
+	case IMPORT:
+		return "IMPORT"
+	case IS:
+		return "IS"
 	default:
 		return "UNKNOWN"
 	}
 }
 
+// Keywords returns the reserved words of the language in sorted order.
+func Keywords() []string {
+	names := make([]string, 0, len(keywords))
+	for name := range keywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func LookupIdent(ident string) TokenType {
 	if tok, ok := keywords[ident]; ok {
 		return tok
@@ -0,0 +1,505 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+)
+
+type bindingKind int
+
+const (
+	bindVariable bindingKind = iota
+	bindArgument
+	bindLoop
+	bindImport
+)
+
+type local struct {
+	name string
+	pos  ast.Position
+	kind bindingKind
+	used bool
+}
+
+// scope is the module or a function. As in the compiler, a name becomes
+// local to a function at its first binding in source order; reading it
+// before that loads the global of that name.
+type scope struct {
+	fn     *ast.FuncDef // nil for the module
+	locals map[string]*local
+	order  []*local
+	bound  map[string]bool // bound earlier in source order, or in an enclosing loop
+	later  map[string]bool // bound anywhere in the function
+	shadow map[string]bool // builtins already reported as shadowed
+}
+
+func newScope(fn *ast.FuncDef) *scope {
+	return &scope{
+		fn:     fn,
+		locals: make(map[string]*local),
+		bound:  make(map[string]bool),
+		later:  make(map[string]bool),
+		shadow: make(map[string]bool),
+	}
+}
+
+// state is what is known at a point of the code: the names assigned on
+// every path that leads there, and whether any path does.
+type state struct {
+	assigned map[string]bool
+	live     bool
+}
+
+func (s state) copy() state {
+	assigned := make(map[string]bool, len(s.assigned))
+	for name := range s.assigned {
+		assigned[name] = true
+	}
+	return state{assigned: assigned, live: s.live}
+}
+
+// merge joins the states at the end of two branches.
+func merge(a, b state) state {
+	if !a.live {
+		return b
+	}
+	if !b.live {
+		return a
+	}
+	for name := range a.assigned {
+		if !b.assigned[name] {
+			delete(a.assigned, name)
+		}
+	}
+	return a
+}
+
+type checker struct {
+	*Linter
+	filename string
+	problems []Problem
+	globals  map[string]int          // number of bindings of each global
+	defs     map[string]*ast.FuncDef // the function bound to a global
+	nested   map[string]bool         // globals bound only by defs inside functions
+}
+
+func newChecker(l *Linter, filename string, module *ast.Module) *checker {
+	c := &checker{
+		Linter:   l,
+		filename: filename,
+		globals:  make(map[string]int),
+		defs:     make(map[string]*ast.FuncDef),
+		nested:   make(map[string]bool),
+	}
+	c.collectGlobals(module.Body, false)
+	return c
+}
+
+// collectGlobals counts the bindings of module-level names and of every
+// function, which the compiler stores as a global wherever it is defined.
+func (c *checker) collectGlobals(stmts []ast.Stmt, inFunction bool) {
+	bindGlobal := func(name string) {
+		if !inFunction {
+			c.globals[name]++
+			delete(c.nested, name)
+		}
+	}
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.FuncDef:
+			if inFunction && c.globals[s.Name] == 0 {
+				c.nested[s.Name] = true
+			}
+			c.globals[s.Name]++
+			c.defs[s.Name] = s
+			c.collectGlobals(s.Body, true)
+		case *ast.AssignStmt:
+			if name, ok := s.Target.(*ast.Name); ok {
+				bindGlobal(name.Id)
+			}
+		case *ast.AugAssignStmt:
+			if name, ok := s.Target.(*ast.Name); ok {
+				bindGlobal(name.Id)
+			}
+		case *ast.ForStmt:
+			if name, ok := s.Target.(*ast.Name); ok {
+				bindGlobal(name.Id)
+			}
+			c.collectGlobals(s.Body, inFunction)
+		case *ast.ImportStmt:
+			for _, name := range s.Names {
+				bindGlobal(name)
+			}
+		case *ast.IfStmt:
+			c.collectGlobals(s.Body, inFunction)
+			c.collectGlobals(s.Orelse, inFunction)
+		case *ast.WhileStmt:
+			c.collectGlobals(s.Body, inFunction)
+		}
+	}
+}
+
+func (c *checker) report(pos ast.Position, rule Rule, format string, args ...interface{}) {
+	if !c.Enabled(rule) {
+		return
+	}
+	c.problems = append(c.problems, Problem{
+		Filename: c.filename,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Rule:     rule,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *checker) checkModule(module *ast.Module) {
+	c.checkBlock(module.Body, newScope(nil), state{assigned: make(map[string]bool), live: true})
+}
+
+func (c *checker) checkFunction(fn *ast.FuncDef) {
+	sc := newScope(fn)
+	boundNames(fn.Body, sc.later)
+	st := state{assigned: make(map[string]bool), live: true}
+	for i, arg := range fn.Args {
+		pos := fn.Position
+		if i < len(fn.ArgPositions) {
+			pos = fn.ArgPositions[i]
+		}
+		c.bind(arg, pos, bindArgument, sc, &st)
+	}
+	c.checkBlock(fn.Body, sc, st)
+
+	for _, v := range sc.order {
+		if v.used || strings.HasPrefix(v.name, "_") {
+			continue
+		}
+		switch v.kind {
+		case bindArgument:
+			c.report(v.pos, RuleUnusedArgument, "argument %s of %s() is not used", v.name, fn.Name)
+		case bindVariable:
+			c.report(v.pos, RuleUnusedVariable, "local variable %s is assigned but never used", v.name)
+		case bindImport:
+			c.report(v.pos, RuleUnusedVariable, "%s is imported but not used", v.name)
+		}
+	}
+}
+
+// boundNames adds the names that stmts bind, outside nested functions.
+func boundNames(stmts []ast.Stmt, names map[string]bool) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.AssignStmt:
+			if name, ok := s.Target.(*ast.Name); ok {
+				names[name.Id] = true
+			}
+		case *ast.AugAssignStmt:
+			if name, ok := s.Target.(*ast.Name); ok {
+				names[name.Id] = true
+			}
+		case *ast.ForStmt:
+			if name, ok := s.Target.(*ast.Name); ok {
+				names[name.Id] = true
+			}
+			boundNames(s.Body, names)
+		case *ast.ImportStmt:
+			for _, name := range s.Names {
+				names[name] = true
+			}
+		case *ast.IfStmt:
+			boundNames(s.Body, names)
+			boundNames(s.Orelse, names)
+		case *ast.WhileStmt:
+			boundNames(s.Body, names)
+		}
+	}
+}
+
+func (c *checker) checkBlock(stmts []ast.Stmt, sc *scope, st state) state {
+	reported := !st.live
+	for _, stmt := range stmts {
+		if !st.live && !reported {
+			c.report(stmt.Pos(), RuleUnreachable, "unreachable code")
+			reported = true
+		}
+		st = c.checkStmt(stmt, sc, st)
+	}
+	return st
+}
+
+func (c *checker) checkStmt(stmt ast.Stmt, sc *scope, st state) state {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		c.checkExpr(s.Value, sc, st)
+		c.assign(s.Target, bindVariable, sc, &st)
+	case *ast.AugAssignStmt:
+		if s.Op != "+=" && s.Op != "-=" {
+			c.report(s.Pos(), RuleUnsupported, "augmented assignment %s is not supported", s.Op)
+		}
+		name, ok := s.Target.(*ast.Name)
+		if !ok {
+			c.report(s.Target.Pos(), RuleUnsupported, "cannot use %s in augmented assignment", describe(s.Target))
+			c.checkExpr(s.Target, sc, st)
+			c.checkExpr(s.Value, sc, st)
+			break
+		}
+		// In a function the compiler makes the target local before it
+		// loads it.
+		if sc.fn != nil && sc.locals[name.Id] == nil {
+			c.declare(name.Id, name.Pos(), bindVariable, sc)
+			sc.locals[name.Id].used = true
+			if st.live {
+				c.report(name.Pos(), RuleUsedBeforeAssignment, "local variable %s is used before it is assigned", name.Id)
+			}
+		} else {
+			c.load(name, sc, st)
+		}
+		c.checkExpr(s.Value, sc, st)
+		c.bind(name.Id, name.Pos(), bindVariable, sc, &st)
+	case *ast.ExprStmt:
+		c.checkExpr(s.Expr, sc, st)
+	case *ast.PrintStmt:
+		if s.Dest != nil {
+			c.checkExpr(s.Dest, sc, st)
+		}
+		for _, value := range s.Values {
+			c.checkExpr(value, sc, st)
+		}
+	case *ast.IfStmt:
+		c.checkExpr(s.Test, sc, st)
+		body := c.checkBlock(s.Body, sc, st.copy())
+		orelse := c.checkBlock(s.Orelse, sc, st.copy())
+		st = merge(body, orelse)
+	case *ast.WhileStmt:
+		c.checkExpr(s.Test, sc, st)
+		boundNames(s.Body, sc.bound)
+		c.checkBlock(s.Body, sc, st.copy())
+		// There is no break, so only return leaves while True.
+		if isTrue(s.Test) {
+			st.live = false
+		}
+	case *ast.ForStmt:
+		c.checkExpr(s.Iter, sc, st)
+		boundNames(s.Body, sc.bound)
+		body := st.copy()
+		if _, ok := s.Target.(*ast.Name); !ok {
+			c.report(s.Target.Pos(), RuleUnsupported, "cannot use %s as a for target", describe(s.Target))
+		}
+		c.assign(s.Target, bindLoop, sc, &body)
+		c.checkBlock(s.Body, sc, body)
+	case *ast.FuncDef:
+		c.shadows(s.Name, s.NamePosition, sc)
+		if sc.fn == nil {
+			st.assigned[s.Name] = true
+			sc.bound[s.Name] = true
+		}
+		c.checkFunction(s)
+	case *ast.ReturnStmt:
+		if s.Value != nil {
+			c.checkExpr(s.Value, sc, st)
+		}
+		st.live = false
+	case *ast.ImportStmt:
+		for i, name := range s.Names {
+			pos := s.Position
+			if i < len(s.NamePositions) {
+				pos = s.NamePositions[i]
+			}
+			c.bind(name, pos, bindImport, sc, &st)
+		}
+	case *ast.PassStmt:
+	default:
+		c.report(stmt.Pos(), RuleUnsupported, "%s is not supported", stmt)
+	}
+	return st
+}
+
+// assign binds target, which may be any expression.
+func (c *checker) assign(target ast.Expr, kind bindingKind, sc *scope, st *state) {
+	switch t := target.(type) {
+	case *ast.Name:
+		c.bind(t.Id, t.Pos(), kind, sc, st)
+	case *ast.Subscript:
+		c.checkExpr(t.Value, sc, *st)
+		c.checkExpr(t.Slice, sc, *st)
+	default:
+		if kind != bindLoop {
+			c.report(t.Pos(), RuleUnsupported, "cannot assign to %s", describe(t))
+		}
+		c.checkExpr(t, sc, *st)
+	}
+}
+
+func (c *checker) bind(name string, pos ast.Position, kind bindingKind, sc *scope, st *state) {
+	if sc.fn != nil {
+		c.declare(name, pos, kind, sc)
+	} else {
+		c.shadows(name, pos, sc)
+	}
+	st.assigned[name] = true
+	sc.bound[name] = true
+}
+
+// declare makes name local to the function of sc.
+func (c *checker) declare(name string, pos ast.Position, kind bindingKind, sc *scope) {
+	if sc.locals[name] != nil {
+		return
+	}
+	v := &local{name: name, pos: pos, kind: kind}
+	sc.locals[name] = v
+	sc.order = append(sc.order, v)
+	c.shadows(name, pos, sc)
+}
+
+func (c *checker) shadows(name string, pos ast.Position, sc *scope) {
+	if !c.builtins[name] || sc.shadow[name] {
+		return
+	}
+	sc.shadow[name] = true
+	c.report(pos, RuleShadowedBuiltin, "%s shadows the builtin %s", name, name)
+}
+
+// load checks a read of name at a point where st holds.
+func (c *checker) load(name *ast.Name, sc *scope, st state) {
+	id := name.Id
+	if sc.fn != nil {
+		if v := sc.locals[id]; v != nil {
+			v.used = true
+			if st.live && !st.assigned[id] {
+				c.usedBeforeAssignment(name, "local variable "+id, sc)
+			}
+			return
+		}
+		switch {
+		case c.globals[id] > 0 || c.builtins[id]:
+		case sc.later[id]:
+			// The compiler loads the global, since the name is not local yet.
+			c.report(name.Pos(), RuleUsedBeforeAssignment, "%s is used before it is assigned", id)
+		default:
+			c.report(name.Pos(), RuleUndefined, "undefined name %s", id)
+		}
+		return
+	}
+
+	switch {
+	case st.assigned[id] || !st.live:
+	case c.globals[id] > 0 && !c.nested[id]:
+		if !c.builtins[id] {
+			c.usedBeforeAssignment(name, id, sc)
+		}
+	case c.globals[id] > 0 || c.builtins[id]:
+	default:
+		c.report(name.Pos(), RuleUndefined, "undefined name %s", id)
+	}
+}
+
+func (c *checker) usedBeforeAssignment(name *ast.Name, what string, sc *scope) {
+	if sc.bound[name.Id] {
+		c.report(name.Pos(), RuleUsedBeforeAssignment, "%s may be used before it is assigned", what)
+	} else {
+		c.report(name.Pos(), RuleUsedBeforeAssignment, "%s is used before it is assigned", what)
+	}
+}
+
+var (
+	binaryOps  = map[string]bool{"+": true, "-": true, "*": true, "/": true, "%": true}
+	unaryOps   = map[string]bool{"+": true, "-": true, "not": true}
+	compareOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true, "is": true, "is not": true}
+)
+
+func (c *checker) checkExpr(expr ast.Expr, sc *scope, st state) {
+	ast.Inspect(expr, func(node ast.Node) bool {
+		switch e := node.(type) {
+		case *ast.Name:
+			c.load(e, sc, st)
+		case *ast.Call:
+			c.checkCall(e, sc)
+		case *ast.BinaryOp:
+			if !binaryOps[e.Op] {
+				c.report(e.Pos(), RuleUnsupported, "operator %s is not supported", e.Op)
+			}
+		case *ast.UnaryOp:
+			if !unaryOps[e.Op] {
+				c.report(e.Pos(), RuleUnsupported, "unary operator %s is not supported", e.Op)
+			}
+		case *ast.BoolOp:
+			if len(e.Values) < 2 {
+				c.report(e.Pos(), RuleUnsupported, "%s needs at least 2 values", e.Op)
+			}
+		case *ast.Compare:
+			for _, op := range e.Ops {
+				if !compareOps[op] {
+					c.report(e.Pos(), RuleUnsupported, "comparison %s is not supported", op)
+				}
+			}
+			if len(e.Ops) > 1 {
+				c.report(e.Pos(), RuleUnsupported, "chained comparison is evaluated as (a %s b) %s c, not as a %s b and b %s c",
+					e.Ops[0], e.Ops[1], e.Ops[0], e.Ops[1])
+			}
+		}
+		return true
+	})
+}
+
+// checkCall checks the number of arguments of a call to a function that is
+// the only binding of a global.
+func (c *checker) checkCall(call *ast.Call, sc *scope) {
+	name, ok := call.Func.(*ast.Name)
+	if !ok || c.globals[name.Id] != 1 {
+		return
+	}
+	if sc.fn != nil && sc.locals[name.Id] != nil {
+		return
+	}
+	fn := c.defs[name.Id]
+	if fn == nil || len(fn.Args) == len(call.Args) {
+		return
+	}
+	given := "were"
+	if len(call.Args) == 1 {
+		given = "was"
+	}
+	c.report(call.Pos(), RuleArity, "%s() takes %s but %d %s given", fn.Name, plural(len(fn.Args), "argument"), len(call.Args), given)
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func describe(expr ast.Expr) string {
+	switch expr.(type) {
+	case *ast.Attribute:
+		return "an attribute"
+	case *ast.Call:
+		return "a function call"
+	case *ast.Subscript:
+		return "a subscript"
+	case *ast.Name:
+		return "a name"
+	}
+	return "an expression"
+}
+
+// isTrue reports whether expr is a constant that is always true.
+func isTrue(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.NameConstant:
+		return e.Value == true
+	case *ast.Num:
+		switch n := e.N.(type) {
+		case int:
+			return n != 0
+		case int64:
+			return n != 0
+		case float64:
+			return n != 0
+		}
+	case *ast.Str:
+		return e.S != ""
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+// Package lint reports likely mistakes in a Python module by looking at its
+// AST before it runs: names that are not defined when they are read, unused
+// variables and arguments, unreachable code, calls with the wrong number of
+// arguments and constructs the compiler does not support.
+package lint
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/parser"
+)
+
+// Rule names one kind of problem, so that it can be enabled or disabled.
+type Rule string
+
+const (
+	RuleUndefined            Rule = "undefined"
+	RuleUsedBeforeAssignment Rule = "used-before-assignment"
+	RuleUnusedVariable       Rule = "unused-variable"
+	RuleUnusedArgument       Rule = "unused-argument"
+	RuleUnreachable          Rule = "unreachable"
+	RuleArity                Rule = "call-arity"
+	RuleShadowedBuiltin      Rule = "shadowed-builtin"
+	RuleUnsupported          Rule = "unsupported"
+
+	// RuleSyntax reports a source that does not parse. It cannot be
+	// disabled.
+	RuleSyntax Rule = "syntax"
+)
+
+// Rules lists every rule, in the order they are documented.
+var Rules = []Rule{
+	RuleUndefined,
+	RuleUsedBeforeAssignment,
+	RuleUnusedVariable,
+	RuleUnusedArgument,
+	RuleUnreachable,
+	RuleArity,
+	RuleShadowedBuiltin,
+	RuleUnsupported,
+}
+
+var ruleDocs = map[Rule]string{
+	RuleUndefined:            "a name that is not a variable, function or builtin",
+	RuleUsedBeforeAssignment: "a name read before it is assigned on every path",
+	RuleUnusedVariable:       "a local variable that is assigned but never read",
+	RuleUnusedArgument:       "a function argument that is never read",
+	RuleUnreachable:          "code after return, or after a while loop that never ends",
+	RuleArity:                "a call to a function of the module with the wrong number of arguments",
+	RuleShadowedBuiltin:      "a variable, argument or function named after a builtin",
+	RuleUnsupported:          "a construct the compiler rejects or compiles differently from Python",
+}
+
+// Doc describes what the rule reports.
+func (r Rule) Doc() string {
+	return ruleDocs[r]
+}
+
+// ParseRule returns the rule called name.
+func ParseRule(name string) (Rule, error) {
+	if _, ok := ruleDocs[Rule(name)]; !ok {
+		return "", fmt.Errorf("unknown rule %q", name)
+	}
+	return Rule(name), nil
+}
+
+// Problem is one finding, located at the start of the code it is about.
+type Problem struct {
+	Filename string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Rule     Rule   `json:"rule"`
+	Message  string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", p.Filename, p.Line, p.Column, p.Message, p.Rule)
+}
+
+// Linter checks modules against the enabled rules. All rules are enabled
+// by default.
+type Linter struct {
+	builtins map[string]bool
+	disabled map[Rule]bool
+}
+
+// NewLinter returns a linter for code run with the given builtins, such as
+// those of vm.NewVM().BuiltinNames().
+func NewLinter(builtins []string) *Linter {
+	l := &Linter{builtins: make(map[string]bool), disabled: make(map[Rule]bool)}
+	for _, name := range builtins {
+		l.builtins[name] = true
+	}
+	return l
+}
+
+// SetEnabled turns rule on or off.
+func (l *Linter) SetEnabled(rule Rule, enabled bool) {
+	l.disabled[rule] = !enabled
+}
+
+// Enabled reports whether rule is on.
+func (l *Linter) Enabled(rule Rule) bool {
+	return rule == RuleSyntax || !l.disabled[rule]
+}
+
+// Check returns the problems found in module, sorted by position.
+func (l *Linter) Check(filename string, module *ast.Module) []Problem {
+	c := newChecker(l, filename, module)
+	c.checkModule(module)
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i], c.problems[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return c.problems
+}
+
+// CheckSource parses source and checks it. A source that does not parse
+// yields its syntax errors.
+func (l *Linter) CheckSource(filename, source string) []Problem {
+	module, err := parser.ParseFile(filename, source)
+	if err != nil {
+		return syntaxProblems(filename, err)
+	}
+	return l.Check(filename, module)
+}
+
+func syntaxProblems(filename string, err error) []Problem {
+	errs, ok := err.(parser.ErrorList)
+	if !ok {
+		errs = parser.ErrorList{err}
+	}
+	problems := make([]Problem, 0, len(errs))
+	for _, err := range errs {
+		p := Problem{Filename: filename, Line: 1, Column: 1, Rule: RuleSyntax, Message: err.Error()}
+		var syntaxErr *lexer.SyntaxError
+		var indentErr *lexer.IndentationError
+		switch {
+		case errors.As(err, &indentErr):
+			syntaxErr = &indentErr.SyntaxError
+			p.Message = "IndentationError: " + indentErr.Msg
+		case errors.As(err, &syntaxErr):
+			p.Message = "SyntaxError: " + syntaxErr.Msg
+		}
+		if syntaxErr != nil {
+			p.Line, p.Column = syntaxErr.Line, syntaxErr.Column
+		}
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+// RuleList formats the rules and what they report, one per line.
+func RuleList() string {
+	var b strings.Builder
+	for _, rule := range Rules {
+		fmt.Fprintf(&b, "  %-24s %s\n", rule, rule.Doc())
+	}
+	return b.String()
+}
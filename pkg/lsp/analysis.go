@@ -0,0 +1,308 @@
+package lsp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+)
+
+type symbolKind int
+
+const (
+	kindVariable symbolKind = iota
+	kindFunction
+	kindParameter
+	kindModule
+	kindBuiltin
+)
+
+// span is a half-open source range in AST coordinates.
+type span struct {
+	start, end ast.Position
+}
+
+func (s span) contains(pos ast.Position) bool {
+	return !before(pos, s.start) && before(pos, s.end)
+}
+
+func before(a, b ast.Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+}
+
+// symbol is a name bound in a scope, with every place it is used.
+type symbol struct {
+	name  string
+	kind  symbolKind
+	def   span
+	fn    *ast.FuncDef // the function, for kindFunction
+	scope *ast.FuncDef // enclosing function, nil for globals and builtins
+	refs  []span
+}
+
+func (s *symbol) signature() string {
+	switch s.kind {
+	case kindFunction:
+		return fmt.Sprintf("def %s(%s)", s.name, strings.Join(s.fn.Args, ", "))
+	case kindParameter:
+		return fmt.Sprintf("(parameter) %s of %s()", s.name, s.scope.Name)
+	case kindModule:
+		return fmt.Sprintf("(module) %s", s.name)
+	case kindBuiltin:
+		return fmt.Sprintf("(builtin) %s", s.name)
+	}
+	if s.scope != nil {
+		return fmt.Sprintf("(local variable) %s", s.name)
+	}
+	return fmt.Sprintf("(variable) %s", s.name)
+}
+
+type occurrence struct {
+	span
+	sym *symbol
+}
+
+// analysis resolves every name in a module the way the compiler does:
+// module-level bindings and all functions are globals; inside a function,
+// parameters and names assigned earlier in the body are locals and every
+// other name is global or builtin. There are no closures.
+type analysis struct {
+	globals     map[string]*symbol
+	builtins    map[string]*symbol
+	builtinSet  map[string]bool
+	symbols     []*symbol // definitions in source order, builtins excluded
+	occurrences []occurrence
+	functions   []*ast.FuncDef
+}
+
+type scope struct {
+	fn     *ast.FuncDef
+	locals map[string]*symbol
+}
+
+func analyze(module *ast.Module, builtins []string) *analysis {
+	a := &analysis{
+		globals:    make(map[string]*symbol),
+		builtins:   make(map[string]*symbol),
+		builtinSet: make(map[string]bool),
+	}
+	for _, name := range builtins {
+		a.builtinSet[name] = true
+	}
+	a.collectGlobals(module.Body, false)
+	a.visitStmts(module.Body, &scope{})
+	return a
+}
+
+// collectGlobals declares module-level bindings and every function, so that
+// functions can refer to globals defined after them.
+func (a *analysis) collectGlobals(stmts []ast.Stmt, inFunction bool) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.FuncDef:
+			a.declareGlobal(s.Name, kindFunction, nameSpan(s.NamePosition, s.Name), s)
+			a.functions = append(a.functions, s)
+			a.collectGlobals(s.Body, true)
+		case *ast.AssignStmt:
+			if name, ok := s.Target.(*ast.Name); ok && !inFunction {
+				a.declareGlobal(name.Id, kindVariable, nodeSpan(name), nil)
+			}
+		case *ast.AugAssignStmt:
+			if name, ok := s.Target.(*ast.Name); ok && !inFunction {
+				a.declareGlobal(name.Id, kindVariable, nodeSpan(name), nil)
+			}
+		case *ast.ForStmt:
+			if name, ok := s.Target.(*ast.Name); ok && !inFunction {
+				a.declareGlobal(name.Id, kindVariable, nodeSpan(name), nil)
+			}
+			a.collectGlobals(s.Body, inFunction)
+		case *ast.ImportStmt:
+			if !inFunction {
+				for i, name := range s.Names {
+					a.declareGlobal(name, kindModule, nameSpan(importPos(s, i), name), nil)
+				}
+			}
+		case *ast.IfStmt:
+			a.collectGlobals(s.Body, inFunction)
+			a.collectGlobals(s.Orelse, inFunction)
+		case *ast.WhileStmt:
+			a.collectGlobals(s.Body, inFunction)
+		}
+	}
+}
+
+func (a *analysis) declareGlobal(name string, kind symbolKind, def span, fn *ast.FuncDef) {
+	if sym, ok := a.globals[name]; ok {
+		// The first binding is the definition; a later def wins as the
+		// more interesting kind.
+		if kind == kindFunction && sym.kind != kindFunction {
+			sym.kind, sym.fn, sym.def = kind, fn, def
+		}
+		return
+	}
+	sym := &symbol{name: name, kind: kind, def: def, fn: fn}
+	a.globals[name] = sym
+	a.symbols = append(a.symbols, sym)
+}
+
+func (a *analysis) visitStmts(stmts []ast.Stmt, sc *scope) {
+	for _, stmt := range stmts {
+		a.visitStmt(stmt, sc)
+	}
+}
+
+func (a *analysis) visitStmt(stmt ast.Stmt, sc *scope) {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		a.visitExpr(s.Value, sc)
+		a.bind(s.Target, sc)
+	case *ast.AugAssignStmt:
+		a.visitExpr(s.Value, sc)
+		if name, ok := s.Target.(*ast.Name); ok && sc.fn != nil && sc.locals[name.Id] == nil {
+			a.bind(s.Target, sc)
+		} else {
+			a.visitExpr(s.Target, sc)
+		}
+	case *ast.ExprStmt:
+		a.visitExpr(s.Expr, sc)
+	case *ast.PrintStmt:
+		if s.Dest != nil {
+			a.visitExpr(s.Dest, sc)
+		}
+		for _, value := range s.Values {
+			a.visitExpr(value, sc)
+		}
+	case *ast.IfStmt:
+		a.visitExpr(s.Test, sc)
+		a.visitStmts(s.Body, sc)
+		a.visitStmts(s.Orelse, sc)
+	case *ast.WhileStmt:
+		a.visitExpr(s.Test, sc)
+		a.visitStmts(s.Body, sc)
+	case *ast.ForStmt:
+		a.visitExpr(s.Iter, sc)
+		a.bind(s.Target, sc)
+		a.visitStmts(s.Body, sc)
+	case *ast.ReturnStmt:
+		if s.Value != nil {
+			a.visitExpr(s.Value, sc)
+		}
+	case *ast.ImportStmt:
+		for i, name := range s.Names {
+			a.bindName(name, nameSpan(importPos(s, i), name), kindModule, sc)
+		}
+	case *ast.FuncDef:
+		sym := a.globals[s.Name]
+		a.record(nameSpan(s.NamePosition, s.Name), sym)
+
+		inner := &scope{fn: s, locals: make(map[string]*symbol)}
+		for i, arg := range s.Args {
+			def := span{}
+			if i < len(s.ArgPositions) {
+				def = nameSpan(s.ArgPositions[i], arg)
+			}
+			param := &symbol{name: arg, kind: kindParameter, def: def, scope: s}
+			inner.locals[arg] = param
+			a.symbols = append(a.symbols, param)
+			a.record(def, param)
+		}
+		a.visitStmts(s.Body, inner)
+	}
+}
+
+// bind records an assignment to target.
+func (a *analysis) bind(target ast.Expr, sc *scope) {
+	name, ok := target.(*ast.Name)
+	if !ok {
+		a.visitExpr(target, sc)
+		return
+	}
+	a.bindName(name.Id, nodeSpan(name), kindVariable, sc)
+}
+
+func (a *analysis) bindName(name string, at span, kind symbolKind, sc *scope) {
+	if sc.fn == nil {
+		a.record(at, a.globals[name])
+		return
+	}
+	sym := sc.locals[name]
+	if sym == nil {
+		sym = &symbol{name: name, kind: kind, def: at, scope: sc.fn}
+		sc.locals[name] = sym
+		a.symbols = append(a.symbols, sym)
+	}
+	a.record(at, sym)
+}
+
+func (a *analysis) visitExpr(expr ast.Expr, sc *scope) {
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if name, ok := node.(*ast.Name); ok {
+			a.record(nodeSpan(name), a.resolve(name.Id, sc))
+		}
+		return true
+	})
+}
+
+func (a *analysis) resolve(name string, sc *scope) *symbol {
+	if sc.fn != nil {
+		if sym := sc.locals[name]; sym != nil {
+			return sym
+		}
+	}
+	if sym := a.globals[name]; sym != nil {
+		return sym
+	}
+	if !a.builtinSet[name] {
+		return nil
+	}
+	sym := a.builtins[name]
+	if sym == nil {
+		sym = &symbol{name: name, kind: kindBuiltin}
+		a.builtins[name] = sym
+	}
+	return sym
+}
+
+func (a *analysis) record(at span, sym *symbol) {
+	if sym == nil || at.start.Line == 0 {
+		return
+	}
+	sym.refs = append(sym.refs, at)
+	a.occurrences = append(a.occurrences, occurrence{span: at, sym: sym})
+}
+
+// symbolAt returns the symbol whose name is at pos.
+func (a *analysis) symbolAt(pos ast.Position) (*symbol, span) {
+	for _, occ := range a.occurrences {
+		if occ.contains(pos) {
+			return occ.sym, occ.span
+		}
+	}
+	return nil, span{}
+}
+
+// functionAt returns the innermost function whose body contains pos.
+func (a *analysis) functionAt(pos ast.Position) *ast.FuncDef {
+	var found *ast.FuncDef
+	for _, fn := range a.functions {
+		if (span{fn.Pos(), fn.End()}).contains(pos) {
+			found = fn
+		}
+	}
+	return found
+}
+
+func nodeSpan(node ast.Node) span {
+	return span{node.Pos(), node.End()}
+}
+
+func nameSpan(pos ast.Position, name string) span {
+	return span{pos, ast.Position{Line: pos.Line, Column: pos.Column + len([]rune(name))}}
+}
+
+func importPos(s *ast.ImportStmt, i int) ast.Position {
+	if i < len(s.NamePositions) {
+		return s.NamePositions[i]
+	}
+	return ast.Position{}
+}
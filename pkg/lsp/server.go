@@ -0,0 +1,460 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// Server serves one editor session over a pair of streams, usually the
+// process's stdin and stdout.
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	writeMu sync.Mutex
+
+	initialized bool
+	shutdown    bool
+	builtins    []string
+	documents   map[string]*document
+}
+
+// document is an open file and what was learned from its last version.
+type document struct {
+	uri      string
+	version  int
+	text     string
+	module   *ast.Module
+	analysis *analysis
+}
+
+// NewServer creates a server reading messages from in and writing
+// responses and notifications to out.
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:        bufio.NewReader(in),
+		out:       out,
+		builtins:  vm.NewVM().BuiltinNames(),
+		documents: make(map[string]*document),
+	}
+}
+
+// Serve handles messages until the client sends exit or in is closed.
+func (s *Server) Serve() error {
+	for {
+		data, err := ReadMessage(s.in)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.reply(nil, nil, &ResponseError{Code: codeParseError, Message: err.Error()})
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("lsp: exit without shutdown")
+			}
+			return nil
+		}
+
+		result, rerr := s.dispatch(&msg)
+		if msg.ID != nil {
+			s.reply(msg.ID, result, rerr)
+		}
+	}
+}
+
+func (s *Server) dispatch(msg *Message) (interface{}, *ResponseError) {
+	if msg.Method == "" {
+		return nil, &ResponseError{Code: codeInvalidRequest, Message: "missing method"}
+	}
+	if !s.initialized && msg.Method != "initialize" {
+		return nil, &ResponseError{Code: codeServerNotInitialized, Message: "server not initialized"}
+	}
+
+	switch msg.Method {
+	case "initialize":
+		s.initialized = true
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // full
+				"documentSymbolProvider": true,
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string]interface{}{},
+			},
+			"serverInfo": map[string]interface{}{"name": "gopy-lsp"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		item := params.TextDocument
+		s.update(item.URI, item.Version, item.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.update(params.TextDocument.URI, params.TextDocument.Version, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.documents, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []diagnostic{},
+		})
+		return nil, nil
+	case "textDocument/documentSymbol":
+		var params documentSymbolParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		doc, rerr := s.document(params.TextDocument.URI)
+		if rerr != nil {
+			return nil, rerr
+		}
+		return doc.symbols(), nil
+	case "textDocument/definition":
+		return s.onDefinition(msg)
+	case "textDocument/references":
+		return s.onReferences(msg)
+	case "textDocument/hover":
+		return s.onHover(msg)
+	case "textDocument/completion":
+		return s.onCompletion(msg)
+	}
+	return nil, &ResponseError{Code: codeMethodNotFound, Message: fmt.Sprintf("method not found: %s", msg.Method)}
+}
+
+func invalidParams(err error) *ResponseError {
+	return &ResponseError{Code: codeInvalidParams, Message: err.Error()}
+}
+
+func (s *Server) document(uri string) (*document, *ResponseError) {
+	doc, ok := s.documents[uri]
+	if !ok {
+		return nil, &ResponseError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown document %s", uri)}
+	}
+	return doc, nil
+}
+
+// update re-analyzes a document and publishes its diagnostics.
+func (s *Server) update(uri string, version int, text string) {
+	doc := &document{uri: uri, version: version, text: text}
+	s.documents[uri] = doc
+
+	filename := filenameOf(uri)
+	diagnostics := []diagnostic{}
+	module, err := parser.ParseFile(filename, text)
+	if err != nil {
+		diagnostics = append(diagnostics, syntaxDiagnostics(err)...)
+	}
+	if module != nil {
+		doc.module = module
+		doc.analysis = analyze(module, s.builtins)
+	}
+	if err == nil {
+		if _, err := compiler.CompileFile(module, filename); err != nil {
+			diagnostics = append(diagnostics, compileDiagnostic(err))
+		}
+	}
+
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+		URI:         uri,
+		Version:     version,
+		Diagnostics: diagnostics,
+	})
+}
+
+func filenameOf(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Path != "" {
+		return path.Base(u.Path)
+	}
+	return uri
+}
+
+func syntaxDiagnostics(err error) []diagnostic {
+	var errs []error
+	if list, ok := err.(parser.ErrorList); ok {
+		errs = list
+	} else {
+		errs = []error{err}
+	}
+
+	diagnostics := make([]diagnostic, 0, len(errs))
+	for _, err := range errs {
+		d := diagnostic{Severity: severityError, Source: "gopy", Message: err.Error()}
+		var syntaxErr *lexer.SyntaxError
+		var indentErr *lexer.IndentationError
+		switch {
+		case errors.As(err, &indentErr):
+			syntaxErr = &indentErr.SyntaxError
+			d.Message = "IndentationError: " + indentErr.Msg
+		case errors.As(err, &syntaxErr):
+			d.Message = "SyntaxError: " + syntaxErr.Msg
+		}
+		if syntaxErr != nil {
+			start := toPosition(ast.Position{Line: syntaxErr.Line, Column: syntaxErr.Column})
+			width := len([]rune(syntaxErr.Text))
+			if width == 0 {
+				width = 1
+			}
+			end := position{Line: start.Line, Character: start.Character + width}
+			d.Range = lspRange{Start: start, End: end}
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics
+}
+
+func compileDiagnostic(err error) diagnostic {
+	d := diagnostic{Severity: severityError, Source: "gopy", Message: err.Error()}
+	var compileErr *compiler.Error
+	if errors.As(err, &compileErr) {
+		d.Message = compileErr.Msg
+		d.Range = toRange(span{compileErr.Pos, compileErr.End})
+	}
+	return d
+}
+
+func (s *Server) lookup(params positionParams) (*document, *symbol, span, *ResponseError) {
+	doc, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil || doc.analysis == nil {
+		return doc, nil, span{}, rerr
+	}
+	sym, at := doc.analysis.symbolAt(fromPosition(params.Position))
+	return doc, sym, at, nil
+}
+
+func (s *Server) onDefinition(msg *Message) (interface{}, *ResponseError) {
+	var params positionParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return nil, invalidParams(err)
+	}
+	doc, sym, _, rerr := s.lookup(params)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if sym == nil || sym.kind == kindBuiltin {
+		return nil, nil
+	}
+	return []location{{URI: doc.uri, Range: toRange(sym.def)}}, nil
+}
+
+func (s *Server) onReferences(msg *Message) (interface{}, *ResponseError) {
+	var params referenceParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return nil, invalidParams(err)
+	}
+	doc, sym, _, rerr := s.lookup(params.positionParams)
+	if rerr != nil {
+		return nil, rerr
+	}
+	locations := []location{}
+	if sym == nil {
+		return locations, nil
+	}
+	for _, ref := range sym.refs {
+		if ref == sym.def && !params.Context.IncludeDeclaration {
+			continue
+		}
+		locations = append(locations, location{URI: doc.uri, Range: toRange(ref)})
+	}
+	return locations, nil
+}
+
+func (s *Server) onHover(msg *Message) (interface{}, *ResponseError) {
+	var params positionParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return nil, invalidParams(err)
+	}
+	_, sym, at, rerr := s.lookup(params)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if sym == nil {
+		return nil, nil
+	}
+	r := toRange(at)
+	return hover{
+		Contents: markupContent{Kind: "markdown", Value: "```python\n" + sym.signature() + "\n```"},
+		Range:    &r,
+	}, nil
+}
+
+func (s *Server) onCompletion(msg *Message) (interface{}, *ResponseError) {
+	var params positionParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return nil, invalidParams(err)
+	}
+	doc, rerr := s.document(params.TextDocument.URI)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	seen := make(map[string]bool)
+	var items []completionItem
+	add := func(label string, kind int, detail string) {
+		if !seen[label] {
+			seen[label] = true
+			items = append(items, completionItem{Label: label, Kind: kind, Detail: detail})
+		}
+	}
+
+	// Innermost scope first, so locals shadow globals of the same name.
+	if a := doc.analysis; a != nil {
+		var names []*symbol
+		fn := a.functionAt(fromPosition(params.Position))
+		for _, sym := range a.symbols {
+			if sym.scope != nil && sym.scope == fn {
+				names = append(names, sym)
+			}
+		}
+		for _, sym := range a.symbols {
+			if sym.scope == nil {
+				names = append(names, sym)
+			}
+		}
+		for _, sym := range names {
+			add(sym.name, completionKind(sym.kind), sym.signature())
+		}
+	}
+	for _, name := range s.builtins {
+		add(name, completionKindFunction, "(builtin) "+name)
+	}
+	for _, keyword := range lexer.Keywords() {
+		add(keyword, completionKindKeyword, "")
+	}
+	return completionList{Items: items}, nil
+}
+
+func completionKind(kind symbolKind) int {
+	switch kind {
+	case kindFunction, kindBuiltin:
+		return completionKindFunction
+	case kindModule:
+		return completionKindModule
+	}
+	return completionKindVariable
+}
+
+// symbols lists functions, with their parameters and locals as children,
+// and module-level variables and imports.
+func (d *document) symbols() []documentSymbol {
+	result := []documentSymbol{}
+	if d.analysis == nil {
+		return result
+	}
+
+	globals := make([]*symbol, 0, len(d.analysis.globals))
+	for _, sym := range d.analysis.symbols {
+		if sym.scope == nil {
+			globals = append(globals, sym)
+		}
+	}
+	sort.SliceStable(globals, func(i, j int) bool {
+		return before(globals[i].def.start, globals[j].def.start)
+	})
+
+	for _, sym := range globals {
+		ds := documentSymbol{
+			Name:           sym.name,
+			Kind:           symbolKindVariable,
+			Range:          toRange(sym.def),
+			SelectionRange: toRange(sym.def),
+		}
+		switch sym.kind {
+		case kindModule:
+			ds.Kind = symbolKindModule
+		case kindFunction:
+			ds.Kind = symbolKindFunction
+			ds.Detail = sym.signature()
+			ds.Range = toRange(span{sym.fn.Pos(), sym.fn.End()})
+			for _, local := range d.analysis.symbols {
+				if local.scope == sym.fn {
+					ds.Children = append(ds.Children, documentSymbol{
+						Name:           local.name,
+						Kind:           symbolKindVariable,
+						Range:          toRange(local.def),
+						SelectionRange: toRange(local.def),
+					})
+				}
+			}
+		}
+		result = append(result, ds)
+	}
+	return result
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, rerr *ResponseError) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if rerr != nil {
+		msg["error"] = rerr
+	} else {
+		// A successful response must carry a result, even if it is null.
+		msg["result"] = result
+	}
+	s.write(msg)
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	s.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *Server) write(v interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	WriteMessage(s.out, v)
+}
+
+// AST positions are 1-based; LSP positions are 0-based.
+func toPosition(pos ast.Position) position {
+	line, char := pos.Line-1, pos.Column-1
+	if line < 0 {
+		line = 0
+	}
+	if char < 0 {
+		char = 0
+	}
+	return position{Line: line, Character: char}
+}
+
+func fromPosition(pos position) ast.Position {
+	return ast.Position{Line: pos.Line + 1, Column: pos.Character + 1}
+}
+
+func toRange(s span) lspRange {
+	return lspRange{Start: toPosition(s.start), End: toPosition(s.end)}
+}
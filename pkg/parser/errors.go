@@ -0,0 +1,56 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/warriorguo/gopy/pkg/lexer"
+)
+
+// ErrorList is a list of syntax errors reported in one pass.
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+func (l ErrorList) Unwrap() []error {
+	return l
+}
+
+// Sort orders the errors by position.
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := position(l[i]), position(l[j])
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+func (l ErrorList) hasErrorAt(err error) bool {
+	pos := position(err)
+	for _, existing := range l {
+		other := position(existing)
+		if other.Line == pos.Line && other.Column == pos.Column {
+			return true
+		}
+	}
+	return false
+}
+
+func position(err error) lexer.SyntaxError {
+	var syntaxErr *lexer.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return *syntaxErr
+	}
+	return lexer.SyntaxError{}
+}
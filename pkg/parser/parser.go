@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/warriorguo/gopy/pkg/ast"
 	"github.com/warriorguo/gopy/pkg/lexer"
@@ -11,6 +12,11 @@ import (
 type Parser struct {
 	tokens   []lexer.Token
 	position int
+
+	filename string
+	lines    []string
+	recovery bool
+	errors   []error
 }
 
 func NewParser(tokens []lexer.Token) *Parser {
@@ -20,6 +26,81 @@ func NewParser(tokens []lexer.Token) *Parser {
 	}
 }
 
+// SetFilename sets the file name reported in syntax errors.
+func (p *Parser) SetFilename(filename string) {
+	p.filename = filename
+}
+
+// SetSource provides the source text so syntax errors can quote the
+// offending line.
+func (p *Parser) SetSource(source string) {
+	p.lines = strings.Split(source, "\n")
+}
+
+// SetRecovery makes Parse report every syntax error instead of stopping at
+// the first one. After an error the parser skips to the next statement.
+func (p *Parser) SetRecovery(recovery bool) {
+	p.recovery = recovery
+}
+
+// Errors returns the syntax errors collected in recovery mode.
+func (p *Parser) Errors() []error {
+	return p.errors
+}
+
+func (p *Parser) newSyntaxError(tok lexer.Token, format string, args ...interface{}) lexer.SyntaxError {
+	err := lexer.SyntaxError{
+		Filename: p.filename,
+		Line:     tok.Line,
+		Column:   tok.Column,
+		Text:     tok.Lexeme,
+		Msg:      fmt.Sprintf(format, args...),
+	}
+	if tok.Type == lexer.NEWLINE || tok.Type == lexer.INDENT || tok.Type == lexer.DEDENT {
+		err.Text = ""
+	}
+	if tok.Line >= 1 && tok.Line <= len(p.lines) {
+		err.SourceLine = p.lines[tok.Line-1]
+	}
+	return err
+}
+
+// errorf reports a syntax error at the current token.
+func (p *Parser) errorf(format string, args ...interface{}) error {
+	err := p.newSyntaxError(p.currentToken(), format, args...)
+	return &err
+}
+
+func (p *Parser) indentationErrorf(format string, args ...interface{}) error {
+	return &lexer.IndentationError{SyntaxError: p.newSyntaxError(p.currentToken(), format, args...)}
+}
+
+// tokenPos returns the start of the current token.
+func (p *Parser) tokenPos() ast.Position {
+	tok := p.currentToken()
+	return ast.Position{Line: tok.Line, Column: tok.Column}
+}
+
+// prevEnd returns the end of the last consumed token.
+func (p *Parser) prevEnd() ast.Position {
+	if p.position == 0 || p.position > len(p.tokens) {
+		return ast.Position{}
+	}
+	tok := p.tokens[p.position-1]
+	return ast.Position{Line: tok.EndLine, Column: tok.EndColumn}
+}
+
+// blockEnd returns the end of the last statement in blocks, or fallback if
+// they are empty.
+func blockEnd(fallback ast.Position, blocks ...[]ast.Stmt) ast.Position {
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if n := len(blocks[i]); n > 0 {
+			return blocks[i][n-1].End()
+		}
+	}
+	return fallback
+}
+
 func (p *Parser) currentToken() lexer.Token {
 	if p.position >= len(p.tokens) {
 		return lexer.Token{Type: lexer.EOF}
@@ -35,7 +116,10 @@ func (p *Parser) advance() {
 
 func (p *Parser) expect(tokenType lexer.TokenType) error {
 	if p.currentToken().Type != tokenType {
-		return fmt.Errorf("expected %s, got %s(%s) at line %d", tokenType, p.currentToken().Type, p.currentToken().Lexeme, p.currentToken().Line)
+		if tokenType == lexer.INDENT {
+			return p.indentationErrorf("expected an indented block")
+		}
+		return p.errorf("expected %s, got %s", tokenType, p.currentToken().Type)
 	}
 	p.advance()
 	return nil
@@ -58,7 +142,13 @@ func (p *Parser) Parse() (*ast.Module, error) {
 	for p.currentToken().Type != lexer.EOF {
 		stmt, err := p.parseStmt()
 		if err != nil {
-			return nil, err
+			if !p.recovery {
+				return nil, err
+			}
+			p.errors = append(p.errors, err)
+			p.synchronize()
+			p.skipNewlines()
+			continue
 		}
 		if stmt != nil {
 			module.Body = append(module.Body, stmt)
@@ -66,9 +156,56 @@ func (p *Parser) Parse() (*ast.Module, error) {
 		p.skipNewlines()
 	}
 
+	if len(p.errors) > 0 {
+		return module, ErrorList(p.errors)
+	}
 	return module, nil
 }
 
+// synchronize skips past the statement containing a syntax error, including
+// any block that belongs to it, so parsing can resume at the next statement.
+func (p *Parser) synchronize() {
+	start := p.position
+	for {
+		switch p.currentToken().Type {
+		case lexer.EOF:
+			return
+		case lexer.DEDENT:
+			if p.position == start {
+				p.advance()
+			}
+			return
+		case lexer.INDENT:
+			p.skipBlock()
+			return
+		case lexer.NEWLINE:
+			p.advance()
+			p.skipNewlines()
+			if p.currentToken().Type == lexer.INDENT {
+				p.skipBlock()
+			}
+			return
+		}
+		p.advance()
+	}
+}
+
+func (p *Parser) skipBlock() {
+	depth := 0
+	for p.currentToken().Type != lexer.EOF {
+		switch p.currentToken().Type {
+		case lexer.INDENT:
+			depth++
+		case lexer.DEDENT:
+			depth--
+		}
+		p.advance()
+		if depth == 0 {
+			return
+		}
+	}
+}
+
 func (p *Parser) parseStmt() (ast.Stmt, error) {
 	switch p.currentToken().Type {
 	case lexer.IF:
@@ -85,6 +222,8 @@ func (p *Parser) parseStmt() (ast.Stmt, error) {
 		return p.parsePassStmt()
 	case lexer.PRINT:
 		return p.parsePrintStmt()
+	case lexer.IMPORT:
+		return p.parseImportStmt()
 	case lexer.NEWLINE:
 		p.advance()
 		return nil, nil
@@ -126,9 +265,10 @@ func (p *Parser) parseAssignStmt() (ast.Stmt, error) {
 			return nil, err
 		}
 		return &ast.AssignStmt{
-			Target:   target,
-			Value:    value,
-			Position: pos,
+			Target:      target,
+			Value:       value,
+			Position:    pos,
+			EndPosition: p.prevEnd(),
 		}, nil
 
 	case lexer.PLUS_ASSIGN:
@@ -138,10 +278,11 @@ func (p *Parser) parseAssignStmt() (ast.Stmt, error) {
 			return nil, err
 		}
 		return &ast.AugAssignStmt{
-			Target:   target,
-			Op:       "+=",
-			Value:    value,
-			Position: pos,
+			Target:      target,
+			Op:          "+=",
+			Value:       value,
+			Position:    pos,
+			EndPosition: p.prevEnd(),
 		}, nil
 
 	case lexer.MINUS_ASSIGN:
@@ -151,14 +292,15 @@ func (p *Parser) parseAssignStmt() (ast.Stmt, error) {
 			return nil, err
 		}
 		return &ast.AugAssignStmt{
-			Target:   target,
-			Op:       "-=",
-			Value:    value,
-			Position: pos,
+			Target:      target,
+			Op:          "-=",
+			Value:       value,
+			Position:    pos,
+			EndPosition: p.prevEnd(),
 		}, nil
 
 	default:
-		return nil, fmt.Errorf("expected assignment operator, got %s at line %d", tokenType, p.currentToken().Line)
+		return nil, p.errorf("expected assignment operator, got %s", tokenType)
 	}
 }
 
@@ -171,8 +313,9 @@ func (p *Parser) parseExprStmt() (ast.Stmt, error) {
 	}
 
 	return &ast.ExprStmt{
-		Expr:     expr,
-		Position: pos,
+		Expr:        expr,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -180,6 +323,21 @@ func (p *Parser) parsePrintStmt() (ast.Stmt, error) {
 	pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 	p.advance()
 
+	var dest ast.Expr
+	if p.currentToken().Type == lexer.RSHIFT {
+		p.advance()
+		var err error
+		dest, err = p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.currentToken().Type == lexer.COMMA {
+			p.advance()
+		} else if p.currentToken().Type != lexer.NEWLINE && p.currentToken().Type != lexer.EOF {
+			return nil, p.errorf("expected ',' after print destination")
+		}
+	}
+
 	var values []ast.Expr
 
 	if p.currentToken().Type != lexer.NEWLINE && p.currentToken().Type != lexer.EOF {
@@ -200,8 +358,38 @@ func (p *Parser) parsePrintStmt() (ast.Stmt, error) {
 	}
 
 	return &ast.PrintStmt{
-		Values:   values,
-		Position: pos,
+		Dest:        dest,
+		Values:      values,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
+	}, nil
+}
+
+func (p *Parser) parseImportStmt() (ast.Stmt, error) {
+	pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
+	p.advance()
+
+	var names []string
+	var positions []ast.Position
+	for {
+		if p.currentToken().Type != lexer.IDENT {
+			return nil, p.errorf("expected module name")
+		}
+		names = append(names, p.currentToken().Lexeme)
+		positions = append(positions, p.tokenPos())
+		p.advance()
+
+		if p.currentToken().Type != lexer.COMMA {
+			break
+		}
+		p.advance()
+	}
+
+	return &ast.ImportStmt{
+		Names:         names,
+		NamePositions: positions,
+		Position:      pos,
+		EndPosition:   p.prevEnd(),
 	}, nil
 }
 
@@ -245,10 +433,11 @@ func (p *Parser) parseIfStmt() (ast.Stmt, error) {
 	}
 
 	return &ast.IfStmt{
-		Test:     test,
-		Body:     body,
-		Orelse:   orelse,
-		Position: pos,
+		Test:        test,
+		Body:        body,
+		Orelse:      orelse,
+		Position:    pos,
+		EndPosition: blockEnd(p.prevEnd(), body, orelse),
 	}, nil
 }
 
@@ -271,9 +460,10 @@ func (p *Parser) parseWhileStmt() (ast.Stmt, error) {
 	}
 
 	return &ast.WhileStmt{
-		Test:     test,
-		Body:     body,
-		Position: pos,
+		Test:        test,
+		Body:        body,
+		Position:    pos,
+		EndPosition: blockEnd(p.prevEnd(), body),
 	}, nil
 }
 
@@ -305,10 +495,11 @@ func (p *Parser) parseForStmt() (ast.Stmt, error) {
 	}
 
 	return &ast.ForStmt{
-		Target:   target,
-		Iter:     iter,
-		Body:     body,
-		Position: pos,
+		Target:      target,
+		Iter:        iter,
+		Body:        body,
+		Position:    pos,
+		EndPosition: blockEnd(p.prevEnd(), body),
 	}, nil
 }
 
@@ -317,9 +508,10 @@ func (p *Parser) parseFuncDef() (ast.Stmt, error) {
 	p.advance()
 
 	if p.currentToken().Type != lexer.IDENT {
-		return nil, fmt.Errorf("expected function name at line %d", p.currentToken().Line)
+		return nil, p.errorf("expected function name")
 	}
 	name := p.currentToken().Lexeme
+	namePos := p.tokenPos()
 	p.advance()
 
 	if err := p.expect(lexer.LPAREN); err != nil {
@@ -327,16 +519,19 @@ func (p *Parser) parseFuncDef() (ast.Stmt, error) {
 	}
 
 	var args []string
+	var argPositions []ast.Position
 	if p.currentToken().Type == lexer.IDENT {
 		args = append(args, p.currentToken().Lexeme)
+		argPositions = append(argPositions, p.tokenPos())
 		p.advance()
 
 		for p.currentToken().Type == lexer.COMMA {
 			p.advance()
 			if p.currentToken().Type != lexer.IDENT {
-				return nil, fmt.Errorf("expected parameter name at line %d", p.currentToken().Line)
+				return nil, p.errorf("expected parameter name")
 			}
 			args = append(args, p.currentToken().Lexeme)
+			argPositions = append(argPositions, p.tokenPos())
 			p.advance()
 		}
 	}
@@ -355,10 +550,13 @@ func (p *Parser) parseFuncDef() (ast.Stmt, error) {
 	}
 
 	return &ast.FuncDef{
-		Name:     name,
-		Args:     args,
-		Body:     body,
-		Position: pos,
+		Name:         name,
+		Args:         args,
+		NamePosition: namePos,
+		ArgPositions: argPositions,
+		Body:         body,
+		Position:     pos,
+		EndPosition:  blockEnd(p.prevEnd(), body),
 	}, nil
 }
 
@@ -376,8 +574,9 @@ func (p *Parser) parseReturnStmt() (ast.Stmt, error) {
 	}
 
 	return &ast.ReturnStmt{
-		Value:    value,
-		Position: pos,
+		Value:       value,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -386,7 +585,8 @@ func (p *Parser) parsePassStmt() (ast.Stmt, error) {
 	p.advance() // consume 'pass' token
 
 	return &ast.PassStmt{
-		Position: pos,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -401,7 +601,15 @@ func (p *Parser) parseBlock() ([]ast.Stmt, error) {
 	for p.currentToken().Type != lexer.DEDENT && p.currentToken().Type != lexer.EOF {
 		stmt, err := p.parseStmt()
 		if err != nil {
-			return nil, err
+			if !p.recovery {
+				return nil, err
+			}
+			p.errors = append(p.errors, err)
+			if p.currentToken().Type != lexer.DEDENT {
+				p.synchronize()
+			}
+			p.skipNewlines()
+			continue
 		}
 		if stmt != nil {
 			stmts = append(stmts, stmt)
@@ -412,8 +620,7 @@ func (p *Parser) parseBlock() ([]ast.Stmt, error) {
 	if p.currentToken().Type == lexer.DEDENT {
 		p.advance()
 	} else if p.currentToken().Type != lexer.EOF {
-		return nil, fmt.Errorf("expected DEDENT or EOF, got %s at line %d",
-			p.currentToken().Type, p.currentToken().Line)
+		return nil, p.errorf("expected DEDENT or EOF, got %s", p.currentToken().Type)
 	}
 
 	return stmts, nil
@@ -430,7 +637,6 @@ func (p *Parser) parseOrExpr() (ast.Expr, error) {
 	}
 
 	if p.currentToken().Type == lexer.OR {
-		pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 		values := []ast.Expr{left}
 
 		for p.currentToken().Type == lexer.OR {
@@ -443,9 +649,10 @@ func (p *Parser) parseOrExpr() (ast.Expr, error) {
 		}
 
 		return &ast.BoolOp{
-			Op:       "or",
-			Values:   values,
-			Position: pos,
+			Op:          "or",
+			Values:      values,
+			Position:    left.Pos(),
+			EndPosition: p.prevEnd(),
 		}, nil
 	}
 
@@ -459,7 +666,6 @@ func (p *Parser) parseAndExpr() (ast.Expr, error) {
 	}
 
 	if p.currentToken().Type == lexer.AND {
-		pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 		values := []ast.Expr{left}
 
 		for p.currentToken().Type == lexer.AND {
@@ -472,9 +678,10 @@ func (p *Parser) parseAndExpr() (ast.Expr, error) {
 		}
 
 		return &ast.BoolOp{
-			Op:       "and",
-			Values:   values,
-			Position: pos,
+			Op:          "and",
+			Values:      values,
+			Position:    left.Pos(),
+			EndPosition: p.prevEnd(),
 		}, nil
 	}
 
@@ -490,9 +697,10 @@ func (p *Parser) parseNotExpr() (ast.Expr, error) {
 			return nil, err
 		}
 		return &ast.UnaryOp{
-			Op:       "not",
-			Expr:     expr,
-			Position: pos,
+			Op:          "not",
+			Expr:        expr,
+			Position:    pos,
+			EndPosition: p.prevEnd(),
 		}, nil
 	}
 	return p.parseCompareExpr()
@@ -505,14 +713,17 @@ func (p *Parser) parseCompareExpr() (ast.Expr, error) {
 	}
 
 	if p.isCompOp() {
-		pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 		var ops []string
 		var rights []ast.Expr
 
 		for p.isCompOp() {
 			op := p.getCompOp()
-			ops = append(ops, op)
 			p.advance()
+			if op == "is" && p.currentToken().Type == lexer.NOT {
+				op = "is not"
+				p.advance()
+			}
+			ops = append(ops, op)
 			right, err := p.parseArithExpr()
 			if err != nil {
 				return nil, err
@@ -521,10 +732,11 @@ func (p *Parser) parseCompareExpr() (ast.Expr, error) {
 		}
 
 		return &ast.Compare{
-			Left:     left,
-			Ops:      ops,
-			Right:    rights,
-			Position: pos,
+			Left:        left,
+			Ops:         ops,
+			Right:       rights,
+			Position:    left.Pos(),
+			EndPosition: p.prevEnd(),
 		}, nil
 	}
 
@@ -533,7 +745,7 @@ func (p *Parser) parseCompareExpr() (ast.Expr, error) {
 
 func (p *Parser) isCompOp() bool {
 	switch p.currentToken().Type {
-	case lexer.EQ, lexer.NOT_EQ, lexer.LT, lexer.GT, lexer.LTE, lexer.GTE, lexer.IN:
+	case lexer.EQ, lexer.NOT_EQ, lexer.LT, lexer.GT, lexer.LTE, lexer.GTE, lexer.IN, lexer.IS:
 		return true
 	}
 	return false
@@ -555,6 +767,8 @@ func (p *Parser) getCompOp() string {
 		return ">="
 	case lexer.IN:
 		return "in"
+	case lexer.IS:
+		return "is"
 	}
 	return ""
 }
@@ -566,7 +780,6 @@ func (p *Parser) parseArithExpr() (ast.Expr, error) {
 	}
 
 	for p.currentToken().Type == lexer.PLUS || p.currentToken().Type == lexer.MINUS {
-		pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 		op := p.currentToken().Lexeme
 		p.advance()
 		right, err := p.parseTermExpr()
@@ -574,10 +787,11 @@ func (p *Parser) parseArithExpr() (ast.Expr, error) {
 			return nil, err
 		}
 		left = &ast.BinaryOp{
-			Left:     left,
-			Op:       op,
-			Right:    right,
-			Position: pos,
+			Left:        left,
+			Op:          op,
+			Right:       right,
+			Position:    left.Pos(),
+			EndPosition: p.prevEnd(),
 		}
 	}
 
@@ -591,7 +805,6 @@ func (p *Parser) parseTermExpr() (ast.Expr, error) {
 	}
 
 	for p.currentToken().Type == lexer.MULTIPLY || p.currentToken().Type == lexer.DIVIDE || p.currentToken().Type == lexer.MODULO {
-		pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 		op := p.currentToken().Lexeme
 		p.advance()
 		right, err := p.parseFactorExpr()
@@ -599,10 +812,11 @@ func (p *Parser) parseTermExpr() (ast.Expr, error) {
 			return nil, err
 		}
 		left = &ast.BinaryOp{
-			Left:     left,
-			Op:       op,
-			Right:    right,
-			Position: pos,
+			Left:        left,
+			Op:          op,
+			Right:       right,
+			Position:    left.Pos(),
+			EndPosition: p.prevEnd(),
 		}
 	}
 
@@ -619,9 +833,10 @@ func (p *Parser) parseFactorExpr() (ast.Expr, error) {
 			return nil, err
 		}
 		return &ast.UnaryOp{
-			Op:       op,
-			Expr:     expr,
-			Position: pos,
+			Op:          op,
+			Expr:        expr,
+			Position:    pos,
+			EndPosition: p.prevEnd(),
 		}, nil
 	}
 
@@ -641,7 +856,6 @@ func (p *Parser) parseCallExpr() (ast.Expr, error) {
 	for {
 		switch p.currentToken().Type {
 		case lexer.LPAREN:
-			pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 			p.advance()
 			var args []ast.Expr
 
@@ -667,13 +881,13 @@ func (p *Parser) parseCallExpr() (ast.Expr, error) {
 			}
 
 			expr = &ast.Call{
-				Func:     expr,
-				Args:     args,
-				Position: pos,
+				Func:        expr,
+				Args:        args,
+				Position:    expr.Pos(),
+				EndPosition: p.prevEnd(),
 			}
 
 		case lexer.LBRACKET:
-			pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
 			p.advance()
 			slice, err := p.parseExpr()
 			if err != nil {
@@ -684,9 +898,25 @@ func (p *Parser) parseCallExpr() (ast.Expr, error) {
 			}
 
 			expr = &ast.Subscript{
-				Value:    expr,
-				Slice:    slice,
-				Position: pos,
+				Value:       expr,
+				Slice:       slice,
+				Position:    expr.Pos(),
+				EndPosition: p.prevEnd(),
+			}
+
+		case lexer.DOT:
+			p.advance()
+			if p.currentToken().Type != lexer.IDENT {
+				return nil, p.errorf("expected attribute name")
+			}
+			attr := p.currentToken().Lexeme
+			p.advance()
+
+			expr = &ast.Attribute{
+				Value:       expr,
+				Attr:        attr,
+				Position:    expr.Pos(),
+				EndPosition: p.prevEnd(),
 			}
 
 		default:
@@ -713,15 +943,20 @@ func (p *Parser) parseAtomExpr() (ast.Expr, error) {
 		return p.parseList()
 	case lexer.LBRACE:
 		return p.parseDict()
+	case lexer.INDENT:
+		return nil, p.indentationErrorf("unexpected indent")
+	case lexer.EOF:
+		return nil, p.errorf("unexpected EOF while parsing")
 	default:
-		return nil, fmt.Errorf("unexpected token %s at line %d", p.currentToken().Type, p.currentToken().Line)
+		return nil, p.errorf("invalid syntax")
 	}
 }
 
 func (p *Parser) parseNumber() (ast.Expr, error) {
 	pos := ast.Position{Line: p.currentToken().Line, Column: p.currentToken().Column}
-	lexeme := p.currentToken().Lexeme
-	tokenType := p.currentToken().Type
+	tok := p.currentToken()
+	lexeme := tok.Lexeme
+	tokenType := tok.Type
 	p.advance()
 
 	var value interface{}
@@ -734,12 +969,14 @@ func (p *Parser) parseNumber() (ast.Expr, error) {
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("invalid number %s at line %d", lexeme, pos.Line)
+		err := p.newSyntaxError(tok, "invalid number %s", lexeme)
+		return nil, &err
 	}
 
 	return &ast.Num{
-		N:        value,
-		Position: pos,
+		N:           value,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -749,8 +986,9 @@ func (p *Parser) parseString() (ast.Expr, error) {
 	p.advance()
 
 	return &ast.Str{
-		S:        value,
-		Position: pos,
+		S:           value,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -769,8 +1007,9 @@ func (p *Parser) parseNameConstant() (ast.Expr, error) {
 	p.advance()
 
 	return &ast.NameConstant{
-		Value:    value,
-		Position: pos,
+		Value:       value,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -780,8 +1019,9 @@ func (p *Parser) parseName() (ast.Expr, error) {
 	p.advance()
 
 	return &ast.Name{
-		Id:       name,
-		Position: pos,
+		Id:          name,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -827,8 +1067,9 @@ func (p *Parser) parseList() (ast.Expr, error) {
 	}
 
 	return &ast.List{
-		Elts:     elts,
-		Position: pos,
+		Elts:        elts,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -880,9 +1121,10 @@ func (p *Parser) parseDict() (ast.Expr, error) {
 	}
 
 	return &ast.Dict{
-		Keys:     keys,
-		Values:   values,
-		Position: pos,
+		Keys:        keys,
+		Values:      values,
+		Position:    pos,
+		EndPosition: p.prevEnd(),
 	}, nil
 }
 
@@ -890,3 +1132,31 @@ func Parse(tokens []lexer.Token) (*ast.Module, error) {
 	parser := NewParser(tokens)
 	return parser.Parse()
 }
+
+// ParseFile lexes and parses source in recovery mode. If there are syntax
+// errors, the returned error is an ErrorList holding all of them in source
+// order, and the module contains the statements that did parse.
+func ParseFile(filename, source string) (*ast.Module, error) {
+	l := lexer.NewLexer(source)
+	l.SetFilename(filename)
+	tokens := l.AllTokens()
+
+	parser := NewParser(tokens)
+	parser.SetFilename(filename)
+	parser.SetSource(source)
+	parser.SetRecovery(true)
+	module, _ := parser.Parse()
+
+	errs := append(ErrorList{}, l.Errors()...)
+	for _, err := range parser.Errors() {
+		// Errors on ILLEGAL tokens were already reported by the lexer.
+		if !errs.hasErrorAt(err) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return module, nil
+	}
+	errs.Sort()
+	return module, errs
+}
@@ -0,0 +1,216 @@
+package profiler
+
+import (
+	"compress/gzip"
+	"io"
+	"path/filepath"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+)
+
+// WritePprof writes the profile in the gzipped protocol buffer format read
+// by `go tool pprof`. Each sample is a Python call stack; its values are
+// the instructions executed and the nanoseconds spent on its leaf line.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	e := &pprofEncoder{strings: map[string]int64{"": 0}, stringList: []string{""}}
+	instructions, nanos := e.str("instructions"), e.str("nanoseconds")
+	var profile protobuf
+
+	// sample_type
+	profile.message(1, func(m *protobuf) {
+		m.int64(1, instructions)
+		m.int64(2, e.str("count"))
+	})
+	profile.message(1, func(m *protobuf) {
+		m.int64(1, e.str("wall"))
+		m.int64(2, nanos)
+	})
+
+	p.walk(func(n *node) {
+		var ids []uint64
+		for a := n; a.parent != nil; a = a.parent {
+			ids = append(ids, e.location(a.key))
+		}
+		profile.message(2, func(m *protobuf) {
+			m.packed(1, ids)
+			m.packed(2, []uint64{uint64(n.instructions), uint64(n.time.Nanoseconds())})
+		})
+	})
+
+	// mapping: a single synthetic one that is already symbolized.
+	profile.message(3, func(m *protobuf) {
+		m.uint64(1, 1)
+		m.int64(5, e.str("gopy"))
+		m.bool(7, true)
+		m.bool(8, true)
+		m.bool(9, true)
+	})
+	for _, loc := range e.locations {
+		profile.message(4, func(m *protobuf) {
+			m.uint64(1, loc.id)
+			m.uint64(2, 1)
+			m.message(4, func(l *protobuf) {
+				l.uint64(1, e.function(loc.key.code))
+				l.int64(2, int64(loc.key.line))
+			})
+		})
+	}
+	for _, fn := range e.functions {
+		profile.message(5, func(m *protobuf) {
+			m.uint64(1, fn.id)
+			m.int64(2, fn.name)
+			m.int64(3, fn.systemName)
+			m.int64(4, fn.filename)
+			m.int64(5, int64(fn.code.Firstlineno))
+		})
+	}
+	// string_table, which must come after every str call.
+	for _, s := range e.stringList {
+		profile.string(6, s)
+	}
+	profile.int64(9, p.start.UnixNano())
+	profile.int64(10, p.duration.Nanoseconds())
+	// period_type and period: every instruction is recorded.
+	profile.message(11, func(m *protobuf) {
+		m.int64(1, instructions)
+		m.int64(2, e.str("count"))
+	})
+	profile.int64(12, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type pprofEncoder struct {
+	strings    map[string]int64
+	stringList []string
+	locations  []pprofLocation
+	locIDs     map[nodeKey]uint64
+	functions  []pprofFunction
+	funcIDs    map[*compiler.CodeObject]uint64
+}
+
+type pprofLocation struct {
+	id  uint64
+	key nodeKey
+}
+
+type pprofFunction struct {
+	id                         uint64
+	code                       *compiler.CodeObject
+	name, systemName, filename int64
+}
+
+func (e *pprofEncoder) str(s string) int64 {
+	if i, ok := e.strings[s]; ok {
+		return i
+	}
+	i := int64(len(e.stringList))
+	e.strings[s] = i
+	e.stringList = append(e.stringList, s)
+	return i
+}
+
+func (e *pprofEncoder) location(key nodeKey) uint64 {
+	if e.locIDs == nil {
+		e.locIDs = make(map[nodeKey]uint64)
+	}
+	if id, ok := e.locIDs[key]; ok {
+		return id
+	}
+	id := uint64(len(e.locations) + 1)
+	e.locIDs[key] = id
+	e.locations = append(e.locations, pprofLocation{id: id, key: key})
+	e.function(key.code)
+	return id
+}
+
+func (e *pprofEncoder) function(code *compiler.CodeObject) uint64 {
+	if e.funcIDs == nil {
+		e.funcIDs = make(map[*compiler.CodeObject]uint64)
+	}
+	if id, ok := e.funcIDs[code]; ok {
+		return id
+	}
+	id := uint64(len(e.functions) + 1)
+	e.funcIDs[code] = id
+	// pprof drops anything in angle brackets from names, so module code is
+	// shown under the name of its file, which no function can have.
+	name := code.Name
+	if name == "<module>" {
+		name = ":module"
+		if code.Filename != "" {
+			name = filepath.Base(code.Filename) + name
+		}
+	}
+	e.functions = append(e.functions, pprofFunction{
+		id:         id,
+		code:       code,
+		name:       e.str(name),
+		systemName: e.str(code.Name),
+		filename:   e.str(code.Filename),
+	})
+	return id
+}
+
+// protobuf is a minimal encoder for the wire format.
+type protobuf struct {
+	data []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protobuf) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protobuf) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(x)
+}
+
+func (b *protobuf) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protobuf) bool(field int, x bool) {
+	if x {
+		b.uint64(field, 1)
+	}
+}
+
+func (b *protobuf) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protobuf) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protobuf) packed(field int, xs []uint64) {
+	var m protobuf
+	for _, x := range xs {
+		m.varint(x)
+	}
+	b.bytes(field, m.data)
+}
+
+func (b *protobuf) message(field int, f func(m *protobuf)) {
+	var m protobuf
+	f(&m)
+	b.bytes(field, m.data)
+}
@@ -0,0 +1,211 @@
+// Package profiler attributes the instructions executed by a VM, and the
+// wall time they take, to Python functions, lines and opcodes.
+package profiler
+
+import (
+	"sort"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// Profiler is an instrumenting profiler built on VM hooks. The time between
+// two instructions is charged to the first of them, so the cost of builtins
+// lands on the CALL_FUNCTION that invoked them. A VM without a profiler
+// attached runs at full speed.
+type Profiler struct {
+	vm     *vm.VM
+	remove func()
+
+	start    time.Time
+	duration time.Duration
+
+	root    *node
+	stack   []stackEntry
+	calls   map[*compiler.CodeObject]int64
+	opcodes [256]opcodeCounter
+
+	// The instruction currently running, charged when the next one starts.
+	last     *node
+	lastOp   compiler.OpCode
+	lastTime time.Time
+}
+
+// node is a position in the call tree: a line of a function, reached
+// through the chain of call sites given by its parents.
+type node struct {
+	key          nodeKey
+	parent       *node
+	children     map[nodeKey]*node
+	instructions int64
+	time         time.Duration
+}
+
+type nodeKey struct {
+	code *compiler.CodeObject
+	line int
+}
+
+func (n *node) child(code *compiler.CodeObject, line int) *node {
+	key := nodeKey{code, line}
+	if c, ok := n.children[key]; ok {
+		return c
+	}
+	if n.children == nil {
+		n.children = make(map[nodeKey]*node)
+	}
+	c := &node{key: key, parent: n}
+	n.children[key] = c
+	return c
+}
+
+// stackEntry shadows one VM frame; node is the frame's current line.
+type stackEntry struct {
+	frame *vm.Frame
+	line  int
+	node  *node
+}
+
+type opcodeCounter struct {
+	count int64
+	time  time.Duration
+}
+
+// Start attaches a new profiler to machine. Call Stop once the run is over.
+func Start(machine *vm.VM) *Profiler {
+	p := &Profiler{
+		vm:    machine,
+		root:  &node{},
+		calls: make(map[*compiler.CodeObject]int64),
+		start: time.Now(),
+	}
+	p.remove = machine.AddHook(p)
+	return p
+}
+
+// Stop detaches the profiler and charges the last instruction. The results
+// remain available.
+func (p *Profiler) Stop() {
+	if p.remove == nil {
+		return
+	}
+	now := time.Now()
+	p.charge(now)
+	p.last = nil
+	p.remove()
+	p.remove = nil
+	p.duration = now.Sub(p.start)
+}
+
+// Trace implements vm.Hook.
+func (p *Profiler) Trace(event vm.Event, frame *vm.Frame, arg object.Object) error {
+	switch event {
+	case vm.EventCall:
+		p.calls[frame.Code]++
+		// Frames unwound by an exception never return; drop them here.
+		p.truncate(p.vm.Depth() - 1)
+		p.stack = append(p.stack, stackEntry{frame: frame})
+	case vm.EventReturn:
+		p.truncate(p.vm.Depth() - 1)
+	}
+	return nil
+}
+
+// Instruction implements vm.InstructionHook.
+func (p *Profiler) Instruction(frame *vm.Frame, offset int) error {
+	now := time.Now()
+	p.charge(now)
+
+	top := p.top(frame)
+	line := frame.Code.LineForOffset(offset)
+	if top.node == nil || line != top.line {
+		top.line = line
+		top.node = p.parent(len(p.stack)-1).child(frame.Code, line)
+	}
+
+	op := frame.Code.Instructions[offset].Op
+	top.node.instructions++
+	p.opcodes[op].count++
+	p.last, p.lastOp, p.lastTime = top.node, op, now
+	return nil
+}
+
+func (p *Profiler) charge(now time.Time) {
+	if p.last == nil {
+		return
+	}
+	elapsed := now.Sub(p.lastTime)
+	p.last.time += elapsed
+	p.opcodes[p.lastOp].time += elapsed
+}
+
+func (p *Profiler) truncate(depth int) {
+	if depth < 0 {
+		depth = 0
+	}
+	if depth < len(p.stack) {
+		p.stack = p.stack[:depth]
+	}
+}
+
+func (p *Profiler) parent(i int) *node {
+	if i <= 0 {
+		return p.root
+	}
+	return p.stack[i-1].node
+}
+
+// top returns the entry shadowing frame, rebuilding the shadow stack from
+// the VM if they disagree, as when the profiler starts mid-run.
+func (p *Profiler) top(frame *vm.Frame) *stackEntry {
+	if n := len(p.stack); n > 0 && p.stack[n-1].frame == frame {
+		return &p.stack[n-1]
+	}
+	frames := p.vm.Frames()
+	p.stack = p.stack[:0]
+	for i, f := range frames {
+		entry := stackEntry{frame: f}
+		if i < len(frames)-1 {
+			entry.line = f.Line()
+			entry.node = p.parent(i).child(f.Code, entry.line)
+		}
+		p.stack = append(p.stack, entry)
+	}
+	return &p.stack[len(p.stack)-1]
+}
+
+// Duration returns the wall time between Start and Stop.
+func (p *Profiler) Duration() time.Duration {
+	return p.duration
+}
+
+// walk calls f for every node of the call tree that ran instructions,
+// depth first in a deterministic order.
+func (p *Profiler) walk(f func(n *node)) {
+	var visit func(n *node)
+	visit = func(n *node) {
+		if n.instructions > 0 {
+			f(n)
+		}
+		children := make([]*node, 0, len(n.children))
+		for _, c := range n.children {
+			children = append(children, c)
+		}
+		sort.Slice(children, func(i, j int) bool {
+			a, b := children[i].key, children[j].key
+			if a.code.Name != b.code.Name {
+				return a.code.Name < b.code.Name
+			}
+			if a.code.Firstlineno != b.code.Firstlineno {
+				return a.code.Firstlineno < b.code.Firstlineno
+			}
+			return a.line < b.line
+		})
+		for _, c := range children {
+			visit(c)
+		}
+	}
+	visit(p.root)
+}
@@ -0,0 +1,193 @@
+package profiler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+)
+
+// FunctionStat summarizes one function. Flat figures count its own
+// instructions; cumulative ones include the functions it called.
+type FunctionStat struct {
+	Name            string
+	Filename        string
+	Line            int
+	Calls           int64
+	Instructions    int64
+	CumInstructions int64
+	Time            time.Duration
+	CumTime         time.Duration
+}
+
+// LineStat summarizes one source line.
+type LineStat struct {
+	Filename     string
+	Function     string
+	Line         int
+	Instructions int64
+	Time         time.Duration
+}
+
+// OpcodeStat summarizes one opcode.
+type OpcodeStat struct {
+	Op    compiler.OpCode
+	Count int64
+	Time  time.Duration
+}
+
+// Total returns the number of instructions executed and the time charged
+// to them.
+func (p *Profiler) Total() (instructions int64, elapsed time.Duration) {
+	for _, op := range p.opcodes {
+		instructions += op.count
+		elapsed += op.time
+	}
+	return instructions, elapsed
+}
+
+// Functions returns per-function statistics, most expensive first.
+func (p *Profiler) Functions() []FunctionStat {
+	stats := make(map[*compiler.CodeObject]*FunctionStat)
+	stat := func(code *compiler.CodeObject) *FunctionStat {
+		s, ok := stats[code]
+		if !ok {
+			s = &FunctionStat{Name: code.Name, Filename: code.Filename, Line: code.Firstlineno, Calls: p.calls[code]}
+			stats[code] = s
+		}
+		return s
+	}
+
+	p.walk(func(n *node) {
+		s := stat(n.key.code)
+		s.Instructions += n.instructions
+		s.Time += n.time
+		// Charge each function on the stack once, even when recursive.
+		seen := make(map[*compiler.CodeObject]bool)
+		for a := n; a.parent != nil; a = a.parent {
+			if !seen[a.key.code] {
+				seen[a.key.code] = true
+				s := stat(a.key.code)
+				s.CumInstructions += n.instructions
+				s.CumTime += n.time
+			}
+		}
+	})
+
+	result := make([]FunctionStat, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.CumTime != b.CumTime {
+			return a.CumTime > b.CumTime
+		}
+		if a.CumInstructions != b.CumInstructions {
+			return a.CumInstructions > b.CumInstructions
+		}
+		return a.Name < b.Name
+	})
+	return result
+}
+
+// Lines returns per-line statistics, most expensive first.
+func (p *Profiler) Lines() []LineStat {
+	stats := make(map[nodeKey]*LineStat)
+	p.walk(func(n *node) {
+		s, ok := stats[n.key]
+		if !ok {
+			s = &LineStat{Filename: n.key.code.Filename, Function: n.key.code.Name, Line: n.key.line}
+			stats[n.key] = s
+		}
+		s.Instructions += n.instructions
+		s.Time += n.time
+	})
+
+	result := make([]LineStat, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		if a.Instructions != b.Instructions {
+			return a.Instructions > b.Instructions
+		}
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Line < b.Line
+	})
+	return result
+}
+
+// Opcodes returns per-opcode statistics, most executed first.
+func (p *Profiler) Opcodes() []OpcodeStat {
+	var result []OpcodeStat
+	for op, c := range p.opcodes {
+		if c.count > 0 {
+			result = append(result, OpcodeStat{Op: compiler.OpCode(op), Count: c.count, Time: c.time})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Op < result[j].Op
+	})
+	return result
+}
+
+// WriteText writes a report of the top n functions, lines and opcodes, or
+// of all of them if n is 0.
+func (p *Profiler) WriteText(w io.Writer, n int) error {
+	instructions, elapsed := p.Total()
+	pw := &printer{w: w}
+	pw.printf("Total: %d instructions in %v\n", instructions, elapsed)
+
+	pw.printf("\nFunctions:\n")
+	pw.printf("%8s %12s %12s %12s %12s  %s\n", "calls", "instrs", "cum instrs", "time", "cum time", "function")
+	for i, f := range p.Functions() {
+		if n > 0 && i == n {
+			break
+		}
+		pw.printf("%8d %12d %12d %12v %12v  %s (%s:%d)\n",
+			f.Calls, f.Instructions, f.CumInstructions, f.Time, f.CumTime, f.Name, f.Filename, f.Line)
+	}
+
+	pw.printf("\nLines:\n")
+	pw.printf("%12s %12s  %s\n", "instrs", "time", "line")
+	for i, l := range p.Lines() {
+		if n > 0 && i == n {
+			break
+		}
+		pw.printf("%12d %12v  %s:%d %s\n", l.Instructions, l.Time, l.Filename, l.Line, l.Function)
+	}
+
+	pw.printf("\nOpcodes:\n")
+	pw.printf("%12s %12s  %s\n", "count", "time", "opcode")
+	for i, o := range p.Opcodes() {
+		if n > 0 && i == n {
+			break
+		}
+		pw.printf("%12d %12v  %s\n", o.Count, o.Time, o.Op)
+	}
+	return pw.err
+}
+
+// printer remembers the first write error.
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
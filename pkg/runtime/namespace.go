@@ -0,0 +1,113 @@
+package runtime
+
+import (
+	"sync/atomic"
+
+	"github.com/warriorguo/gopy/pkg/object"
+)
+
+// Namespace holds named variables, such as a module's globals or the
+// builtins. Every name is stored in a slot that does not move while the
+// name is bound, and the version changes whenever a name is added or
+// removed. A slot found by Lookup therefore stays valid for as long as
+// Version returns the same value, which lets the VM cache lookups.
+type Namespace struct {
+	index   map[string]int
+	names   []string
+	values  []object.Object // nil in the slots of removed names
+	version uint64
+}
+
+// lastVersion makes versions unique across all namespaces, so a version
+// also identifies the namespace it came from.
+var lastVersion atomic.Uint64
+
+func NewNamespace() *Namespace {
+	return &Namespace{
+		index:   make(map[string]int),
+		version: lastVersion.Add(1),
+	}
+}
+
+// NamespaceOf returns a namespace holding the variables of vars.
+func NamespaceOf(vars map[string]object.Object) *Namespace {
+	ns := NewNamespace()
+	for name, value := range vars {
+		ns.Set(name, value)
+	}
+	return ns
+}
+
+// Version identifies the set of names bound in ns. Rebinding a name to a
+// new value keeps the version.
+func (ns *Namespace) Version() uint64 {
+	return ns.version
+}
+
+func (ns *Namespace) Get(name string) (object.Object, bool) {
+	if slot, ok := ns.index[name]; ok {
+		return ns.values[slot], true
+	}
+	return nil, false
+}
+
+func (ns *Namespace) Set(name string, value object.Object) {
+	if slot, ok := ns.index[name]; ok {
+		ns.values[slot] = value
+		return
+	}
+	ns.index[name] = len(ns.values)
+	ns.names = append(ns.names, name)
+	ns.values = append(ns.values, value)
+	ns.version = lastVersion.Add(1)
+}
+
+func (ns *Namespace) Delete(name string) {
+	slot, ok := ns.index[name]
+	if !ok {
+		return
+	}
+	delete(ns.index, name)
+	ns.values[slot] = nil
+	ns.version = lastVersion.Add(1)
+}
+
+// Lookup returns the slot of name.
+func (ns *Namespace) Lookup(name string) (int, bool) {
+	slot, ok := ns.index[name]
+	return slot, ok
+}
+
+// Slot returns the value in slot, which must come from Lookup at the
+// current version.
+func (ns *Namespace) Slot(slot int) object.Object {
+	return ns.values[slot]
+}
+
+// SetSlot rebinds the name in slot, which must come from Lookup at the
+// current version.
+func (ns *Namespace) SetSlot(slot int, value object.Object) {
+	ns.values[slot] = value
+}
+
+func (ns *Namespace) Len() int {
+	return len(ns.index)
+}
+
+// Range calls fn for each variable in the order the names were first bound.
+func (ns *Namespace) Range(fn func(name string, value object.Object)) {
+	for slot, name := range ns.names {
+		if ns.index[name] == slot {
+			fn(name, ns.values[slot])
+		}
+	}
+}
+
+// Map returns a copy of the variables in ns.
+func (ns *Namespace) Map() map[string]object.Object {
+	vars := make(map[string]object.Object, len(ns.index))
+	for name, slot := range ns.index {
+		vars[name] = ns.values[slot]
+	}
+	return vars
+}
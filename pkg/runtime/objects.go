@@ -1,7 +1,9 @@
 package runtime
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 
@@ -79,6 +81,61 @@ func (p *PyNone) Equal(other object.Object) bool {
 	return ok
 }
 
+// None, True and False are the only instances of their types that the
+// interpreter creates.
+var (
+	None  = &PyNone{}
+	True  = &PyBool{Value: true}
+	False = &PyBool{Value: false}
+)
+
+func NewBool(b bool) *PyBool {
+	if b {
+		return True
+	}
+	return False
+}
+
+// Ints from SmallIntMin to SmallIntMax are preallocated and shared, so
+// that arithmetic on small values and range() do not allocate.
+const (
+	SmallIntMin = -5
+	SmallIntMax = 256
+)
+
+var smallInts = func() (ints [SmallIntMax - SmallIntMin + 1]PyInt) {
+	for i := range ints {
+		ints[i].Value = i + SmallIntMin
+	}
+	return ints
+}()
+
+func NewInt(v int) *PyInt {
+	if v >= SmallIntMin && v <= SmallIntMax {
+		return &smallInts[v-SmallIntMin]
+	}
+	return &PyInt{Value: v}
+}
+
+// Is reports whether a and b are the same object, as the is operator does.
+// None, bools and small ints are compared by value, so that objects made
+// without NewBool or NewInt still behave as the shared instances.
+func Is(a, b object.Object) bool {
+	switch x := a.(type) {
+	case *PyNone:
+		_, ok := b.(*PyNone)
+		return ok
+	case *PyBool:
+		y, ok := b.(*PyBool)
+		return ok && x.Value == y.Value
+	case *PyInt:
+		if y, ok := b.(*PyInt); ok && x.Value == y.Value && x.Value >= SmallIntMin && x.Value <= SmallIntMax {
+			return true
+		}
+	}
+	return a == b
+}
+
 type PyList struct {
 	Elements []object.Object
 }
@@ -107,6 +164,28 @@ func (p *PyList) Equal(other object.Object) bool {
 	return false
 }
 
+// PyListIterator iterates over the elements of a list.
+type PyListIterator struct {
+	List  *PyList
+	Index int
+}
+
+func (p *PyListIterator) String() string { return fmt.Sprintf("<listiterator object at %p>", p) }
+func (p *PyListIterator) Type() string   { return "listiterator" }
+func (p *PyListIterator) IsTruthy() bool { return true }
+func (p *PyListIterator) Equal(other object.Object) bool {
+	return p == other
+}
+
+// Next returns the next element, or false once the list is exhausted.
+func (p *PyListIterator) Next() (object.Object, bool) {
+	if p.Index >= len(p.List.Elements) {
+		return nil, false
+	}
+	p.Index++
+	return p.List.Elements[p.Index-1], true
+}
+
 type PyDict struct {
 	Pairs map[string]object.Object
 	Keys  []string
@@ -157,6 +236,66 @@ func (p *PyDict) Equal(other object.Object) bool {
 	return false
 }
 
+type PyModule struct {
+	Name string
+	Dict map[string]object.Object
+}
+
+func NewPyModule(name string) *PyModule {
+	return &PyModule{
+		Name: name,
+		Dict: make(map[string]object.Object),
+	}
+}
+
+func (p *PyModule) String() string { return fmt.Sprintf("<module '%s'>", p.Name) }
+func (p *PyModule) Type() string   { return "module" }
+func (p *PyModule) IsTruthy() bool { return true }
+func (p *PyModule) Equal(other object.Object) bool {
+	if o, ok := other.(*PyModule); ok {
+		return p == o
+	}
+	return false
+}
+
+// PyFile is a file-like object backed by Go streams. Either side may be nil
+// for write-only or read-only files; Closer is nil for the standard streams.
+type PyFile struct {
+	Name   string
+	Writer io.Writer
+	Reader *bufio.Reader
+	Closer io.Closer
+	Closed bool
+}
+
+func NewPyFile(name string, w io.Writer, r io.Reader) *PyFile {
+	f := &PyFile{Name: name, Writer: w}
+	f.SetReader(r)
+	return f
+}
+
+func (p *PyFile) SetReader(r io.Reader) {
+	if r == nil {
+		p.Reader = nil
+		return
+	}
+	if br, ok := r.(*bufio.Reader); ok {
+		p.Reader = br
+		return
+	}
+	p.Reader = bufio.NewReader(r)
+}
+
+func (p *PyFile) String() string { return fmt.Sprintf("<open file '%s'>", p.Name) }
+func (p *PyFile) Type() string   { return "file" }
+func (p *PyFile) IsTruthy() bool { return true }
+func (p *PyFile) Equal(other object.Object) bool {
+	if o, ok := other.(*PyFile); ok {
+		return p == o
+	}
+	return false
+}
+
 type CodeObject interface {
 	String() string
 	Disassemble() string
@@ -242,15 +381,15 @@ func ToGoString(obj object.Object) string {
 func ToPyObject(value interface{}) object.Object {
 	switch v := value.(type) {
 	case int:
-		return &PyInt{Value: v}
+		return NewInt(v)
 	case float64:
 		return &PyFloat{Value: v}
 	case string:
 		return &PyString{Value: v}
 	case bool:
-		return &PyBool{Value: v}
+		return NewBool(v)
 	case nil:
-		return &PyNone{}
+		return None
 	default:
 		return &PyString{Value: fmt.Sprintf("%v", v)}
 	}
@@ -0,0 +1,498 @@
+package transpiler
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// CRuntimeHeader is the name of the runtime header that generated C
+// includes, and CRuntime its text.
+const CRuntimeHeader = "gopy.h"
+
+//go:embed gopy.h
+var CRuntime string
+
+// COptions configure GenerateC.
+type COptions struct {
+	// Source is the source text of the module, which tracebacks quote.
+	Source string
+}
+
+// cBuiltins maps the builtins the C runtime implements to their
+// gp_function.
+var cBuiltins = map[string]string{
+	"len":       "gp_builtin_len",
+	"range":     "gp_builtin_range",
+	"type":      "gp_builtin_type",
+	"str":       "gp_builtin_str",
+	"raw_input": "gp_builtin_raw_input",
+}
+
+// GenerateC returns a C99 program that runs code as the VM would, which
+// includes CRuntimeHeader. Unlike Generate it has no bytecode to fall back
+// on: every code object must have register code, and code the C runtime
+// cannot run, such as imports, is an error.
+func GenerateC(code *compiler.CodeObject, opts COptions) ([]byte, error) {
+	g := &cGenerator{
+		byCode:  make(map[*compiler.CodeObject]*cFunction),
+		globals: make(map[string]int),
+		stored:  make(map[string]bool),
+		consts:  make(map[cConst]string),
+		used:    make(map[string]bool),
+		vm:      make(map[string]bool),
+	}
+	for _, name := range vm.NewVM().BuiltinNames() {
+		g.vm[name] = true
+	}
+	g.collect(code)
+	for _, fn := range g.functions {
+		if err := g.translate(fn); err != nil {
+			return nil, err
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "/* Code generated by py2c from %s. DO NOT EDIT. */\n\n", code.Filename)
+	fmt.Fprintf(&b, "#define GOPY_IMPLEMENTATION\n#include %q\n\n", CRuntimeHeader)
+	for _, fn := range g.functions {
+		fmt.Fprintf(&b, "static gp_value %s(gp_value *args);\n", fn.name)
+	}
+	b.WriteByte('\n')
+	for _, fn := range g.functions[1:] {
+		fmt.Fprintf(&b, "static const gp_function %s_object = {%s, %d, %s, NULL};\n",
+			fn.name, cString(fn.co.Name), fn.co.Argcount, fn.name)
+	}
+	if len(g.functions) > 1 {
+		b.WriteByte('\n')
+	}
+	if g.strings.Len() > 0 {
+		b.Write(g.strings.Bytes())
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "static gp_value globals[%d];", max(len(g.names), 1))
+	if len(g.names) > 0 {
+		fmt.Fprintf(&b, " /* %s */", strings.Join(g.names, ", "))
+	}
+	b.WriteString("\n\n")
+	var lines []string
+	if opts.Source != "" {
+		lines = strings.Split(opts.Source, "\n")
+		b.WriteString("static const char *const source[] = {\n")
+		for _, line := range lines {
+			fmt.Fprintf(&b, "\t%s,\n", cString(strings.TrimSpace(line)))
+		}
+		b.WriteString("};\n\n")
+	}
+	for _, fn := range g.functions {
+		b.Write(fn.body.Bytes())
+		b.WriteByte('\n')
+	}
+	b.WriteString("int main(void)\n{\n")
+	source := "NULL"
+	if lines != nil {
+		source = "source"
+	}
+	fmt.Fprintf(&b, "\treturn gp_run(module, %s, globals, %d, %s, %d);\n}\n",
+		cString(code.Filename), len(g.names), source, len(lines))
+	return b.Bytes(), nil
+}
+
+type cGenerator struct {
+	functions []*cFunction // the module first
+	byCode    map[*compiler.CodeObject]*cFunction
+	names     []string       // globals, by index
+	globals   map[string]int // indexes of the globals
+	stored    map[string]bool
+	strings   bytes.Buffer // definitions of the string constants
+	consts    map[cConst]string
+	used      map[string]bool // C names of the functions
+	vm        map[string]bool // builtins of the VM
+}
+
+// cFunction is the C function of a code object.
+type cFunction struct {
+	name string
+	co   *compiler.CodeObject
+	body bytes.Buffer
+}
+
+// cConst is constant k of a code object.
+type cConst struct {
+	co *compiler.CodeObject
+	k  int
+}
+
+// collect names the C functions of co and the functions it defines, and
+// records the globals they store.
+func (g *cGenerator) collect(co *compiler.CodeObject) {
+	fn := &cFunction{name: g.cName(co), co: co}
+	g.functions = append(g.functions, fn)
+	g.byCode[co] = fn
+	if rc := co.Registers; rc != nil {
+		for _, instr := range rc.Instructions {
+			if instr.Op == compiler.RegStoreGlobal {
+				g.stored[co.Names[instr.A]] = true
+			}
+		}
+	}
+	for _, c := range co.Consts {
+		if fn, ok := c.(*compiler.PyFunction); ok && fn.Code != nil {
+			g.collect(fn.Code)
+		}
+	}
+}
+
+// cName returns an unused C name for the function of co.
+func (g *cGenerator) cName(co *compiler.CodeObject) string {
+	base := "module"
+	if co.Name != "<module>" {
+		base = "fn_" + co.Name
+		if !isCIdentifier(base) {
+			base = "fn"
+		}
+	}
+	name := base
+	for i := 2; g.used[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	g.used[name] = true
+	return name
+}
+
+// global returns the C expression for the global called name.
+func (g *cGenerator) global(name string) string {
+	i, ok := g.globals[name]
+	if !ok {
+		i = len(g.names)
+		g.globals[name] = i
+		g.names = append(g.names, name)
+	}
+	return fmt.Sprintf("globals[%d]", i)
+}
+
+// str returns the C name of the string constant k of co.
+func (g *cGenerator) str(co *compiler.CodeObject, k int) string {
+	key := cConst{co, k}
+	if name, ok := g.consts[key]; ok {
+		return name
+	}
+	name := fmt.Sprintf("s%d", len(g.consts))
+	g.consts[key] = name
+	s := co.Consts[k].(*runtime.PyString).Value
+	fmt.Fprintf(&g.strings, "static gp_str %s = GP_STR_CONSTANT(%s, %d);\n", name, cString(s), len(s))
+	return name
+}
+
+// cTranslator translates the register code of a code object into a C
+// function. The registers are the frame's window of the value stack, where
+// the collector finds them, and each jump is a goto.
+type cTranslator struct {
+	*flow
+	g    *cGenerator
+	co   *compiler.CodeObject
+	b    *bytes.Buffer
+	line int // line of frame.line while emitting
+}
+
+func (g *cGenerator) translate(fn *cFunction) error {
+	co := fn.co
+	rc := co.Registers
+	if rc == nil {
+		return fmt.Errorf("%s: %s has no register code", co.Filename, co.Name)
+	}
+	if err := compiler.Verify(co); err != nil {
+		return err
+	}
+	t := &cTranslator{g: g, co: co, b: &fn.body}
+	f, err := newFlow(rc.Instructions, t.check)
+	if err != nil {
+		return err
+	}
+	t.flow = f
+	t.function(fn.name)
+	return nil
+}
+
+// check reports why the instruction at pc cannot run in C, if it cannot.
+func (t *cTranslator) check(pc int) error {
+	co := t.co
+	instr := co.Registers.Instructions[pc]
+	errorf := func(format string, args ...interface{}) error {
+		line := co.Registers.LineForOffset(pc)
+		return fmt.Errorf("%s:%d: %s", co.Filename, line, fmt.Sprintf(format, args...))
+	}
+	switch instr.Op {
+	case compiler.RegImport:
+		return errorf("import is not supported by the C target")
+	case compiler.RegLoadAttr:
+		return errorf("attribute access is not supported by the C target")
+	case compiler.RegPrintTo, compiler.RegPrintNewlineTo:
+		return errorf("print >> is not supported by the C target")
+	case compiler.RegLoadName, compiler.RegLoadGlobal:
+		name := co.Names[instr.B]
+		if _, ok := cBuiltins[name]; !ok && t.g.vm[name] && !t.g.stored[name] {
+			return errorf("builtin %s is not supported by the C target", name)
+		}
+	}
+	if !supported(instr.Op) {
+		return errorf("unsupported instruction %s", instr.Op)
+	}
+	for i, kind := range instr.Op.Operands() {
+		if kind != 'k' {
+			continue
+		}
+		if k, ok := compiler.IsConstOperand(instr.Operand(i)); ok {
+			switch c := co.Consts[k].(type) {
+			case *runtime.PyNone, *runtime.PyBool, *runtime.PyInt, *runtime.PyFloat, *runtime.PyString:
+			default:
+				return errorf("%s constants are not supported by the C target", c.Type())
+			}
+		}
+	}
+	return nil
+}
+
+func (t *cTranslator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(t.b, format, args...)
+}
+
+// function emits the C function called name.
+func (t *cTranslator) function(name string) {
+	co := t.co
+	nregs := co.Registers.NumRegisters
+	t.printf("/* %s runs %s, line %d of %s. */\n", name, co.Name, co.Firstlineno, co.Filename)
+	t.printf("static gp_value %s(gp_value *args)\n{\n", name)
+	t.printf("\tgp_frame frame;\n")
+	if nregs > 0 {
+		t.printf("\tgp_value *r = gp_enter(&frame, %s, %d);\n\n", cString(co.Name), nregs)
+	} else {
+		t.printf("\tgp_enter(&frame, %s, 0);\n\n", cString(co.Name))
+	}
+	if co.Argcount == 0 {
+		t.printf("\t(void)args;\n")
+	}
+	for i := 0; i < co.Argcount; i++ {
+		t.printf("\tr[%d] = args[%d]; /* %s */\n", i, i, co.Varnames[i])
+	}
+
+	last := len(t.code) - 1
+	for pc := range t.code {
+		if !t.reachable[pc] {
+			continue
+		}
+		if t.blocks[pc] {
+			t.block(pc)
+		} else if fallible(t.code[pc].Op) {
+			t.setLine(pc)
+		}
+		t.instruction(pc)
+	}
+	if op := t.code[last].Op; t.reachable[last] && op != compiler.RegReturn && op != compiler.RegJump {
+		t.printf("\treturn gp_leave(&frame, gp_none);\n")
+	}
+	t.printf("}\n")
+}
+
+// block starts the basic block at pc, which is a safepoint.
+func (t *cTranslator) block(pc int) {
+	if t.labels[pc] {
+		t.printf("L%d:\n", pc)
+	}
+	t.line = -1
+	t.setLine(pc)
+	t.printf("\tgp_safepoint();\n")
+}
+
+// setLine sets the line of the frame to that of the instruction at pc.
+func (t *cTranslator) setLine(pc int) {
+	if line := t.co.Registers.LineForOffset(pc); line != t.line {
+		t.printf("\tframe.line = %d;\n", line)
+		t.line = line
+	}
+}
+
+func (t *cTranslator) reg(r int32) string {
+	return fmt.Sprintf("r[%d]", r)
+}
+
+// rk returns the C expression for the RK operand x.
+func (t *cTranslator) rk(x int32) string {
+	k, ok := compiler.IsConstOperand(x)
+	if !ok {
+		return t.reg(x)
+	}
+	switch c := t.co.Consts[k].(type) {
+	case *runtime.PyNone:
+		return "gp_none"
+	case *runtime.PyBool:
+		if c.Value {
+			return "gp_true"
+		}
+		return "gp_false"
+	case *runtime.PyInt:
+		return fmt.Sprintf("gp_int(%s)", cInt(int64(c.Value)))
+	case *runtime.PyFloat:
+		return fmt.Sprintf("gp_float(%s)", cFloat(c.Value))
+	}
+	return fmt.Sprintf("gp_obj(&%s.h)", t.g.str(t.co, k))
+}
+
+// cOps are the runtime functions of the operators.
+var cOps = map[compiler.RegOp]string{
+	compiler.RegAdd:         "gp_add",
+	compiler.RegSub:         "gp_sub",
+	compiler.RegMul:         "gp_mul",
+	compiler.RegDiv:         "gp_div",
+	compiler.RegMod:         "gp_mod",
+	compiler.RegPos:         "gp_pos",
+	compiler.RegNeg:         "gp_neg",
+	compiler.RegEq:          "gp_equal",
+	compiler.RegNe:          "!gp_equal",
+	compiler.RegLt:          "gp_lt",
+	compiler.RegLe:          "gp_le",
+	compiler.RegGt:          "gp_gt",
+	compiler.RegGe:          "gp_ge",
+	compiler.RegIn:          "gp_in",
+	compiler.RegIs:          "gp_is",
+	compiler.RegIsNot:       "!gp_is",
+	compiler.RegJumpIfNotEq: "gp_equal",
+	compiler.RegJumpIfNotNe: "!gp_equal",
+	compiler.RegJumpIfNotLt: "gp_lt",
+	compiler.RegJumpIfNotLe: "gp_le",
+	compiler.RegJumpIfNotGt: "gp_gt",
+	compiler.RegJumpIfNotGe: "gp_ge",
+}
+
+func (t *cTranslator) instruction(pc int) {
+	instr := t.code[pc]
+	a, b, c := instr.A, instr.B, instr.C
+	switch op := instr.Op; op {
+	case compiler.RegMove:
+		t.printf("\t%s = %s;\n", t.reg(a), t.rk(b))
+
+	case compiler.RegLoadName, compiler.RegLoadGlobal:
+		name := t.co.Names[b]
+		builtin := "NULL"
+		if fn, ok := cBuiltins[name]; ok {
+			builtin = "&" + fn
+		}
+		load := "gp_load_name"
+		if op == compiler.RegLoadGlobal {
+			load = "gp_load_global"
+		}
+		t.printf("\t%s = %s(&%s, %s, %s);\n", t.reg(a), load, t.g.global(name), cString(name), builtin)
+	case compiler.RegStoreGlobal:
+		t.printf("\t%s = %s; /* %s */\n", t.g.global(t.co.Names[a]), t.rk(b), t.co.Names[a])
+
+	case compiler.RegAdd, compiler.RegSub, compiler.RegMul, compiler.RegDiv, compiler.RegMod:
+		t.printf("\t%s = %s(%s, %s);\n", t.reg(a), cOps[op], t.rk(b), t.rk(c))
+	case compiler.RegPos, compiler.RegNeg:
+		t.printf("\t%s = %s(%s);\n", t.reg(a), cOps[op], t.rk(b))
+	case compiler.RegNot:
+		t.printf("\t%s = gp_bool(!gp_truthy(%s));\n", t.reg(a), t.rk(b))
+	case compiler.RegEq, compiler.RegNe, compiler.RegLt, compiler.RegLe, compiler.RegGt, compiler.RegGe,
+		compiler.RegIn, compiler.RegIs, compiler.RegIsNot:
+		t.printf("\t%s = gp_bool(%s(%s, %s));\n", t.reg(a), cOps[op], t.rk(b), t.rk(c))
+
+	case compiler.RegJump:
+		t.printf("\tgoto L%d;\n", a)
+	case compiler.RegJumpIfFalse:
+		t.printf("\tif (!gp_truthy(%s))\n\t\tgoto L%d;\n", t.rk(b), a)
+	case compiler.RegJumpIfTrue:
+		t.printf("\tif (gp_truthy(%s))\n\t\tgoto L%d;\n", t.rk(b), a)
+	case compiler.RegJumpIfNotEq, compiler.RegJumpIfNotLt, compiler.RegJumpIfNotLe, compiler.RegJumpIfNotGt,
+		compiler.RegJumpIfNotGe:
+		t.printf("\tif (!%s(%s, %s))\n\t\tgoto L%d;\n", cOps[op], t.rk(b), t.rk(c), a)
+	case compiler.RegJumpIfNotNe:
+		t.printf("\tif (gp_equal(%s, %s))\n\t\tgoto L%d;\n", t.rk(b), t.rk(c), a)
+
+	case compiler.RegBuildList:
+		t.printf("\t%s = gp_build_list(&%s, %d);\n", t.reg(a), t.reg(b), c)
+	case compiler.RegBuildDict:
+		t.printf("\t%s = gp_build_dict(&%s, %d);\n", t.reg(a), t.reg(b), c)
+	case compiler.RegGetItem:
+		t.printf("\t%s = gp_get_item(%s, %s);\n", t.reg(a), t.rk(b), t.rk(c))
+	case compiler.RegSetItem:
+		t.printf("\tgp_set_item(%s, %s, %s);\n", t.rk(a), t.rk(b), t.rk(c))
+	case compiler.RegCall:
+		t.printf("\t%s = gp_call(%s, &%s, %d);\n", t.reg(a), t.reg(b), t.reg(b+1), c)
+	case compiler.RegReturn:
+		t.printf("\treturn gp_leave(&frame, %s);\n", t.rk(a))
+
+	case compiler.RegPrint:
+		t.printf("\tgp_print(%s, %d);\n", t.rk(a), b)
+	case compiler.RegPrintNewline:
+		t.printf("\tgp_print_newline();\n")
+
+	case compiler.RegMakeFunction:
+		template := t.co.Consts[b].(*compiler.PyFunction)
+		t.printf("\t%s = gp_func(&%s_object);\n", t.reg(a), t.g.byCode[template.Code].name)
+	case compiler.RegGetIter:
+		t.printf("\t%s = gp_iter(%s);\n", t.reg(a), t.rk(b))
+	case compiler.RegForIter:
+		t.printf("\tif (!gp_next(%s, &%s))\n\t\tgoto L%d;\n", t.reg(b), t.reg(a), c)
+	}
+}
+
+func isCIdentifier(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// cString returns a C string literal for s. Bytes other than printable
+// ASCII are octal escapes, and so is ? so that no trigraphs form.
+func cString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= ' ' && c <= '~' && c != '?':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func cInt(i int64) string {
+	switch {
+	case i == math.MinInt64:
+		return "INT64_MIN"
+	case i < math.MinInt32 || i > math.MaxInt32:
+		return fmt.Sprintf("INT64_C(%d)", i)
+	}
+	return strconv.FormatInt(i, 10)
+}
+
+func cFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "HUGE_VAL"
+	case math.IsInf(f, -1):
+		return "-HUGE_VAL"
+	case math.IsNaN(f):
+		return "(HUGE_VAL - HUGE_VAL)"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
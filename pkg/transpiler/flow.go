@@ -0,0 +1,85 @@
+package transpiler
+
+import "github.com/warriorguo/gopy/pkg/compiler"
+
+// flow is the control flow of register code: which instructions can run,
+// which are jump targets and where basic blocks start.
+type flow struct {
+	code      []compiler.RegInstruction
+	reachable []bool
+	labels    []bool // targets of reachable jumps
+	blocks    []bool // starts of basic blocks
+}
+
+// newFlow analyzes code. It calls check with the offset of each reachable
+// instruction and fails with the first error check returns.
+func newFlow(code []compiler.RegInstruction, check func(pc int) error) (*flow, error) {
+	f := &flow{
+		code:      code,
+		reachable: make([]bool, len(code)),
+		labels:    make([]bool, len(code)),
+		blocks:    make([]bool, len(code)),
+	}
+	work := []int{0}
+	f.reachable[0] = true
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		if err := check(pc); err != nil {
+			return nil, err
+		}
+		for _, next := range f.successors(pc) {
+			if !f.reachable[next] {
+				f.reachable[next] = true
+				work = append(work, next)
+			}
+		}
+	}
+
+	f.blocks[0] = true
+	for pc, instr := range code {
+		if i := instr.Op.JumpOperand(); i >= 0 && f.reachable[pc] {
+			target := int(instr.Operand(i))
+			f.labels[target] = true
+			f.blocks[target] = true
+			if pc+1 < len(code) {
+				f.blocks[pc+1] = true
+			}
+		}
+	}
+	return f, nil
+}
+
+// successors returns the offsets that may run after the instruction at pc.
+func (f *flow) successors(pc int) []int {
+	instr := f.code[pc]
+	switch instr.Op {
+	case compiler.RegReturn:
+		return nil
+	case compiler.RegJump:
+		return []int{int(instr.A)}
+	}
+	next := []int{}
+	if pc+1 < len(f.code) {
+		next = append(next, pc+1)
+	}
+	if i := instr.Op.JumpOperand(); i >= 0 {
+		next = append(next, int(instr.Operand(i)))
+	}
+	return next
+}
+
+// blockLen returns how many instructions the basic block at pc runs.
+func (f *flow) blockLen(pc int) int {
+	n := 0
+	for i := pc; i < len(f.code); i++ {
+		if i > pc && f.blocks[i] {
+			break
+		}
+		n++
+		if op := f.code[i].Op; op == compiler.RegReturn || op == compiler.RegJump {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,379 @@
+package transpiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+)
+
+// function is the native function of a code object.
+type function struct {
+	name      string // Go name
+	path      string // Go expression for the code object
+	qualified string
+	body      bytes.Buffer
+}
+
+// opNames are the Go names of the operators that native functions pass to
+// the VM.
+var opNames = map[compiler.OpCode]string{
+	compiler.OpBinaryAdd:    "compiler.OpBinaryAdd",
+	compiler.OpBinarySub:    "compiler.OpBinarySub",
+	compiler.OpBinaryMul:    "compiler.OpBinaryMul",
+	compiler.OpBinaryDiv:    "compiler.OpBinaryDiv",
+	compiler.OpBinaryMod:    "compiler.OpBinaryMod",
+	compiler.OpUnaryPos:     "compiler.OpUnaryPos",
+	compiler.OpUnaryNeg:     "compiler.OpUnaryNeg",
+	compiler.OpCompareEq:    "compiler.OpCompareEq",
+	compiler.OpCompareNe:    "compiler.OpCompareNe",
+	compiler.OpCompareLt:    "compiler.OpCompareLt",
+	compiler.OpCompareLe:    "compiler.OpCompareLe",
+	compiler.OpCompareGt:    "compiler.OpCompareGt",
+	compiler.OpCompareGe:    "compiler.OpCompareGe",
+	compiler.OpCompareIn:    "compiler.OpCompareIn",
+	compiler.OpCompareIs:    "compiler.OpCompareIs",
+	compiler.OpCompareIsNot: "compiler.OpCompareIsNot",
+}
+
+// translator translates the register code of a code object into the body
+// of a native function. Each register is a Go variable and each jump a
+// goto, so control flow is that of the register code.
+type translator struct {
+	*flow
+	g  *generator
+	co *compiler.CodeObject
+	b  *bytes.Buffer
+
+	read   []bool // registers the code reads
+	consts bool   // whether the code reads constants
+	line   int    // line of frame.IP while emitting
+}
+
+// translate returns the native function of co, or why it has none.
+func (g *generator) translate(co *compiler.CodeObject) (*function, error) {
+	rc := co.Registers
+	if rc == nil {
+		return nil, errors.New("no register code")
+	}
+	if err := compiler.Verify(co); err != nil {
+		return nil, err
+	}
+	f, err := newFlow(rc.Instructions, func(pc int) error {
+		if op := rc.Instructions[pc].Op; !supported(op) {
+			return fmt.Errorf("unsupported instruction %s", op)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fn := &function{}
+	t := &translator{
+		flow: f,
+		g:    g,
+		co:   co,
+		b:    &fn.body,
+		read: make([]bool, rc.NumRegisters),
+	}
+	// Instructions without effects whose result is never read are left
+	// out, and so are the registers only they read.
+	for changed := true; changed; {
+		changed = false
+		for pc, instr := range t.code {
+			if t.emitted(pc) {
+				changed = t.uses(instr) || changed
+			}
+		}
+	}
+	fn.name = g.goName(co)
+	t.function(fn.name)
+	return fn, nil
+}
+
+// emitted reports whether the instruction at pc is translated.
+func (t *translator) emitted(pc int) bool {
+	instr := t.code[pc]
+	return t.reachable[pc] && (!pure(instr.Op) || t.read[instr.A])
+}
+
+// uses records the registers and constants instr reads, and reports
+// whether it found new ones.
+func (t *translator) uses(instr compiler.RegInstruction) bool {
+	changed := false
+	use := func(x int32) {
+		if x < 0 {
+			t.consts = true
+		} else if !t.read[x] {
+			t.read[x] = true
+			changed = true
+		}
+	}
+	for i, kind := range instr.Op.Operands() {
+		if kind == 'k' {
+			use(instr.Operand(i))
+		}
+	}
+	first, n := instr.B, int32(0)
+	switch instr.Op {
+	case compiler.RegBuildList:
+		n = instr.C
+	case compiler.RegBuildDict:
+		n = 2 * instr.C
+	case compiler.RegCall:
+		n = instr.C + 1
+	case compiler.RegForIter:
+		n = 1
+	}
+	for r := first; r < first+n; r++ {
+		use(r)
+	}
+	return changed
+}
+
+func (t *translator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(t.b, format, args...)
+}
+
+// function emits the native function called name.
+func (t *translator) function(name string) {
+	co := t.co
+	t.printf("// %s runs %s, line %d of %s.\n", name, co.Name, co.Firstlineno, co.Filename)
+	t.printf("func %s(m *vm.Native, frame *vm.Frame) (object.Object, error) {\n", name)
+	if t.consts {
+		t.printf("consts := frame.Code.Consts\n")
+	}
+	var temps []string
+	for r, read := range t.read {
+		switch {
+		case !read:
+		case r < len(co.Varnames):
+			t.printf("r%d := frame.Locals[%d] // %s\n", r, r, co.Varnames[r])
+		default:
+			temps = append(temps, fmt.Sprintf("r%d", r))
+		}
+	}
+	if len(temps) > 0 {
+		t.printf("var %s object.Object\n", strings.Join(temps, ", "))
+	}
+	t.printf("var err error\n")
+
+	for pc := range t.code {
+		if !t.emitted(pc) {
+			if t.blocks[pc] && t.reachable[pc] {
+				t.block(pc)
+			}
+			continue
+		}
+		if t.blocks[pc] {
+			t.block(pc)
+		} else if fallible(t.code[pc].Op) {
+			t.setLine(pc)
+		}
+		t.instruction(pc)
+	}
+	t.printf("}\n")
+}
+
+// block starts the basic block at pc.
+func (t *translator) block(pc int) {
+	if t.labels[pc] {
+		t.printf("L%d:\n", pc)
+	}
+	t.line = -1
+	t.setLine(pc)
+	t.check(fmt.Sprintf("m.Step(%d)", t.blockLen(pc)))
+}
+
+// setLine points frame.IP at the instruction at pc, if that changes the
+// line a traceback shows.
+func (t *translator) setLine(pc int) {
+	if line := t.co.Registers.LineForOffset(pc); line != t.line {
+		t.printf("frame.IP = %d\n", pc+1)
+		t.line = line
+	}
+}
+
+// check emits a call of the VM that may fail.
+func (t *translator) check(call string) {
+	t.printf("if err = %s; err != nil {\nreturn nil, err\n}\n", call)
+}
+
+// assign emits the assignment of the result of a VM call that may fail to
+// register r.
+func (t *translator) assign(r int32, call string) {
+	t.printf("if %s, err = %s; err != nil {\nreturn nil, err\n}\n", t.dst(r), call)
+}
+
+// assignName is assign for a call that looks up a name, which it notes.
+func (t *translator) assignName(r int32, call, name string) {
+	t.printf("if %s, err = %s; err != nil { // %s\nreturn nil, err\n}\n", t.dst(r), call, name)
+}
+
+func (t *translator) reg(r int32) string {
+	return fmt.Sprintf("r%d", r)
+}
+
+// dst returns the variable an instruction writing register r assigns.
+func (t *translator) dst(r int32) string {
+	if !t.read[r] {
+		return "_"
+	}
+	return t.reg(r)
+}
+
+// rk returns the expression for the RK operand x.
+func (t *translator) rk(x int32) string {
+	if k, ok := compiler.IsConstOperand(x); ok {
+		return fmt.Sprintf("consts[%d]", k)
+	}
+	return t.reg(x)
+}
+
+// regs returns the expression for a slice of n registers from first.
+func (t *translator) regs(first, n int32) string {
+	if n == 0 {
+		return "nil"
+	}
+	elements := make([]string, n)
+	for i := range elements {
+		elements[i] = t.reg(first + int32(i))
+	}
+	return "[]object.Object{" + strings.Join(elements, ", ") + "}"
+}
+
+func (t *translator) instruction(pc int) {
+	instr := t.code[pc]
+	a, b, c := instr.A, instr.B, instr.C
+	switch op := instr.Op; op {
+	case compiler.RegMove:
+		if t.read[a] {
+			t.printf("%s = %s\n", t.reg(a), t.rk(b))
+		}
+
+	case compiler.RegLoadName:
+		t.assignName(a, fmt.Sprintf("m.LoadName(frame, %d, %d)", pc, b), t.co.Names[b])
+	case compiler.RegLoadGlobal:
+		t.assignName(a, fmt.Sprintf("m.LoadGlobal(frame, %d, %d)", pc, b), t.co.Names[b])
+	case compiler.RegStoreGlobal:
+		t.printf("m.StoreGlobal(frame, %d, %d, %s) // %s\n", pc, a, t.rk(b), t.co.Names[a])
+
+	case compiler.RegAdd, compiler.RegSub, compiler.RegMul, compiler.RegDiv, compiler.RegMod:
+		t.assign(a, fmt.Sprintf("m.BinaryOp(%s, %s, %s)", opNames[op.Operator()], t.rk(b), t.rk(c)))
+	case compiler.RegPos, compiler.RegNeg:
+		t.assign(a, fmt.Sprintf("m.UnaryOp(%s, %s)", opNames[op.Operator()], t.rk(b)))
+	case compiler.RegNot:
+		if t.read[a] {
+			t.g.runtime = true
+			t.printf("%s = runtime.NewBool(!%s.IsTruthy())\n", t.reg(a), t.rk(b))
+		}
+
+	case compiler.RegEq, compiler.RegNe, compiler.RegIs, compiler.RegIsNot:
+		if t.read[a] {
+			t.g.runtime = true
+			t.printf("%s = runtime.NewBool(%s)\n", t.reg(a), t.test(op.Operator(), b, c))
+		}
+	case compiler.RegLt, compiler.RegLe, compiler.RegGt, compiler.RegGe, compiler.RegIn:
+		t.assign(a, fmt.Sprintf("m.Compare(%s, %s, %s)", opNames[op.Operator()], t.rk(b), t.rk(c)))
+
+	case compiler.RegJump:
+		t.printf("goto L%d\n", a)
+	case compiler.RegJumpIfFalse:
+		t.printf("if !%s.IsTruthy() {\ngoto L%d\n}\n", t.rk(b), a)
+	case compiler.RegJumpIfTrue:
+		t.printf("if %s.IsTruthy() {\ngoto L%d\n}\n", t.rk(b), a)
+	case compiler.RegJumpIfNotEq:
+		t.printf("if !%s {\ngoto L%d\n}\n", t.test(compiler.OpCompareEq, b, c), a)
+	case compiler.RegJumpIfNotNe:
+		t.printf("if %s {\ngoto L%d\n}\n", t.test(compiler.OpCompareEq, b, c), a)
+	case compiler.RegJumpIfNotLt, compiler.RegJumpIfNotLe, compiler.RegJumpIfNotGt, compiler.RegJumpIfNotGe:
+		t.printf("if ok, err := m.Test(%s, %s, %s); err != nil {\nreturn nil, err\n} else if !ok {\ngoto L%d\n}\n",
+			opNames[op.Operator()], t.rk(b), t.rk(c), a)
+
+	case compiler.RegBuildList:
+		t.assign(a, fmt.Sprintf("m.BuildList(%s)", t.regs(b, c)))
+	case compiler.RegBuildDict:
+		t.assign(a, fmt.Sprintf("m.BuildDict(%s)", t.regs(b, 2*c)))
+	case compiler.RegGetItem:
+		t.assign(a, fmt.Sprintf("m.GetItem(%s, %s)", t.rk(b), t.rk(c)))
+	case compiler.RegSetItem:
+		t.check(fmt.Sprintf("m.SetItem(%s, %s, %s)", t.rk(a), t.rk(b), t.rk(c)))
+	case compiler.RegCall:
+		t.assign(a, fmt.Sprintf("m.Call(%s, %s)", t.reg(b), t.regs(b+1, c)))
+	case compiler.RegReturn:
+		t.printf("return %s, nil\n", t.rk(a))
+
+	case compiler.RegPrint:
+		t.check(fmt.Sprintf("m.Print(%s, %t)", t.rk(a), b == 1))
+	case compiler.RegPrintNewline:
+		t.check("m.PrintNewline()")
+	case compiler.RegPrintTo:
+		t.check(fmt.Sprintf("m.PrintTo(%s, %s, %t)", t.rk(a), t.rk(b), c == 1))
+	case compiler.RegPrintNewlineTo:
+		t.check(fmt.Sprintf("m.PrintNewlineTo(%s)", t.rk(a)))
+
+	case compiler.RegMakeFunction:
+		if t.read[a] {
+			t.printf("%s = m.MakeFunction(frame, %d)\n", t.reg(a), b)
+		}
+	case compiler.RegLoadAttr:
+		t.assign(a, fmt.Sprintf("m.GetAttr(%s, %s)", t.rk(b), strconv.Quote(t.co.Names[c])))
+	case compiler.RegImport:
+		t.assign(a, fmt.Sprintf("m.Import(%s)", strconv.Quote(t.co.Names[b])))
+	case compiler.RegGetIter:
+		t.assign(a, fmt.Sprintf("m.GetIter(%s)", t.rk(b)))
+	case compiler.RegForIter:
+		item := "_"
+		if t.read[a] {
+			item = "item"
+		}
+		t.printf("if %s, ok, err := m.Next(%s); err != nil {\nreturn nil, err\n} else if !ok {\ngoto L%d\n}", item, t.reg(b), c)
+		if t.read[a] {
+			t.printf(" else {\n%s = item\n}", t.reg(a))
+		}
+		t.printf("\n")
+	}
+}
+
+// test returns the Go condition for a comparison that cannot fail.
+func (t *translator) test(op compiler.OpCode, b, c int32) string {
+	switch op {
+	case compiler.OpCompareEq:
+		return fmt.Sprintf("%s.Equal(%s)", t.rk(b), t.rk(c))
+	case compiler.OpCompareNe:
+		return fmt.Sprintf("!%s.Equal(%s)", t.rk(b), t.rk(c))
+	case compiler.OpCompareIs:
+		return fmt.Sprintf("runtime.Is(%s, %s)", t.rk(b), t.rk(c))
+	}
+	return fmt.Sprintf("!runtime.Is(%s, %s)", t.rk(b), t.rk(c))
+}
+
+// pure reports whether instructions with opcode op only set register A.
+func pure(op compiler.RegOp) bool {
+	switch op {
+	case compiler.RegMove, compiler.RegNot, compiler.RegEq, compiler.RegNe, compiler.RegIs, compiler.RegIsNot,
+		compiler.RegMakeFunction:
+		return true
+	}
+	return false
+}
+
+// supported reports whether instructions with opcode op can be translated.
+func supported(op compiler.RegOp) bool {
+	return op <= compiler.RegForIter
+}
+
+// fallible reports whether instructions with opcode op may fail or call
+// other code, so that frame.IP must point at them.
+func fallible(op compiler.RegOp) bool {
+	switch op {
+	case compiler.RegMove, compiler.RegNot, compiler.RegEq, compiler.RegNe, compiler.RegIs, compiler.RegIsNot,
+		compiler.RegJump, compiler.RegJumpIfFalse, compiler.RegJumpIfTrue, compiler.RegJumpIfNotEq, compiler.RegJumpIfNotNe,
+		compiler.RegStoreGlobal, compiler.RegMakeFunction, compiler.RegReturn:
+		return false
+	}
+	return true
+}
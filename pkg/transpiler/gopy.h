@@ -0,0 +1,1340 @@
+/*
+ * gopy.h is the runtime of the C99 programs that py2c -target=c generates.
+ * It implements the values of gopy scripts (None, bools, ints, floats,
+ * strings, lists and dicts), their operators, the builtins len, range,
+ * type, str and raw_input, the calling convention of compiled functions
+ * and tracebacks, with the semantics of the gopy VM.
+ *
+ * Compiled functions keep their registers on a value stack, which together
+ * with the globals is what the mark-and-sweep collector scans, at the
+ * safepoints that start each basic block.
+ *
+ * Exactly one file of a program defines GOPY_IMPLEMENTATION before it
+ * includes this header.
+ */
+#ifndef GOPY_H
+#define GOPY_H
+
+#include <math.h>
+#include <stddef.h>
+#include <stdint.h>
+
+#if defined(__GNUC__)
+#define GP_NORETURN __attribute__((noreturn))
+#else
+#define GP_NORETURN
+#endif
+
+typedef enum {
+	GP_UNBOUND, /* a global that was never assigned */
+	GP_NONE,
+	GP_BOOL,
+	GP_INT,
+	GP_FLOAT,
+	GP_STR,
+	GP_LIST,
+	GP_DICT,
+	GP_ITER,
+	GP_FUNCTION,
+	GP_BUILTIN
+} gp_type;
+
+/* gp_object is the header of the values that live on the heap. */
+typedef struct gp_object gp_object;
+struct gp_object {
+	gp_object *next;
+	size_t size;
+	unsigned char type;
+	unsigned char mark; /* GP_PERMANENT for constants */
+};
+
+#define GP_PERMANENT 2
+
+typedef struct gp_function gp_function;
+
+typedef struct {
+	gp_type type;
+	union {
+		int64_t i; /* GP_BOOL, GP_INT */
+		double f;
+		gp_object *o; /* GP_STR, GP_LIST, GP_DICT, GP_ITER */
+		const gp_function *fn;
+	} u;
+} gp_value;
+
+typedef struct {
+	gp_object h;
+	size_t len;
+	const char *data;
+} gp_str;
+
+/* GP_STR_CONSTANT initializes a string constant. */
+#define GP_STR_CONSTANT(data, len) {{NULL, 0, GP_STR, GP_PERMANENT}, (len), (data)}
+
+typedef struct {
+	gp_object h;
+	size_t len, cap;
+	gp_value *items;
+} gp_list;
+
+/* gp_function is a compiled function, which the caller has checked gets
+ * argcount arguments, or a builtin, which checks its arguments itself. */
+struct gp_function {
+	const char *name;
+	int argcount;
+	gp_value (*code)(gp_value *args);
+	gp_value (*builtin)(const gp_value *args, int nargs);
+};
+
+/* gp_frame is a running function, for tracebacks. */
+typedef struct gp_frame gp_frame;
+struct gp_frame {
+	const char *name;
+	int line;
+	gp_frame *back;
+	gp_value *registers;
+};
+
+static const gp_value gp_none = {GP_NONE, {0}};
+static const gp_value gp_true = {GP_BOOL, {1}};
+static const gp_value gp_false = {GP_BOOL, {0}};
+
+enum { GP_ADD, GP_SUB, GP_MUL, GP_DIV, GP_MOD, GP_POS, GP_NEG };
+enum { GP_LT, GP_LE, GP_GT, GP_GE };
+
+extern size_t gp_allocated, gp_threshold;
+extern gp_value *gp_sp;
+extern gp_frame *gp_top;
+extern int gp_depth;
+
+extern const gp_function gp_builtin_len, gp_builtin_range, gp_builtin_type, gp_builtin_str, gp_builtin_raw_input;
+
+void gp_raise(const char *type, const char *format, ...) GP_NORETURN;
+void gp_collect(void);
+gp_value *gp_enter(gp_frame *frame, const char *name, int nregisters);
+gp_value gp_load_name(const gp_value *slot, const char *name, const gp_function *builtin);
+gp_value gp_load_global(const gp_value *slot, const char *name, const gp_function *builtin);
+gp_value gp_binary(int op, gp_value a, gp_value b);
+gp_value gp_unary(int op, gp_value a);
+int gp_truthy_object(gp_value v);
+int gp_equal(gp_value a, gp_value b);
+int gp_is(gp_value a, gp_value b);
+int gp_compare(int op, gp_value a, gp_value b);
+int gp_in(gp_value item, gp_value container);
+gp_value gp_build_list(const gp_value *items, int n);
+gp_value gp_build_dict(const gp_value *items, int npairs);
+gp_value gp_get_item(gp_value container, gp_value index);
+void gp_set_item(gp_value container, gp_value index, gp_value value);
+gp_value gp_call(gp_value fn, gp_value *args, int nargs);
+void gp_print(gp_value v, int space);
+void gp_print_newline(void);
+gp_value gp_iter(gp_value v);
+int gp_next(gp_value it, gp_value *item);
+int gp_run(gp_value (*module)(gp_value *args), const char *filename, gp_value *globals, int nglobals,
+	const char *const *source, int nsource);
+
+static inline gp_value gp_int(int64_t i)
+{
+	gp_value v;
+	v.type = GP_INT;
+	v.u.i = i;
+	return v;
+}
+
+static inline gp_value gp_float(double f)
+{
+	gp_value v;
+	v.type = GP_FLOAT;
+	v.u.f = f;
+	return v;
+}
+
+static inline gp_value gp_bool(int b)
+{
+	return b ? gp_true : gp_false;
+}
+
+static inline gp_value gp_obj(gp_object *o)
+{
+	gp_value v;
+	v.type = (gp_type)o->type;
+	v.u.o = o;
+	return v;
+}
+
+static inline gp_value gp_func(const gp_function *fn)
+{
+	gp_value v;
+	v.type = fn->code ? GP_FUNCTION : GP_BUILTIN;
+	v.u.fn = fn;
+	return v;
+}
+
+/* gp_safepoint collects garbage once enough has been allocated. */
+static inline void gp_safepoint(void)
+{
+	if (gp_allocated >= gp_threshold)
+		gp_collect();
+}
+
+static inline gp_value gp_leave(gp_frame *frame, gp_value result)
+{
+	gp_sp = frame->registers;
+	gp_top = frame->back;
+	gp_depth--;
+	return result;
+}
+
+static inline int gp_truthy(gp_value v)
+{
+	switch (v.type) {
+	case GP_BOOL:
+	case GP_INT:
+		return v.u.i != 0;
+	case GP_NONE:
+		return 0;
+	default:
+		return gp_truthy_object(v);
+	}
+}
+
+/* Ints wrap around as the VM's do, by way of unsigned arithmetic. */
+#define GP_ARITH(name, op, expr)                                   \
+	static inline gp_value name(gp_value a, gp_value b)        \
+	{                                                          \
+		if (a.type == GP_INT && b.type == GP_INT)          \
+			return gp_int((int64_t)(expr));            \
+		return gp_binary(op, a, b);                        \
+	}
+GP_ARITH(gp_add, GP_ADD, (uint64_t)a.u.i + (uint64_t)b.u.i)
+GP_ARITH(gp_sub, GP_SUB, (uint64_t)a.u.i - (uint64_t)b.u.i)
+GP_ARITH(gp_mul, GP_MUL, (uint64_t)a.u.i * (uint64_t)b.u.i)
+#undef GP_ARITH
+
+static inline gp_value gp_div(gp_value a, gp_value b)
+{
+	return gp_binary(GP_DIV, a, b);
+}
+
+static inline gp_value gp_mod(gp_value a, gp_value b)
+{
+	return gp_binary(GP_MOD, a, b);
+}
+
+static inline gp_value gp_pos(gp_value a)
+{
+	return gp_unary(GP_POS, a);
+}
+
+static inline gp_value gp_neg(gp_value a)
+{
+	return gp_unary(GP_NEG, a);
+}
+
+#define GP_ORDER(name, op, cmp)                                    \
+	static inline int name(gp_value a, gp_value b)             \
+	{                                                          \
+		if (a.type == GP_INT && b.type == GP_INT)          \
+			return a.u.i cmp b.u.i;                    \
+		return gp_compare(op, a, b);                       \
+	}
+GP_ORDER(gp_lt, GP_LT, <)
+GP_ORDER(gp_le, GP_LE, <=)
+GP_ORDER(gp_gt, GP_GT, >)
+GP_ORDER(gp_ge, GP_GE, >=)
+#undef GP_ORDER
+
+#ifdef GOPY_IMPLEMENTATION
+
+#include <float.h>
+#include <inttypes.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#define GP_MAX_DEPTH 1000
+#define GP_STACK_SIZE (1 << 18)
+/* GP_MIN_HEAP is how many bytes may be allocated before the first
+ * collection, and the least the heap grows between collections. */
+#ifndef GP_MIN_HEAP
+#define GP_MIN_HEAP ((size_t)4 << 20)
+#endif
+
+typedef struct {
+	gp_str *key;
+	gp_value value;
+} gp_entry;
+
+typedef struct {
+	gp_object h;
+	size_t count, cap;
+	gp_entry *entries; /* in insertion order */
+	size_t nslots;
+	size_t *slots; /* 1 + index of an entry, or 0 */
+} gp_dict;
+
+typedef struct {
+	gp_object h;
+	gp_list *list;
+	size_t index;
+} gp_iterator;
+
+typedef struct {
+	char *data;
+	size_t len, cap;
+} gp_buffer;
+
+size_t gp_allocated, gp_threshold = GP_MIN_HEAP;
+gp_value *gp_sp;
+gp_frame *gp_top;
+int gp_depth;
+
+static gp_value gp_stack[GP_STACK_SIZE];
+static gp_object *gp_heap;
+static gp_value *gp_globals;
+static int gp_nglobals;
+static const char *gp_filename;
+static const char *const *gp_source;
+static int gp_nsource;
+static gp_buffer gp_scratch;
+
+static const char *gp_type_name(gp_value v)
+{
+	switch (v.type) {
+	case GP_NONE:
+		return "NoneType";
+	case GP_BOOL:
+		return "bool";
+	case GP_INT:
+		return "int";
+	case GP_FLOAT:
+		return "float";
+	case GP_STR:
+		return "str";
+	case GP_LIST:
+		return "list";
+	case GP_DICT:
+		return "dict";
+	case GP_ITER:
+		return "listiterator";
+	case GP_FUNCTION:
+		return "function";
+	case GP_BUILTIN:
+		return "builtin_function_or_method";
+	default:
+		return "unbound";
+	}
+}
+
+/* Tracebacks. */
+
+static void gp_write_entry(const gp_frame *f)
+{
+	fprintf(stderr, "  File \"%s\", line %d, in %s\n", gp_filename, f->line, f->name);
+	if (f->line >= 1 && f->line <= gp_nsource && gp_source[f->line - 1][0] != '\0')
+		fprintf(stderr, "    %s\n", gp_source[f->line - 1]);
+}
+
+static int gp_same_entry(const gp_frame *a, const gp_frame *b)
+{
+	return a->line == b->line && strcmp(a->name, b->name) == 0;
+}
+
+/* gp_raise prints a traceback of the running functions, as the VM does,
+ * and exits. */
+void gp_raise(const char *type, const char *format, ...)
+{
+	const gp_frame **frames;
+	const gp_frame *f;
+	va_list ap;
+	int n = 0, i, run, j;
+
+	fflush(stdout);
+	for (f = gp_top; f != NULL; f = f->back)
+		n++;
+	frames = malloc((size_t)(n > 0 ? n : 1) * sizeof *frames);
+	if (frames != NULL) {
+		fprintf(stderr, "Traceback (most recent call last):\n");
+		for (f = gp_top, i = n; f != NULL; f = f->back)
+			frames[--i] = f;
+		/* Identical consecutive entries past the third are summarized,
+		 * as CPython does for deep recursion. */
+		for (i = 0; i < n; i += run) {
+			for (run = 1; i + run < n && gp_same_entry(frames[i], frames[i + run]); run++)
+				;
+			for (j = 0; j < run && j < 3; j++)
+				gp_write_entry(frames[i]);
+			if (run > 3)
+				fprintf(stderr, "  [Previous line repeated %d more times]\n", run - 3);
+		}
+	}
+	fprintf(stderr, "%s: ", type);
+	va_start(ap, format);
+	vfprintf(stderr, format, ap);
+	va_end(ap);
+	fputc('\n', stderr);
+	exit(1);
+}
+
+/* The heap. */
+
+static void *gp_malloc(size_t size)
+{
+	void *p = malloc(size > 0 ? size : 1);
+	if (p == NULL)
+		gp_raise("MemoryError", "out of memory");
+	return p;
+}
+
+static gp_object *gp_alloc(size_t size, gp_type type)
+{
+	gp_object *o = gp_malloc(size);
+	o->next = gp_heap;
+	o->size = size;
+	o->type = (unsigned char)type;
+	o->mark = 0;
+	gp_heap = o;
+	gp_allocated += size;
+	return o;
+}
+
+/* gp_resize resizes *p, part of the heap object o, from n to m bytes. */
+static void gp_resize(gp_object *o, void **p, size_t n, size_t m)
+{
+	void *q = realloc(*p, m > 0 ? m : 1);
+	if (q == NULL)
+		gp_raise("MemoryError", "out of memory");
+	*p = q;
+	o->size = o->size - n + m;
+	gp_allocated = gp_allocated - n + m;
+}
+
+static gp_object **gp_marks;
+static size_t gp_nmarks, gp_capmarks;
+
+static void gp_mark(gp_value v)
+{
+	gp_object *o;
+
+	if (v.type != GP_STR && v.type != GP_LIST && v.type != GP_DICT && v.type != GP_ITER)
+		return;
+	o = v.u.o;
+	if (o->mark)
+		return;
+	o->mark = 1;
+	if (o->type == GP_STR)
+		return;
+	if (gp_nmarks == gp_capmarks) {
+		gp_capmarks = gp_capmarks ? 2 * gp_capmarks : 256;
+		gp_marks = realloc(gp_marks, gp_capmarks * sizeof *gp_marks);
+		if (gp_marks == NULL) {
+			fprintf(stderr, "MemoryError: out of memory\n");
+			exit(1);
+		}
+	}
+	gp_marks[gp_nmarks++] = o;
+}
+
+void gp_collect(void)
+{
+	gp_object **p, *o;
+	gp_value *v;
+	size_t i;
+
+	for (v = gp_stack; v < gp_sp; v++)
+		gp_mark(*v);
+	for (i = 0; i < (size_t)gp_nglobals; i++)
+		gp_mark(gp_globals[i]);
+	while (gp_nmarks > 0) {
+		o = gp_marks[--gp_nmarks];
+		if (o->type == GP_LIST) {
+			gp_list *l = (gp_list *)o;
+			for (i = 0; i < l->len; i++)
+				gp_mark(l->items[i]);
+		} else if (o->type == GP_DICT) {
+			gp_dict *d = (gp_dict *)o;
+			for (i = 0; i < d->count; i++) {
+				gp_mark(gp_obj(&d->entries[i].key->h));
+				gp_mark(d->entries[i].value);
+			}
+		} else if (o->type == GP_ITER) {
+			gp_mark(gp_obj(&((gp_iterator *)o)->list->h));
+		}
+	}
+
+	for (p = &gp_heap; (o = *p) != NULL;) {
+		if (o->mark) {
+			o->mark = 0;
+			p = &o->next;
+			continue;
+		}
+		*p = o->next;
+		gp_allocated -= o->size;
+		if (o->type == GP_LIST) {
+			free(((gp_list *)o)->items);
+		} else if (o->type == GP_DICT) {
+			free(((gp_dict *)o)->entries);
+			free(((gp_dict *)o)->slots);
+		}
+		free(o);
+	}
+	gp_threshold = 2 * gp_allocated > GP_MIN_HEAP ? 2 * gp_allocated : GP_MIN_HEAP;
+}
+
+static gp_str *gp_new_str(const char *data, size_t len)
+{
+	gp_str *s = (gp_str *)gp_alloc(sizeof(gp_str) + len + 1, GP_STR);
+	char *p = (char *)(s + 1);
+	memcpy(p, data, len);
+	p[len] = '\0';
+	s->len = len;
+	s->data = p;
+	return s;
+}
+
+static gp_list *gp_new_list(size_t len)
+{
+	gp_list *l = (gp_list *)gp_alloc(sizeof(gp_list), GP_LIST);
+	l->len = 0;
+	l->cap = 0;
+	l->items = NULL;
+	gp_resize(&l->h, (void **)&l->items, 0, len * sizeof(gp_value));
+	l->len = len;
+	l->cap = len;
+	return l;
+}
+
+static gp_dict *gp_new_dict(void)
+{
+	gp_dict *d = (gp_dict *)gp_alloc(sizeof(gp_dict), GP_DICT);
+	d->count = 0;
+	d->cap = 0;
+	d->entries = NULL;
+	d->nslots = 0;
+	d->slots = NULL;
+	return d;
+}
+
+/* Strings. */
+
+static void gp_append(gp_buffer *b, const char *s, size_t n)
+{
+	if (b->len + n > b->cap) {
+		size_t cap = b->cap ? b->cap : 64;
+		while (cap < b->len + n)
+			cap *= 2;
+		b->data = realloc(b->data, cap);
+		if (b->data == NULL)
+			gp_raise("MemoryError", "out of memory");
+		b->cap = cap;
+	}
+	memcpy(b->data + b->len, s, n);
+	b->len += n;
+}
+
+static void gp_appends(gp_buffer *b, const char *s)
+{
+	gp_append(b, s, strlen(s));
+}
+
+/* gp_format_float formats f as Go's %g does: with the fewest digits that
+ * read back as f, in exponent form when the exponent is below -4 or at
+ * least 6. */
+static void gp_format_float(gp_buffer *b, double f)
+{
+	char e[40], digits[20], out[64];
+	const char *p;
+	int prec, nd = 0, exp, dp, i, n = 0;
+
+	if (f != f) {
+		gp_appends(b, "NaN");
+		return;
+	}
+	if (f > DBL_MAX || f < -DBL_MAX) {
+		gp_appends(b, f > 0 ? "+Inf" : "-Inf");
+		return;
+	}
+	for (prec = 1; prec < 17; prec++) {
+		sprintf(e, "%.*e", prec - 1, f);
+		if (strtod(e, NULL) == f)
+			break;
+	}
+	sprintf(e, "%.*e", prec - 1, f);
+	p = e;
+	if (*p == '-') {
+		out[n++] = '-';
+		p++;
+	}
+	for (; *p != 'e'; p++) {
+		if (*p != '.')
+			digits[nd++] = *p;
+	}
+	exp = atoi(p + 1);
+	while (nd > 1 && digits[nd - 1] == '0')
+		nd--;
+
+	if (exp < -4 || exp >= 6) {
+		out[n++] = digits[0];
+		if (nd > 1) {
+			out[n++] = '.';
+			for (i = 1; i < nd; i++)
+				out[n++] = digits[i];
+		}
+		n += sprintf(out + n, "e%c%02d", exp < 0 ? '-' : '+', exp < 0 ? -exp : exp);
+	} else {
+		dp = exp + 1;
+		if (dp > 0) {
+			for (i = 0; i < dp; i++)
+				out[n++] = i < nd ? digits[i] : '0';
+		} else {
+			out[n++] = '0';
+		}
+		if (nd > dp) {
+			out[n++] = '.';
+			for (i = dp; i < nd; i++)
+				out[n++] = i >= 0 ? digits[i] : '0';
+		}
+	}
+	gp_append(b, out, (size_t)n);
+}
+
+/* gp_format appends the str() of v to b. */
+static void gp_format(gp_buffer *b, gp_value v)
+{
+	char s[64];
+	size_t i;
+
+	switch (v.type) {
+	case GP_NONE:
+		gp_appends(b, "None");
+		break;
+	case GP_BOOL:
+		gp_appends(b, v.u.i ? "True" : "False");
+		break;
+	case GP_INT:
+		sprintf(s, "%" PRId64, v.u.i);
+		gp_appends(b, s);
+		break;
+	case GP_FLOAT:
+		gp_format_float(b, v.u.f);
+		break;
+	case GP_STR:
+		gp_append(b, ((gp_str *)v.u.o)->data, ((gp_str *)v.u.o)->len);
+		break;
+	case GP_LIST: {
+		gp_list *l = (gp_list *)v.u.o;
+		gp_appends(b, "[");
+		for (i = 0; i < l->len; i++) {
+			if (i > 0)
+				gp_appends(b, ", ");
+			gp_format(b, l->items[i]);
+		}
+		gp_appends(b, "]");
+		break;
+	}
+	case GP_DICT: {
+		gp_dict *d = (gp_dict *)v.u.o;
+		gp_appends(b, "{");
+		for (i = 0; i < d->count; i++) {
+			if (i > 0)
+				gp_appends(b, ", ");
+			gp_append(b, d->entries[i].key->data, d->entries[i].key->len);
+			gp_appends(b, ": ");
+			gp_format(b, d->entries[i].value);
+		}
+		gp_appends(b, "}");
+		break;
+	}
+	case GP_ITER:
+		sprintf(s, "<listiterator object at %p>", (void *)v.u.o);
+		gp_appends(b, s);
+		break;
+	case GP_FUNCTION:
+		gp_appends(b, "<function ");
+		gp_appends(b, v.u.fn->name);
+		gp_appends(b, ">");
+		break;
+	case GP_BUILTIN:
+		gp_appends(b, "<built-in function ");
+		gp_appends(b, v.u.fn->name);
+		gp_appends(b, ">");
+		break;
+	default:
+		break;
+	}
+}
+
+/* gp_to_str returns the str() of v. */
+static gp_str *gp_to_str(gp_value v)
+{
+	gp_scratch.len = 0;
+	gp_format(&gp_scratch, v);
+	return gp_new_str(gp_scratch.data, gp_scratch.len);
+}
+
+/* gp_utf8_len returns the length of the UTF-8 sequence at p, or 0 if it is
+ * not valid UTF-8. */
+static size_t gp_utf8_len(const unsigned char *p, size_t n)
+{
+	unsigned char lo = 0x80, hi = 0xBF;
+	size_t len, i;
+
+	if (p[0] < 0x80)
+		return 1;
+	if (p[0] >= 0xC2 && p[0] <= 0xDF)
+		len = 2;
+	else if (p[0] >= 0xE0 && p[0] <= 0xEF)
+		len = 3;
+	else if (p[0] >= 0xF0 && p[0] <= 0xF4)
+		len = 4;
+	else
+		return 0;
+	if (p[0] == 0xE0)
+		lo = 0xA0;
+	else if (p[0] == 0xED)
+		hi = 0x9F;
+	else if (p[0] == 0xF0)
+		lo = 0x90;
+	else if (p[0] == 0xF4)
+		hi = 0x8F;
+	if (n < len || p[1] < lo || p[1] > hi)
+		return 0;
+	for (i = 2; i < len; i++) {
+		if (p[i] < 0x80 || p[i] > 0xBF)
+			return 0;
+	}
+	return len;
+}
+
+/* gp_byte_str returns the string of the code point c, a byte. */
+static gp_str *gp_byte_str(unsigned char c)
+{
+	char s[2];
+	if (c < 0x80) {
+		s[0] = (char)c;
+		return gp_new_str(s, 1);
+	}
+	s[0] = (char)(0xC0 | (c >> 6));
+	s[1] = (char)(0x80 | (c & 0x3F));
+	return gp_new_str(s, 2);
+}
+
+/* Dicts, keyed by the str() of their keys as the VM's are. */
+
+static size_t gp_hash(const char *s, size_t n)
+{
+	uint64_t h = 14695981039346656037u;
+	size_t i;
+	for (i = 0; i < n; i++) {
+		h ^= (unsigned char)s[i];
+		h *= 1099511628211u;
+	}
+	return (size_t)h;
+}
+
+static gp_entry *gp_dict_find(gp_dict *d, const char *key, size_t len)
+{
+	size_t i, slot;
+
+	if (d->nslots == 0)
+		return NULL;
+	for (i = gp_hash(key, len) & (d->nslots - 1); (slot = d->slots[i]) != 0; i = (i + 1) & (d->nslots - 1)) {
+		gp_entry *e = &d->entries[slot - 1];
+		if (e->key->len == len && memcmp(e->key->data, key, len) == 0)
+			return e;
+	}
+	return NULL;
+}
+
+static void gp_dict_index(gp_dict *d, size_t entry)
+{
+	gp_str *key = d->entries[entry].key;
+	size_t i = gp_hash(key->data, key->len) & (d->nslots - 1);
+	while (d->slots[i] != 0)
+		i = (i + 1) & (d->nslots - 1);
+	d->slots[i] = entry + 1;
+}
+
+/* gp_dict_get returns the entry for key, or NULL. */
+static gp_entry *gp_dict_get(gp_dict *d, gp_value key)
+{
+	if (key.type == GP_STR)
+		return gp_dict_find(d, ((gp_str *)key.u.o)->data, ((gp_str *)key.u.o)->len);
+	gp_scratch.len = 0;
+	gp_format(&gp_scratch, key);
+	return gp_dict_find(d, gp_scratch.data, gp_scratch.len);
+}
+
+static void gp_dict_set(gp_dict *d, gp_value key, gp_value value)
+{
+	gp_entry *e = gp_dict_get(d, key);
+	size_t i;
+
+	if (e != NULL) {
+		e->value = value;
+		return;
+	}
+	if (d->count == d->cap) {
+		size_t cap = d->cap ? 2 * d->cap : 8;
+		gp_resize(&d->h, (void **)&d->entries, d->cap * sizeof(gp_entry), cap * sizeof(gp_entry));
+		d->cap = cap;
+	}
+	e = &d->entries[d->count++];
+	e->key = key.type == GP_STR ? (gp_str *)key.u.o : gp_to_str(key);
+	e->value = value;
+	if (2 * d->count > d->nslots) {
+		size_t n = d->nslots ? 2 * d->nslots : 16;
+		gp_resize(&d->h, (void **)&d->slots, d->nslots * sizeof(size_t), n * sizeof(size_t));
+		d->nslots = n;
+		memset(d->slots, 0, n * sizeof(size_t));
+		for (i = 0; i < d->count; i++)
+			gp_dict_index(d, i);
+	} else {
+		gp_dict_index(d, d->count - 1);
+	}
+}
+
+/* Functions and names. */
+
+gp_value *gp_enter(gp_frame *frame, const char *name, int nregisters)
+{
+	gp_value *r = gp_sp;
+	int i;
+
+	if (nregisters > gp_stack + GP_STACK_SIZE - gp_sp)
+		gp_raise("RuntimeError", "operand stack overflow");
+	frame->name = name;
+	frame->line = 0;
+	frame->back = gp_top;
+	frame->registers = r;
+	gp_top = frame;
+	gp_depth++;
+	for (i = 0; i < nregisters; i++)
+		r[i] = gp_none;
+	gp_sp += nregisters;
+	return r;
+}
+
+gp_value gp_call(gp_value fn, gp_value *args, int nargs)
+{
+	if (fn.type == GP_BUILTIN)
+		return fn.u.fn->builtin(args, nargs);
+	if (fn.type != GP_FUNCTION)
+		gp_raise("TypeError", "'%s' object is not callable", gp_type_name(fn));
+	if (nargs != fn.u.fn->argcount)
+		gp_raise("TypeError", "function takes %d arguments but %d were given", fn.u.fn->argcount, nargs);
+	if (gp_depth >= GP_MAX_DEPTH)
+		gp_raise("RuntimeError", "maximum recursion depth exceeded");
+	return fn.u.fn->code(args);
+}
+
+gp_value gp_load_name(const gp_value *slot, const char *name, const gp_function *builtin)
+{
+	if (slot->type != GP_UNBOUND)
+		return *slot;
+	if (builtin == NULL)
+		gp_raise("NameError", "name '%s' is not defined", name);
+	return gp_func(builtin);
+}
+
+gp_value gp_load_global(const gp_value *slot, const char *name, const gp_function *builtin)
+{
+	if (slot->type != GP_UNBOUND)
+		return *slot;
+	if (builtin == NULL)
+		gp_raise("NameError", "global name '%s' is not defined", name);
+	return gp_func(builtin);
+}
+
+/* Operators. */
+
+static const char *gp_symbol(int op)
+{
+	static const char *const symbols[] = {"+", "-", "*", "/", "%", "+", "-"};
+	return symbols[op];
+}
+
+static int gp_number(gp_value v, double *f)
+{
+	if (v.type == GP_INT)
+		*f = (double)v.u.i;
+	else if (v.type == GP_FLOAT)
+		*f = v.u.f;
+	else
+		return 0;
+	return 1;
+}
+
+gp_value gp_binary(int op, gp_value a, gp_value b)
+{
+	double l, r;
+
+	if (a.type == GP_INT && b.type == GP_INT) {
+		int64_t x = a.u.i, y = b.u.i;
+		switch (op) {
+		case GP_ADD:
+			return gp_int((int64_t)((uint64_t)x + (uint64_t)y));
+		case GP_SUB:
+			return gp_int((int64_t)((uint64_t)x - (uint64_t)y));
+		case GP_MUL:
+			return gp_int((int64_t)((uint64_t)x * (uint64_t)y));
+		case GP_DIV:
+			if (y == 0)
+				gp_raise("ZeroDivisionError", "division by zero");
+			return gp_int(y == -1 ? (int64_t)(0 - (uint64_t)x) : x / y);
+		case GP_MOD:
+			if (y == 0)
+				gp_raise("ZeroDivisionError", "integer division or modulo by zero");
+			return gp_int(y == -1 ? 0 : x % y);
+		}
+	}
+	if (op == GP_ADD && a.type == GP_STR && b.type == GP_STR) {
+		gp_str *x = (gp_str *)a.u.o, *y = (gp_str *)b.u.o;
+		gp_str *s = (gp_str *)gp_alloc(sizeof(gp_str) + x->len + y->len + 1, GP_STR);
+		char *p = (char *)(s + 1);
+		memcpy(p, x->data, x->len);
+		memcpy(p + x->len, y->data, y->len);
+		p[x->len + y->len] = '\0';
+		s->len = x->len + y->len;
+		s->data = p;
+		return gp_obj(&s->h);
+	}
+	if (gp_number(a, &l) && gp_number(b, &r)) {
+		switch (op) {
+		case GP_ADD:
+			return gp_float(l + r);
+		case GP_SUB:
+			return gp_float(l - r);
+		case GP_MUL:
+			return gp_float(l * r);
+		case GP_DIV:
+			if (r == 0.0)
+				gp_raise("ZeroDivisionError", "division by zero");
+			return gp_float(l / r);
+		}
+	}
+	gp_raise("TypeError", "unsupported operand type(s) for %s: '%s' and '%s'", gp_symbol(op), gp_type_name(a),
+		gp_type_name(b));
+}
+
+gp_value gp_unary(int op, gp_value a)
+{
+	if (a.type == GP_INT)
+		return op == GP_NEG ? gp_int((int64_t)(0 - (uint64_t)a.u.i)) : a;
+	if (a.type == GP_FLOAT)
+		return op == GP_NEG ? gp_float(-a.u.f) : a;
+	gp_raise("TypeError", "bad operand type for unary %s: '%s'", gp_symbol(op), gp_type_name(a));
+}
+
+int gp_truthy_object(gp_value v)
+{
+	switch (v.type) {
+	case GP_FLOAT:
+		return v.u.f != 0.0;
+	case GP_STR:
+		return ((gp_str *)v.u.o)->len > 0;
+	case GP_LIST:
+		return ((gp_list *)v.u.o)->len > 0;
+	case GP_DICT:
+		return ((gp_dict *)v.u.o)->count > 0;
+	default:
+		return 1;
+	}
+}
+
+int gp_equal(gp_value a, gp_value b)
+{
+	size_t i;
+
+	if (a.type != b.type)
+		return 0;
+	switch (a.type) {
+	case GP_NONE:
+		return 1;
+	case GP_BOOL:
+	case GP_INT:
+		return a.u.i == b.u.i;
+	case GP_FLOAT:
+		return a.u.f == b.u.f;
+	case GP_STR: {
+		gp_str *x = (gp_str *)a.u.o, *y = (gp_str *)b.u.o;
+		return x->len == y->len && memcmp(x->data, y->data, x->len) == 0;
+	}
+	case GP_LIST: {
+		gp_list *x = (gp_list *)a.u.o, *y = (gp_list *)b.u.o;
+		if (x->len != y->len)
+			return 0;
+		for (i = 0; i < x->len; i++) {
+			if (!gp_equal(x->items[i], y->items[i]))
+				return 0;
+		}
+		return 1;
+	}
+	case GP_DICT: {
+		gp_dict *x = (gp_dict *)a.u.o, *y = (gp_dict *)b.u.o;
+		if (x->count != y->count)
+			return 0;
+		for (i = 0; i < x->count; i++) {
+			gp_entry *e = gp_dict_find(y, x->entries[i].key->data, x->entries[i].key->len);
+			if (e == NULL || !gp_equal(x->entries[i].value, e->value))
+				return 0;
+		}
+		return 1;
+	}
+	case GP_ITER:
+		return a.u.o == b.u.o;
+	default:
+		return a.u.fn == b.u.fn;
+	}
+}
+
+/* gp_is compares ints and floats, which are not objects here, by value. */
+int gp_is(gp_value a, gp_value b)
+{
+	if (a.type != b.type)
+		return 0;
+	switch (a.type) {
+	case GP_NONE:
+		return 1;
+	case GP_BOOL:
+	case GP_INT:
+		return a.u.i == b.u.i;
+	case GP_FLOAT:
+		return a.u.f == b.u.f;
+	case GP_FUNCTION:
+	case GP_BUILTIN:
+		return a.u.fn == b.u.fn;
+	default:
+		return a.u.o == b.u.o;
+	}
+}
+
+int gp_compare(int op, gp_value a, gp_value b)
+{
+	static const char *const symbols[] = {"<", "<=", ">", ">="};
+	double l, r;
+	int c;
+
+	if (a.type == GP_INT && b.type == GP_INT) {
+		c = a.u.i < b.u.i ? -1 : a.u.i > b.u.i;
+	} else if (gp_number(a, &l) && gp_number(b, &r)) {
+		switch (op) {
+		case GP_LT:
+			return l < r;
+		case GP_LE:
+			return l <= r;
+		case GP_GT:
+			return l > r;
+		default:
+			return l >= r;
+		}
+	} else if (a.type == GP_STR && b.type == GP_STR) {
+		gp_str *x = (gp_str *)a.u.o, *y = (gp_str *)b.u.o;
+		c = memcmp(x->data, y->data, x->len < y->len ? x->len : y->len);
+		if (c == 0)
+			c = x->len < y->len ? -1 : x->len > y->len;
+	} else {
+		gp_raise("TypeError", "'%s' not supported between instances of '%s' and '%s'", symbols[op],
+			gp_type_name(a), gp_type_name(b));
+	}
+	switch (op) {
+	case GP_LT:
+		return c < 0;
+	case GP_LE:
+		return c <= 0;
+	case GP_GT:
+		return c > 0;
+	default:
+		return c >= 0;
+	}
+}
+
+int gp_in(gp_value item, gp_value container)
+{
+	size_t i;
+
+	if (container.type == GP_LIST) {
+		gp_list *l = (gp_list *)container.u.o;
+		for (i = 0; i < l->len; i++) {
+			if (gp_equal(item, l->items[i]))
+				return 1;
+		}
+		return 0;
+	}
+	if (container.type == GP_DICT)
+		return gp_dict_get((gp_dict *)container.u.o, item) != NULL;
+	if (container.type == GP_STR && item.type == GP_STR) {
+		gp_str *s = (gp_str *)container.u.o, *sub = (gp_str *)item.u.o;
+		for (i = 0; i + sub->len <= s->len; i++) {
+			if (memcmp(s->data + i, sub->data, sub->len) == 0)
+				return 1;
+		}
+		return 0;
+	}
+	gp_raise("TypeError", "argument of type '%s' is not iterable", gp_type_name(container));
+}
+
+/* Containers. */
+
+static int64_t gp_to_int(gp_value v)
+{
+	switch (v.type) {
+	case GP_INT:
+	case GP_BOOL:
+		return v.u.i;
+	case GP_FLOAT:
+		/* Out of range, Go gives the most negative int on amd64. */
+		if (v.u.f != v.u.f || v.u.f >= 9223372036854775808.0 || v.u.f < -9223372036854775808.0)
+			return INT64_MIN;
+		return (int64_t)v.u.f;
+	default:
+		gp_raise("TypeError", "cannot convert %s to int", gp_type_name(v));
+	}
+}
+
+gp_value gp_build_list(const gp_value *items, int n)
+{
+	gp_list *l = gp_new_list((size_t)n);
+	if (n > 0)
+		memcpy(l->items, items, (size_t)n * sizeof(gp_value));
+	return gp_obj(&l->h);
+}
+
+/* gp_build_dict sets the pairs last first, as the VM does. */
+gp_value gp_build_dict(const gp_value *items, int npairs)
+{
+	gp_dict *d = gp_new_dict();
+	int i;
+	for (i = npairs - 1; i >= 0; i--)
+		gp_dict_set(d, items[2 * i], items[2 * i + 1]);
+	return gp_obj(&d->h);
+}
+
+gp_value gp_get_item(gp_value container, gp_value index)
+{
+	int64_t i;
+
+	switch (container.type) {
+	case GP_LIST: {
+		gp_list *l = (gp_list *)container.u.o;
+		i = gp_to_int(index);
+		if (i < 0 || (uint64_t)i >= l->len)
+			gp_raise("IndexError", "list index out of range");
+		return l->items[i];
+	}
+	case GP_DICT: {
+		gp_entry *e = gp_dict_get((gp_dict *)container.u.o, index);
+		if (e == NULL) {
+			gp_str *key = gp_to_str(index);
+			gp_raise("KeyError", "%.*s", (int)key->len, key->data);
+		}
+		return e->value;
+	}
+	case GP_STR: {
+		gp_str *s = (gp_str *)container.u.o;
+		i = gp_to_int(index);
+		if (i < 0 || (uint64_t)i >= s->len)
+			gp_raise("IndexError", "string index out of range");
+		return gp_obj(&gp_byte_str((unsigned char)s->data[i])->h);
+	}
+	default:
+		gp_raise("TypeError", "'%s' object is not subscriptable", gp_type_name(container));
+	}
+}
+
+void gp_set_item(gp_value container, gp_value index, gp_value value)
+{
+	int64_t i;
+
+	if (container.type == GP_LIST) {
+		gp_list *l = (gp_list *)container.u.o;
+		i = gp_to_int(index);
+		if (i < 0 || (uint64_t)i >= l->len)
+			gp_raise("IndexError", "list index out of range");
+		l->items[i] = value;
+		return;
+	}
+	if (container.type == GP_DICT) {
+		gp_dict_set((gp_dict *)container.u.o, index, value);
+		return;
+	}
+	gp_raise("TypeError", "'%s' object does not support item assignment", gp_type_name(container));
+}
+
+gp_value gp_iter(gp_value v)
+{
+	gp_iterator *it;
+	gp_list *l;
+
+	if (v.type == GP_LIST) {
+		l = (gp_list *)v.u.o;
+	} else if (v.type == GP_STR) {
+		/* A list of the characters, as the VM makes. */
+		gp_str *s = (gp_str *)v.u.o;
+		size_t i, n;
+		l = gp_new_list(0);
+		for (i = 0; i < s->len; i += n) {
+			n = gp_utf8_len((const unsigned char *)s->data + i, s->len - i);
+			if (l->len == l->cap) {
+				size_t cap = l->cap ? 2 * l->cap : 8;
+				gp_resize(&l->h, (void **)&l->items, l->cap * sizeof(gp_value), cap * sizeof(gp_value));
+				l->cap = cap;
+			}
+			if (n == 0) {
+				n = 1;
+				l->items[l->len++] = gp_obj(&gp_new_str("\xEF\xBF\xBD", 3)->h);
+			} else {
+				l->items[l->len++] = gp_obj(&gp_new_str(s->data + i, n)->h);
+			}
+		}
+	} else {
+		gp_raise("TypeError", "'%s' object is not iterable", gp_type_name(v));
+	}
+	it = (gp_iterator *)gp_alloc(sizeof(gp_iterator), GP_ITER);
+	it->list = l;
+	it->index = 0;
+	return gp_obj(&it->h);
+}
+
+int gp_next(gp_value it, gp_value *item)
+{
+	gp_iterator *i;
+
+	if (it.type != GP_ITER)
+		gp_raise("SystemError", "FOR_ITER: expected iterator");
+	i = (gp_iterator *)it.u.o;
+	if (i->index >= i->list->len)
+		return 0;
+	*item = i->list->items[i->index++];
+	return 1;
+}
+
+/* Printing. */
+
+void gp_print(gp_value v, int space)
+{
+	if (v.type == GP_STR) {
+		fwrite(((gp_str *)v.u.o)->data, 1, ((gp_str *)v.u.o)->len, stdout);
+	} else {
+		gp_scratch.len = 0;
+		gp_format(&gp_scratch, v);
+		fwrite(gp_scratch.data, 1, gp_scratch.len, stdout);
+	}
+	if (space)
+		putchar(' ');
+}
+
+void gp_print_newline(void)
+{
+	putchar('\n');
+}
+
+/* Builtins. */
+
+static gp_value gp_len(const gp_value *args, int nargs)
+{
+	if (nargs != 1)
+		gp_raise("TypeError", "len() takes exactly one argument (%d given)", nargs);
+	switch (args[0].type) {
+	case GP_STR:
+		return gp_int((int64_t)((gp_str *)args[0].u.o)->len);
+	case GP_LIST:
+		return gp_int((int64_t)((gp_list *)args[0].u.o)->len);
+	case GP_DICT:
+		return gp_int((int64_t)((gp_dict *)args[0].u.o)->count);
+	default:
+		gp_raise("TypeError", "object of type '%s' has no len()", gp_type_name(args[0]));
+	}
+}
+
+static gp_value gp_range(const gp_value *args, int nargs)
+{
+	int64_t start = 0, stop, step = 1, count = 0, i;
+	gp_list *l;
+
+	if (nargs < 1 || nargs > 3)
+		gp_raise("TypeError", "range() takes 1 to 3 arguments");
+	if (nargs == 1) {
+		stop = gp_to_int(args[0]);
+	} else {
+		start = gp_to_int(args[0]);
+		stop = gp_to_int(args[1]);
+		if (nargs == 3) {
+			step = gp_to_int(args[2]);
+			if (step == 0)
+				gp_raise("ValueError", "range() step argument must not be zero");
+		}
+	}
+	if (step > 0 && stop > start)
+		count = (stop - start + step - 1) / step;
+	else if (step < 0 && start > stop)
+		count = (start - stop - step - 1) / -step;
+	l = gp_new_list((size_t)count);
+	for (i = 0; i < count; i++)
+		l->items[i] = gp_int(start + i * step);
+	return gp_obj(&l->h);
+}
+
+static gp_value gp_type_of(const gp_value *args, int nargs)
+{
+	const char *name;
+	if (nargs != 1)
+		gp_raise("TypeError", "type() takes exactly one argument");
+	name = gp_type_name(args[0]);
+	return gp_obj(&gp_new_str(name, strlen(name))->h);
+}
+
+static gp_value gp_str_of(const gp_value *args, int nargs)
+{
+	if (nargs != 1)
+		gp_raise("TypeError", "str() takes exactly one argument");
+	return gp_obj(&gp_to_str(args[0])->h);
+}
+
+static gp_value gp_raw_input(const gp_value *args, int nargs)
+{
+	int c = EOF;
+
+	if (nargs > 1)
+		gp_raise("TypeError", "raw_input() takes at most 1 argument (%d given)", nargs);
+	if (nargs == 1)
+		gp_print(args[0], 0);
+	fflush(stdout);
+	gp_scratch.len = 0;
+	while ((c = getchar()) != EOF) {
+		char ch = (char)c;
+		gp_append(&gp_scratch, &ch, 1);
+		if (c == '\n')
+			break;
+	}
+	if (c == EOF && gp_scratch.len == 0)
+		gp_raise("EOFError", "EOF when reading a line");
+	while (gp_scratch.len > 0 && (gp_scratch.data[gp_scratch.len - 1] == '\n' || gp_scratch.data[gp_scratch.len - 1] == '\r'))
+		gp_scratch.len--;
+	return gp_obj(&gp_new_str(gp_scratch.data, gp_scratch.len)->h);
+}
+
+const gp_function gp_builtin_len = {"len", -1, NULL, gp_len};
+const gp_function gp_builtin_range = {"range", -1, NULL, gp_range};
+const gp_function gp_builtin_type = {"type", -1, NULL, gp_type_of};
+const gp_function gp_builtin_str = {"str", -1, NULL, gp_str_of};
+const gp_function gp_builtin_raw_input = {"raw_input", -1, NULL, gp_raw_input};
+
+/* gp_run runs the module function of a program. */
+int gp_run(gp_value (*module)(gp_value *args), const char *filename, gp_value *globals, int nglobals,
+	const char *const *source, int nsource)
+{
+	gp_filename = filename;
+	gp_globals = globals;
+	gp_nglobals = nglobals;
+	gp_source = source;
+	gp_nsource = nsource;
+	gp_sp = gp_stack;
+	module(NULL);
+	return fflush(stdout) == 0 ? 0 : 1;
+}
+
+#endif /* GOPY_IMPLEMENTATION */
+
+#endif /* GOPY_H */
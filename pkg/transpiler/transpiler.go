@@ -0,0 +1,181 @@
+// Package transpiler translates compiled modules into Go source. The
+// generated package embeds the bytecode of the module and registers a Go
+// function for each code object it could translate, which the VM then runs
+// in place of the bytecode. Code objects it cannot translate still run from
+// the embedded bytecode.
+package transpiler
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+)
+
+// Options configure Generate.
+type Options struct {
+	// Package is the name of the generated package.
+	Package string
+	// Source is the file the module was compiled from, named in the header
+	// comment of the generated file.
+	Source string
+}
+
+// Result is a generated Go file.
+type Result struct {
+	Source []byte
+
+	// Native lists the code objects translated to Go and Interpreted those
+	// left to the VM, by qualified name such as "<module>" or "outer.inner".
+	Native      []string
+	Interpreted []string
+}
+
+// Generate returns the Go source of a package whose Run function runs code
+// in a VM as the VM would run it itself, with the code objects that have
+// register code translated to Go.
+func Generate(code *compiler.CodeObject, opts Options) (*Result, error) {
+	if opts.Package == "" {
+		return nil, fmt.Errorf("no package name")
+	}
+	if !token.IsIdentifier(opts.Package) {
+		return nil, fmt.Errorf("invalid package name %q", opts.Package)
+	}
+	var data bytes.Buffer
+	if err := code.Serialize(&data); err != nil {
+		return nil, err
+	}
+
+	g := &generator{used: make(map[string]bool)}
+	g.walk(code, "Code", "")
+
+	var b bytes.Buffer
+	source := opts.Source
+	if source == "" {
+		source = code.Filename
+	}
+	fmt.Fprintf(&b, "// Code generated by py2go from %s. DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(&b, "package %s\n\n", opts.Package)
+	b.WriteString("import (\n")
+	b.WriteString("\t\"strings\"\n\n")
+	b.WriteString("\t\"github.com/warriorguo/gopy/pkg/compiler\"\n")
+	b.WriteString("\t\"github.com/warriorguo/gopy/pkg/object\"\n")
+	if g.runtime {
+		b.WriteString("\t\"github.com/warriorguo/gopy/pkg/runtime\"\n")
+	}
+	b.WriteString("\t\"github.com/warriorguo/gopy/pkg/vm\"\n")
+	b.WriteString(")\n\n")
+
+	b.WriteString("// Code is the compiled module. Code objects without a native function run\n")
+	b.WriteString("// from its bytecode.\n")
+	b.WriteString("var Code = load(bytecode)\n\n")
+	b.WriteString("// Run runs the module in machine, as machine.Run(Code) would.\n")
+	b.WriteString("func Run(machine *vm.VM) (object.Object, error) {\n")
+	for _, fn := range g.natives {
+		fmt.Fprintf(&b, "\tmachine.SetNative(%s, %s)\n", fn.path, fn.name)
+	}
+	b.WriteString("\treturn machine.Run(Code)\n}\n\n")
+	b.WriteString(`func load(data string) *compiler.CodeObject {
+	code, err := compiler.DeserializeCodeObject(strings.NewReader(data))
+	if err != nil {
+		panic("regenerate with py2go: " + err.Error())
+	}
+	return code
+}
+
+// function returns the code of the function whose template is constant i
+// of code.
+func function(code *compiler.CodeObject, i int) *compiler.CodeObject {
+	return code.Consts[i].(*compiler.PyFunction).Code
+}
+`)
+	for _, fn := range g.natives {
+		b.WriteByte('\n')
+		b.Write(fn.body.Bytes())
+	}
+	b.WriteString("\nconst bytecode = ")
+	writeBytes(&b, data.Bytes())
+	b.WriteByte('\n')
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v", err)
+	}
+	result := &Result{Source: src, Interpreted: g.interpreted}
+	for _, fn := range g.natives {
+		result.Native = append(result.Native, fn.qualified)
+	}
+	return result, nil
+}
+
+type generator struct {
+	natives     []*function
+	interpreted []string
+	used        map[string]bool // Go names of the native functions
+	runtime     bool            // whether the code uses package runtime
+}
+
+// walk translates co, found at the Go expression path, and the functions
+// it defines.
+func (g *generator) walk(co *compiler.CodeObject, path, prefix string) {
+	qualified := prefix + co.Name
+	if fn, err := g.translate(co); err == nil {
+		fn.path = path
+		fn.qualified = qualified
+		g.natives = append(g.natives, fn)
+	} else {
+		g.interpreted = append(g.interpreted, fmt.Sprintf("%s (%v)", qualified, err))
+	}
+	if path != "Code" {
+		prefix = qualified + "."
+	}
+	for i, c := range co.Consts {
+		if fn, ok := c.(*compiler.PyFunction); ok && fn.Code != nil {
+			g.walk(fn.Code, fmt.Sprintf("function(%s, %d)", path, i), prefix)
+		}
+	}
+}
+
+// goName returns an unused Go name for the native function of co.
+func (g *generator) goName(co *compiler.CodeObject) string {
+	base := "module"
+	if co.Name != "<module>" {
+		base = "fn_" + co.Name
+		if !token.IsIdentifier(base) {
+			base = "fn"
+		}
+	}
+	name := base
+	for i := 2; g.used[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	g.used[name] = true
+	return name
+}
+
+// bytesPerLine is how many bytes of bytecode each line of the string
+// literal holds.
+const bytesPerLine = 32
+
+func writeBytes(b *bytes.Buffer, data []byte) {
+	if len(data) == 0 {
+		b.WriteString(`""`)
+		return
+	}
+	var lines []string
+	for len(data) > 0 {
+		n := min(len(data), bytesPerLine)
+		var s strings.Builder
+		s.WriteByte('"')
+		for _, c := range data[:n] {
+			fmt.Fprintf(&s, "\\x%02x", c)
+		}
+		s.WriteByte('"')
+		lines = append(lines, s.String())
+		data = data[n:]
+	}
+	b.WriteString(strings.Join(lines, " +\n\t"))
+}
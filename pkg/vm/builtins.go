@@ -0,0 +1,238 @@
+package vm
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// BuiltinNames returns the names of the builtins visible to code run by the
+// VM, sorted.
+func (vm *VM) BuiltinNames() []string {
+	names := make([]string, 0, vm.builtins.Len())
+	vm.builtins.Range(func(name string, _ object.Object) {
+		names = append(names, name)
+	})
+	sort.Strings(names)
+	return names
+}
+
+func (vm *VM) newBuiltins() map[string]object.Object {
+	builtins := make(map[string]object.Object)
+	builtins["len"] = &compiler.PyBuiltin{
+		Name: "len",
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) != 1 {
+				return nil, raise("TypeError", "len() takes exactly one argument (%d given)", len(args))
+			}
+
+			switch obj := args[0].(type) {
+			case *runtime.PyString:
+				return runtime.NewInt(len(obj.Value)), nil
+			case *runtime.PyList:
+				return runtime.NewInt(len(obj.Elements)), nil
+			case *runtime.PyDict:
+				return runtime.NewInt(len(obj.Pairs)), nil
+			default:
+				return nil, raise("TypeError", "object of type '%s' has no len()", obj.Type())
+			}
+		},
+	}
+
+	builtins["range"] = &compiler.PyBuiltin{
+		Name: "range",
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) < 1 || len(args) > 3 {
+				return nil, raise("TypeError", "range() takes 1 to 3 arguments")
+			}
+
+			var start, stop, step int
+			var err error
+
+			if len(args) == 1 {
+				start = 0
+				stop, err = toGoInt(args[0])
+				if err != nil {
+					return nil, err
+				}
+				step = 1
+			} else if len(args) == 2 {
+				start, err = toGoInt(args[0])
+				if err != nil {
+					return nil, err
+				}
+				stop, err = toGoInt(args[1])
+				if err != nil {
+					return nil, err
+				}
+				step = 1
+			} else {
+				start, err = toGoInt(args[0])
+				if err != nil {
+					return nil, err
+				}
+				stop, err = toGoInt(args[1])
+				if err != nil {
+					return nil, err
+				}
+				step, err = toGoInt(args[2])
+				if err != nil {
+					return nil, err
+				}
+				if step == 0 {
+					return nil, raise("ValueError", "range() step argument must not be zero")
+				}
+			}
+
+			count := 0
+			if step > 0 && stop > start {
+				count = (stop - start + step - 1) / step
+			} else if step < 0 && start > stop {
+				count = (start - stop - step - 1) / -step
+			}
+			// The list itself plus one int object per element.
+			if err := vm.chargeList(count); err != nil {
+				return nil, err
+			}
+			if err := vm.charge(int64(count) * objectHeaderSize); err != nil {
+				return nil, err
+			}
+
+			var elements []object.Object
+			if step > 0 {
+				for i := start; i < stop; i += step {
+					elements = append(elements, runtime.NewInt(i))
+				}
+			} else {
+				for i := start; i > stop; i += step {
+					elements = append(elements, runtime.NewInt(i))
+				}
+			}
+
+			return &runtime.PyList{Elements: elements}, nil
+		},
+	}
+
+	builtins["type"] = &compiler.PyBuiltin{
+		Name: "type",
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) != 1 {
+				return nil, raise("TypeError", "type() takes exactly one argument")
+			}
+			return &runtime.PyString{Value: args[0].Type()}, nil
+		},
+	}
+
+	builtins["str"] = &compiler.PyBuiltin{
+		Name: "str",
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) != 1 {
+				return nil, raise("TypeError", "str() takes exactly one argument")
+			}
+			value := toGoString(args[0])
+			if err := vm.chargeString(len(value)); err != nil {
+				return nil, err
+			}
+			return &runtime.PyString{Value: value}, nil
+		},
+	}
+
+	builtins["raw_input"] = &compiler.PyBuiltin{
+		Name: "raw_input",
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) > 1 {
+				return nil, raise("TypeError", "raw_input() takes at most 1 argument (%d given)", len(args))
+			}
+			if len(args) == 1 {
+				if err := vm.writeTo(vm.stdout, toGoString(args[0])); err != nil {
+					return nil, err
+				}
+			}
+			line, err := vm.readLine(vm.stdin)
+			if err != nil {
+				return nil, err
+			}
+			if err := vm.chargeString(len(line)); err != nil {
+				return nil, err
+			}
+			return &runtime.PyString{Value: strings.TrimRight(line, "\r\n")}, nil
+		},
+	}
+
+	builtins["open"] = &compiler.PyBuiltin{
+		Name: "open",
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) < 1 || len(args) > 2 {
+				return nil, raise("TypeError", "open() takes 1 or 2 arguments (%d given)", len(args))
+			}
+			if err := vm.checkCapability(CapFile, "open()"); err != nil {
+				return nil, err
+			}
+			name := toGoString(args[0])
+			mode := "r"
+			if len(args) == 2 {
+				mode = toGoString(args[1])
+			}
+			return openFile(name, mode)
+		},
+	}
+
+	return builtins
+}
+
+func openFile(name, mode string) (*runtime.PyFile, error) {
+	var flag int
+	switch strings.TrimSuffix(mode, "b") {
+	case "r":
+		flag = os.O_RDONLY
+	case "w":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case "a":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	default:
+		return nil, raise("ValueError", "mode string must begin with one of 'r', 'w' or 'a', not '%s'", mode)
+	}
+
+	file, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, raise("IOError", "%v", err)
+	}
+
+	f := &runtime.PyFile{Name: name, Closer: file}
+	if flag == os.O_RDONLY {
+		f.SetReader(file)
+	} else {
+		f.Writer = file
+	}
+	return f, nil
+}
+
+func (vm *VM) writeTo(f *runtime.PyFile, s string) error {
+	if f.Closed {
+		return raise("ValueError", "I/O operation on closed file")
+	}
+	if f.Writer == nil {
+		return raise("IOError", "File not open for writing")
+	}
+	_, err := io.WriteString(f.Writer, s)
+	return err
+}
+
+func (vm *VM) readLine(f *runtime.PyFile) (string, error) {
+	if f.Reader == nil {
+		return "", raise("IOError", "File not open for reading")
+	}
+	line, err := f.Reader.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return "", raise("EOFError", "EOF when reading a line")
+		}
+		return line, nil
+	}
+	return line, err
+}
@@ -0,0 +1,54 @@
+package vm
+
+import (
+	"fmt"
+	"time"
+)
+
+// InstructionLimitError is returned when a run executes more instructions
+// than allowed by SetMaxInstructions.
+type InstructionLimitError struct {
+	Limit int64
+}
+
+func (e *InstructionLimitError) Error() string {
+	return fmt.Sprintf("instruction limit exceeded (%d instructions)", e.Limit)
+}
+
+// TimeoutError is returned when a run takes longer than allowed by SetTimeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("execution timed out after %s", e.Timeout)
+}
+
+// CancelledError is returned when the context passed to RunContext is done.
+// It unwraps to the context's error.
+type CancelledError struct {
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("execution cancelled: %v", e.Err)
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// Exception is a Python-level error raised while executing code, such as
+// RuntimeError or MemoryError.
+type Exception struct {
+	Type    string
+	Message string
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+func raise(typ, format string, args ...interface{}) *Exception {
+	return &Exception{Type: typ, Message: fmt.Sprintf(format, args...)}
+}
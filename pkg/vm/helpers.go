@@ -1,7 +1,6 @@
 package vm
 
 import (
-	"fmt"
 	"github.com/warriorguo/gopy/pkg/runtime"
 	"github.com/warriorguo/gopy/pkg/object"
 )
@@ -18,7 +17,7 @@ func toGoInt(obj object.Object) (int, error) {
 		}
 		return 0, nil
 	default:
-		return 0, fmt.Errorf("cannot convert %s to int", obj.Type())
+		return 0, raise("TypeError", "cannot convert %s to int", obj.Type())
 	}
 }
 
@@ -34,7 +33,7 @@ func toGoFloat(obj object.Object) (float64, error) {
 		}
 		return 0.0, nil
 	default:
-		return 0, fmt.Errorf("cannot convert %s to float", obj.Type())
+		return 0, raise("TypeError", "cannot convert %s to float", obj.Type())
 	}
 }
 
@@ -0,0 +1,205 @@
+package vm
+
+import (
+	"context"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// Event identifies the kind of execution event passed to a Hook.
+type Event int
+
+const (
+	// EventCall is sent before the first instruction of a frame runs.
+	EventCall Event = iota
+	// EventLine is sent before the first instruction of a new source line
+	// runs, and again when a loop jumps back to a line.
+	EventLine
+	// EventReturn is sent when a frame returns; arg is the return value.
+	EventReturn
+	// EventException is sent when an exception ends the run; arg is the
+	// exception message and the frame is the one that raised it.
+	EventException
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCall:
+		return "call"
+	case EventLine:
+		return "line"
+	case EventReturn:
+		return "return"
+	case EventException:
+		return "exception"
+	default:
+		return "unknown"
+	}
+}
+
+// Hook observes execution. Hooks run on the VM's goroutine while the program
+// is suspended, so they may inspect frames freely. Returning an error stops
+// the run with that error.
+type Hook interface {
+	Trace(event Event, frame *Frame, arg object.Object) error
+}
+
+// HookFunc adapts a function to the Hook interface.
+type HookFunc func(event Event, frame *Frame, arg object.Object) error
+
+func (f HookFunc) Trace(event Event, frame *Frame, arg object.Object) error {
+	return f(event, frame, arg)
+}
+
+// InstructionHook is implemented by hooks that also observe every
+// instruction, such as profilers. Instruction is called before the
+// instruction at offset runs, after any call or line event for it.
+type InstructionHook interface {
+	Hook
+	Instruction(frame *Frame, offset int) error
+}
+
+type hookEntry struct {
+	id    int
+	hook  Hook
+	instr InstructionHook
+}
+
+// AddHook installs h and returns a function that removes it. Hooks are
+// called in the order they were added. A VM without hooks pays only a nil
+// check per instruction. If h is an InstructionHook it is also called for
+// every instruction.
+func (vm *VM) AddHook(h Hook) (remove func()) {
+	vm.nextHookID++
+	id := vm.nextHookID
+	entry := hookEntry{id: id, hook: h}
+	if instr, ok := h.(InstructionHook); ok {
+		entry.instr = instr
+		vm.instructionHooks++
+	}
+	vm.hooks = append(vm.hooks, entry)
+	return func() {
+		for i, entry := range vm.hooks {
+			if entry.id == id {
+				if entry.instr != nil {
+					vm.instructionHooks--
+				}
+				vm.hooks = append(vm.hooks[:i:i], vm.hooks[i+1:]...)
+				break
+			}
+		}
+		if len(vm.hooks) == 0 {
+			vm.hooks = nil
+		}
+	}
+}
+
+func (vm *VM) fire(event Event, frame *Frame, arg object.Object) error {
+	for _, entry := range vm.hooks {
+		if err := entry.hook.Trace(event, frame, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// traceInstruction reports call and line events for the instruction at
+// offset, which the frame is about to execute.
+func (vm *VM) traceInstruction(frame *Frame, offset int) error {
+	if !frame.started {
+		frame.started = true
+		if err := vm.fire(EventCall, frame, nil); err != nil {
+			return err
+		}
+	}
+	line := frame.lineFor(offset)
+	if line > 0 && (line != frame.lastLine || offset <= frame.lastOffset) {
+		frame.lastLine = line
+		frame.lastOffset = offset
+		if err := vm.fire(EventLine, frame, nil); err != nil {
+			return err
+		}
+	} else {
+		frame.lastOffset = offset
+	}
+	// Instruction hooks observe stack code; frames created before one was
+	// added may still be running register code.
+	if vm.instructionHooks == 0 || frame.regs != nil {
+		return nil
+	}
+	for _, entry := range vm.hooks {
+		if entry.instr != nil {
+			if err := entry.instr.Instruction(frame, offset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (vm *VM) traceException(err error) {
+	exc, ok := err.(*Exception)
+	if !ok || vm.frameIdx < 0 {
+		return
+	}
+	// The run is already failing; errors from hooks cannot replace it.
+	_ = vm.fire(EventException, vm.currentFrame(), &runtime.PyString{Value: exc.Error()})
+}
+
+// Line returns the source line of the instruction the frame is executing,
+// or 0 if it has not started or carries no line information.
+func (f *Frame) Line() int {
+	if f.IP == 0 {
+		return 0
+	}
+	return f.lineFor(f.IP - 1)
+}
+
+// lineFor returns the source line of the instruction at offset in the
+// stack or register code the frame runs. Native frames keep offsets into
+// the register code they were generated from.
+func (f *Frame) lineFor(offset int) int {
+	if f.regs != nil || f.native != nil {
+		return f.Code.Registers.LineForOffset(offset)
+	}
+	return f.Code.LineForOffset(offset)
+}
+
+// Frames returns the active frames, outermost first.
+func (vm *VM) Frames() []*Frame {
+	frames := make([]*Frame, vm.frameIdx+1)
+	copy(frames, vm.frames[:vm.frameIdx+1])
+	return frames
+}
+
+// Depth returns the number of active frames.
+func (vm *VM) Depth() int {
+	return vm.frameIdx + 1
+}
+
+// Globals returns a copy of the module namespace of the VM.
+func (vm *VM) Globals() map[string]object.Object {
+	return vm.globals.Map()
+}
+
+// GlobalNamespace returns the module namespace of the VM itself, so that
+// changes to it are seen by running code.
+func (vm *VM) GlobalNamespace() *runtime.Namespace {
+	return vm.globals
+}
+
+// Eval runs code, typically a compiled expression, in the scope of frame:
+// the frame's locals shadow its globals. Names assigned by code are not
+// written back to the frame.
+func (vm *VM) Eval(frame *Frame, code *compiler.CodeObject) (object.Object, error) {
+	scope := runtime.NewNamespace()
+	frame.Globals.Range(scope.Set)
+	for i, name := range frame.Code.Varnames {
+		if i < len(frame.Locals) {
+			scope.Set(name, frame.Locals[i])
+		}
+	}
+	return vm.run(context.Background(), code, scope)
+}
@@ -0,0 +1,34 @@
+package vm
+
+// Approximate sizes, in bytes, used to account allocations against the
+// memory limit. They only need to be in the right order of magnitude.
+const (
+	objectHeaderSize = 16
+	listSlotSize     = 16
+	dictEntrySize    = 64
+)
+
+// charge records an allocation of n bytes and raises MemoryError once the
+// run exceeds its memory limit.
+func (vm *VM) charge(n int64) error {
+	if vm.memoryLimit <= 0 {
+		return nil
+	}
+	vm.allocated += n
+	if vm.allocated > vm.memoryLimit {
+		return &Exception{Type: "MemoryError", Message: "memory limit exceeded"}
+	}
+	return nil
+}
+
+func (vm *VM) chargeString(length int) error {
+	return vm.charge(objectHeaderSize + int64(length))
+}
+
+func (vm *VM) chargeList(length int) error {
+	return vm.charge(objectHeaderSize + int64(length)*listSlotSize)
+}
+
+func (vm *VM) chargeDict(entries int) error {
+	return vm.charge(objectHeaderSize + int64(entries)*dictEntrySize)
+}
@@ -0,0 +1,237 @@
+package vm
+
+import (
+	"io"
+	"os"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+type moduleDef struct {
+	build        func() *runtime.PyModule
+	capabilities Capability
+}
+
+// RegisterModule makes a host-provided module importable. The module is
+// built on first import, and only if the sandbox policy grants caps.
+func (vm *VM) RegisterModule(name string, caps Capability, build func() *runtime.PyModule) {
+	vm.registry[name] = moduleDef{build: build, capabilities: caps}
+	delete(vm.modules, name)
+}
+
+func (vm *VM) registerStdModules() {
+	vm.RegisterModule("sys", CapNone, vm.newSysModule)
+	vm.RegisterModule("os", CapEnv, vm.newOSModule)
+}
+
+func (vm *VM) importModule(name string) (*runtime.PyModule, error) {
+	def, exists := vm.registry[name]
+	if !exists {
+		return nil, raise("ImportError", "No module named %s", name)
+	}
+	if err := vm.checkModule(name, def.capabilities); err != nil {
+		return nil, err
+	}
+
+	if module, exists := vm.modules[name]; exists {
+		return module, nil
+	}
+	module := def.build()
+	if _, exists := module.Dict["__name__"]; !exists {
+		module.Dict["__name__"] = &runtime.PyString{Value: name}
+	}
+	vm.modules[name] = module
+	return module, nil
+}
+
+func (vm *VM) newSysModule() *runtime.PyModule {
+	module := runtime.NewPyModule("sys")
+	module.Dict["stdout"] = vm.stdout
+	module.Dict["stderr"] = vm.stderr
+	module.Dict["stdin"] = vm.stdin
+	module.Dict["settrace"] = vm.traceSetter("settrace", vm.setTrace)
+	module.Dict["setprofile"] = vm.traceSetter("setprofile", vm.setProfile)
+	module.Dict["gettrace"] = vm.traceGetter("gettrace", func(t *pyTracer) object.Object { return t.trace })
+	module.Dict["getprofile"] = vm.traceGetter("getprofile", func(t *pyTracer) object.Object { return t.profile })
+	return module
+}
+
+func (vm *VM) traceSetter(name string, set func(fn object.Object)) *compiler.PyBuiltin {
+	return &compiler.PyBuiltin{
+		Name: name,
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) != 1 {
+				return nil, raise("TypeError", "%s() takes exactly one argument (%d given)", name, len(args))
+			}
+			switch fn := args[0].(type) {
+			case *runtime.PyNone:
+				set(nil)
+			case *compiler.PyFunction, *compiler.PyBuiltin:
+				set(fn)
+			default:
+				return nil, raise("TypeError", "%s() argument must be callable or None", name)
+			}
+			return runtime.None, nil
+		},
+	}
+}
+
+func (vm *VM) traceGetter(name string, get func(t *pyTracer) object.Object) *compiler.PyBuiltin {
+	return &compiler.PyBuiltin{
+		Name: name,
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) != 0 {
+				return nil, raise("TypeError", "%s() takes no arguments (%d given)", name, len(args))
+			}
+			if vm.tracer != nil {
+				if fn := get(vm.tracer); fn != nil {
+					return fn, nil
+				}
+			}
+			return runtime.None, nil
+		},
+	}
+}
+
+func (vm *VM) newOSModule() *runtime.PyModule {
+	module := runtime.NewPyModule("os")
+	module.Dict["getenv"] = &compiler.PyBuiltin{
+		Name: "getenv",
+		Func: func(args []object.Object) (object.Object, error) {
+			if len(args) < 1 || len(args) > 2 {
+				return nil, raise("TypeError", "getenv() takes 1 or 2 arguments (%d given)", len(args))
+			}
+			if err := vm.checkCapability(CapEnv, "os.getenv()"); err != nil {
+				return nil, err
+			}
+			if value, ok := os.LookupEnv(toGoString(args[0])); ok {
+				return &runtime.PyString{Value: value}, nil
+			}
+			if len(args) == 2 {
+				return args[1], nil
+			}
+			return runtime.None, nil
+		},
+	}
+	return module
+}
+
+func (vm *VM) getAttr(obj object.Object, name string) (object.Object, error) {
+	if err := vm.checkAttribute(name); err != nil {
+		return nil, err
+	}
+
+	switch o := obj.(type) {
+	case *runtime.PyModule:
+		if value, exists := o.Dict[name]; exists {
+			return value, nil
+		}
+		return nil, raise("AttributeError", "'module' object has no attribute '%s'", name)
+	case *runtime.PyFile:
+		if method := vm.fileMethod(o, name); method != nil {
+			return method, nil
+		}
+	case *PyFrame:
+		if value, ok := vm.frameAttr(o, name); ok {
+			return value, nil
+		}
+	case *PyCode:
+		if value, ok := codeAttr(o, name); ok {
+			return value, nil
+		}
+	}
+	return nil, raise("AttributeError", "'%s' object has no attribute '%s'", obj.Type(), name)
+}
+
+func (vm *VM) fileMethod(f *runtime.PyFile, name string) object.Object {
+	switch name {
+	case "write":
+		return &compiler.PyBuiltin{
+			Name: "write",
+			Func: func(args []object.Object) (object.Object, error) {
+				if len(args) != 1 {
+					return nil, raise("TypeError", "write() takes exactly one argument (%d given)", len(args))
+				}
+				s, ok := args[0].(*runtime.PyString)
+				if !ok {
+					return nil, raise("TypeError", "expected a string, got %s", args[0].Type())
+				}
+				if err := vm.writeTo(f, s.Value); err != nil {
+					return nil, err
+				}
+				return runtime.None, nil
+			},
+		}
+	case "read":
+		return &compiler.PyBuiltin{
+			Name: "read",
+			Func: func(args []object.Object) (object.Object, error) {
+				if len(args) != 0 {
+					return nil, raise("TypeError", "read() takes no arguments (%d given)", len(args))
+				}
+				if f.Closed {
+					return nil, raise("ValueError", "I/O operation on closed file")
+				}
+				if f.Reader == nil {
+					return nil, raise("IOError", "File not open for reading")
+				}
+				data, err := io.ReadAll(f.Reader)
+				if err != nil {
+					return nil, err
+				}
+				if err := vm.chargeString(len(data)); err != nil {
+					return nil, err
+				}
+				return &runtime.PyString{Value: string(data)}, nil
+			},
+		}
+	case "close":
+		return &compiler.PyBuiltin{
+			Name: "close",
+			Func: func(args []object.Object) (object.Object, error) {
+				if f.Closer != nil && !f.Closed {
+					if err := f.Closer.Close(); err != nil {
+						return nil, err
+					}
+				}
+				f.Closed = f.Closer != nil
+				return runtime.None, nil
+			},
+		}
+	case "readline":
+		return &compiler.PyBuiltin{
+			Name: "readline",
+			Func: func(args []object.Object) (object.Object, error) {
+				if len(args) != 0 {
+					return nil, raise("TypeError", "readline() takes no arguments (%d given)", len(args))
+				}
+				if f.Closed {
+					return nil, raise("ValueError", "I/O operation on closed file")
+				}
+				if f.Reader == nil {
+					return nil, raise("IOError", "File not open for reading")
+				}
+				line, err := f.Reader.ReadString('\n')
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+				return &runtime.PyString{Value: line}, nil
+			},
+		}
+	case "flush":
+		return &compiler.PyBuiltin{
+			Name: "flush",
+			Func: func(args []object.Object) (object.Object, error) {
+				if flusher, ok := f.Writer.(interface{ Flush() error }); ok {
+					if err := flusher.Flush(); err != nil {
+						return nil, err
+					}
+				}
+				return runtime.None, nil
+			},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// NativeFunc runs a code object as Go code, as generated by py2go from its
+// register code. It is called with the frame of the code object pushed and
+// the arguments in frame.Locals. It keeps frame.IP one past the offset of
+// the register instruction it is executing, so that tracebacks show the
+// right line.
+type NativeFunc func(m *Native, frame *Frame) (object.Object, error)
+
+// SetNative makes the VM run fn in place of code, which must have register
+// code. Code still runs in the VM while hooks are installed, so tracing,
+// debugging and profiling see every line.
+func (vm *VM) SetNative(code *compiler.CodeObject, fn NativeFunc) {
+	if code.Registers == nil {
+		panic(fmt.Sprintf("vm: native function for %s, which has no register code", code.Name))
+	}
+	vm.natives[code] = fn
+}
+
+func (vm *VM) newNativeFrame(code *compiler.CodeObject, globals *runtime.Namespace, fn NativeFunc) *Frame {
+	locals := make([]object.Object, len(code.Varnames))
+	for i := range locals {
+		locals[i] = runtime.None
+	}
+	return &Frame{
+		Code:     code,
+		Locals:   locals,
+		Globals:  globals,
+		Builtins: vm.builtins,
+		caches:   vm.registerCaches(code.Registers),
+		native:   fn,
+	}
+}
+
+// onStack reports whether the frame runs on the stack engine.
+func (f *Frame) onStack() bool {
+	return f.regs == nil && f.native == nil
+}
+
+// executeNative runs the native function of the current frame and returns
+// its result to the calling frame.
+func (vm *VM) executeNative(base int) (object.Object, error) {
+	frame := vm.currentFrame()
+	result, err := frame.native((*Native)(vm), frame)
+	if err != nil {
+		return nil, err
+	}
+	vm.popFrame()
+	if vm.frameIdx <= base {
+		return result, nil
+	}
+	caller := vm.currentFrame()
+	if caller.regs != nil {
+		caller.regs[caller.ret] = result
+	} else {
+		caller.push(result)
+	}
+	return nil, nil
+}
+
+// Native is the interface of a VM to native functions. Its methods perform
+// the operations of register instructions with the semantics, limits and
+// errors of the VM.
+type Native VM
+
+// Step accounts for count instructions about to run and reports whether
+// the run must stop. Native functions call it at the start of every basic
+// block, so an instruction limit stops them at the start of the block that
+// would exceed it.
+func (m *Native) Step(count int) error {
+	st := m.state
+	before := st.steps
+	st.steps += int64(count)
+	// The steps crossed a multiple of the interval if they differ above it.
+	crossed := before^st.steps >= interruptCheckInterval
+	if m.maxInstructions > 0 || crossed {
+		return (*VM)(m).stepped(st, crossed)
+	}
+	return nil
+}
+
+// stepped is the slow path of Step. The context and deadline are checked
+// when the count crossed a multiple of interruptCheckInterval.
+func (vm *VM) stepped(st *execState, crossed bool) error {
+	if vm.maxInstructions > 0 && st.steps > vm.maxInstructions {
+		return &InstructionLimitError{Limit: vm.maxInstructions}
+	}
+	if crossed {
+		return vm.expired(st)
+	}
+	return nil
+}
+
+// Call calls fn with args, which it may keep, and runs it to completion
+// within the current run.
+func (m *Native) Call(fn object.Object, args []object.Object) (object.Object, error) {
+	vm := (*VM)(m)
+	switch f := fn.(type) {
+	case *compiler.PyBuiltin:
+		return f.Func(args)
+	case *compiler.PyFunction:
+		base := vm.frameIdx
+		if _, err := vm.enter(f, args); err != nil {
+			return nil, err
+		}
+		return vm.dispatch(vm.state, base)
+	}
+	return nil, raise("TypeError", "'%s' object is not callable", fn.Type())
+}
+
+// LoadName returns the global or builtin named by names[name] of the
+// frame's code, using the inline cache of the LOAD_NAME instruction at pc.
+func (m *Native) LoadName(frame *Frame, pc, name int) (object.Object, error) {
+	if obj, ok := cachedGlobal(frame, &frame.caches[pc], frame.Code.Names[name]); ok {
+		return obj, nil
+	}
+	return nil, raise("NameError", "name '%s' is not defined", frame.Code.Names[name])
+}
+
+// LoadGlobal is LoadName for the LOAD_GLOBAL instruction at pc.
+func (m *Native) LoadGlobal(frame *Frame, pc, name int) (object.Object, error) {
+	if obj, ok := cachedGlobal(frame, &frame.caches[pc], frame.Code.Names[name]); ok {
+		return obj, nil
+	}
+	return nil, raise("NameError", "global name '%s' is not defined", frame.Code.Names[name])
+}
+
+func cachedGlobal(frame *Frame, cache *nameCache, name string) (object.Object, bool) {
+	if cache.globals == frame.Globals.Version() {
+		if cache.builtins == 0 {
+			return frame.Globals.Slot(cache.slot), true
+		}
+		if cache.builtins == frame.Builtins.Version() {
+			return frame.Builtins.Slot(cache.slot), true
+		}
+	}
+	return loadGlobal(frame, cache, name)
+}
+
+// StoreGlobal binds the global named by names[name] to value, using the
+// inline cache of the STORE_GLOBAL instruction at pc.
+func (m *Native) StoreGlobal(frame *Frame, pc, name int, value object.Object) {
+	cache := &frame.caches[pc]
+	if cache.globals == frame.Globals.Version() {
+		frame.Globals.SetSlot(cache.slot, value)
+		return
+	}
+	storeGlobal(frame, cache, frame.Code.Names[name], value)
+}
+
+// BinaryOp applies the arithmetic operator op to left and right.
+func (m *Native) BinaryOp(op compiler.OpCode, left, right object.Object) (object.Object, error) {
+	if l, r, ok := intOperands(left, right); ok {
+		if value, ok := intArith(op, l, r); ok {
+			return runtime.NewInt(value), nil
+		}
+	}
+	return (*VM)(m).binaryOp(left, right, op)
+}
+
+// UnaryOp applies the unary operator op, + or -, to operand.
+func (m *Native) UnaryOp(op compiler.OpCode, operand object.Object) (object.Object, error) {
+	return (*VM)(m).unaryOp(operand, op)
+}
+
+// Compare applies the comparison operator op to left and right.
+func (m *Native) Compare(op compiler.OpCode, left, right object.Object) (object.Object, error) {
+	return (*VM)(m).compare(op, left, right)
+}
+
+// Test reports whether the comparison op holds between left and right.
+func (m *Native) Test(op compiler.OpCode, left, right object.Object) (bool, error) {
+	if l, r, ok := intOperands(left, right); ok && op != compiler.OpCompareEq && op != compiler.OpCompareNe {
+		return compareOrdered(op, l, r), nil
+	}
+	result, err := (*VM)(m).compare(op, left, right)
+	if err != nil {
+		return false, err
+	}
+	return result.IsTruthy(), nil
+}
+
+// BuildList returns a list of elements, which it keeps.
+func (m *Native) BuildList(elements []object.Object) (object.Object, error) {
+	if err := (*VM)(m).chargeList(len(elements)); err != nil {
+		return nil, err
+	}
+	return &runtime.PyList{Elements: elements}, nil
+}
+
+// BuildDict returns a dict of items, alternating keys and values.
+func (m *Native) BuildDict(items []object.Object) (object.Object, error) {
+	n := len(items) / 2
+	if err := (*VM)(m).chargeDict(n); err != nil {
+		return nil, err
+	}
+	// Pairs are set last first, as the stack code pops them.
+	dict := runtime.NewPyDict()
+	for i := n - 1; i >= 0; i-- {
+		dict.Set(items[2*i], items[2*i+1])
+	}
+	return dict, nil
+}
+
+// GetItem returns container[index].
+func (m *Native) GetItem(container, index object.Object) (object.Object, error) {
+	return (*VM)(m).subscript(container, index)
+}
+
+// SetItem performs container[index] = value.
+func (m *Native) SetItem(container, index, value object.Object) error {
+	return (*VM)(m).storeSubscript(container, index, value)
+}
+
+// GetAttr returns the attribute called name of obj.
+func (m *Native) GetAttr(obj object.Object, name string) (object.Object, error) {
+	return (*VM)(m).getAttr(obj, name)
+}
+
+// Import returns the module called name.
+func (m *Native) Import(name string) (object.Object, error) {
+	module, err := (*VM)(m).importModule(name)
+	if err != nil {
+		return nil, err
+	}
+	return module, nil
+}
+
+// MakeFunction returns the function whose template is constant c of the
+// code the frame runs, defined in the frame's globals.
+func (m *Native) MakeFunction(frame *Frame, c int) object.Object {
+	template := frame.Code.Consts[c].(*compiler.PyFunction)
+	return &compiler.PyFunction{
+		Code:    template.Code,
+		Name:    template.Name,
+		Globals: frame.Globals,
+	}
+}
+
+// GetIter returns an iterator over iterable.
+func (m *Native) GetIter(iterable object.Object) (object.Object, error) {
+	iterator, err := (*VM)(m).getIter(iterable)
+	if err != nil {
+		return nil, err
+	}
+	return iterator, nil
+}
+
+// Next returns the next item of an iterator returned by GetIter, and false
+// once it is exhausted.
+func (m *Native) Next(iterator object.Object) (object.Object, bool, error) {
+	it, ok := iterator.(*runtime.PyListIterator)
+	if !ok {
+		return nil, false, raise("SystemError", "FOR_ITER: expected iterator")
+	}
+	item, ok := it.Next()
+	return item, ok, nil
+}
+
+// Print writes obj to standard output, followed by a space if space is
+// set.
+func (m *Native) Print(obj object.Object, space bool) error {
+	return m.PrintTo(m.stdout, obj, space)
+}
+
+// PrintNewline writes a newline to standard output.
+func (m *Native) PrintNewline() error {
+	return m.PrintNewlineTo(m.stdout)
+}
+
+// PrintTo is Print for print >> dest.
+func (m *Native) PrintTo(dest, obj object.Object, space bool) error {
+	file, ok := dest.(*runtime.PyFile)
+	if !ok {
+		return raise("AttributeError", "'%s' object has no attribute 'write'", dest.Type())
+	}
+	if err := (*VM)(m).writeTo(file, obj.String()); err != nil {
+		return err
+	}
+	if space {
+		return (*VM)(m).writeTo(file, " ")
+	}
+	return nil
+}
+
+// PrintNewlineTo is PrintNewline for print >> dest.
+func (m *Native) PrintNewlineTo(dest object.Object) error {
+	file, ok := dest.(*runtime.PyFile)
+	if !ok {
+		return raise("AttributeError", "'%s' object has no attribute 'write'", dest.Type())
+	}
+	return (*VM)(m).writeTo(file, "\n")
+}
@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"os"
+	"sync"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// Reset discards all state left behind by previous runs (globals, imported
+// modules, registered sources, stream redirections) while keeping
+// configuration such as limits, the sandbox policy and registered modules.
+func (vm *VM) Reset() {
+	for vm.frameIdx >= 0 {
+		vm.popFrame()
+	}
+	vm.globals = runtime.NewNamespace()
+	vm.caches = make(map[*compiler.CodeObject][]nameCache)
+	vm.regCache = make(map[*compiler.RegisterCode][]nameCache)
+	vm.modules = make(map[string]*runtime.PyModule)
+	vm.sources = nil
+	vm.files = nil
+	vm.allocated = 0
+	vm.clearTracer()
+
+	vm.stdout.Writer = os.Stdout
+	vm.stderr.Writer = os.Stderr
+	vm.stdin.SetReader(os.Stdin)
+}
+
+// Pool reuses VMs across executions. A VM must only be used by one goroutine
+// at a time; the pool hands each caller its own VM and resets it on return.
+type Pool struct {
+	pool sync.Pool
+}
+
+// NewPool creates a pool whose VMs are created by newVM, which is where
+// limits and policies should be configured. A nil newVM uses NewVM.
+func NewPool(newVM func() *VM) *Pool {
+	if newVM == nil {
+		newVM = NewVM
+	}
+	return &Pool{
+		pool: sync.Pool{New: func() interface{} { return newVM() }},
+	}
+}
+
+// Get returns a VM with no state from earlier runs.
+func (p *Pool) Get() *VM {
+	return p.pool.Get().(*VM)
+}
+
+// Put resets vm and makes it available to later Get calls. The caller must
+// not use vm afterwards.
+func (p *Pool) Put(vm *VM) {
+	vm.Reset()
+	p.pool.Put(vm)
+}
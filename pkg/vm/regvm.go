@@ -0,0 +1,347 @@
+package vm
+
+import (
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// newRegisterFrame returns a frame that runs the register code of code.
+// Its locals are the first registers.
+func (vm *VM) newRegisterFrame(code *compiler.CodeObject, globals *runtime.Namespace) *Frame {
+	rc := code.Registers
+	regs := make([]object.Object, rc.NumRegisters)
+	for i := range regs {
+		regs[i] = runtime.None
+	}
+	n := len(code.Varnames)
+	return &Frame{
+		Code:     code,
+		Locals:   regs[:n:n],
+		Globals:  globals,
+		Builtins: vm.builtins,
+		caches:   vm.registerCaches(rc),
+		regs:     regs,
+	}
+}
+
+// registerCaches returns the inline caches of the register instructions
+// of rc, which all frames running rc share.
+func (vm *VM) registerCaches(rc *compiler.RegisterCode) []nameCache {
+	caches, ok := vm.regCache[rc]
+	if !ok {
+		caches = make([]nameCache, len(rc.Instructions))
+		vm.regCache[rc] = caches
+	}
+	return caches
+}
+
+// rk returns the value of the RK operand x.
+func (f *Frame) rk(x int32) object.Object {
+	if x < 0 {
+		return f.Code.Consts[-1-x]
+	}
+	return f.regs[x]
+}
+
+// executeRegisters runs register frames, the current frame first, until
+// the frame at base+1 returns or control passes to a stack frame.
+func (vm *VM) executeRegisters(st *execState, base int) (object.Object, error) {
+	frame := vm.currentFrame()
+	code := frame.Code.Registers.Instructions
+	for {
+		st.steps++
+		if vm.maxInstructions > 0 || st.steps&(interruptCheckInterval-1) == 0 {
+			if err := vm.interrupted(st); err != nil {
+				return nil, err
+			}
+		}
+
+		instr := code[frame.IP]
+		frame.IP++
+
+		if vm.hooks != nil {
+			if err := vm.traceInstruction(frame, frame.IP-1); err != nil {
+				return nil, err
+			}
+		}
+
+		switch instr.Op {
+		case compiler.RegMove:
+			frame.regs[instr.A] = frame.rk(instr.B)
+
+		case compiler.RegLoadName, compiler.RegLoadGlobal:
+			cache := &frame.caches[frame.IP-1]
+			if cache.globals == frame.Globals.Version() {
+				if cache.builtins == 0 {
+					frame.regs[instr.A] = frame.Globals.Slot(cache.slot)
+					break
+				}
+				if cache.builtins == frame.Builtins.Version() {
+					frame.regs[instr.A] = frame.Builtins.Slot(cache.slot)
+					break
+				}
+			}
+			name := frame.Code.Names[instr.B]
+			obj, exists := loadGlobal(frame, cache, name)
+			if !exists && instr.Op == compiler.RegLoadGlobal {
+				return nil, raise("NameError", "global name '%s' is not defined", name)
+			} else if !exists {
+				return nil, raise("NameError", "name '%s' is not defined", name)
+			}
+			frame.regs[instr.A] = obj
+
+		case compiler.RegStoreGlobal:
+			cache := &frame.caches[frame.IP-1]
+			if cache.globals == frame.Globals.Version() {
+				frame.Globals.SetSlot(cache.slot, frame.rk(instr.B))
+				break
+			}
+			storeGlobal(frame, cache, frame.Code.Names[instr.A], frame.rk(instr.B))
+
+		case compiler.RegAdd, compiler.RegSub, compiler.RegMul, compiler.RegDiv, compiler.RegMod:
+			left, right := frame.rk(instr.B), frame.rk(instr.C)
+			op := instr.Op.Operator()
+			if l, r, ok := intOperands(left, right); ok {
+				if value, ok := intArith(op, l, r); ok {
+					frame.regs[instr.A] = runtime.NewInt(value)
+					break
+				}
+			}
+			result, err := vm.binaryOp(left, right, op)
+			if err != nil {
+				return nil, err
+			}
+			frame.regs[instr.A] = result
+
+		case compiler.RegPos, compiler.RegNeg:
+			result, err := vm.unaryOp(frame.rk(instr.B), instr.Op.Operator())
+			if err != nil {
+				return nil, err
+			}
+			frame.regs[instr.A] = result
+
+		case compiler.RegNot:
+			frame.regs[instr.A] = runtime.NewBool(!frame.rk(instr.B).IsTruthy())
+
+		case compiler.RegEq, compiler.RegNe, compiler.RegLt, compiler.RegLe, compiler.RegGt, compiler.RegGe,
+			compiler.RegIn, compiler.RegIs, compiler.RegIsNot:
+			result, err := vm.compare(instr.Op.Operator(), frame.rk(instr.B), frame.rk(instr.C))
+			if err != nil {
+				return nil, err
+			}
+			frame.regs[instr.A] = result
+
+		case compiler.RegJump:
+			frame.IP = int(instr.A)
+
+		case compiler.RegJumpIfFalse:
+			if !frame.rk(instr.B).IsTruthy() {
+				frame.IP = int(instr.A)
+			}
+
+		case compiler.RegJumpIfTrue:
+			if frame.rk(instr.B).IsTruthy() {
+				frame.IP = int(instr.A)
+			}
+
+		case compiler.RegJumpIfNotEq, compiler.RegJumpIfNotNe, compiler.RegJumpIfNotLt,
+			compiler.RegJumpIfNotLe, compiler.RegJumpIfNotGt, compiler.RegJumpIfNotGe:
+			left, right := frame.rk(instr.B), frame.rk(instr.C)
+			op := instr.Op.Operator()
+			if l, r, ok := intOperands(left, right); ok && op != compiler.OpCompareEq && op != compiler.OpCompareNe {
+				if !compareOrdered(op, l, r) {
+					frame.IP = int(instr.A)
+				}
+				break
+			}
+			result, err := vm.compare(op, left, right)
+			if err != nil {
+				return nil, err
+			}
+			if !result.IsTruthy() {
+				frame.IP = int(instr.A)
+			}
+
+		case compiler.RegBuildList:
+			n := int(instr.C)
+			if err := vm.chargeList(n); err != nil {
+				return nil, err
+			}
+			elements := make([]object.Object, n)
+			copy(elements, frame.regs[instr.B:])
+			frame.regs[instr.A] = &runtime.PyList{Elements: elements}
+
+		case compiler.RegBuildDict:
+			n := int(instr.C)
+			if err := vm.chargeDict(n); err != nil {
+				return nil, err
+			}
+			// Pairs are set last first, as the stack code pops them.
+			dict := runtime.NewPyDict()
+			for i := n - 1; i >= 0; i-- {
+				dict.Set(frame.regs[int(instr.B)+2*i], frame.regs[int(instr.B)+2*i+1])
+			}
+			frame.regs[instr.A] = dict
+
+		case compiler.RegGetItem:
+			result, err := vm.subscript(frame.rk(instr.B), frame.rk(instr.C))
+			if err != nil {
+				return nil, err
+			}
+			frame.regs[instr.A] = result
+
+		case compiler.RegSetItem:
+			if err := vm.storeSubscript(frame.rk(instr.A), frame.rk(instr.B), frame.rk(instr.C)); err != nil {
+				return nil, err
+			}
+
+		case compiler.RegCall:
+			function := frame.regs[instr.B]
+			args := frame.regs[instr.B+1 : instr.B+1+instr.C]
+			switch f := function.(type) {
+			case *compiler.PyBuiltin:
+				result, err := f.Func(append(make([]object.Object, 0, len(args)), args...))
+				if err != nil {
+					return nil, err
+				}
+				frame.regs[instr.A] = result
+			case *compiler.PyFunction:
+				funcFrame, err := vm.enter(f, args)
+				if err != nil {
+					return nil, err
+				}
+				frame.ret = instr.A
+				frame = funcFrame
+				if frame.regs == nil {
+					return nil, nil
+				}
+				code = frame.Code.Registers.Instructions
+			default:
+				return nil, raise("TypeError", "'%s' object is not callable", function.Type())
+			}
+
+		case compiler.RegReturn:
+			result := frame.rk(instr.A)
+			if vm.hooks != nil {
+				if err := vm.fire(EventReturn, frame, result); err != nil {
+					return nil, err
+				}
+			}
+			vm.popFrame()
+			if vm.frameIdx <= base {
+				return result, nil
+			}
+			frame = vm.currentFrame()
+			if frame.regs == nil {
+				frame.push(result)
+				return nil, nil
+			}
+			frame.regs[frame.ret] = result
+			code = frame.Code.Registers.Instructions
+
+		case compiler.RegPrint:
+			if err := vm.writeTo(vm.stdout, frame.rk(instr.A).String()); err != nil {
+				return nil, err
+			}
+			if instr.B == 1 {
+				if err := vm.writeTo(vm.stdout, " "); err != nil {
+					return nil, err
+				}
+			}
+
+		case compiler.RegPrintNewline:
+			if err := vm.writeTo(vm.stdout, "\n"); err != nil {
+				return nil, err
+			}
+
+		case compiler.RegPrintTo:
+			dest := frame.rk(instr.A)
+			file, ok := dest.(*runtime.PyFile)
+			if !ok {
+				return nil, raise("AttributeError", "'%s' object has no attribute 'write'", dest.Type())
+			}
+			if err := vm.writeTo(file, frame.rk(instr.B).String()); err != nil {
+				return nil, err
+			}
+			if instr.C == 1 {
+				if err := vm.writeTo(file, " "); err != nil {
+					return nil, err
+				}
+			}
+
+		case compiler.RegPrintNewlineTo:
+			dest := frame.rk(instr.A)
+			file, ok := dest.(*runtime.PyFile)
+			if !ok {
+				return nil, raise("AttributeError", "'%s' object has no attribute 'write'", dest.Type())
+			}
+			if err := vm.writeTo(file, "\n"); err != nil {
+				return nil, err
+			}
+
+		case compiler.RegMakeFunction:
+			template := frame.Code.Consts[instr.B].(*compiler.PyFunction)
+			frame.regs[instr.A] = &compiler.PyFunction{
+				Code:    template.Code,
+				Name:    template.Name,
+				Globals: frame.Globals,
+			}
+
+		case compiler.RegLoadAttr:
+			result, err := vm.getAttr(frame.rk(instr.B), frame.Code.Names[instr.C])
+			if err != nil {
+				return nil, err
+			}
+			frame.regs[instr.A] = result
+
+		case compiler.RegImport:
+			module, err := vm.importModule(frame.Code.Names[instr.B])
+			if err != nil {
+				return nil, err
+			}
+			frame.regs[instr.A] = module
+
+		case compiler.RegGetIter:
+			iterator, err := vm.getIter(frame.rk(instr.B))
+			if err != nil {
+				return nil, err
+			}
+			frame.regs[instr.A] = iterator
+
+		case compiler.RegForIter:
+			iterator, ok := frame.regs[instr.B].(*runtime.PyListIterator)
+			if !ok {
+				return nil, raise("SystemError", "FOR_ITER: expected iterator")
+			}
+			if item, ok := iterator.Next(); ok {
+				frame.regs[instr.A] = item
+			} else {
+				frame.IP = int(instr.C)
+			}
+
+		default:
+			return nil, raise("SystemError", "unknown register opcode: %d", instr.Op)
+		}
+	}
+}
+
+// compare applies the comparison operator op to left and right.
+func (vm *VM) compare(op compiler.OpCode, left, right object.Object) (object.Object, error) {
+	switch op {
+	case compiler.OpCompareEq:
+		return runtime.NewBool(left.Equal(right)), nil
+	case compiler.OpCompareNe:
+		return runtime.NewBool(!left.Equal(right)), nil
+	case compiler.OpCompareIs:
+		return runtime.NewBool(runtime.Is(left, right)), nil
+	case compiler.OpCompareIsNot:
+		return runtime.NewBool(!runtime.Is(left, right)), nil
+	case compiler.OpCompareIn:
+		return vm.inOp(left, right)
+	}
+	if l, r, ok := intOperands(left, right); ok {
+		return runtime.NewBool(compareOrdered(op, l, r)), nil
+	}
+	return vm.compareOp(left, right, op)
+}
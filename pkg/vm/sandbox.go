@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// Capability is a set of host resources that scripts may reach through
+// builtins and modules.
+type Capability uint
+
+const (
+	CapFile Capability = 1 << iota
+	CapNetwork
+	CapEnv
+
+	CapNone Capability = 0
+	CapAll             = CapFile | CapNetwork | CapEnv
+)
+
+func (c Capability) String() string {
+	if c == CapNone {
+		return "none"
+	}
+	var names []string
+	if c&CapFile != 0 {
+		names = append(names, "file")
+	}
+	if c&CapNetwork != 0 {
+		names = append(names, "network")
+	}
+	if c&CapEnv != 0 {
+		names = append(names, "env")
+	}
+	return strings.Join(names, "|")
+}
+
+// Policy restricts what a script running in the VM can reach. A nil policy
+// (the default) allows everything.
+type Policy struct {
+	// Builtins lists the visible builtin names; nil makes all builtins visible.
+	Builtins []string
+	// Modules lists the importable module names; nil allows every module
+	// whose required capabilities are granted.
+	Modules []string
+	// Capabilities grants access to host resources.
+	Capabilities Capability
+	// AllowDunder permits attribute access to names like __name__.
+	AllowDunder bool
+}
+
+// SetPolicy applies a sandbox policy to subsequent runs. Modules already
+// imported under a previous policy are discarded.
+func (vm *VM) SetPolicy(policy *Policy) {
+	vm.policy = policy
+	vm.modules = make(map[string]*runtime.PyModule)
+
+	all := vm.newBuiltins()
+	if policy == nil || policy.Builtins == nil {
+		vm.builtins = runtime.NamespaceOf(all)
+		return
+	}
+	vm.builtins = runtime.NewNamespace()
+	for _, name := range policy.Builtins {
+		if builtin, exists := all[name]; exists {
+			vm.builtins.Set(name, builtin)
+		}
+	}
+}
+
+func securityError(format string, args ...interface{}) *Exception {
+	return &Exception{Type: "SecurityError", Message: fmt.Sprintf(format, args...)}
+}
+
+func (vm *VM) checkCapability(required Capability, what string) error {
+	if vm.policy == nil || vm.policy.Capabilities&required == required {
+		return nil
+	}
+	return securityError("%s requires %s access", what, required&^vm.policy.Capabilities)
+}
+
+func (vm *VM) checkModule(name string, required Capability) error {
+	if vm.policy == nil {
+		return nil
+	}
+	if vm.policy.Modules != nil {
+		allowed := false
+		for _, m := range vm.policy.Modules {
+			if m == name {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return securityError("import of module '%s' is not allowed", name)
+		}
+	}
+	return vm.checkCapability(required, fmt.Sprintf("module '%s'", name))
+}
+
+func (vm *VM) checkAttribute(name string) error {
+	if vm.policy == nil || vm.policy.AllowDunder {
+		return nil
+	}
+	if strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__") {
+		return securityError("access to attribute '%s' is not allowed", name)
+	}
+	return nil
+}
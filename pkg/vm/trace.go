@@ -0,0 +1,230 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+)
+
+// PyFrame is the frame object passed to Python trace and profile functions.
+type PyFrame struct {
+	Frame *Frame
+}
+
+func (f *PyFrame) String() string {
+	return fmt.Sprintf("<frame at %p, file '%s', line %d, code %s>", f.Frame, f.Frame.Code.Filename, f.Frame.Line(), f.Frame.Code.Name)
+}
+func (f *PyFrame) Type() string   { return "frame" }
+func (f *PyFrame) IsTruthy() bool { return true }
+func (f *PyFrame) Equal(other object.Object) bool {
+	o, ok := other.(*PyFrame)
+	return ok && o.Frame == f.Frame
+}
+
+// PyCode is the code object of a frame, as seen from Python.
+type PyCode struct {
+	Code *compiler.CodeObject
+}
+
+func (c *PyCode) String() string {
+	return fmt.Sprintf("<code object %s at %p, file \"%s\", line %d>", c.Code.Name, c.Code, c.Code.Filename, c.Code.Firstlineno)
+}
+func (c *PyCode) Type() string   { return "code" }
+func (c *PyCode) IsTruthy() bool { return true }
+func (c *PyCode) Equal(other object.Object) bool {
+	o, ok := other.(*PyCode)
+	return ok && o.Code == c.Code
+}
+
+func (vm *VM) frameAttr(f *PyFrame, name string) (object.Object, bool) {
+	frame := f.Frame
+	switch name {
+	case "f_lineno":
+		return runtime.NewInt(frame.Line()), true
+	case "f_code":
+		return &PyCode{Code: frame.Code}, true
+	case "f_locals":
+		locals := runtime.NewPyDict()
+		if isModuleFrame(frame) {
+			frame.Globals.Range(func(name string, value object.Object) {
+				locals.Set(&runtime.PyString{Value: name}, value)
+			})
+		} else {
+			for i, name := range frame.Code.Varnames {
+				if i < len(frame.Locals) {
+					locals.Set(&runtime.PyString{Value: name}, frame.Locals[i])
+				}
+			}
+		}
+		return locals, true
+	case "f_globals":
+		globals := runtime.NewPyDict()
+		frame.Globals.Range(func(name string, value object.Object) {
+			globals.Set(&runtime.PyString{Value: name}, value)
+		})
+		return globals, true
+	case "f_back":
+		for i := vm.frameIdx; i > 0; i-- {
+			if vm.frames[i] == frame {
+				return &PyFrame{Frame: vm.frames[i-1]}, true
+			}
+		}
+		return runtime.None, true
+	}
+	return nil, false
+}
+
+func isModuleFrame(frame *Frame) bool {
+	return frame.Code.Name == "<module>"
+}
+
+func codeAttr(c *PyCode, name string) (object.Object, bool) {
+	switch name {
+	case "co_name":
+		return &runtime.PyString{Value: c.Code.Name}, true
+	case "co_filename":
+		return &runtime.PyString{Value: c.Code.Filename}, true
+	case "co_firstlineno":
+		return runtime.NewInt(c.Code.Firstlineno), true
+	case "co_argcount":
+		return runtime.NewInt(c.Code.Argcount), true
+	case "co_varnames":
+		names := make([]object.Object, len(c.Code.Varnames))
+		for i, name := range c.Code.Varnames {
+			names[i] = &runtime.PyString{Value: name}
+		}
+		return &runtime.PyList{Elements: names}, true
+	}
+	return nil, false
+}
+
+// CallFunction calls a Python function or builtin with args and runs it to
+// completion. It may be used from builtins and hooks while a program runs.
+func (vm *VM) CallFunction(fn object.Object, args ...object.Object) (object.Object, error) {
+	switch f := fn.(type) {
+	case *compiler.PyBuiltin:
+		return f.Func(args)
+	case *compiler.PyFunction:
+		if len(args) != f.Code.Argcount {
+			return nil, raise("TypeError", "%s() takes %d arguments but %d were given", f.Name, f.Code.Argcount, len(args))
+		}
+		globals := f.Globals
+		if globals == nil {
+			globals = vm.globals
+		}
+		frame := vm.newFrame(f.Code, globals)
+		copy(frame.Locals, args)
+		return vm.runFrame(context.Background(), frame)
+	}
+	return nil, raise("TypeError", "'%s' object is not callable", fn.Type())
+}
+
+// pyTracer runs the functions installed by sys.settrace and sys.setprofile.
+// As in CPython, the trace function is called for each new frame and
+// returns the local trace function that receives that frame's line, return
+// and exception events; the profile function sees calls and returns.
+// Neither is traced itself.
+type pyTracer struct {
+	vm      *VM
+	remove  func()
+	trace   object.Object
+	profile object.Object
+	local   map[*Frame]object.Object
+	active  bool
+}
+
+func (vm *VM) setTrace(fn object.Object) {
+	vm.pyTracer().trace = fn
+	vm.updateTracer()
+}
+
+func (vm *VM) setProfile(fn object.Object) {
+	vm.pyTracer().profile = fn
+	vm.updateTracer()
+}
+
+func (vm *VM) pyTracer() *pyTracer {
+	if vm.tracer == nil {
+		vm.tracer = &pyTracer{vm: vm, local: make(map[*Frame]object.Object)}
+	}
+	return vm.tracer
+}
+
+// updateTracer installs the tracer while a trace or profile function is set.
+func (vm *VM) updateTracer() {
+	t := vm.tracer
+	switch {
+	case t.trace == nil && t.profile == nil:
+		if t.remove != nil {
+			t.remove()
+		}
+		vm.tracer = nil
+	case t.remove == nil:
+		t.remove = vm.AddHook(t)
+	}
+}
+
+// clearTracer removes the functions installed from Python.
+func (vm *VM) clearTracer() {
+	if vm.tracer != nil {
+		vm.tracer.trace, vm.tracer.profile = nil, nil
+		vm.updateTracer()
+	}
+}
+
+func (t *pyTracer) Trace(event Event, frame *Frame, arg object.Object) error {
+	if t.active {
+		return nil
+	}
+	// Frames that were already running when the tracer was installed are
+	// not traced, as in CPython.
+	if event == EventCall && frame.IP > 1 {
+		return nil
+	}
+	if arg == nil {
+		arg = runtime.None
+	}
+
+	if t.profile != nil && (event == EventCall || event == EventReturn) {
+		if _, err := t.call(t.profile, frame, event, arg); err != nil {
+			t.vm.clearTracer()
+			return err
+		}
+	}
+
+	var fn object.Object
+	if event == EventCall {
+		fn = t.trace
+	} else {
+		fn = t.local[frame]
+	}
+	if event == EventReturn {
+		delete(t.local, frame)
+	}
+	if fn == nil {
+		return nil
+	}
+
+	result, err := t.call(fn, frame, event, arg)
+	if err != nil {
+		t.vm.clearTracer()
+		return err
+	}
+	if event != EventReturn && t.vm.tracer == t {
+		if _, none := result.(*runtime.PyNone); none {
+			delete(t.local, frame)
+		} else {
+			t.local[frame] = result
+		}
+	}
+	return nil
+}
+
+func (t *pyTracer) call(fn object.Object, frame *Frame, event Event, arg object.Object) (object.Object, error) {
+	t.active = true
+	defer func() { t.active = false }()
+	return t.vm.CallFunction(fn, &PyFrame{Frame: frame}, &runtime.PyString{Value: event.String()}, arg)
+}
@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TracebackEntry describes one active frame at the point an error occurred.
+type TracebackEntry struct {
+	Filename string
+	Line     int
+	Name     string
+	Source   string
+}
+
+// Traceback wraps an error raised during execution with the frames that were
+// active when it happened, outermost first. It unwraps to the original error.
+type Traceback struct {
+	Entries []TracebackEntry
+	Err     error
+}
+
+func (t *Traceback) Unwrap() error {
+	return t.Err
+}
+
+// maxRepeatedEntries is how many identical consecutive entries are printed
+// before the rest are summarized, as CPython does for deep recursion.
+const maxRepeatedEntries = 3
+
+func (t *Traceback) Error() string {
+	var sb strings.Builder
+	sb.WriteString("Traceback (most recent call last):\n")
+
+	for i := 0; i < len(t.Entries); {
+		entry := t.Entries[i]
+		run := 1
+		for i+run < len(t.Entries) && t.Entries[i+run] == entry {
+			run++
+		}
+		shown := run
+		if shown > maxRepeatedEntries {
+			shown = maxRepeatedEntries
+		}
+		for j := 0; j < shown; j++ {
+			writeTracebackEntry(&sb, entry)
+		}
+		if run > shown {
+			fmt.Fprintf(&sb, "  [Previous line repeated %d more times]\n", run-shown)
+		}
+		i += run
+	}
+
+	sb.WriteString(exceptionLine(t.Err))
+	return sb.String()
+}
+
+func writeTracebackEntry(sb *strings.Builder, entry TracebackEntry) {
+	fmt.Fprintf(sb, "  File \"%s\", line %d, in %s\n", entry.Filename, entry.Line, entry.Name)
+	if entry.Source != "" {
+		fmt.Fprintf(sb, "    %s\n", entry.Source)
+	}
+}
+
+func exceptionLine(err error) string {
+	switch e := err.(type) {
+	case *Exception:
+		return e.Error()
+	case *InstructionLimitError, *TimeoutError, *CancelledError:
+		return "ExecutionInterrupted: " + err.Error()
+	}
+	return "RuntimeError: " + err.Error()
+}
+
+// SetSource registers the source text for filename so tracebacks can show
+// the offending lines of scripts that do not live on disk.
+func (vm *VM) SetSource(filename, source string) {
+	if vm.sources == nil {
+		vm.sources = make(map[string][]string)
+	}
+	vm.sources[filename] = strings.Split(source, "\n")
+}
+
+// SourceLine returns the given line of filename with surrounding whitespace
+// removed, or an empty string if the source is not available. Sources not
+// registered with SetSource are read from disk only when the policy grants
+// file access, since filenames and line numbers come from the bytecode.
+func (vm *VM) SourceLine(filename string, line int) string {
+	lines, registered := vm.sources[filename]
+	if !registered {
+		if vm.checkCapability(CapFile, "reading source") != nil {
+			return ""
+		}
+		var cached bool
+		lines, cached = vm.files[filename]
+		if !cached {
+			if data, err := os.ReadFile(filename); err == nil {
+				lines = strings.Split(string(data), "\n")
+			}
+			if vm.files == nil {
+				vm.files = make(map[string][]string)
+			}
+			vm.files[filename] = lines
+		}
+	}
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimSpace(lines[line-1])
+}
+
+// newTraceback captures the frames above base. Errors that already carry a
+// traceback are returned unchanged.
+func (vm *VM) newTraceback(err error, base int) error {
+	if _, ok := err.(*Traceback); ok {
+		return err
+	}
+
+	tb := &Traceback{Err: err}
+	for i := base + 1; i <= vm.frameIdx; i++ {
+		frame := vm.frames[i]
+		line := frame.Line()
+		tb.Entries = append(tb.Entries, TracebackEntry{
+			Filename: frame.Code.Filename,
+			Line:     line,
+			Name:     frame.Code.Name,
+			Source:   vm.SourceLine(frame.Code.Filename, line),
+		})
+	}
+	return tb
+}
@@ -1,7 +1,10 @@
 package vm
 
 import (
-	"fmt"
+	"context"
+	"io"
+	"os"
+	"time"
 
 	"github.com/warriorguo/gopy/pkg/compiler"
 	"github.com/warriorguo/gopy/pkg/object"
@@ -14,20 +17,49 @@ type Frame struct {
 	Stack    []object.Object
 	SP       int
 	Locals   []object.Object
-	Globals  map[string]object.Object
-	Builtins map[string]object.Object
+	Globals  *runtime.Namespace
+	Builtins *runtime.Namespace
+
+	maxStack int
+	caches   []nameCache
+
+	// Register frames keep their locals and temporaries in regs, and the
+	// register a call returns to in ret.
+	regs []object.Object
+	ret  int32
+
+	// Native frames run Go code generated from their code object.
+	native NativeFunc
+
+	// Tracing state, only maintained while hooks are installed.
+	started    bool
+	lastLine   int
+	lastOffset int
 }
 
-func NewFrame(code *compiler.CodeObject, globals, builtins map[string]object.Object) *Frame {
-	locals := make([]object.Object, len(code.Varnames))
+// initialStackSize is the operand stack capacity of a new frame whose code
+// has no verified StackSize; the stack doubles on demand up to the VM's
+// operand stack limit.
+const initialStackSize = 16
+
+func NewFrame(code *compiler.CodeObject, globals, builtins *runtime.Namespace) *Frame {
+	stackSize := initialStackSize
+	if code.StackSize > 0 {
+		stackSize = code.StackSize
+	}
+
+	// Locals and stack share one allocation.
+	n := len(code.Varnames)
+	slots := make([]object.Object, n+stackSize)
+	locals := slots[:n:n]
 	for i := range locals {
-		locals[i] = &runtime.PyNone{}
+		locals[i] = runtime.None
 	}
 
 	return &Frame{
 		Code:     code,
 		IP:       0,
-		Stack:    make([]object.Object, 1000),
+		Stack:    slots[n:],
 		SP:       0,
 		Locals:   locals,
 		Globals:  globals,
@@ -36,18 +68,47 @@ func NewFrame(code *compiler.CodeObject, globals, builtins map[string]object.Obj
 }
 
 func (f *Frame) push(obj object.Object) {
+	if f.SP == len(f.Stack) {
+		f.grow()
+	}
 	f.Stack[f.SP] = obj
 	f.SP++
 }
 
+func (f *Frame) grow() {
+	size := len(f.Stack) * 2
+	if size == 0 {
+		size = initialStackSize
+	}
+	if f.maxStack > 0 && size > f.maxStack {
+		if len(f.Stack) >= f.maxStack {
+			panic(&Exception{Type: "RuntimeError", Message: "operand stack overflow"})
+		}
+		size = f.maxStack
+	}
+	stack := make([]object.Object, size)
+	copy(stack, f.Stack)
+	f.Stack = stack
+}
+
 func (f *Frame) pop() object.Object {
 	if f.SP <= 0 {
-		panic("stack underflow")
+		panic(&Exception{Type: "SystemError", Message: "stack underflow"})
 	}
 	f.SP--
 	return f.Stack[f.SP]
 }
 
+// popN pops n values and returns them in the order they were pushed. The
+// result aliases the stack, so it is only valid until the next push.
+func (f *Frame) popN(n int) []object.Object {
+	if n > f.SP {
+		panic(&Exception{Type: "SystemError", Message: "stack underflow"})
+	}
+	f.SP -= n
+	return f.Stack[f.SP : f.SP+n]
+}
+
 func (f *Frame) peek() object.Object {
 	if f.SP <= 0 {
 		return nil
@@ -58,123 +119,146 @@ func (f *Frame) peek() object.Object {
 type VM struct {
 	frames   []*Frame
 	frameIdx int
-	globals  map[string]object.Object
-	builtins map[string]object.Object
+	globals  *runtime.Namespace
+	builtins *runtime.Namespace
+	caches   map[*compiler.CodeObject][]nameCache
+	regCache map[*compiler.RegisterCode][]nameCache
+	natives  map[*compiler.CodeObject]NativeFunc
+	modules  map[string]*runtime.PyModule
+	registry map[string]moduleDef
+	policy   *Policy
+	sources  map[string][]string
+	files    map[string][]string
+
+	stdout *runtime.PyFile
+	stderr *runtime.PyFile
+	stdin  *runtime.PyFile
+
+	maxInstructions int64
+	timeout         time.Duration
+
+	maxDepth    int
+	maxStack    int
+	memoryLimit int64
+	allocated   int64
+
+	hooks            []hookEntry
+	nextHookID       int
+	instructionHooks int
+	tracer           *pyTracer
+
+	// state is the run in progress, which native code shares.
+	state *execState
 }
 
+const (
+	DefaultMaxRecursionDepth = 1000
+	DefaultMaxStackSize      = 1 << 16
+)
+
+// interruptCheckInterval is how many instructions run between checks of the
+// context and the wall-clock deadline. Must be a power of two.
+const interruptCheckInterval = 1024
+
 func NewVM() *VM {
-	builtins := make(map[string]object.Object)
-	builtins["len"] = &compiler.PyBuiltin{
-		Name: "len",
-		Func: func(args []object.Object) (object.Object, error) {
-			if len(args) != 1 {
-				return nil, fmt.Errorf("len() takes exactly one argument (%d given)", len(args))
-			}
-
-			switch obj := args[0].(type) {
-			case *runtime.PyString:
-				return &runtime.PyInt{Value: len(obj.Value)}, nil
-			case *runtime.PyList:
-				return &runtime.PyInt{Value: len(obj.Elements)}, nil
-			case *runtime.PyDict:
-				return &runtime.PyInt{Value: len(obj.Pairs)}, nil
-			default:
-				return nil, fmt.Errorf("object of type '%s' has no len()", obj.Type())
-			}
-		},
+	vm := &VM{
+		frameIdx: -1,
+		maxDepth: DefaultMaxRecursionDepth,
+		maxStack: DefaultMaxStackSize,
+		globals:  runtime.NewNamespace(),
+		caches:   make(map[*compiler.CodeObject][]nameCache),
+		regCache: make(map[*compiler.RegisterCode][]nameCache),
+		natives:  make(map[*compiler.CodeObject]NativeFunc),
+		modules:  make(map[string]*runtime.PyModule),
+		registry: make(map[string]moduleDef),
+		stdout:   runtime.NewPyFile("<stdout>", os.Stdout, nil),
+		stderr:   runtime.NewPyFile("<stderr>", os.Stderr, nil),
+		stdin:    runtime.NewPyFile("<stdin>", nil, os.Stdin),
 	}
+	vm.builtins = runtime.NamespaceOf(vm.newBuiltins())
+	vm.registerStdModules()
+	return vm
+}
 
-	builtins["range"] = &compiler.PyBuiltin{
-		Name: "range",
-		Func: func(args []object.Object) (object.Object, error) {
-			if len(args) < 1 || len(args) > 3 {
-				return nil, fmt.Errorf("range() takes 1 to 3 arguments")
-			}
+// SetStdout redirects print statements and sys.stdout to w.
+func (vm *VM) SetStdout(w io.Writer) {
+	vm.stdout.Writer = w
+}
 
-			var start, stop, step int
-			var err error
+// SetStderr redirects sys.stderr to w.
+func (vm *VM) SetStderr(w io.Writer) {
+	vm.stderr.Writer = w
+}
 
-			if len(args) == 1 {
-				start = 0
-				stop, err = toGoInt(args[0])
-				if err != nil {
-					return nil, err
-				}
-				step = 1
-			} else if len(args) == 2 {
-				start, err = toGoInt(args[0])
-				if err != nil {
-					return nil, err
-				}
-				stop, err = toGoInt(args[1])
-				if err != nil {
-					return nil, err
-				}
-				step = 1
-			} else {
-				start, err = toGoInt(args[0])
-				if err != nil {
-					return nil, err
-				}
-				stop, err = toGoInt(args[1])
-				if err != nil {
-					return nil, err
-				}
-				step, err = toGoInt(args[2])
-				if err != nil {
-					return nil, err
-				}
-				if step == 0 {
-					return nil, fmt.Errorf("range() step argument must not be zero")
-				}
-			}
+// SetStdin makes raw_input and sys.stdin read from r.
+func (vm *VM) SetStdin(r io.Reader) {
+	vm.stdin.SetReader(r)
+}
 
-			var elements []object.Object
-			if step > 0 {
-				for i := start; i < stop; i += step {
-					elements = append(elements, &runtime.PyInt{Value: i})
-				}
-			} else {
-				for i := start; i > stop; i += step {
-					elements = append(elements, &runtime.PyInt{Value: i})
-				}
-			}
+// SetMaxInstructions limits the number of instructions a single run may
+// execute. Zero means no limit.
+func (vm *VM) SetMaxInstructions(n int64) {
+	vm.maxInstructions = n
+}
 
-			return &runtime.PyList{Elements: elements}, nil
-		},
-	}
+// SetTimeout limits the wall-clock time of a single run. Zero means no limit.
+func (vm *VM) SetTimeout(d time.Duration) {
+	vm.timeout = d
+}
 
-	builtins["type"] = &compiler.PyBuiltin{
-		Name: "type",
-		Func: func(args []object.Object) (object.Object, error) {
-			if len(args) != 1 {
-				return nil, fmt.Errorf("type() takes exactly one argument")
-			}
-			return &runtime.PyString{Value: args[0].Type()}, nil
-		},
-	}
+// SetMaxRecursionDepth limits the number of nested frames. Exceeding it
+// raises RuntimeError. Zero means no limit.
+func (vm *VM) SetMaxRecursionDepth(n int) {
+	vm.maxDepth = n
+}
 
-	builtins["str"] = &compiler.PyBuiltin{
-		Name: "str",
-		Func: func(args []object.Object) (object.Object, error) {
-			if len(args) != 1 {
-				return nil, fmt.Errorf("str() takes exactly one argument")
-			}
-			return &runtime.PyString{Value: toGoString(args[0])}, nil
-		},
-	}
+// SetMaxStackSize limits the operand stack of each frame. Zero means no limit.
+func (vm *VM) SetMaxStackSize(n int) {
+	vm.maxStack = n
+}
 
-	return &VM{
-		frames:   make([]*Frame, 1000),
-		frameIdx: -1,
-		globals:  make(map[string]object.Object),
-		builtins: builtins,
+// SetMemoryLimit sets an approximate budget, in bytes, for the strings, lists
+// and dicts a single run may create. Exceeding it raises MemoryError. Zero
+// means no limit.
+func (vm *VM) SetMemoryLimit(bytes int64) {
+	vm.memoryLimit = bytes
+}
+
+// newFrame returns a frame that runs code. Code with a native function
+// runs it unless hooks are installed, and code with register code runs on
+// the register engine unless instruction hooks need the stack code.
+func (vm *VM) newFrame(code *compiler.CodeObject, globals *runtime.Namespace) *Frame {
+	if fn, ok := vm.natives[code]; ok && vm.hooks == nil {
+		return vm.newNativeFrame(code, globals, fn)
+	}
+	if code.Registers != nil && vm.instructionHooks == 0 {
+		return vm.newRegisterFrame(code, globals)
+	}
+	frame := NewFrame(code, globals, vm.builtins)
+	frame.maxStack = vm.maxStack
+	frame.caches = vm.nameCaches(code)
+	if vm.maxStack > 0 && len(frame.Stack) > vm.maxStack {
+		// Overflows when the stack outgrows the limit, as unverified code.
+		frame.Stack = make([]object.Object, vm.maxStack)
 	}
+	return frame
 }
 
-func (vm *VM) pushFrame(frame *Frame) {
+func (vm *VM) pushFrame(frame *Frame) error {
+	if vm.maxDepth > 0 && vm.frameIdx+1 >= vm.maxDepth {
+		return &Exception{Type: "RuntimeError", Message: "maximum recursion depth exceeded"}
+	}
+	// Temporaries take the place of the operand stack in register frames.
+	if vm.maxStack > 0 && len(frame.regs)-len(frame.Locals) > vm.maxStack {
+		return &Exception{Type: "RuntimeError", Message: "operand stack overflow"}
+	}
 	vm.frameIdx++
-	vm.frames[vm.frameIdx] = frame
+	if vm.frameIdx == len(vm.frames) {
+		vm.frames = append(vm.frames, frame)
+	} else {
+		vm.frames[vm.frameIdx] = frame
+	}
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -182,6 +266,7 @@ func (vm *VM) popFrame() *Frame {
 		return nil
 	}
 	frame := vm.frames[vm.frameIdx]
+	vm.frames[vm.frameIdx] = nil
 	vm.frameIdx--
 	return frame
 }
@@ -194,51 +279,197 @@ func (vm *VM) currentFrame() *Frame {
 }
 
 func (vm *VM) Run(code *compiler.CodeObject) (object.Object, error) {
-	frame := NewFrame(code, vm.globals, vm.builtins)
-	vm.pushFrame(frame)
+	return vm.RunContext(context.Background(), code)
+}
+
+// RunContext executes code until it returns, fails, or is interrupted by ctx,
+// the instruction limit or the timeout.
+func (vm *VM) RunContext(ctx context.Context, code *compiler.CodeObject) (object.Object, error) {
+	return vm.run(ctx, code, vm.globals)
+}
 
-	for vm.currentFrame() != nil {
-		frame := vm.currentFrame()
+func (vm *VM) run(ctx context.Context, code *compiler.CodeObject, globals *runtime.Namespace) (object.Object, error) {
+	return vm.runFrame(ctx, vm.newFrame(code, globals))
+}
+
+// runFrame pushes frame and executes it until it returns.
+func (vm *VM) runFrame(ctx context.Context, frame *Frame) (result object.Object, err error) {
+	base := vm.frameIdx
+	defer func() {
+		if r := recover(); r != nil {
+			exc, ok := r.(*Exception)
+			if !ok {
+				panic(r)
+			}
+			if vm.hooks != nil {
+				vm.traceException(exc)
+			}
+			result, err = nil, vm.newTraceback(exc, base)
+		}
+		for vm.frameIdx > base {
+			vm.popFrame()
+		}
+	}()
+	if base < 0 {
+		vm.allocated = 0
+	}
+
+	if err := vm.pushFrame(frame); err != nil {
+		return nil, err
+	}
 
+	result, err = vm.execute(ctx, base)
+	if err != nil {
+		if vm.hooks != nil {
+			vm.traceException(err)
+		}
+		return nil, vm.newTraceback(err, base)
+	}
+	return result, nil
+}
+
+// execState is the state of a run that both engines check for interruption.
+type execState struct {
+	ctx      context.Context
+	done     <-chan struct{}
+	deadline time.Time
+	steps    int64
+}
+
+// execute runs the frames above base until the frame at base+1 returns.
+// Runs nested in a run in progress, such as trace functions called by
+// hooks, share its context, deadline and instruction count.
+func (vm *VM) execute(ctx context.Context, base int) (object.Object, error) {
+	if vm.state != nil {
+		return vm.dispatch(vm.state, base)
+	}
+	st := &execState{ctx: ctx, done: ctx.Done()}
+	if vm.timeout > 0 {
+		st.deadline = time.Now().Add(vm.timeout)
+	}
+	outer := vm.state
+	vm.state = st
+	defer func() { vm.state = outer }()
+	return vm.dispatch(st, base)
+}
+
+// dispatch runs the frames above base on the engine of the current frame,
+// switching engines whenever a call or return passes control between
+// frames of different kinds.
+func (vm *VM) dispatch(st *execState, base int) (object.Object, error) {
+	for {
+		var result object.Object
+		var err error
+		switch frame := vm.currentFrame(); {
+		case frame.native != nil:
+			result, err = vm.executeNative(base)
+		case frame.regs != nil:
+			result, err = vm.executeRegisters(st, base)
+		default:
+			result, err = vm.executeStack(st, base)
+		}
+		if err != nil || vm.frameIdx <= base {
+			return result, err
+		}
+	}
+}
+
+// interrupted reports why the run must stop after st.steps instructions,
+// if it must. The engines call it when an instruction limit is set and
+// every interruptCheckInterval instructions.
+func (vm *VM) interrupted(st *execState) error {
+	if vm.maxInstructions > 0 && st.steps > vm.maxInstructions {
+		return &InstructionLimitError{Limit: vm.maxInstructions}
+	}
+	if st.steps&(interruptCheckInterval-1) == 0 {
+		return vm.expired(st)
+	}
+	return nil
+}
+
+// expired reports whether the context of the run is done or its deadline
+// has passed.
+func (vm *VM) expired(st *execState) error {
+	if st.done != nil {
+		select {
+		case <-st.done:
+			return &CancelledError{Err: st.ctx.Err()}
+		default:
+		}
+	}
+	if !st.deadline.IsZero() && time.Now().After(st.deadline) {
+		return &TimeoutError{Timeout: vm.timeout}
+	}
+	return nil
+}
+
+// executeStack runs stack frames, the current frame first, until the frame
+// at base+1 returns or control passes to a register frame.
+func (vm *VM) executeStack(st *execState, base int) (object.Object, error) {
+	// frame caches vm.currentFrame(); it changes only on calls and returns.
+	frame := vm.currentFrame()
+	for vm.frameIdx > base {
+		st.steps++
+		if vm.maxInstructions > 0 || st.steps&(interruptCheckInterval-1) == 0 {
+			if err := vm.interrupted(st); err != nil {
+				return nil, err
+			}
+		}
 		if frame.IP >= len(frame.Code.Instructions) {
+			if vm.hooks != nil {
+				if err := vm.fire(EventReturn, frame, runtime.None); err != nil {
+					return nil, err
+				}
+			}
 			vm.popFrame()
+			frame = vm.currentFrame()
+			if vm.frameIdx > base && !frame.onStack() {
+				return nil, nil
+			}
 			continue
 		}
 
 		instruction := frame.Code.Instructions[frame.IP]
 		frame.IP++
 
+		if vm.hooks != nil {
+			if err := vm.traceInstruction(frame, frame.IP-1); err != nil {
+				return nil, err
+			}
+		}
+
 		switch instruction.Op {
 		case compiler.OpLoadConst:
 			frame.push(frame.Code.Consts[instruction.Arg])
 
-		case compiler.OpLoadName:
-			name := frame.Code.Names[instruction.Arg]
-			if obj, exists := frame.Globals[name]; exists {
-				frame.push(obj)
-			} else if obj, exists := frame.Builtins[name]; exists {
-				frame.push(obj)
-			} else {
-				return nil, fmt.Errorf("name '%s' is not defined", name)
+		case compiler.OpLoadName, compiler.OpLoadGlobal:
+			cache := &frame.caches[frame.IP-1]
+			if cache.globals == frame.Globals.Version() {
+				if cache.builtins == 0 {
+					frame.push(frame.Globals.Slot(cache.slot))
+					break
+				}
+				if cache.builtins == frame.Builtins.Version() {
+					frame.push(frame.Builtins.Slot(cache.slot))
+					break
+				}
 			}
-
-		case compiler.OpStoreName:
-			name := frame.Code.Names[instruction.Arg]
-			frame.Globals[name] = frame.pop()
-
-		case compiler.OpLoadGlobal:
 			name := frame.Code.Names[instruction.Arg]
-			if obj, exists := frame.Globals[name]; exists {
-				frame.push(obj)
-			} else if obj, exists := frame.Builtins[name]; exists {
-				frame.push(obj)
-			} else {
-				return nil, fmt.Errorf("global name '%s' is not defined", name)
+			obj, exists := loadGlobal(frame, cache, name)
+			if !exists && instruction.Op == compiler.OpLoadGlobal {
+				return nil, raise("NameError", "global name '%s' is not defined", name)
+			} else if !exists {
+				return nil, raise("NameError", "name '%s' is not defined", name)
 			}
+			frame.push(obj)
 
-		case compiler.OpStoreGlobal:
-			name := frame.Code.Names[instruction.Arg]
-			frame.Globals[name] = frame.pop()
+		case compiler.OpStoreName, compiler.OpStoreGlobal:
+			cache := &frame.caches[frame.IP-1]
+			if cache.globals == frame.Globals.Version() {
+				frame.Globals.SetSlot(cache.slot, frame.pop())
+				break
+			}
+			storeGlobal(frame, cache, frame.Code.Names[instruction.Arg], frame.pop())
 
 		case compiler.OpLoadFast:
 			frame.push(frame.Locals[instruction.Arg])
@@ -246,119 +477,92 @@ func (vm *VM) Run(code *compiler.CodeObject) (object.Object, error) {
 		case compiler.OpStoreFast:
 			frame.Locals[instruction.Arg] = frame.pop()
 
-		case compiler.OpBinaryAdd:
-			right := frame.pop()
-			left := frame.pop()
-			result, err := vm.binaryOp(left, right, "+")
-			if err != nil {
-				return nil, err
-			}
-			frame.push(result)
+		case compiler.OpLoadFastLoadFast:
+			first, second := compiler.UnpackOperands(instruction.Arg)
+			frame.push(frame.Locals[first])
+			frame.push(frame.Locals[second])
 
-		case compiler.OpBinarySub:
-			right := frame.pop()
-			left := frame.pop()
-			result, err := vm.binaryOp(left, right, "-")
-			if err != nil {
-				return nil, err
-			}
-			frame.push(result)
+		case compiler.OpLoadFastLoadConst:
+			local, c := compiler.UnpackOperands(instruction.Arg)
+			frame.push(frame.Locals[local])
+			frame.push(frame.Code.Consts[c])
 
-		case compiler.OpBinaryMul:
-			right := frame.pop()
-			left := frame.pop()
-			result, err := vm.binaryOp(left, right, "*")
-			if err != nil {
-				return nil, err
-			}
-			frame.push(result)
+		case compiler.OpStoreFastLoadFast:
+			store, load := compiler.UnpackOperands(instruction.Arg)
+			frame.Locals[store] = frame.pop()
+			frame.push(frame.Locals[load])
 
-		case compiler.OpBinaryDiv:
+		case compiler.OpBinaryAdd, compiler.OpBinarySub, compiler.OpBinaryMul, compiler.OpBinaryDiv, compiler.OpBinaryMod:
 			right := frame.pop()
 			left := frame.pop()
-			result, err := vm.binaryOp(left, right, "/")
-			if err != nil {
-				return nil, err
+			if l, r, ok := intOperands(left, right); ok {
+				if value, ok := intArith(instruction.Op, l, r); ok {
+					frame.push(runtime.NewInt(value))
+					break
+				}
 			}
-			frame.push(result)
-
-		case compiler.OpBinaryMod:
-			right := frame.pop()
-			left := frame.pop()
-			result, err := vm.binaryOp(left, right, "%")
+			result, err := vm.binaryOp(left, right, instruction.Op)
 			if err != nil {
 				return nil, err
 			}
 			frame.push(result)
 
-		case compiler.OpUnaryPos:
-			operand := frame.pop()
-			result, err := vm.unaryOp(operand, "+")
+		case compiler.OpBinaryAddFastConst, compiler.OpBinarySubFastConst:
+			local, c := compiler.UnpackOperands(instruction.Arg)
+			left, right := frame.Locals[local], frame.Code.Consts[c]
+			op := compiler.OpBinaryAdd
+			if instruction.Op == compiler.OpBinarySubFastConst {
+				op = compiler.OpBinarySub
+			}
+			if l, r, ok := intOperands(left, right); ok {
+				value, _ := intArith(op, l, r)
+				frame.push(runtime.NewInt(value))
+				break
+			}
+			result, err := vm.binaryOp(left, right, op)
 			if err != nil {
 				return nil, err
 			}
 			frame.push(result)
 
-		case compiler.OpUnaryNeg:
+		case compiler.OpUnaryPos, compiler.OpUnaryNeg:
 			operand := frame.pop()
-			result, err := vm.unaryOp(operand, "-")
+			result, err := vm.unaryOp(operand, instruction.Op)
 			if err != nil {
 				return nil, err
 			}
 			frame.push(result)
 
 		case compiler.OpUnaryNot:
-			operand := frame.pop()
-			result := &runtime.PyBool{Value: !operand.IsTruthy()}
-			frame.push(result)
+			frame.push(runtime.NewBool(!frame.pop().IsTruthy()))
 
 		case compiler.OpCompareEq:
 			right := frame.pop()
 			left := frame.pop()
-			result := &runtime.PyBool{Value: left.Equal(right)}
-			frame.push(result)
+			frame.push(runtime.NewBool(left.Equal(right)))
 
 		case compiler.OpCompareNe:
 			right := frame.pop()
 			left := frame.pop()
-			result := &runtime.PyBool{Value: !left.Equal(right)}
-			frame.push(result)
+			frame.push(runtime.NewBool(!left.Equal(right)))
 
-		case compiler.OpCompareLt:
+		case compiler.OpCompareLt, compiler.OpCompareLe, compiler.OpCompareGt, compiler.OpCompareGe:
 			right := frame.pop()
 			left := frame.pop()
-			result, err := vm.compareOp(left, right, "<")
-			if err != nil {
-				return nil, err
+			if l, r, ok := intOperands(left, right); ok {
+				frame.push(runtime.NewBool(compareOrdered(instruction.Op, l, r)))
+				break
 			}
-			frame.push(result)
-
-		case compiler.OpCompareLe:
-			right := frame.pop()
-			left := frame.pop()
-			result, err := vm.compareOp(left, right, "<=")
+			result, err := vm.compareOp(left, right, instruction.Op)
 			if err != nil {
 				return nil, err
 			}
 			frame.push(result)
 
-		case compiler.OpCompareGt:
+		case compiler.OpCompareIs, compiler.OpCompareIsNot:
 			right := frame.pop()
 			left := frame.pop()
-			result, err := vm.compareOp(left, right, ">")
-			if err != nil {
-				return nil, err
-			}
-			frame.push(result)
-
-		case compiler.OpCompareGe:
-			right := frame.pop()
-			left := frame.pop()
-			result, err := vm.compareOp(left, right, ">=")
-			if err != nil {
-				return nil, err
-			}
-			frame.push(result)
+			frame.push(runtime.NewBool(runtime.Is(left, right) == (instruction.Op == compiler.OpCompareIs)))
 
 		case compiler.OpCompareIn:
 			right := frame.pop()
@@ -398,6 +602,9 @@ func (vm *VM) Run(code *compiler.CodeObject) (object.Object, error) {
 			}
 
 		case compiler.OpBuildList:
+			if err := vm.chargeList(instruction.Arg); err != nil {
+				return nil, err
+			}
 			elements := make([]object.Object, instruction.Arg)
 			for i := instruction.Arg - 1; i >= 0; i-- {
 				elements[i] = frame.pop()
@@ -405,6 +612,9 @@ func (vm *VM) Run(code *compiler.CodeObject) (object.Object, error) {
 			frame.push(&runtime.PyList{Elements: elements})
 
 		case compiler.OpBuildDict:
+			if err := vm.chargeDict(instruction.Arg); err != nil {
+				return nil, err
+			}
 			dict := runtime.NewPyDict()
 			for i := 0; i < instruction.Arg; i++ {
 				value := frame.pop()
@@ -432,47 +642,105 @@ func (vm *VM) Run(code *compiler.CodeObject) (object.Object, error) {
 			}
 
 		case compiler.OpCallFunction:
-			args := make([]object.Object, instruction.Arg)
-			for i := instruction.Arg - 1; i >= 0; i-- {
-				args[i] = frame.pop()
-			}
+			args := frame.popN(instruction.Arg)
 			function := frame.pop()
 
 			switch f := function.(type) {
 			case *compiler.PyBuiltin:
-				result, err := f.Func(args)
+				result, err := f.Func(append(make([]object.Object, 0, len(args)), args...))
 				if err != nil {
 					return nil, err
 				}
 				frame.push(result)
 			case *compiler.PyFunction:
-				if len(args) != f.Code.Argcount {
-					return nil, fmt.Errorf("function takes %d arguments but %d were given", f.Code.Argcount, len(args))
+				funcFrame, err := vm.enter(f, args)
+				if err != nil {
+					return nil, err
 				}
-
-				funcFrame := NewFrame(f.Code, vm.globals, vm.builtins)
-				copy(funcFrame.Locals, args)
-				vm.pushFrame(funcFrame)
+				frame = funcFrame
 				// Continue execution with the new frame - no result pushed yet
+				if !frame.onStack() {
+					return nil, nil
+				}
 			default:
-				return nil, fmt.Errorf("'%s' object is not callable", function.Type())
+				return nil, raise("TypeError", "'%s' object is not callable", function.Type())
 			}
 
 		case compiler.OpReturnValue:
 			result := frame.pop()
+			if vm.hooks != nil {
+				if err := vm.fire(EventReturn, frame, result); err != nil {
+					return nil, err
+				}
+			}
 			vm.popFrame()
-			if vm.currentFrame() != nil {
-				vm.currentFrame().push(result)
-			} else {
+			if vm.frameIdx <= base {
 				return result, nil
 			}
+			frame = vm.currentFrame()
+			if frame.regs != nil {
+				frame.regs[frame.ret] = result
+				return nil, nil
+			}
+			frame.push(result)
 
 		case compiler.OpPrintExpr:
 			obj := frame.pop()
-			fmt.Print(obj.String())
+			if err := vm.writeTo(vm.stdout, obj.String()); err != nil {
+				return nil, err
+			}
 
 		case compiler.OpPrintNewline:
-			fmt.Println()
+			if err := vm.writeTo(vm.stdout, "\n"); err != nil {
+				return nil, err
+			}
+
+		case compiler.OpPrintItemTo:
+			dest := frame.pop()
+			obj := frame.pop()
+			file, ok := dest.(*runtime.PyFile)
+			if !ok {
+				return nil, raise("AttributeError", "'%s' object has no attribute 'write'", dest.Type())
+			}
+			if err := vm.writeTo(file, obj.String()); err != nil {
+				return nil, err
+			}
+
+		case compiler.OpPrintNewlineTo:
+			dest := frame.pop()
+			file, ok := dest.(*runtime.PyFile)
+			if !ok {
+				return nil, raise("AttributeError", "'%s' object has no attribute 'write'", dest.Type())
+			}
+			if err := vm.writeTo(file, "\n"); err != nil {
+				return nil, err
+			}
+
+		case compiler.OpMakeFunction:
+			template, ok := frame.pop().(*compiler.PyFunction)
+			if !ok {
+				return nil, raise("SystemError", "MAKE_FUNCTION: expected function template")
+			}
+			frame.push(&compiler.PyFunction{
+				Code:    template.Code,
+				Name:    template.Name,
+				Globals: frame.Globals,
+			})
+
+		case compiler.OpLoadAttr:
+			obj := frame.pop()
+			result, err := vm.getAttr(obj, frame.Code.Names[instruction.Arg])
+			if err != nil {
+				return nil, err
+			}
+			frame.push(result)
+
+		case compiler.OpImportName:
+			module, err := vm.importModule(frame.Code.Names[instruction.Arg])
+			if err != nil {
+				return nil, err
+			}
+			frame.push(module)
 
 		case compiler.OpPopTop:
 			frame.pop()
@@ -495,263 +763,235 @@ func (vm *VM) Run(code *compiler.CodeObject) (object.Object, error) {
 			frame.push(frame.peek())
 
 		case compiler.OpGetIter:
-			iterable := frame.pop()
-			switch obj := iterable.(type) {
-			case *runtime.PyList:
-				frame.push(obj)
-			case *runtime.PyString:
-				// Convert string to list of characters
-				var chars []object.Object
-				for _, char := range obj.Value {
-					chars = append(chars, &runtime.PyString{Value: string(char)})
-				}
-				frame.push(&runtime.PyList{Elements: chars})
-			default:
-				return nil, fmt.Errorf("OpGetIter: '%s' object is not iterable", iterable.Type())
+			iterator, err := vm.getIter(frame.pop())
+			if err != nil {
+				return nil, err
 			}
+			frame.push(iterator)
 
 		case compiler.OpForIter:
-			// Stack layout: [..., iterator_index, iterable]
-			// Pop the iterable from the stack
-			iterable := frame.pop()
-
-			// Get or initialize the iterator index
-			var iterIndex int
-			if frame.SP > 0 {
-				if idx, ok := frame.peek().(*runtime.PyInt); ok {
-					iterIndex = idx.Value
-					frame.pop() // Remove the old index
-				} else {
-					iterIndex = 0
-				}
-			} else {
-				iterIndex = 0
-			}
-
-			if list, ok := iterable.(*runtime.PyList); ok {
-				if iterIndex < len(list.Elements) {
-					// Push the new index and current element
-					frame.push(&runtime.PyInt{Value: iterIndex + 1})
-					frame.push(list)
-					frame.push(list.Elements[iterIndex])
-				} else {
-					// End of iteration - jump to end of loop
-					frame.IP = instruction.Arg
-				}
+			// Stack layout: [..., iterator]. The iterator stays on the
+			// stack while the loop runs and is popped when it is exhausted.
+			iterator, ok := frame.peek().(*runtime.PyListIterator)
+			if !ok {
+				return nil, raise("SystemError", "FOR_ITER: expected iterator")
+			}
+			if item, ok := iterator.Next(); ok {
+				frame.push(item)
 			} else {
-				return nil, fmt.Errorf("OpForIter:'%s' object is not iterable", iterable.Type())
+				frame.pop()
+				frame.IP = instruction.Arg
 			}
 
 		case compiler.OpNop:
 
 		default:
-			return nil, fmt.Errorf("unknown opcode: %d", instruction.Op)
+			return nil, raise("SystemError", "unknown opcode: %d", instruction.Op)
 		}
 	}
 
-	return &runtime.PyNone{}, nil
+	return runtime.None, nil
 }
 
-func (vm *VM) binaryOp(left, right object.Object, op string) (object.Object, error) {
-	switch op {
-	case "+":
-		switch l := left.(type) {
-		case *runtime.PyInt:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				return &runtime.PyInt{Value: l.Value + r.Value}, nil
-			case *runtime.PyFloat:
-				return &runtime.PyFloat{Value: float64(l.Value) + r.Value}, nil
-			}
-		case *runtime.PyFloat:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				return &runtime.PyFloat{Value: l.Value + float64(r.Value)}, nil
-			case *runtime.PyFloat:
-				return &runtime.PyFloat{Value: l.Value + r.Value}, nil
-			}
-		case *runtime.PyString:
-			if r, ok := right.(*runtime.PyString); ok {
-				return &runtime.PyString{Value: l.Value + r.Value}, nil
-			}
-		}
+// enter pushes a frame that calls f with args.
+func (vm *VM) enter(f *compiler.PyFunction, args []object.Object) (*Frame, error) {
+	if len(args) != f.Code.Argcount {
+		return nil, raise("TypeError", "function takes %d arguments but %d were given", f.Code.Argcount, len(args))
+	}
 
-	case "-":
-		switch l := left.(type) {
-		case *runtime.PyInt:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				return &runtime.PyInt{Value: l.Value - r.Value}, nil
-			case *runtime.PyFloat:
-				return &runtime.PyFloat{Value: float64(l.Value) - r.Value}, nil
-			}
-		case *runtime.PyFloat:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				return &runtime.PyFloat{Value: l.Value - float64(r.Value)}, nil
-			case *runtime.PyFloat:
-				return &runtime.PyFloat{Value: l.Value - r.Value}, nil
-			}
+	globals := f.Globals
+	if globals == nil {
+		globals = vm.globals
+	}
+	frame := vm.newFrame(f.Code, globals)
+	copy(frame.Locals, args)
+	if err := vm.pushFrame(frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (vm *VM) getIter(iterable object.Object) (*runtime.PyListIterator, error) {
+	switch obj := iterable.(type) {
+	case *runtime.PyList:
+		return &runtime.PyListIterator{List: obj}, nil
+	case *runtime.PyString:
+		if err := vm.chargeList(len(obj.Value)); err != nil {
+			return nil, err
 		}
+		// Convert string to list of characters
+		var chars []object.Object
+		for _, char := range obj.Value {
+			chars = append(chars, &runtime.PyString{Value: string(char)})
+		}
+		return &runtime.PyListIterator{List: &runtime.PyList{Elements: chars}}, nil
+	}
+	return nil, raise("TypeError", "'%s' object is not iterable", iterable.Type())
+}
 
-	case "*":
-		switch l := left.(type) {
-		case *runtime.PyInt:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				return &runtime.PyInt{Value: l.Value * r.Value}, nil
-			case *runtime.PyFloat:
-				return &runtime.PyFloat{Value: float64(l.Value) * r.Value}, nil
-			}
-		case *runtime.PyFloat:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				return &runtime.PyFloat{Value: l.Value * float64(r.Value)}, nil
-			case *runtime.PyFloat:
-				return &runtime.PyFloat{Value: l.Value * r.Value}, nil
-			}
+// binaryOp applies the arithmetic operator op to left and right.
+func (vm *VM) binaryOp(left, right object.Object, op compiler.OpCode) (object.Object, error) {
+	if l, r, ok := intOperands(left, right); ok {
+		if value, ok := intArith(op, l, r); ok {
+			return runtime.NewInt(value), nil
+		}
+		switch op {
+		case compiler.OpBinaryDiv:
+			return nil, raise("ZeroDivisionError", "division by zero")
+		case compiler.OpBinaryMod:
+			return nil, raise("ZeroDivisionError", "integer division or modulo by zero")
 		}
+	}
 
-	case "/":
-		switch l := left.(type) {
-		case *runtime.PyInt:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				if r.Value == 0 {
-					return nil, fmt.Errorf("division by zero")
-				}
-				return &runtime.PyInt{Value: l.Value / r.Value}, nil
-			case *runtime.PyFloat:
-				if r.Value == 0.0 {
-					return nil, fmt.Errorf("division by zero")
-				}
-				return &runtime.PyFloat{Value: float64(l.Value) / r.Value}, nil
-			}
-		case *runtime.PyFloat:
-			switch r := right.(type) {
-			case *runtime.PyInt:
-				if r.Value == 0 {
-					return nil, fmt.Errorf("division by zero")
-				}
-				return &runtime.PyFloat{Value: l.Value / float64(r.Value)}, nil
-			case *runtime.PyFloat:
-				if r.Value == 0.0 {
-					return nil, fmt.Errorf("division by zero")
-				}
-				return &runtime.PyFloat{Value: l.Value / r.Value}, nil
+	if l, ok := left.(*runtime.PyString); ok && op == compiler.OpBinaryAdd {
+		if r, ok := right.(*runtime.PyString); ok {
+			if err := vm.chargeString(len(l.Value) + len(r.Value)); err != nil {
+				return nil, err
 			}
+			return &runtime.PyString{Value: l.Value + r.Value}, nil
 		}
+	}
 
-	case "%":
-		if l, ok := left.(*runtime.PyInt); ok {
-			if r, ok := right.(*runtime.PyInt); ok {
-				if r.Value == 0 {
-					return nil, fmt.Errorf("integer division or modulo by zero")
-				}
-				return &runtime.PyInt{Value: l.Value % r.Value}, nil
+	if l, r, ok := floatOperands(left, right); ok {
+		switch op {
+		case compiler.OpBinaryAdd:
+			return &runtime.PyFloat{Value: l + r}, nil
+		case compiler.OpBinarySub:
+			return &runtime.PyFloat{Value: l - r}, nil
+		case compiler.OpBinaryMul:
+			return &runtime.PyFloat{Value: l * r}, nil
+		case compiler.OpBinaryDiv:
+			if r == 0.0 {
+				return nil, raise("ZeroDivisionError", "division by zero")
 			}
+			return &runtime.PyFloat{Value: l / r}, nil
 		}
 	}
 
-	return nil, fmt.Errorf("unsupported operand type(s) for %s: '%s' and '%s'", op, left.Type(), right.Type())
+	return nil, raise("TypeError", "unsupported operand type(s) for %s: '%s' and '%s'", operatorSymbol(op), left.Type(), right.Type())
 }
 
-func (vm *VM) unaryOp(operand object.Object, op string) (object.Object, error) {
-	switch op {
-	case "+":
-		switch o := operand.(type) {
+// intOperands returns the values of left and right if both are ints. It is
+// the type check of the integer fast paths.
+func intOperands(left, right object.Object) (int, int, bool) {
+	l, ok := left.(*runtime.PyInt)
+	if !ok {
+		return 0, 0, false
+	}
+	r, ok := right.(*runtime.PyInt)
+	if !ok {
+		return 0, 0, false
+	}
+	return l.Value, r.Value, true
+}
+
+// floatOperands converts left and right to float64 if both are numbers.
+func floatOperands(left, right object.Object) (float64, float64, bool) {
+	var values [2]float64
+	for i, obj := range [2]object.Object{left, right} {
+		switch v := obj.(type) {
 		case *runtime.PyInt:
-			return o, nil
+			values[i] = float64(v.Value)
 		case *runtime.PyFloat:
-			return o, nil
+			values[i] = v.Value
 		default:
-			return nil, fmt.Errorf("bad operand type for unary +: '%s'", operand.Type())
+			return 0, 0, false
 		}
+	}
+	return values[0], values[1], true
+}
 
-	case "-":
-		switch o := operand.(type) {
-		case *runtime.PyInt:
-			return &runtime.PyInt{Value: -o.Value}, nil
-		case *runtime.PyFloat:
-			return &runtime.PyFloat{Value: -o.Value}, nil
-		default:
-			return nil, fmt.Errorf("bad operand type for unary -: '%s'", operand.Type())
+// intArith applies the arithmetic operator op to two ints. It fails for
+// division by zero, which the caller reports.
+func intArith(op compiler.OpCode, l, r int) (int, bool) {
+	switch op {
+	case compiler.OpBinaryAdd:
+		return l + r, true
+	case compiler.OpBinarySub:
+		return l - r, true
+	case compiler.OpBinaryMul:
+		return l * r, true
+	case compiler.OpBinaryDiv:
+		if r != 0 {
+			return l / r, true
+		}
+	case compiler.OpBinaryMod:
+		if r != 0 {
+			return l % r, true
 		}
 	}
+	return 0, false
+}
 
-	return nil, fmt.Errorf("unknown unary operator: %s", op)
+// compareOrdered applies the ordering comparison op to l and r.
+func compareOrdered[T int | float64 | string](op compiler.OpCode, l, r T) bool {
+	switch op {
+	case compiler.OpCompareLt:
+		return l < r
+	case compiler.OpCompareLe:
+		return l <= r
+	case compiler.OpCompareGt:
+		return l > r
+	}
+	return l >= r
+}
+
+// operatorSymbol returns the source form of an operator opcode, for error
+// messages.
+func operatorSymbol(op compiler.OpCode) string {
+	switch op {
+	case compiler.OpBinaryAdd, compiler.OpUnaryPos:
+		return "+"
+	case compiler.OpBinarySub, compiler.OpUnaryNeg:
+		return "-"
+	case compiler.OpBinaryMul:
+		return "*"
+	case compiler.OpBinaryDiv:
+		return "/"
+	case compiler.OpBinaryMod:
+		return "%"
+	case compiler.OpCompareLt:
+		return "<"
+	case compiler.OpCompareLe:
+		return "<="
+	case compiler.OpCompareGt:
+		return ">"
+	case compiler.OpCompareGe:
+		return ">="
+	}
+	return op.String()
 }
 
-func (vm *VM) compareOp(left, right object.Object, op string) (object.Object, error) {
-	switch l := left.(type) {
+func (vm *VM) unaryOp(operand object.Object, op compiler.OpCode) (object.Object, error) {
+	switch o := operand.(type) {
 	case *runtime.PyInt:
-		switch r := right.(type) {
-		case *runtime.PyInt:
-			switch op {
-			case "<":
-				return &runtime.PyBool{Value: l.Value < r.Value}, nil
-			case "<=":
-				return &runtime.PyBool{Value: l.Value <= r.Value}, nil
-			case ">":
-				return &runtime.PyBool{Value: l.Value > r.Value}, nil
-			case ">=":
-				return &runtime.PyBool{Value: l.Value >= r.Value}, nil
-			}
-		case *runtime.PyFloat:
-			lf := float64(l.Value)
-			switch op {
-			case "<":
-				return &runtime.PyBool{Value: lf < r.Value}, nil
-			case "<=":
-				return &runtime.PyBool{Value: lf <= r.Value}, nil
-			case ">":
-				return &runtime.PyBool{Value: lf > r.Value}, nil
-			case ">=":
-				return &runtime.PyBool{Value: lf >= r.Value}, nil
-			}
+		if op == compiler.OpUnaryNeg {
+			return runtime.NewInt(-o.Value), nil
 		}
+		return o, nil
 	case *runtime.PyFloat:
-		switch r := right.(type) {
-		case *runtime.PyInt:
-			rf := float64(r.Value)
-			switch op {
-			case "<":
-				return &runtime.PyBool{Value: l.Value < rf}, nil
-			case "<=":
-				return &runtime.PyBool{Value: l.Value <= rf}, nil
-			case ">":
-				return &runtime.PyBool{Value: l.Value > rf}, nil
-			case ">=":
-				return &runtime.PyBool{Value: l.Value >= rf}, nil
-			}
-		case *runtime.PyFloat:
-			switch op {
-			case "<":
-				return &runtime.PyBool{Value: l.Value < r.Value}, nil
-			case "<=":
-				return &runtime.PyBool{Value: l.Value <= r.Value}, nil
-			case ">":
-				return &runtime.PyBool{Value: l.Value > r.Value}, nil
-			case ">=":
-				return &runtime.PyBool{Value: l.Value >= r.Value}, nil
-			}
+		if op == compiler.OpUnaryNeg {
+			return &runtime.PyFloat{Value: -o.Value}, nil
 		}
-	case *runtime.PyString:
+		return o, nil
+	}
+	return nil, raise("TypeError", "bad operand type for unary %s: '%s'", operatorSymbol(op), operand.Type())
+}
+
+// compareOp applies an ordering comparison to numbers or strings.
+func (vm *VM) compareOp(left, right object.Object, op compiler.OpCode) (object.Object, error) {
+	if l, r, ok := intOperands(left, right); ok {
+		return runtime.NewBool(compareOrdered(op, l, r)), nil
+	}
+	if l, r, ok := floatOperands(left, right); ok {
+		return runtime.NewBool(compareOrdered(op, l, r)), nil
+	}
+	if l, ok := left.(*runtime.PyString); ok {
 		if r, ok := right.(*runtime.PyString); ok {
-			switch op {
-			case "<":
-				return &runtime.PyBool{Value: l.Value < r.Value}, nil
-			case "<=":
-				return &runtime.PyBool{Value: l.Value <= r.Value}, nil
-			case ">":
-				return &runtime.PyBool{Value: l.Value > r.Value}, nil
-			case ">=":
-				return &runtime.PyBool{Value: l.Value >= r.Value}, nil
-			}
+			return runtime.NewBool(compareOrdered(op, l.Value, r.Value)), nil
 		}
 	}
-
-	return nil, fmt.Errorf("'%s' not supported between instances of '%s' and '%s'", op, left.Type(), right.Type())
+	return nil, raise("TypeError", "'%s' not supported between instances of '%s' and '%s'", operatorSymbol(op), left.Type(), right.Type())
 }
 
 func (vm *VM) inOp(left, right object.Object) (object.Object, error) {
@@ -759,13 +999,13 @@ func (vm *VM) inOp(left, right object.Object) (object.Object, error) {
 	case *runtime.PyList:
 		for _, elem := range container.Elements {
 			if left.Equal(elem) {
-				return &runtime.PyBool{Value: true}, nil
+				return runtime.True, nil
 			}
 		}
-		return &runtime.PyBool{Value: false}, nil
+		return runtime.False, nil
 	case *runtime.PyDict:
 		_, exists := container.Get(left)
-		return &runtime.PyBool{Value: exists}, nil
+		return runtime.NewBool(exists), nil
 	case *runtime.PyString:
 		if str, ok := left.(*runtime.PyString); ok {
 			found := false
@@ -777,58 +1017,106 @@ func (vm *VM) inOp(left, right object.Object) (object.Object, error) {
 					}
 				}
 			}
-			return &runtime.PyBool{Value: found}, nil
+			return runtime.NewBool(found), nil
 		}
 	}
-	return nil, fmt.Errorf("argument of type '%s' is not iterable", right.Type())
+	return nil, raise("TypeError", "argument of type '%s' is not iterable", right.Type())
 }
 
 func (vm *VM) subscript(container, index object.Object) (object.Object, error) {
 	switch c := container.(type) {
 	case *runtime.PyList:
-		idx, err := runtime.ToGoInt(index)
+		idx, err := toGoInt(index)
 		if err != nil {
 			return nil, err
 		}
 		if idx < 0 || idx >= len(c.Elements) {
-			return nil, fmt.Errorf("list index out of range")
+			return nil, raise("IndexError", "list index out of range")
 		}
 		return c.Elements[idx], nil
 	case *runtime.PyDict:
 		value, exists := c.Get(index)
 		if !exists {
-			return nil, fmt.Errorf("KeyError: %s", index.String())
+			return nil, raise("KeyError", "%s", index.String())
 		}
 		return value, nil
 	case *runtime.PyString:
-		idx, err := runtime.ToGoInt(index)
+		idx, err := toGoInt(index)
 		if err != nil {
 			return nil, err
 		}
 		if idx < 0 || idx >= len(c.Value) {
-			return nil, fmt.Errorf("string index out of range")
+			return nil, raise("IndexError", "string index out of range")
 		}
 		return &runtime.PyString{Value: string(c.Value[idx])}, nil
 	}
-	return nil, fmt.Errorf("'%s' object is not subscriptable", container.Type())
+	return nil, raise("TypeError", "'%s' object is not subscriptable", container.Type())
 }
 
 func (vm *VM) storeSubscript(container, index, value object.Object) error {
 	switch c := container.(type) {
 	case *runtime.PyList:
-		idx, err := runtime.ToGoInt(index)
+		idx, err := toGoInt(index)
 		if err != nil {
 			return err
 		}
 		if idx < 0 || idx >= len(c.Elements) {
-			return fmt.Errorf("list index out of range")
+			return raise("IndexError", "list index out of range")
 		}
 		c.Elements[idx] = value
 		return nil
 	case *runtime.PyDict:
+		if _, exists := c.Get(index); !exists {
+			if err := vm.chargeDict(1); err != nil {
+				return err
+			}
+		}
 		c.Set(index, value)
 		return nil
 	}
-	return fmt.Errorf("'%s' object does not support item assignment", container.Type())
+	return raise("TypeError", "'%s' object does not support item assignment", container.Type())
+}
+
+
+// nameCache is the inline cache of an instruction that loads or stores a
+// global. It holds the slot the name was found in, which is valid while
+// the globals, and for names found in the builtins also the builtins, keep
+// the recorded versions.
+type nameCache struct {
+	globals  uint64
+	builtins uint64 // 0 if the slot is in the globals
+	slot     int
+}
+
+// nameCaches returns the inline caches of the instructions of code, which
+// all frames running code share.
+func (vm *VM) nameCaches(code *compiler.CodeObject) []nameCache {
+	caches, ok := vm.caches[code]
+	if !ok {
+		caches = make([]nameCache, len(code.Instructions))
+		vm.caches[code] = caches
+	}
+	return caches
 }
 
+// loadGlobal looks name up in the globals, then the builtins, of frame and
+// fills cache with where it was found.
+func loadGlobal(frame *Frame, cache *nameCache, name string) (object.Object, bool) {
+	if slot, ok := frame.Globals.Lookup(name); ok {
+		*cache = nameCache{globals: frame.Globals.Version(), slot: slot}
+		return frame.Globals.Slot(slot), true
+	}
+	if slot, ok := frame.Builtins.Lookup(name); ok {
+		*cache = nameCache{globals: frame.Globals.Version(), builtins: frame.Builtins.Version(), slot: slot}
+		return frame.Builtins.Slot(slot), true
+	}
+	return nil, false
+}
+
+// storeGlobal binds name in the globals of frame and fills cache with its
+// slot.
+func storeGlobal(frame *Frame, cache *nameCache, name string, value object.Object) {
+	frame.Globals.Set(name, value)
+	slot, _ := frame.Globals.Lookup(name)
+	*cache = nameCache{globals: frame.Globals.Version(), slot: slot}
+}
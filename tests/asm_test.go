@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func TestAssembleRoundTrip(t *testing.T) {
+	for _, source := range []string{verifySource, pycSource, traceFunctions} {
+		code := compileFileSource(t, "prog.py", source)
+		listing := code.Disassemble()
+		assembled, err := compiler.Assemble(listing)
+		if err != nil {
+			t.Fatalf("Assemble error: %v\n%s", err, listing)
+		}
+		if !reflect.DeepEqual(code, assembled) {
+			t.Errorf("Round trip changed the code object:\n%s\n%s", listing, assembled.Disassemble())
+		}
+	}
+}
+
+func TestAssembleRoundTripUnusual(t *testing.T) {
+	dict := runtime.NewPyDict()
+	dict.Set(&runtime.PyString{Value: "k\"ey"}, &runtime.PyList{Elements: []object.Object{}})
+	code := &compiler.CodeObject{
+		Name:     "weird name",
+		Filename: "dir/with space.py",
+		Instructions: []compiler.Instruction{
+			{Op: compiler.OpNop, Arg: 5},
+			{Op: compiler.OpCode(99)},
+			{Op: compiler.OpLoadConst, Arg: -1},
+		},
+		Consts: []object.Object{
+			&runtime.PyFloat{Value: 2},
+			&runtime.PyFloat{Value: 1e300},
+			&runtime.PyFloat{Value: -0.25},
+			&runtime.PyString{Value: "semi;colon\n\ttab"},
+			&runtime.PyList{Elements: []object.Object{&runtime.PyInt{Value: -3}, &runtime.PyBool{}, dict}},
+		},
+		Names:     []string{".dot", "a:b"},
+		Varnames:  []string{},
+		LineTable: []compiler.LineEntry{{Offset: 1, Line: 4}, {Offset: 3, Line: 9}},
+	}
+	assembled, err := compiler.Assemble(code.Disassemble())
+	if err != nil {
+		t.Fatalf("Assemble error: %v\n%s", err, code.Disassemble())
+	}
+	if !reflect.DeepEqual(code, assembled) {
+		t.Errorf("Round trip changed the code object:\n%s\n%s", code.Disassemble(), assembled.Disassemble())
+	}
+}
+
+const countdownAsm = `
+; Prints n, n-1, ..., 1 and returns "done".
+.code <module>
+.consts
+    0: 3
+    1: 1
+    2: 0
+    3: "done"
+.names
+    0: n
+.instructions
+    LOAD_CONST 0
+    STORE_NAME 0
+loop:
+    LOAD_NAME 0
+    LOAD_CONST 2
+    COMPARE_GT
+    POP_JUMP_IF_FALSE exit
+    LOAD_NAME 0
+    PRINT_EXPR
+    PRINT_NEWLINE
+    LOAD_NAME 0
+    LOAD_CONST 1
+    BINARY_SUB
+    STORE_NAME 0
+    JUMP_ABSOLUTE loop
+exit: JUMP_FORWARD end
+    LOAD_CONST 2        ; skipped
+    RETURN_VALUE
+end:
+    LOAD_CONST 3
+    RETURN_VALUE
+.end
+`
+
+func TestAssembleAndRun(t *testing.T) {
+	code, err := compiler.Assemble(countdownAsm)
+	if err != nil {
+		t.Fatalf("Assemble error: %v", err)
+	}
+	if code.Instructions[14].Arg != 2 {
+		t.Errorf("Expected JUMP_FORWARD to get a relative offset of 2, got %d", code.Instructions[14].Arg)
+	}
+	if err := compiler.Verify(code); err != nil {
+		t.Fatalf("Verify error: %v", err)
+	}
+
+	var out bytes.Buffer
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	result, err := machine.Run(code)
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	if out.String() != "3\n2\n1\n" || result.String() != "done" {
+		t.Errorf("Unexpected output %q and result %v", out.String(), result)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", "line 0: expected .code"},
+		{".code m\n.instructions\n  FROB 1\n.end", "line 3: unknown opcode \"FROB\""},
+		{".code m\n.instructions\n  JUMP_ABSOLUTE nowhere\n.end", "line 3: undefined label \"nowhere\""},
+		{".code m\n.instructions\n  LOAD_CONST x\n.end", "line 3: invalid operand \"x\" for LOAD_CONST"},
+		{".code m\n.names\n  1: a\n.end", "line 3: index 1 out of sequence, expected 0"},
+		{".code m\n.consts\n  [1, 2\n.end", "line 3: expected ',' or ']'"},
+		{".code m\n.consts\n  \"open\n.end", "line 3: unterminated string"},
+		{".code m\n.consts\n  0: .code f\n.end", "line 4: missing .end for m"},
+		{".code m\n.line 3\n.end", "line 2: .line outside .instructions"},
+		{".code m\n  NOP\n.end", "line 2: expected a section directive"},
+		{".code m\n.instructions\na:\na:\n.end", "line 4: label \"a\" defined twice"},
+		{".code m\n.end\nNOP", "line 3: unexpected \"NOP\" after .end"},
+	}
+	for _, tt := range tests {
+		_, err := compiler.Assemble(tt.source)
+		var asmErr *compiler.AsmError
+		if !errors.As(err, &asmErr) {
+			t.Errorf("%q: expected an *AsmError, got %v", tt.source, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected %q, got %q", tt.source, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/coverage"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const coverageSource = `def grade(score):
+    if score >= 90:
+        return "A"
+    elif score >= 80:
+        return "B"
+    elif score >= 70:
+        return "C"
+    return "F"
+
+def unused():
+    return 1
+
+for s in [95, 85, 50]:
+    print grade(s)
+`
+
+func runCovered(t *testing.T) *coverage.Profile {
+	t.Helper()
+	code := compileFileSource(t, "grade.py", coverageSource)
+	machine := vm.NewVM()
+	var out bytes.Buffer
+	machine.SetStdout(&out)
+
+	c := coverage.Start(machine)
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	c.Stop()
+	if out.String() != "A\nB\nF\n" {
+		t.Fatalf("Unexpected output %q", out.String())
+	}
+	return c.Profile()
+}
+
+func TestCoverageLinesAndBranches(t *testing.T) {
+	p := runCovered(t)
+	f := p.Files["grade.py"]
+	if f == nil {
+		t.Fatalf("Expected grade.py in %v", p.Filenames())
+	}
+
+	if got := f.Missing(); len(got) != 2 || got[0] != 7 || got[1] != 11 {
+		t.Errorf("Expected lines 7 and 11 to be missed, got %v", got)
+	}
+	if f.Lines[2] != 3 || f.Lines[3] != 1 || f.Lines[8] != 1 {
+		t.Errorf("Unexpected line hits %v", f.Lines)
+	}
+	if _, ok := f.Lines[9]; ok {
+		t.Errorf("Blank line 9 should not be executable")
+	}
+
+	var partial []int
+	for _, b := range f.Branches {
+		if b.Function != "grade" {
+			t.Errorf("Unexpected branch %+v", b)
+		}
+		if b.Partial() {
+			partial = append(partial, b.Line)
+		}
+	}
+	if len(f.Branches) != 3 || len(partial) != 1 || partial[0] != 6 {
+		t.Errorf("Expected only the elif on line 6 to be partial, got %v", partial)
+	}
+	if b := f.Branches[0]; b.Line != 2 || b.True != 1 || b.False != 2 {
+		t.Errorf("Unexpected outcomes for line 2: %+v", b)
+	}
+
+	s := f.Summary()
+	if s.Lines != 12 || s.CoveredLines != 10 || s.Branches != 6 || s.CoveredBranches != 5 {
+		t.Errorf("Unexpected summary %+v", s)
+	}
+}
+
+func TestCoverageMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cover.json")
+	for i := 0; i < 2; i++ {
+		if err := runCovered(t).MergeFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := coverage.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := p.Files["grade.py"]
+	if f.Lines[2] != 6 || f.Lines[7] != 0 || len(f.Branches) != 3 || f.Branches[0].False != 4 {
+		t.Errorf("Expected merged counts to double, got %v %+v", f.Lines, f.Branches[0])
+	}
+}
+
+func TestCoverageReports(t *testing.T) {
+	p := runCovered(t)
+
+	var text strings.Builder
+	if err := p.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"grade.py", "10/12", "83.3%", "5/6", "7, 11", "Partial branches:", "grade.py:6: condition in grade() was never true"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("Expected %q in text report:\n%s", want, text.String())
+		}
+	}
+
+	var html strings.Builder
+	err := p.WriteHTML(&html, func(filename string) (string, error) {
+		return coverageSource, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := html.String()
+	for _, want := range []string{
+		`<tr class="miss"><td class="num">7</td><td class="hits">0</td><td>        return &#34;C&#34;</td></tr>`,
+		`<tr class="partial" title="condition in grade() was never true"><td class="num">6</td>`,
+		`<tr class="hit"><td class="num">3</td><td class="hits">1</td>`,
+		`<tr class=""><td class="num">9</td><td class="hits"></td><td></td></tr>`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected %q in HTML report", want)
+		}
+	}
+}
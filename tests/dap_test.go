@@ -0,0 +1,341 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/dap"
+)
+
+const dapSource = `def total(items):
+    s = 0
+    for item in items:
+        s += item
+    return s
+
+config = {"name": "rules", "limit": 3}
+values = [1, 2, 3]
+result = total(values)
+print result
+`
+
+// dapClient drives a dap.Server over in-memory pipes.
+type dapClient struct {
+	t       *testing.T
+	w       io.WriteCloser
+	seq     int
+	msgs    chan map[string]interface{}
+	pending []map[string]interface{}
+	done    chan error
+}
+
+func newDAPClient(t *testing.T) *dapClient {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	server := dap.NewServer(serverR, serverW)
+
+	c := &dapClient{t: t, w: clientW, msgs: make(chan map[string]interface{}, 100), done: make(chan error, 1)}
+	go func() {
+		err := server.Serve()
+		serverW.Close()
+		c.done <- err
+	}()
+	go func() {
+		r := bufio.NewReader(clientR)
+		for {
+			data, err := dap.ReadMessage(r)
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			var msg map[string]interface{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Errorf("invalid message from server: %v", err)
+				continue
+			}
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *dapClient) next() map[string]interface{} {
+	c.t.Helper()
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		return msg
+	}
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+// request sends a request and returns its response, keeping events that
+// arrive meanwhile for later.
+func (c *dapClient) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	req := map[string]interface{}{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := dap.WriteMessage(c.w, req); err != nil {
+		c.t.Fatalf("write %s: %v", command, err)
+	}
+
+	var skipped []map[string]interface{}
+	for {
+		msg := c.next()
+		if msg["type"] == "response" && int(msg["request_seq"].(float64)) == c.seq {
+			c.pending = append(skipped, c.pending...)
+			return msg
+		}
+		skipped = append(skipped, msg)
+	}
+}
+
+func (c *dapClient) success(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	resp := c.request(command, args)
+	if resp["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, resp["message"])
+	}
+	body, _ := resp["body"].(map[string]interface{})
+	return body
+}
+
+// event waits for the named event, collecting output events on the way.
+func (c *dapClient) event(name string, output *strings.Builder) map[string]interface{} {
+	c.t.Helper()
+	for {
+		msg := c.next()
+		if msg["type"] != "event" {
+			continue
+		}
+		body, _ := msg["body"].(map[string]interface{})
+		if msg["event"] == "output" && output != nil {
+			output.WriteString(body["output"].(string))
+		}
+		if msg["event"] == name {
+			return body
+		}
+	}
+}
+
+func (c *dapClient) variables(ref float64) map[string]map[string]interface{} {
+	c.t.Helper()
+	body := c.success("variables", map[string]interface{}{"variablesReference": ref})
+	vars := make(map[string]map[string]interface{})
+	for _, v := range body["variables"].([]interface{}) {
+		variable := v.(map[string]interface{})
+		vars[variable["name"].(string)] = variable
+	}
+	return vars
+}
+
+func writeDAPProgram(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.py")
+	if err := os.WriteFile(path, []byte(dapSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDAPSession(t *testing.T) {
+	program := writeDAPProgram(t)
+	c := newDAPClient(t)
+
+	caps := c.success("initialize", map[string]interface{}{"adapterID": "gopy"})
+	if caps["supportsConfigurationDoneRequest"] != true {
+		t.Errorf("Expected configurationDone support, got %v", caps)
+	}
+	c.success("launch", map[string]interface{}{"program": program})
+	c.event("initialized", nil)
+
+	bps := c.success("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": program},
+		"breakpoints": []map[string]interface{}{{"line": 4}, {"line": 6}},
+	})["breakpoints"].([]interface{})
+	if bps[0].(map[string]interface{})["verified"] != true {
+		t.Errorf("Expected line 4 to be verified: %v", bps[0])
+	}
+	if bps[1].(map[string]interface{})["verified"] != false {
+		t.Errorf("Expected blank line 6 to be rejected: %v", bps[1])
+	}
+	c.success("configurationDone", nil)
+
+	var output strings.Builder
+	stopped := c.event("stopped", &output)
+	if stopped["reason"] != "breakpoint" {
+		t.Fatalf("Expected breakpoint stop, got %v", stopped)
+	}
+
+	threads := c.success("threads", nil)["threads"].([]interface{})
+	if len(threads) != 1 {
+		t.Errorf("Expected one thread, got %v", threads)
+	}
+
+	frames := c.success("stackTrace", map[string]interface{}{"threadId": 1})["stackFrames"].([]interface{})
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames, got %v", frames)
+	}
+	top := frames[0].(map[string]interface{})
+	if top["name"] != "total" || top["line"] != float64(4) {
+		t.Errorf("Unexpected top frame %v", top)
+	}
+	if frames[1].(map[string]interface{})["name"] != "<module>" {
+		t.Errorf("Unexpected caller frame %v", frames[1])
+	}
+
+	scopes := c.success("scopes", map[string]interface{}{"frameId": top["id"]})["scopes"].([]interface{})
+	if len(scopes) != 3 {
+		t.Fatalf("Expected locals, globals and builtins scopes, got %v", scopes)
+	}
+	locals := c.variables(scopes[0].(map[string]interface{})["variablesReference"].(float64))
+	if locals["s"]["value"] != "0" || locals["item"]["value"] != "1" {
+		t.Errorf("Unexpected locals %v", locals)
+	}
+	items := locals["items"]
+	if items["type"] != "list" || items["variablesReference"] == float64(0) {
+		t.Fatalf("Expected an expandable list, got %v", items)
+	}
+	elements := c.variables(items["variablesReference"].(float64))
+	if len(elements) != 3 || elements["2"]["value"] != "3" {
+		t.Errorf("Unexpected list elements %v", elements)
+	}
+
+	globals := c.variables(scopes[1].(map[string]interface{})["variablesReference"].(float64))
+	config := globals["config"]
+	if config["type"] != "dict" {
+		t.Fatalf("Expected config dict in globals, got %v", globals)
+	}
+	entries := c.variables(config["variablesReference"].(float64))
+	if entries["name"]["value"] != "'rules'" || entries["limit"]["value"] != "3" {
+		t.Errorf("Unexpected dict entries %v", entries)
+	}
+
+	builtins := c.variables(scopes[2].(map[string]interface{})["variablesReference"].(float64))
+	if _, ok := builtins["len"]; !ok {
+		t.Errorf("Expected len in builtins, got %v", builtins)
+	}
+
+	eval := c.success("evaluate", map[string]interface{}{"expression": "s + item * 10", "frameId": top["id"]})
+	if eval["result"] != "10" {
+		t.Errorf("Expected 10, got %v", eval)
+	}
+	if resp := c.request("evaluate", map[string]interface{}{"expression": "nope", "frameId": top["id"]}); resp["success"] != false {
+		t.Errorf("Expected evaluate of an undefined name to fail: %v", resp)
+	}
+
+	// Step to the next line of the loop, then out of the function.
+	c.success("next", map[string]interface{}{"threadId": 1})
+	if reason := c.event("stopped", &output)["reason"]; reason != "step" {
+		t.Errorf("Expected step stop, got %v", reason)
+	}
+	frames = c.success("stackTrace", map[string]interface{}{"threadId": 1})["stackFrames"].([]interface{})
+	if line := frames[0].(map[string]interface{})["line"]; line != float64(3) {
+		t.Errorf("Expected to step to line 3, got %v", line)
+	}
+
+	c.success("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": program},
+		"breakpoints": []map[string]interface{}{},
+	})
+	c.success("stepOut", map[string]interface{}{"threadId": 1})
+	c.event("stopped", &output)
+	c.success("continue", map[string]interface{}{"threadId": 1})
+
+	exited := c.event("exited", &output)
+	if exited["exitCode"] != float64(0) {
+		t.Errorf("Expected exit code 0, got %v", exited)
+	}
+	c.event("terminated", &output)
+	if output.String() != "6\n" {
+		t.Errorf("Expected program output 6, got %q", output.String())
+	}
+
+	c.success("disconnect", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestDAPStopOnEntryAndDisconnect(t *testing.T) {
+	program := writeDAPProgram(t)
+	c := newDAPClient(t)
+
+	c.success("initialize", nil)
+	c.success("launch", map[string]interface{}{"program": program, "stopOnEntry": true})
+	c.success("setFunctionBreakpoints", map[string]interface{}{
+		"breakpoints": []map[string]interface{}{{"name": "total"}},
+	})
+	c.success("configurationDone", nil)
+
+	if reason := c.event("stopped", nil)["reason"]; reason != "entry" {
+		t.Fatalf("Expected entry stop, got %v", reason)
+	}
+	c.success("continue", nil)
+	if reason := c.event("stopped", nil)["reason"]; reason != "breakpoint" {
+		t.Fatalf("Expected function breakpoint stop, got %v", reason)
+	}
+
+	// Disconnecting while stopped aborts the program.
+	c.success("disconnect", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestDAPErrors(t *testing.T) {
+	c := newDAPClient(t)
+	c.success("initialize", nil)
+
+	if resp := c.request("launch", map[string]interface{}{"program": "/does/not/exist.py"}); resp["success"] != false {
+		t.Errorf("Expected launch of a missing file to fail: %v", resp)
+	}
+	if resp := c.request("stackTrace", map[string]interface{}{"threadId": 1}); resp["success"] != false {
+		t.Errorf("Expected stackTrace without a stopped program to fail: %v", resp)
+	}
+	if resp := c.request("frobnicate", nil); resp["success"] != false {
+		t.Errorf("Expected unknown request to fail: %v", resp)
+	}
+
+	c.w.Close()
+	if err := <-c.done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestDAPDisconnectRunningProgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop.py")
+	if err := os.WriteFile(path, []byte("while 1:\n    pass\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, noDebug := range []bool{true, false} {
+		c := newDAPClient(t)
+		c.success("initialize", nil)
+		c.success("launch", map[string]interface{}{"program": path, "noDebug": noDebug})
+		c.success("configurationDone", nil)
+
+		// The loop never stops, so disconnecting has to interrupt it.
+		c.success("disconnect", nil)
+		if err := <-c.done; err != nil {
+			t.Errorf("noDebug=%v: Serve returned %v", noDebug, err)
+		}
+	}
+}
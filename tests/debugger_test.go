@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/debugger"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const debuggerSource = `def add(a, b):
+    c = a + b
+    return c
+
+def twice(n):
+    first = add(n, n)
+    return add(first, first)
+
+x = 3
+y = twice(x)
+print y
+`
+
+type stopRecord struct {
+	reason   debugger.Reason
+	function string
+	line     int
+}
+
+func (r stopRecord) String() string {
+	return fmt.Sprintf("%s %s:%d", r.reason, r.function, r.line)
+}
+
+// runDebugged runs debuggerSource, answering every stop with the next action
+// from actions and recording where it stopped.
+func runDebugged(t *testing.T, setup func(d *debugger.Debugger), actions ...debugger.Action) ([]stopRecord, error) {
+	t.Helper()
+	code := compileFileSource(t, "script.py", debuggerSource)
+	machine := vm.NewVM()
+	machine.SetStdout(&bytes.Buffer{})
+
+	var stops []stopRecord
+	d := debugger.New(machine, func(d *debugger.Debugger, stop *debugger.Stop) debugger.Action {
+		stops = append(stops, stopRecord{stop.Reason, stop.Function(), stop.Line()})
+		if len(actions) == 0 {
+			return debugger.Continue
+		}
+		action := actions[0]
+		actions = actions[1:]
+		return action
+	})
+	if setup != nil {
+		setup(d)
+	}
+	_, err := machine.Run(code)
+	return stops, err
+}
+
+func expectStops(t *testing.T, got []stopRecord, want ...string) {
+	t.Helper()
+	var lines []string
+	for _, stop := range got {
+		lines = append(lines, stop.String())
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("stops mismatch\nexpected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestDebuggerLineBreakpoints(t *testing.T) {
+	stops, err := runDebugged(t, func(d *debugger.Debugger) {
+		d.Break("script.py", 2)
+		d.Break("script.py", 11)
+	})
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	expectStops(t, stops,
+		"breakpoint add:2",
+		"breakpoint add:2",
+		"breakpoint <module>:11",
+	)
+}
+
+func TestDebuggerFunctionBreakpoint(t *testing.T) {
+	var hits *debugger.Breakpoint
+	stops, err := runDebugged(t, func(d *debugger.Debugger) {
+		hits = d.BreakFunction("twice")
+	})
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	expectStops(t, stops, "breakpoint twice:6")
+	if hits.Hits != 1 {
+		t.Errorf("Expected 1 hit, got %d", hits.Hits)
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	stops, err := runDebugged(t, func(d *debugger.Debugger) {
+		d.BreakFunction("twice")
+	},
+		debugger.StepOver, // twice:6 -> twice:7
+		debugger.StepIn,   // twice:7 -> add:2
+		debugger.StepOut,  // add:2 -> return from add
+		debugger.StepOver, // return -> twice's caller, module line 11
+		debugger.Continue,
+	)
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	expectStops(t, stops,
+		"breakpoint twice:6",
+		"step twice:7",
+		"step add:2",
+		"return add:3",
+		"step <module>:11",
+	)
+}
+
+func TestDebuggerEntryAndAbort(t *testing.T) {
+	stops, err := runDebugged(t, func(d *debugger.Debugger) {
+		d.SetStopOnEntry(true)
+	}, debugger.StepIn, debugger.Abort)
+	if !errors.Is(err, debugger.ErrAborted) {
+		t.Fatalf("Expected ErrAborted, got %v", err)
+	}
+	expectStops(t, stops, "entry <module>:1", "step <module>:5")
+}
+
+func TestDebuggerInspection(t *testing.T) {
+	code := compileFileSource(t, "script.py", debuggerSource)
+	machine := vm.NewVM()
+	machine.SetStdout(&bytes.Buffer{})
+
+	checked := false
+	d := debugger.New(machine, func(d *debugger.Debugger, stop *debugger.Stop) debugger.Action {
+		checked = true
+		trace := d.Backtrace()
+		var names []string
+		for _, info := range trace {
+			names = append(names, fmt.Sprintf("%s:%d", info.Function, info.Line))
+		}
+		if got := strings.Join(names, " "); got != "add:3 twice:6 <module>:10" {
+			t.Errorf("Unexpected backtrace %q", got)
+		}
+
+		locals := d.Locals(stop.Frame)
+		var vars []string
+		for _, v := range locals {
+			vars = append(vars, v.Name+"="+v.Value.String())
+		}
+		if got := strings.Join(vars, " "); got != "a=3 b=3 c=6" {
+			t.Errorf("Unexpected locals %q", got)
+		}
+
+		if value, ok := d.Lookup(trace[1].Frame, "n"); !ok || value.String() != "3" {
+			t.Errorf("Expected n=3 in caller, got %v", value)
+		}
+		if _, ok := d.Lookup(stop.Frame, "len"); !ok {
+			t.Error("Expected builtins to be visible")
+		}
+
+		value, err := d.Eval(stop.Frame, "c * 10 + x")
+		if err != nil {
+			t.Fatalf("Eval error: %v", err)
+		}
+		if value.String() != "63" {
+			t.Errorf("Expected 63, got %s", value)
+		}
+		if _, err := d.Eval(stop.Frame, "missing + 1"); err == nil {
+			t.Error("Expected NameError from Eval")
+		}
+		d.ClearAll()
+		return debugger.Continue
+	})
+	d.Break("script.py", 3)
+
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	if !checked {
+		t.Fatal("Breakpoint was not hit")
+	}
+	if y := machine.Globals()["y"]; y == nil || y.String() != "12" {
+		t.Errorf("Expected y=12 after debugging, got %v", y)
+	}
+}
+
+func TestDebuggerException(t *testing.T) {
+	code := compileFileSource(t, "bad.py", "def f(n):\n    return n / 0\n\nf(4)\n")
+	machine := vm.NewVM()
+
+	var stop *debugger.Stop
+	var local object.Object
+	debugger.New(machine, func(d *debugger.Debugger, s *debugger.Stop) debugger.Action {
+		stop = s
+		local, _ = d.Lookup(s.Frame, "n")
+		return debugger.Continue
+	})
+
+	if _, err := machine.Run(code); err == nil {
+		t.Fatal("Expected ZeroDivisionError")
+	}
+	if stop == nil || stop.Reason != debugger.StopException {
+		t.Fatalf("Expected an exception stop, got %+v", stop)
+	}
+	if stop.Function() != "f" || stop.Line() != 2 {
+		t.Errorf("Expected stop in f:2, got %s:%d", stop.Function(), stop.Line())
+	}
+	if local == nil || local.String() != "4" {
+		t.Errorf("Expected n=4 at the exception, got %v", local)
+	}
+}
+
+func TestDebuggerConsole(t *testing.T) {
+	code := compileFileSource(t, "script.py", debuggerSource)
+	machine := vm.NewVM()
+	var programOut bytes.Buffer
+	machine.SetStdout(&programOut)
+
+	input := strings.Join([]string{
+		"break add",
+		"continue",
+		"where",
+		"locals",
+		"print a + b",
+		"up",
+		"info locals",
+		"info breakpoints",
+		"info frames",
+		"delete 1",
+		"continue",
+	}, "\n")
+	var out bytes.Buffer
+	console := debugger.NewConsole(strings.NewReader(input), &out)
+	d := debugger.New(machine, console.Handle)
+	d.SetStopOnEntry(true)
+
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v\n%s", err, out.String())
+	}
+	for _, want := range []string{
+		"Set breakpoint 1 in add()",
+		"Stopped at breakpoint 1 in add()",
+		"-> #0 add() at script.py:2",
+		"   #1 twice() at script.py:6",
+		"a = 3\nb = 3\nc = None",
+		"(gopy-db) 6\n",
+		"n = 3\nfirst = None",
+		"breakpoint 1 in add(), hit 1 times",
+		"Unknown info subcommand \"frames\", expected breakpoints or locals",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Console output missing %q:\n%s", want, out.String())
+		}
+	}
+	if programOut.String() != "12\n" {
+		t.Errorf("Expected program output 12, got %q", programOut.String())
+	}
+}
+
+func TestDebuggerConsoleFinishModule(t *testing.T) {
+	code := compileFileSource(t, "script.py", debuggerSource)
+	machine := vm.NewVM()
+	machine.SetStdout(&bytes.Buffer{})
+
+	var out bytes.Buffer
+	console := debugger.NewConsole(strings.NewReader("finish\ncontinue\n"), &out)
+	d := debugger.New(machine, console.Handle)
+	d.SetStopOnEntry(true)
+
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v\n%s", err, out.String())
+	}
+	_, after, found := strings.Cut(out.String(), "(gopy-db) ")
+	if !found || !strings.HasPrefix(after, "The program finished\n(gopy-db) ") {
+		t.Errorf("Expected finish at module level to end the program:\n%s", out.String())
+	}
+}
+
+func TestVMHooks(t *testing.T) {
+	code := compileFileSource(t, "script.py", "def f():\n    return 1\n\nx = f()\n")
+	machine := vm.NewVM()
+
+	var events []string
+	remove := machine.AddHook(vm.HookFunc(func(event vm.Event, frame *vm.Frame, arg object.Object) error {
+		events = append(events, fmt.Sprintf("%s %s:%d", event, frame.Code.Name, frame.Line()))
+		return nil
+	}))
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	want := "call <module>:1 line <module>:1 line <module>:4 call f:2 line f:2 return f:2 return <module>:4"
+	if got := strings.Join(events, " "); got != want {
+		t.Errorf("Unexpected events\nexpected: %s\ngot:      %s", want, got)
+	}
+
+	remove()
+	events = nil
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected no events after removing the hook, got %v", events)
+	}
+}
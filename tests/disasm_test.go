@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+)
+
+const disasmSource = `def countdown(n):
+    while n > 0:
+        n -= 1
+    return "done"
+
+print countdown(3)
+`
+
+func TestDisassembleAnnotations(t *testing.T) {
+	code := compileFileSource(t, "countdown.py", disasmSource)
+	listing := code.DisassembleSource(disasmSource)
+	want := `        .instructions
+            .line 2                              ; while n > 0:
+        L0:
+            0: LOAD_FAST 0                       ; n
+            1: LOAD_CONST 0                      ; 0
+            2: COMPARE_GT
+            3: POP_JUMP_IF_FALSE L9
+
+            .line 3                              ; n -= 1
+            4: LOAD_FAST 0                       ; n
+            5: LOAD_CONST 1                      ; 1
+            6: BINARY_SUB
+            7: STORE_FAST 0                      ; n
+
+            .line 2                              ; while n > 0:
+            8: JUMP_ABSOLUTE L0
+
+            .line 4                              ; return "done"
+        L9:
+            9: LOAD_CONST 2                      ; "done"
+`
+	if !strings.Contains(listing, want) {
+		t.Errorf("Expected countdown() listing to contain:\n%s\ngot:\n%s", want, listing)
+	}
+	for _, line := range []string{
+		"    0: LOAD_CONST 0                      ; <code countdown>\n",
+		"    5: CALL_FUNCTION 1                   ; 1 argument\n",
+	} {
+		if !strings.Contains(listing, line) {
+			t.Errorf("Expected %q in listing:\n%s", line, listing)
+		}
+	}
+
+	if plain := code.Disassemble(); strings.Contains(plain, "; while") {
+		t.Errorf("Disassemble without source shows source text:\n%s", plain)
+	}
+	assembled, err := compiler.Assemble(listing)
+	if err != nil {
+		t.Fatalf("Assemble error: %v\n%s", err, listing)
+	}
+	if !reflect.DeepEqual(code, assembled) {
+		t.Errorf("Annotated listing did not round trip:\n%s", listing)
+	}
+}
+
+func TestDisassembleOutOfRangeOperand(t *testing.T) {
+	code := &compiler.CodeObject{
+		Name:         "<module>",
+		Instructions: instrs(compiler.OpLoadName, 3, compiler.OpJumpAbsolute, 7),
+	}
+	listing := code.Disassemble()
+	for _, line := range []string{
+		"0: LOAD_NAME 3                       ; out of range\n",
+		"1: JUMP_ABSOLUTE 7\n",
+	} {
+		if !strings.Contains(listing, line) {
+			t.Errorf("Expected %q in listing:\n%s", line, listing)
+		}
+	}
+}
+
+func TestDisassembleJSON(t *testing.T) {
+	code := compileFileSource(t, "countdown.py", disasmSource)
+	var buf bytes.Buffer
+	if err := compiler.WriteDisassembly(&buf, code, "json", ""); err != nil {
+		t.Fatalf("WriteDisassembly error: %v", err)
+	}
+	var listing compiler.CodeListing
+	if err := json.Unmarshal(buf.Bytes(), &listing); err != nil {
+		t.Fatalf("Invalid JSON: %v\n%s", err, buf.String())
+	}
+	if listing.Name != "<module>" || listing.Consts[0].Repr != "<code countdown>" || listing.Consts[0].Code == nil {
+		t.Fatalf("Unexpected module listing %+v", listing)
+	}
+
+	fn := listing.Consts[0].Code
+	if fn.Name != "countdown" || fn.Argcount != 1 || !reflect.DeepEqual(fn.Varnames, []string{"n"}) {
+		t.Errorf("Unexpected function listing %+v", fn)
+	}
+	first, jump, store := fn.Instructions[0], fn.Instructions[3], fn.Instructions[7]
+	if !first.StartsLine || !first.IsJumpTarget || first.Line != 2 || first.Argrepr != "n" {
+		t.Errorf("Unexpected first instruction %+v", first)
+	}
+	if jump.Opname != "POP_JUMP_IF_FALSE" || jump.Target == nil || *jump.Target != 9 || jump.Argrepr != "to 9" {
+		t.Errorf("Unexpected jump instruction %+v", jump)
+	}
+	if store.StartsLine || store.Line != 3 || store.Target != nil || store.Opcode != int(compiler.OpStoreFast) {
+		t.Errorf("Unexpected store instruction %+v", store)
+	}
+}
+
+func TestWriteDisassemblyUnknownFormat(t *testing.T) {
+	code := compileFileSource(t, "countdown.py", disasmSource)
+	err := compiler.WriteDisassembly(&bytes.Buffer{}, code, "xml", "")
+	if err == nil || !strings.Contains(err.Error(), `unknown disassembly format "xml"`) {
+		t.Errorf("Expected an unknown format error, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// fibonacciBench is examples/fibonacci.py with a larger argument.
+const fibonacciBench = `def fibonacci(n):
+    if n <= 1:
+        return n
+    else:
+        return fibonacci(n - 1) + fibonacci(n - 2)
+
+print fibonacci(20)
+`
+
+// loopBench is the accumulator loops of examples/for_loops.py, repeated
+// inside a function as hot loops usually are.
+const loopBench = `def loops(n):
+    total = 0
+    for i in range(n):
+        total = total + i
+    count = 0
+    while count < n:
+        if count % 3 == 0:
+            total = total - 1
+        count = count + 1
+    return total
+
+print loops(20000)
+`
+
+func TestOptimizeFormsSuperinstructions(t *testing.T) {
+	code := compileFileSource(t, "fib.py", fibonacciBench)
+	if err := compiler.Optimize(code, compiler.OptPeephole); err != nil {
+		t.Fatal(err)
+	}
+	fib := code.Consts[0].(*compiler.PyFunction).Code
+	want := []string{
+		"LOAD_FAST_LOAD_CONST", "COMPARE_LE", "POP_JUMP_IF_FALSE",
+		"LOAD_FAST", "RETURN_VALUE", "JUMP_FORWARD",
+		"LOAD_GLOBAL", "BINARY_SUB_FAST_CONST", "CALL_FUNCTION",
+		"LOAD_GLOBAL", "BINARY_SUB_FAST_CONST", "CALL_FUNCTION", "BINARY_ADD", "RETURN_VALUE",
+		"LOAD_CONST", "RETURN_VALUE",
+	}
+	if got := opcodes(fib); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected fibonacci() code:\n got %v\nwant %v", got, want)
+	}
+	if local, c := compiler.UnpackOperands(fib.Instructions[7].Arg); fib.Varnames[local] != "n" || fib.Consts[c].String() != "1" {
+		t.Errorf("BINARY_SUB_FAST_CONST operands refer to %s and %v", fib.Varnames[local], fib.Consts[c])
+	}
+
+	listing := code.Disassemble()
+	if !strings.Contains(listing, "7: BINARY_SUB_FAST_CONST 0 0         ; n, 1\n") {
+		t.Errorf("Expected packed operands in the listing:\n%s", listing)
+	}
+	assembled, err := compiler.Assemble(listing)
+	if err != nil {
+		t.Fatalf("Assemble error: %v", err)
+	}
+	if !reflect.DeepEqual(code, assembled) {
+		t.Errorf("Superinstructions did not round trip:\n%s", listing)
+	}
+}
+
+func TestSuperinstructionsRespectLinesAndJumps(t *testing.T) {
+	// The loop jumps back to the load of i, and the store and load of x
+	// are on different lines.
+	source := "def f(a, b):\n    i = 0\n    while i < 3:\n        i = i + 1\n    x = a\n    return x + b\n"
+	code := compileFileSource(t, "lines.py", source)
+	if err := compiler.Optimize(code, compiler.OptPeephole); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"LOAD_CONST", "STORE_FAST", "LOAD_FAST_LOAD_CONST", "COMPARE_LT", "POP_JUMP_IF_FALSE",
+		"BINARY_ADD_FAST_CONST", "STORE_FAST", "JUMP_ABSOLUTE",
+		"LOAD_FAST", "STORE_FAST", "LOAD_FAST_LOAD_FAST", "BINARY_ADD", "RETURN_VALUE",
+		"LOAD_CONST", "RETURN_VALUE",
+	}
+	if got := opcodes(code.Consts[0].(*compiler.PyFunction).Code); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected code:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestSuperinstructionFallbacks(t *testing.T) {
+	source := `def shout(s):
+    return s + "!"
+
+def minus(x):
+    return x - 1.5
+
+def bad(x):
+    return x - "a"
+
+print shout("hi"), minus(4), minus(2.5)
+print bad(1)
+`
+	assertSameAtAllLevels(t, "fallback.py", source)
+	got := runAtLevel(t, "fallback.py", source, compiler.OptPeephole)
+	if !strings.HasPrefix(got, `output "hi! 2.5 1\n"`) ||
+		!strings.Contains(got, "TypeError: unsupported operand type(s) for -: 'int' and 'str'") {
+		t.Errorf("Unexpected run: %s", got)
+	}
+}
+
+func TestVerifyPackedOperands(t *testing.T) {
+	tests := []struct {
+		arg  int
+		want string
+	}{
+		{compiler.PackOperands(1, 0), "local variable index 1 out of range"},
+		{compiler.PackOperands(0, 1), "constant index 1 out of range"},
+		{-1, "packed operand -1 out of range"},
+	}
+	for _, tt := range tests {
+		code := &compiler.CodeObject{
+			Name:         "f",
+			Instructions: instrs(compiler.OpLoadFastLoadConst, tt.arg, compiler.OpReturnValue, 0),
+			Consts:       []object.Object{&runtime.PyNone{}},
+			Varnames:     []string{"x"},
+		}
+		err := compiler.Verify(code)
+		var verr *compiler.VerifyError
+		if !errors.As(err, &verr) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Expected %q, got %v", tt.want, err)
+		}
+	}
+	if _, err := compiler.Assemble(".code m\n.instructions\n  LOAD_FAST_LOAD_FAST 70000 1\n.end"); err == nil ||
+		!strings.Contains(err.Error(), `invalid operands "70000" "1"`) {
+		t.Errorf("Expected an operand error, got %v", err)
+	}
+}
+
+func benchmarkProgram(b *testing.B, source string, level int) {
+	code := compileFileSource(b, "bench.py", source)
+	if err := compiler.Optimize(code, level); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		machine := vm.NewVM()
+		machine.SetStdout(&bytes.Buffer{})
+		if _, err := machine.Run(code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFibonacciExample(b *testing.B) { benchmarkProgram(b, fibonacciBench, compiler.OptNone) }
+func BenchmarkFibonacciExampleO1(b *testing.B) {
+	benchmarkProgram(b, fibonacciBench, compiler.OptPeephole)
+}
+func BenchmarkLoopExample(b *testing.B)   { benchmarkProgram(b, loopBench, compiler.OptNone) }
+func BenchmarkLoopExampleO1(b *testing.B) { benchmarkProgram(b, loopBench, compiler.OptPeephole) }
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func TestRebindGlobalMidLoop(t *testing.T) {
+	out, err := runTraced(t, vm.NewVM(), `def get():
+    return x
+
+x = 1
+total = 0
+for i in range(6):
+    total = total + x + get()
+    if i == 2:
+        x = 10
+    if i == 3:
+        y = 0
+print total, x, y
+`)
+	if err != nil || out != "66 10 0\n" {
+		t.Errorf("Expected 66 10 0, got %q, %v", out, err)
+	}
+}
+
+func TestShadowBuiltinMidLoop(t *testing.T) {
+	out, err := runTraced(t, vm.NewVM(), `def mylen(s):
+    return 100
+
+def size(s):
+    return len(s)
+
+total = 0
+for i in range(4):
+    total = total + len("ab") + size("abc")
+    if i == 1:
+        len = mylen
+print total
+`)
+	// Two rounds of 2 + 3, then two rounds of 100 + 100.
+	if err != nil || out != "410\n" {
+		t.Errorf("Expected 410, got %q, %v", out, err)
+	}
+}
+
+// hookAt calls fn for each line event in the module frame once the global
+// i has the value n.
+func hookAt(machine *vm.VM, n int, fn func(frame *vm.Frame)) {
+	done := false
+	machine.AddHook(vm.HookFunc(func(event vm.Event, frame *vm.Frame, arg object.Object) error {
+		if i, ok := frame.Globals.Get("i"); ok && !done && event == vm.EventLine && i.Equal(&runtime.PyInt{Value: n}) {
+			done = true
+			fn(frame)
+		}
+		return nil
+	}))
+}
+
+const builtinLoop = `total = 0
+for i in range(4):
+    total = total + len("ab")
+print total
+`
+
+func TestRebindBuiltinMidLoop(t *testing.T) {
+	machine := vm.NewVM()
+	hookAt(machine, 2, func(frame *vm.Frame) {
+		frame.Builtins.Set("len", &compiler.PyBuiltin{Name: "len", Func: func(args []object.Object) (object.Object, error) {
+			return &runtime.PyInt{Value: 10}, nil
+		}})
+	})
+	out, err := runTraced(t, machine, builtinLoop)
+	if err != nil || out != "24\n" {
+		t.Errorf("Expected 24, got %q, %v", out, err)
+	}
+}
+
+func TestRemoveBuiltinMidLoop(t *testing.T) {
+	machine := vm.NewVM()
+	hookAt(machine, 2, func(frame *vm.Frame) {
+		frame.Builtins.Delete("len")
+	})
+	_, err := runTraced(t, machine, builtinLoop)
+	if err == nil || !strings.Contains(err.Error(), "name 'len' is not defined") {
+		t.Errorf("Expected a NameError, got %v", err)
+	}
+}
+
+func TestRemoveShadowingGlobalMidLoop(t *testing.T) {
+	machine := vm.NewVM()
+	hookAt(machine, 2, func(frame *vm.Frame) {
+		machine.GlobalNamespace().Delete("len")
+	})
+	out, err := runTraced(t, machine, "def zero(s):\n    return 0\nlen = zero\n"+builtinLoop)
+	if err != nil || out != "4\n" {
+		t.Errorf("Expected 4, got %q, %v", out, err)
+	}
+}
+
+func TestNamespaceVersions(t *testing.T) {
+	ns := runtime.NewNamespace()
+	other := runtime.NewNamespace()
+	if ns.Version() == other.Version() {
+		t.Errorf("Expected namespaces to have distinct versions")
+	}
+
+	ns.Set("a", &runtime.PyInt{Value: 1})
+	version := ns.Version()
+	slot, ok := ns.Lookup("a")
+	if !ok {
+		t.Fatal("Expected a to be bound")
+	}
+	ns.Set("a", &runtime.PyInt{Value: 2})
+	ns.SetSlot(slot, &runtime.PyInt{Value: 3})
+	if ns.Version() != version {
+		t.Errorf("Expected rebinding to keep the version")
+	}
+	if value, _ := ns.Get("a"); value.String() != "3" {
+		t.Errorf("Expected 3, got %v", value)
+	}
+
+	ns.Set("b", &runtime.PyInt{Value: 4})
+	if ns.Version() == version {
+		t.Errorf("Expected a new name to change the version")
+	}
+	version = ns.Version()
+	ns.Delete("a")
+	if _, ok := ns.Get("a"); ok || ns.Version() == version || ns.Len() != 1 {
+		t.Errorf("Expected a to be removed with a new version")
+	}
+	ns.Set("a", &runtime.PyInt{Value: 5})
+	var names []string
+	ns.Range(func(name string, _ object.Object) { names = append(names, name) })
+	if strings.Join(names, " ") != "b a" {
+		t.Errorf("Expected names in binding order, got %v", names)
+	}
+}
+
+func BenchmarkGlobalLoop(b *testing.B) {
+	source := "total = 0\nfor i in range(20000):\n    total = total + len(\"ab\")\n"
+	code := compileFileSource(b, "globals.py", source)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.NewVM().Run(code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
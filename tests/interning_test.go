@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const identitySource = `def nothing():
+    pass
+
+def count(n):
+    total = 0
+    for i in range(n):
+        total = total + 1
+    return total
+
+x = None
+a = 100
+b = 50 + 50
+big = 1000
+bigger = big + 0
+same = big
+items = []
+print x is None, x is not None, nothing() is None, None is not None
+print a is b, count(256) is 256, count(300) is 300, -5 is 0 - 5
+print big is bigger, big is same, big is not bigger
+print items is items, [] is [], items is not []
+print True is (1 == 1), False is not (1 < 0), not 1 is 1, 1 is True, "a" is None
+`
+
+func TestIsOperator(t *testing.T) {
+	assertSameAtAllLevels(t, "identity.py", identitySource)
+	out, err := runTraced(t, vm.NewVM(), identitySource)
+	want := "True False True False\n" +
+		"True True False True\n" +
+		"False True True\n" +
+		"True False True\n" +
+		"True False False False False\n"
+	if err != nil || out != want {
+		t.Errorf("Unexpected output %q, %v\nwant %q", out, err, want)
+	}
+}
+
+func TestParseIsNot(t *testing.T) {
+	module, err := parser.NewParser(lexer.NewLexer("x = a is not b is c\n").AllTokens()).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare := module.Body[0].(*ast.AssignStmt).Value.(*ast.Compare)
+	if !reflect.DeepEqual(compare.Ops, []string{"is not", "is"}) {
+		t.Errorf("Unexpected operators %v", compare.Ops)
+	}
+}
+
+func TestInternedObjects(t *testing.T) {
+	if runtime.NewInt(42) != runtime.NewInt(42) || runtime.NewInt(runtime.SmallIntMin) != runtime.NewInt(runtime.SmallIntMin) {
+		t.Errorf("Expected small ints to be shared")
+	}
+	if runtime.NewInt(runtime.SmallIntMax+1) == runtime.NewInt(runtime.SmallIntMax+1) {
+		t.Errorf("Expected large ints to be allocated")
+	}
+	if runtime.NewBool(true) != runtime.True || runtime.NewBool(false) != runtime.False {
+		t.Errorf("Expected NewBool to return the shared bools")
+	}
+	if runtime.ToPyObject(nil) != runtime.None || runtime.ToPyObject(7) != runtime.NewInt(7) {
+		t.Errorf("Expected ToPyObject to return shared objects")
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		runtime.NewInt(-5)
+		runtime.NewInt(256)
+		runtime.NewBool(true)
+	}); allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestIsWithSeparateInstances(t *testing.T) {
+	tests := []struct {
+		a, b object.Object
+		want bool
+	}{
+		{&runtime.PyNone{}, runtime.None, true},
+		{&runtime.PyBool{Value: true}, runtime.True, true},
+		{&runtime.PyBool{Value: true}, runtime.False, false},
+		{&runtime.PyInt{Value: 7}, runtime.NewInt(7), true},
+		{&runtime.PyInt{Value: 1000}, &runtime.PyInt{Value: 1000}, false},
+		{runtime.NewInt(1), runtime.True, false},
+		{&runtime.PyString{Value: "a"}, &runtime.PyString{Value: "a"}, false},
+	}
+	for _, tt := range tests {
+		if got := runtime.Is(tt.a, tt.b); got != tt.want {
+			t.Errorf("Is(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+	list := &runtime.PyList{}
+	if !runtime.Is(list, list) {
+		t.Errorf("Expected an object to be itself")
+	}
+}
+
+func benchmarkAllocations(b *testing.B, source string) {
+	code := compileFileSource(b, "allocs.py", source)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.NewVM().Run(code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSmallIntAllocs counts and compares small ints, which no longer
+// allocate.
+func BenchmarkSmallIntAllocs(b *testing.B) {
+	benchmarkAllocations(b, "def f():\n    n = 0\n    while n < 200:\n        n = n + 1\n    return n == 200\n\nfor i in range(100):\n    f()\n")
+}
+
+// BenchmarkNoneAllocs calls functions with many locals, which start as None.
+func BenchmarkNoneAllocs(b *testing.B) {
+	benchmarkAllocations(b, "def f(a):\n    b = a\n    c = b\n    d = c\n    e = d\n    return None\n\nfor i in range(5000):\n    f(i)\n")
+}
@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/lint"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func lintSource(linter *lint.Linter, source string) []string {
+	var got []string
+	for _, p := range linter.CheckSource("x.py", source) {
+		got = append(got, p.String())
+	}
+	return got
+}
+
+func TestLintRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"clean", "def f(a):\n    b = a + 1\n    return b\nprint f(len(\"ab\"))\n", nil},
+		{"undefined", "print x\ndef f():\n    return y\n", []string{
+			"x.py:1:7: undefined name x (undefined)",
+			"x.py:3:12: undefined name y (undefined)",
+		}},
+		{"globals from functions", "def f():\n    return g() + n\ndef g():\n    return 1\nn = 2\nprint f()\n", nil},
+		{"module before assignment", "print y\ny = 1\nif y:\n    z = 1\nprint z\nif y:\n    w = 1\nelse:\n    w = 2\nprint w\n", []string{
+			"x.py:1:7: y is used before it is assigned (used-before-assignment)",
+			"x.py:5:7: z may be used before it is assigned (used-before-assignment)",
+		}},
+		{"local before assignment", "def f(xs):\n    print later\n    later = 1\n    for x in xs:\n        total += x\n    if xs:\n        found = 1\n    return found + later\n", []string{
+			"x.py:2:11: later is used before it is assigned (used-before-assignment)",
+			"x.py:5:9: local variable total is used before it is assigned (used-before-assignment)",
+			"x.py:8:12: local variable found may be used before it is assigned (used-before-assignment)",
+		}},
+		{"loop variable after loop", "def f(xs):\n    for x in xs:\n        pass\n    return x\n", []string{
+			"x.py:4:12: local variable x may be used before it is assigned (used-before-assignment)",
+		}},
+		{"unused", "def f(a, b, _c):\n    import sys\n    x = 1\n    _y = 2\n    for i in range(3):\n        pass\n    return b\n", []string{
+			"x.py:1:7: argument a of f() is not used (unused-argument)",
+			"x.py:2:12: sys is imported but not used (unused-variable)",
+			"x.py:3:5: local variable x is assigned but never used (unused-variable)",
+		}},
+		{"unreachable", "def f(a):\n    if a:\n        return 1\n        print a\n    else:\n        return 2\n    print a\n    print a\nwhile True:\n    pass\nprint 1\n", []string{
+			"x.py:4:9: unreachable code (unreachable)",
+			"x.py:7:5: unreachable code (unreachable)",
+			"x.py:11:1: unreachable code (unreachable)",
+		}},
+		{"arity", "def f(a, b):\n    return a + b\ndef g(a):\n    return f(a)\nprint f(1, 2), g(1, 2), g()\nh = f\nh(1)\n", []string{
+			"x.py:4:12: f() takes 2 arguments but 1 was given (call-arity)",
+			"x.py:5:16: g() takes 1 argument but 2 were given (call-arity)",
+			"x.py:5:25: g() takes 1 argument but 0 were given (call-arity)",
+		}},
+		{"arity of rebound function", "def f(a):\n    return a\nf = len\nprint f(\"ab\", 1)\n", nil},
+		{"shadowed builtins", "len = 1\nlen = 2\ndef str(type):\n    open = type\n    return open\nprint len, str(1)\n", []string{
+			"x.py:1:1: len shadows the builtin len (shadowed-builtin)",
+			"x.py:3:5: str shadows the builtin str (shadowed-builtin)",
+			"x.py:3:9: type shadows the builtin type (shadowed-builtin)",
+			"x.py:4:5: open shadows the builtin open (shadowed-builtin)",
+		}},
+		{"unsupported", "x = 2\nprint 1 < x < 3\n", []string{
+			"x.py:2:7: chained comparison is evaluated as (a < b) < c, not as a < b and b < c (unsupported)",
+		}},
+		{"syntax error", "def f(:\n", []string{
+			"x.py:1:7: SyntaxError: expected RPAREN, got COLON (syntax)",
+		}},
+	}
+
+	linter := lint.NewLinter(vm.NewVM().BuiltinNames())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lintSource(linter, tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLintEnableDisable(t *testing.T) {
+	source := "def f(a):\n    return 1\n    print \"b\"\n"
+	linter := lint.NewLinter(nil)
+	linter.SetEnabled(lint.RuleUnusedArgument, false)
+	want := []string{"x.py:3:5: unreachable code (unreachable)"}
+	if got := lintSource(linter, source); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	linter.SetEnabled(lint.RuleUnusedArgument, true)
+	linter.SetEnabled(lint.RuleUnreachable, false)
+	want = []string{"x.py:1:7: argument a of f() is not used (unused-argument)"}
+	if got := lintSource(linter, source); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, rule := range lint.Rules {
+		linter.SetEnabled(rule, false)
+	}
+	if got := lintSource(linter, source+"def g(:\n"); len(got) != 1 || !strings.Contains(got[0], "(syntax)") {
+		t.Errorf("Expected only the syntax error, got %q", got)
+	}
+
+	if _, err := lint.ParseRule("unused-variable"); err != nil {
+		t.Errorf("ParseRule error: %v", err)
+	}
+	if _, err := lint.ParseRule("unused"); err == nil {
+		t.Error("Expected an error for an unknown rule")
+	}
+}
+
+func TestLintJSON(t *testing.T) {
+	problems := lint.NewLinter(nil).CheckSource("x.py", "print x\n")
+	data, err := json.Marshal(problems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"file":"x.py","line":1,"column":7,"rule":"undefined","message":"undefined name x"}]`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
+
+func TestLintExamples(t *testing.T) {
+	linter := lint.NewLinter(vm.NewVM().BuiltinNames())
+	files, _ := filepath.Glob("../examples/*.py")
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problems := linter.CheckSource(file, string(source)); len(problems) > 0 {
+			t.Errorf("%s: unexpected problems %v", file, problems)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/ast"
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/lsp"
+	"github.com/warriorguo/gopy/pkg/parser"
+)
+
+const lspSource = `import sys
+
+def area(width, height):
+    size = width * height
+    return size
+
+total = area(3, 4)
+print len(str(total))
+`
+
+const lspURI = "file:///work/shapes.py"
+
+// lspClient drives an lsp.Server over in-memory pipes.
+type lspClient struct {
+	t       *testing.T
+	w       io.WriteCloser
+	id      int
+	msgs    chan map[string]interface{}
+	pending []map[string]interface{}
+	done    chan error
+}
+
+func newLSPClient(t *testing.T) *lspClient {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	server := lsp.NewServer(serverR, serverW)
+
+	c := &lspClient{t: t, w: clientW, msgs: make(chan map[string]interface{}, 100), done: make(chan error, 1)}
+	go func() {
+		err := server.Serve()
+		serverW.Close()
+		c.done <- err
+	}()
+	go func() {
+		r := bufio.NewReader(clientR)
+		for {
+			data, err := lsp.ReadMessage(r)
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			var msg map[string]interface{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Errorf("invalid message from server: %v", err)
+				continue
+			}
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *lspClient) next() map[string]interface{} {
+	c.t.Helper()
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		return msg
+	}
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+func (c *lspClient) send(msg map[string]interface{}) {
+	c.t.Helper()
+	msg["jsonrpc"] = "2.0"
+	if err := lsp.WriteMessage(c.w, msg); err != nil {
+		c.t.Fatalf("write %v: %v", msg["method"], err)
+	}
+}
+
+// call sends a request and returns its response, keeping notifications
+// that arrive meanwhile for later.
+func (c *lspClient) call(method string, params interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.id++
+	c.send(map[string]interface{}{"id": c.id, "method": method, "params": params})
+
+	var skipped []map[string]interface{}
+	for {
+		msg := c.next()
+		if id, ok := msg["id"].(float64); ok && int(id) == c.id {
+			c.pending = append(skipped, c.pending...)
+			return msg
+		}
+		skipped = append(skipped, msg)
+	}
+}
+
+func (c *lspClient) result(method string, params interface{}) interface{} {
+	c.t.Helper()
+	resp := c.call(method, params)
+	if resp["error"] != nil {
+		c.t.Fatalf("%s failed: %v", method, resp["error"])
+	}
+	return resp["result"]
+}
+
+func (c *lspClient) notify(method string, params interface{}) {
+	c.t.Helper()
+	c.send(map[string]interface{}{"method": method, "params": params})
+}
+
+// diagnostics waits for the next diagnostics published for uri.
+func (c *lspClient) diagnostics(uri string) []interface{} {
+	c.t.Helper()
+	for {
+		msg := c.next()
+		if msg["method"] != "textDocument/publishDiagnostics" {
+			continue
+		}
+		params := msg["params"].(map[string]interface{})
+		if params["uri"] == uri {
+			return params["diagnostics"].([]interface{})
+		}
+	}
+}
+
+func (c *lspClient) open(uri, text string) []interface{} {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "python", "version": 1, "text": text},
+	})
+	return c.diagnostics(uri)
+}
+
+func at(line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": lspURI},
+		"position":     map[string]interface{}{"line": line, "character": character},
+	}
+}
+
+// rangeOf formats an LSP range as "line:char-line:char".
+func rangeOf(v interface{}) string {
+	r := v.(map[string]interface{})
+	pos := func(p interface{}) string {
+		m := p.(map[string]interface{})
+		return strings.Join([]string{itoa(m["line"]), itoa(m["character"])}, ":")
+	}
+	return pos(r["start"]) + "-" + pos(r["end"])
+}
+
+func itoa(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func locationRanges(result interface{}) []string {
+	var ranges []string
+	for _, loc := range result.([]interface{}) {
+		ranges = append(ranges, rangeOf(loc.(map[string]interface{})["range"]))
+	}
+	return ranges
+}
+
+func TestLSPSession(t *testing.T) {
+	c := newLSPClient(t)
+
+	init := c.result("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}})
+	caps := init.(map[string]interface{})["capabilities"].(map[string]interface{})
+	for _, name := range []string{"documentSymbolProvider", "definitionProvider", "referencesProvider", "hoverProvider"} {
+		if caps[name] != true {
+			t.Errorf("Expected %s, got %v", name, caps)
+		}
+	}
+	c.notify("initialized", map[string]interface{}{})
+
+	if diags := c.open(lspURI, lspSource); len(diags) != 0 {
+		t.Errorf("Expected no diagnostics, got %v", diags)
+	}
+
+	t.Run("DocumentSymbols", func(t *testing.T) {
+		symbols := c.result("textDocument/documentSymbol", map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": lspURI},
+		}).([]interface{})
+		var names []string
+		for _, s := range symbols {
+			names = append(names, s.(map[string]interface{})["name"].(string))
+		}
+		if strings.Join(names, ",") != "sys,area,total" {
+			t.Fatalf("Unexpected symbols %v", names)
+		}
+		area := symbols[1].(map[string]interface{})
+		if got := rangeOf(area["range"]); got != "2:0-4:15" {
+			t.Errorf("Expected area to span 2:0-4:15, got %s", got)
+		}
+		if got := rangeOf(area["selectionRange"]); got != "2:4-2:8" {
+			t.Errorf("Expected area name at 2:4-2:8, got %s", got)
+		}
+		var children []string
+		for _, s := range area["children"].([]interface{}) {
+			children = append(children, s.(map[string]interface{})["name"].(string))
+		}
+		if strings.Join(children, ",") != "width,height,size" {
+			t.Errorf("Unexpected children %v", children)
+		}
+	})
+
+	t.Run("Definition", func(t *testing.T) {
+		if got := locationRanges(c.result("textDocument/definition", at(6, 9))); len(got) != 1 || got[0] != "2:4-2:8" {
+			t.Errorf("Expected area defined at 2:4-2:8, got %v", got)
+		}
+		if got := locationRanges(c.result("textDocument/definition", at(4, 12))); len(got) != 1 || got[0] != "3:4-3:8" {
+			t.Errorf("Expected size defined at 3:4-3:8, got %v", got)
+		}
+		if got := locationRanges(c.result("textDocument/definition", at(3, 11))); len(got) != 1 || got[0] != "2:9-2:14" {
+			t.Errorf("Expected width defined at 2:9-2:14, got %v", got)
+		}
+		if got := c.result("textDocument/definition", at(7, 7)); got != nil {
+			t.Errorf("Expected no definition for a builtin, got %v", got)
+		}
+	})
+
+	t.Run("References", func(t *testing.T) {
+		params := at(3, 5)
+		params["context"] = map[string]interface{}{"includeDeclaration": true}
+		if got := locationRanges(c.result("textDocument/references", params)); strings.Join(got, " ") != "3:4-3:8 4:11-4:15" {
+			t.Errorf("Unexpected references to size %v", got)
+		}
+		params = at(7, 15)
+		params["context"] = map[string]interface{}{"includeDeclaration": false}
+		if got := locationRanges(c.result("textDocument/references", params)); strings.Join(got, " ") != "7:14-7:19" {
+			t.Errorf("Unexpected references to total %v", got)
+		}
+	})
+
+	t.Run("Hover", func(t *testing.T) {
+		for _, tt := range []struct {
+			line, char int
+			want       string
+		}{
+			{6, 10, "def area(width, height)"},
+			{7, 7, "(builtin) len"},
+			{0, 8, "(module) sys"},
+			{3, 14, "(parameter) width of area()"},
+		} {
+			hover := c.result("textDocument/hover", at(tt.line, tt.char)).(map[string]interface{})
+			value := hover["contents"].(map[string]interface{})["value"].(string)
+			if !strings.Contains(value, tt.want) {
+				t.Errorf("Hover at %d:%d: expected %q, got %q", tt.line, tt.char, tt.want, value)
+			}
+		}
+		if got := c.result("textDocument/hover", at(1, 0)); got != nil {
+			t.Errorf("Expected no hover on a blank line, got %v", got)
+		}
+	})
+
+	t.Run("Completion", func(t *testing.T) {
+		labels := func(line, char int) map[string]bool {
+			list := c.result("textDocument/completion", at(line, char)).(map[string]interface{})
+			found := make(map[string]bool)
+			for _, item := range list["items"].([]interface{}) {
+				found[item.(map[string]interface{})["label"].(string)] = true
+			}
+			return found
+		}
+		inside := labels(4, 4)
+		for _, name := range []string{"size", "width", "area", "total", "len", "str", "def"} {
+			if !inside[name] {
+				t.Errorf("Expected %q to be offered inside area", name)
+			}
+		}
+		if outside := labels(7, 0); outside["size"] {
+			t.Errorf("Did not expect the local size to be offered at module level")
+		}
+	})
+
+	t.Run("Diagnostics", func(t *testing.T) {
+		c.notify("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": lspURI, "version": 2},
+			"contentChanges": []map[string]interface{}{{"text": "x = (1 +\ny = 2\n  z = 3\n"}},
+		})
+		diags := c.diagnostics(lspURI)
+		if len(diags) < 2 {
+			t.Fatalf("Expected several diagnostics, got %v", diags)
+		}
+		first := diags[0].(map[string]interface{})
+		if !strings.HasPrefix(first["message"].(string), "SyntaxError") || first["severity"] != float64(1) {
+			t.Errorf("Unexpected diagnostic %v", first)
+		}
+		last := diags[len(diags)-1].(map[string]interface{})
+		if !strings.HasPrefix(last["message"].(string), "IndentationError") {
+			t.Errorf("Expected an indentation error last, got %v", last)
+		}
+		if got := rangeOf(last["range"]); !strings.HasPrefix(got, "2:") {
+			t.Errorf("Expected the indentation error on line 2, got %s", got)
+		}
+
+		c.notify("textDocument/didClose", map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": lspURI},
+		})
+		if diags := c.diagnostics(lspURI); len(diags) != 0 {
+			t.Errorf("Expected diagnostics to be cleared on close, got %v", diags)
+		}
+	})
+
+	if resp := c.call("textDocument/hover", at(0, 0)); resp["error"] == nil {
+		t.Errorf("Expected hover on a closed document to fail: %v", resp)
+	}
+	if resp := c.call("workspace/frobnicate", nil); resp["error"] == nil {
+		t.Errorf("Expected an unknown method to fail: %v", resp)
+	}
+
+	c.result("shutdown", nil)
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestLSPRequiresInitialize(t *testing.T) {
+	c := newLSPClient(t)
+	resp := c.call("textDocument/hover", at(0, 0))
+	rerr, _ := resp["error"].(map[string]interface{})
+	if rerr == nil || rerr["code"] != float64(-32002) {
+		t.Errorf("Expected a not-initialized error, got %v", resp)
+	}
+	c.notify("exit", nil)
+	if err := <-c.done; err == nil {
+		t.Errorf("Expected exit without shutdown to be an error")
+	}
+}
+
+func TestASTEndPositions(t *testing.T) {
+	source := "def f(a, b):\n    return a + b * 2\n\nx = f(1, [2, 3])\nprint x.real\n"
+	module, err := parser.ParseFile("t.py", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(source, "\n")
+	text := func(n ast.Node) string {
+		start, end := n.Pos(), n.End()
+		if start.Line != end.Line {
+			return ""
+		}
+		return lines[start.Line-1][start.Column-1 : end.Column-1]
+	}
+
+	var got []string
+	ast.Inspect(module, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.BinaryOp, *ast.Call, *ast.List, *ast.Attribute, *ast.ReturnStmt, *ast.AssignStmt, *ast.PrintStmt:
+			got = append(got, text(n))
+		}
+		return true
+	})
+	want := []string{
+		"return a + b * 2", "a + b * 2", "b * 2",
+		"x = f(1, [2, 3])", "f(1, [2, 3])", "[2, 3]",
+		"print x.real", "x.real",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Unexpected node text\n got: %q\nwant: %q", got, want)
+	}
+
+	fn := module.Body[0].(*ast.FuncDef)
+	if fn.End() != (ast.Position{Line: 2, Column: 21}) {
+		t.Errorf("Expected def to end at 2:21, got %v", fn.End())
+	}
+	if fn.NamePosition != (ast.Position{Line: 1, Column: 5}) || len(fn.ArgPositions) != 2 || fn.ArgPositions[1].Column != 10 {
+		t.Errorf("Unexpected name/arg positions %v %v", fn.NamePosition, fn.ArgPositions)
+	}
+}
+
+func TestCompileErrorPosition(t *testing.T) {
+	stmt := &ast.AugAssignStmt{
+		Target:      &ast.Name{Id: "x", Position: ast.Position{Line: 3, Column: 1}, EndPosition: ast.Position{Line: 3, Column: 2}},
+		Op:          "**=",
+		Value:       &ast.Num{N: 2, Position: ast.Position{Line: 3, Column: 7}, EndPosition: ast.Position{Line: 3, Column: 8}},
+		Position:    ast.Position{Line: 3, Column: 1},
+		EndPosition: ast.Position{Line: 3, Column: 8},
+	}
+	_, err := compiler.CompileFile(&ast.Module{Body: []ast.Stmt{stmt}}, "t.py")
+	var compileErr *compiler.Error
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("Expected a *compiler.Error, got %v", err)
+	}
+	if compileErr.Pos.Line != 3 || compileErr.End.Column != 8 || !strings.HasPrefix(err.Error(), "t.py:3:1: ") {
+		t.Errorf("Unexpected compile error %v (%+v)", err, compileErr)
+	}
+}
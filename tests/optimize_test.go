@@ -0,0 +1,278 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// runAtLevel compiles source, optimizes it at level and describes what
+// running it does.
+func runAtLevel(t *testing.T, filename, source string, level int) string {
+	t.Helper()
+	code := compileFileSource(t, filename, source)
+	if err := compiler.Optimize(code, level); err != nil {
+		t.Fatalf("%s: Optimize(%d) error: %v", filename, level, err)
+	}
+	var out bytes.Buffer
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	machine.SetStdin(strings.NewReader(""))
+	result, err := machine.Run(code)
+	return fmt.Sprintf("output %q, result %v, error %v", out.String(), result, err)
+}
+
+func assertSameAtAllLevels(t *testing.T, filename, source string) {
+	t.Helper()
+	want := runAtLevel(t, filename, source, compiler.OptNone)
+	for level := compiler.OptPeephole; level <= compiler.MaxOptLevel; level++ {
+		if got := runAtLevel(t, filename, source, level); got != want {
+			t.Errorf("%s at level %d:\n got %s\nwant %s", filename, level, got, want)
+		}
+	}
+}
+
+func TestOptimizedExamplesBehaveTheSame(t *testing.T) {
+	files, err := filepath.Glob("../examples/*.py")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No examples found: %v", err)
+	}
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameAtAllLevels(t, file, string(source))
+	}
+}
+
+const optimizeSource = `def sign(n):
+    if not n > 0:
+        if n == 0:
+            return 0
+        return -1
+    return 1
+    print "unreachable"
+
+def spin(limit):
+    count = 0
+    while 1:
+        count += 1
+        if count == limit:
+            return count
+
+def pick(a, b):
+    if not a == b and True:
+        return a or b
+    elif False:
+        return "never"
+    else:
+        return not a
+
+total = 0
+for i in [1, 2, 3]:
+    total = total + i * (2 * 3 - 4)
+if True:
+    print "yes"
+else:
+    print "no"
+print sign(-5), sign(0), sign(7), spin(4), pick(1, 2), pick(3, 3), pick(0, 0)
+print total, 7 / 2, -7 % 3, 1.5 * 2, "ab" + "cd", "a" < "b", 2 > 3.5, not ""
+print 1 / 0
+`
+
+func TestOptimizedCodeBehavesTheSame(t *testing.T) {
+	assertSameAtAllLevels(t, "optimize.py", optimizeSource)
+	got := runAtLevel(t, "optimize.py", optimizeSource, compiler.OptFull)
+	want := `output "yes\n-1 0 1 4 1 False True\n12 3 -1 3 abcd True False True\n"`
+	if !strings.HasPrefix(got, want) || !strings.Contains(got, "ZeroDivisionError") {
+		t.Errorf("Unexpected run: %s", got)
+	}
+}
+
+func opcodes(code *compiler.CodeObject) []string {
+	var ops []string
+	for _, instr := range code.Instructions {
+		ops = append(ops, instr.Op.String())
+	}
+	return ops
+}
+
+func TestOptimizeRewrites(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		level  int
+		want   string
+	}{
+		{"folding", "x = 2 * 3 + -1\n", compiler.OptPeephole,
+			"LOAD_CONST 5; STORE_NAME; LOAD_CONST None; RETURN_VALUE"},
+		{"string folding", "x = \"a\" + \"b\" == \"ab\"\n", compiler.OptPeephole,
+			"LOAD_CONST True; STORE_NAME; LOAD_CONST None; RETURN_VALUE"},
+		{"division by zero is kept", "x = 1 / 0\n", compiler.OptFull,
+			"LOAD_CONST 1; LOAD_CONST 0; BINARY_DIV; STORE_NAME; LOAD_CONST None; RETURN_VALUE"},
+		{"not fusion", "if not x:\n    y = 1\n", compiler.OptPeephole,
+			"LOAD_NAME; POP_JUMP_IF_TRUE; LOAD_CONST 1; STORE_NAME; LOAD_CONST None; RETURN_VALUE"},
+		{"not equal", "y = not x == 1\n", compiler.OptPeephole,
+			"LOAD_NAME; LOAD_CONST 1; COMPARE_NE; STORE_NAME; LOAD_CONST None; RETURN_VALUE"},
+		{"constant condition kept", "if True:\n    y = 1\n", compiler.OptPeephole,
+			"LOAD_CONST True; POP_JUMP_IF_FALSE; LOAD_CONST 1; STORE_NAME; LOAD_CONST None; RETURN_VALUE"},
+		{"if true", "if True:\n    y = 1\nelse:\n    y = 2\n", compiler.OptFull,
+			"LOAD_CONST 1; STORE_NAME; LOAD_CONST None; RETURN_VALUE"},
+		{"if false", "if 0:\n    y = 1\n", compiler.OptFull,
+			"LOAD_CONST None; RETURN_VALUE"},
+		{"while 1", "while 1:\n    y = 1\n", compiler.OptFull,
+			"LOAD_CONST 1; STORE_NAME; JUMP_ABSOLUTE"},
+	}
+	for _, tt := range tests {
+		code := compileFileSource(t, "rewrite.py", tt.source)
+		if err := compiler.Optimize(code, tt.level); err != nil {
+			t.Fatalf("%s: Optimize error: %v", tt.name, err)
+		}
+		var got []string
+		for _, instr := range code.Instructions {
+			text := instr.Op.String()
+			if instr.Op == compiler.OpLoadConst {
+				text += " " + code.Consts[instr.Arg].String()
+			}
+			got = append(got, text)
+		}
+		if strings.Join(got, "; ") != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, strings.Join(got, "; "), tt.want)
+		}
+	}
+}
+
+func TestOptimizeThreadsJumpsToFinalTarget(t *testing.T) {
+	code := compileFileSource(t, "thread.py", "if x:\n    if y:\n        z = 1\n    else:\n        z = 2\nelse:\n    z = 3\n")
+	if err := compiler.Optimize(code, compiler.OptPeephole); err != nil {
+		t.Fatal(err)
+	}
+	// Both JUMP_FORWARDs go straight to the end instead of to each other.
+	end := len(code.Instructions) - 2
+	for i, instr := range code.Instructions {
+		if instr.Op == compiler.OpJumpForward && i+1+instr.Arg != end {
+			t.Errorf("JUMP_FORWARD at %d goes to %d, want %d\n%s", i, i+1+instr.Arg, end, code.Disassemble())
+		}
+	}
+}
+
+func TestOptimizeRemovesDeadCodeAndConstants(t *testing.T) {
+	code := compileFileSource(t, "dead.py", "def f():\n    return 1\n    print \"gone\"\n")
+	if err := compiler.Optimize(code, compiler.OptFull); err != nil {
+		t.Fatal(err)
+	}
+	f := code.Consts[0].(*compiler.PyFunction).Code
+	if got := opcodes(f); !reflect.DeepEqual(got, []string{"LOAD_CONST", "RETURN_VALUE"}) {
+		t.Errorf("Unexpected code for f: %v", got)
+	}
+	if len(f.Consts) != 1 || f.Consts[0].String() != "1" {
+		t.Errorf("Expected unused constants to be dropped, got %v", f.Consts)
+	}
+	if !reflect.DeepEqual(f.LineTable, []compiler.LineEntry{{Offset: 0, Line: 2}}) {
+		t.Errorf("Unexpected line table %v", f.LineTable)
+	}
+}
+
+// unusedConstants returns the constants of code and the functions it
+// defines that neither its stack code nor its register code refers to.
+func unusedConstants(code *compiler.CodeObject) []string {
+	used := make([]bool, len(code.Consts))
+	for _, instr := range code.Instructions {
+		switch instr.Op {
+		case compiler.OpLoadConst:
+			used[instr.Arg] = true
+		case compiler.OpLoadFastLoadConst, compiler.OpBinaryAddFastConst, compiler.OpBinarySubFastConst:
+			_, c := compiler.UnpackOperands(instr.Arg)
+			used[c] = true
+		}
+	}
+	if code.Registers != nil {
+		for _, instr := range code.Registers.Instructions {
+			for i, kind := range instr.Op.Operands() {
+				if k, ok := compiler.IsConstOperand(instr.Operand(i)); ok && kind == 'k' {
+					used[k] = true
+				} else if kind == 'c' {
+					used[instr.Operand(i)] = true
+				}
+			}
+		}
+	}
+	var unused []string
+	for i, c := range code.Consts {
+		if !used[i] {
+			unused = append(unused, fmt.Sprintf("%s: %s", code.Name, c))
+		}
+		if fn, ok := c.(*compiler.PyFunction); ok {
+			unused = append(unused, unusedConstants(fn.Code)...)
+		}
+	}
+	return unused
+}
+
+func TestOptimizeKeepsOnlyUsedConstants(t *testing.T) {
+	sources := map[string]string{"optimize.py": optimizeSource}
+	files, _ := filepath.Glob("../examples/*.py")
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[file] = string(source)
+	}
+	for name, source := range sources {
+		for _, backend := range []compiler.Backend{compiler.BackendStack, compiler.BackendRegister} {
+			code := compileWithBackend(t, name, source, backend)
+			if err := compiler.Optimize(code, compiler.MaxOptLevel); err != nil {
+				t.Fatalf("%s: Optimize error: %v", name, err)
+			}
+			if unused := unusedConstants(code); len(unused) > 0 {
+				t.Errorf("%s with the %s backend has unused constants %v\n%s", name, backend, unused, code.Disassemble())
+			}
+		}
+	}
+
+	// The operands of folded operations are dropped with either backend.
+	source := "x = 2 * 3 + 4\ndef f(a):\n    return a + (10 - 3) * -2\nprint x, f(1), not 1 < 2\n"
+	for _, backend := range []compiler.Backend{compiler.BackendStack, compiler.BackendRegister} {
+		code := compileWithBackend(t, "fold.py", source, backend)
+		if err := compiler.Optimize(code, compiler.OptPeephole); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range code.Consts {
+			if fn, ok := c.(*compiler.PyFunction); ok {
+				for _, c := range fn.Code.Consts {
+					got = append(got, c.String())
+				}
+			} else {
+				got = append(got, c.String())
+			}
+		}
+		sort.Strings(got)
+		if want := []string{" ", "-14", "1", "10", "False", "None", "None"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s backend: got constants %q, want %q\n%s", backend, got, want, code.Disassemble())
+		}
+	}
+}
+
+func TestOptimizeLevels(t *testing.T) {
+	code := compileFileSource(t, "levels.py", "x = 1 + 2\n")
+	before := opcodes(code)
+	if err := compiler.Optimize(code, compiler.OptNone); err != nil || !reflect.DeepEqual(opcodes(code), before) {
+		t.Errorf("Level 0 changed the code or failed: %v", err)
+	}
+	for _, level := range []int{-1, compiler.MaxOptLevel + 1} {
+		if err := compiler.Optimize(code, level); err == nil || !strings.Contains(err.Error(), "invalid optimization level") {
+			t.Errorf("Expected level %d to be rejected, got %v", level, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/profiler"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const profilerSource = `def fib(n):
+    if n < 2:
+        return n
+    return fib(n - 1) + fib(n - 2)
+
+def main():
+    total = 0
+    for i in range(10):
+        total = total + fib(i)
+    print total
+
+main()
+`
+
+func runProfiled(t *testing.T) *profiler.Profiler {
+	t.Helper()
+	code := compileFileSource(t, "fib.py", profilerSource)
+	machine := vm.NewVM()
+	var out bytes.Buffer
+	machine.SetStdout(&out)
+
+	p := profiler.Start(machine)
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	p.Stop()
+	if out.String() != "88\n" {
+		t.Fatalf("Expected 88, got %q", out.String())
+	}
+	return p
+}
+
+func TestProfilerFunctions(t *testing.T) {
+	p := runProfiled(t)
+	total, elapsed := p.Total()
+	if total == 0 || elapsed <= 0 {
+		t.Fatalf("Expected instructions and time to be recorded, got %d in %v", total, elapsed)
+	}
+
+	stats := make(map[string]profiler.FunctionStat)
+	for _, f := range p.Functions() {
+		stats[f.Name] = f
+	}
+	if fib := stats["fib"]; fib.Calls != 276 || fib.Line != 1 || fib.Instructions != fib.CumInstructions {
+		t.Errorf("Unexpected fib stats %+v", fib)
+	}
+	if main := stats["main"]; main.Calls != 1 || main.CumInstructions != main.Instructions+stats["fib"].Instructions {
+		t.Errorf("Unexpected main stats %+v", main)
+	}
+	if module := stats["<module>"]; module.CumInstructions != total {
+		t.Errorf("Expected <module> to account for all %d instructions, got %+v", total, module)
+	}
+
+	var sum int64
+	for _, l := range p.Lines() {
+		sum += l.Instructions
+		if l.Function == "fib" && l.Line == 3 && l.Instructions != 2*143 {
+			t.Errorf("Expected return n to run %d instructions, got %d", 2*143, l.Instructions)
+		}
+	}
+	if sum != total {
+		t.Errorf("Line totals %d do not add up to %d", sum, total)
+	}
+
+	sum = 0
+	counts := make(map[compiler.OpCode]int64)
+	for _, o := range p.Opcodes() {
+		sum += o.Count
+		counts[o.Op] = o.Count
+	}
+	if sum != total || counts[compiler.OpPopJumpIfFalse] != 276 {
+		t.Errorf("Unexpected opcode counts %v", counts)
+	}
+}
+
+func TestProfilerTextReport(t *testing.T) {
+	p := runProfiled(t)
+	var out strings.Builder
+	if err := p.WriteText(&out, 3); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	for _, want := range []string{"Total: ", "Functions:", "fib (fib.py:1)", "Lines:", "fib.py:4 fib", "Opcodes:", "LOAD_FAST"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected %q in report:\n%s", want, report)
+		}
+	}
+	if lines := strings.Count(report, "\n"); lines != 1+3*(3+3) {
+		t.Errorf("Expected 3 rows per section, got:\n%s", report)
+	}
+}
+
+func TestProfilerPprof(t *testing.T) {
+	p := runProfiled(t)
+	var buf bytes.Buffer
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Expected gzip data: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"instructions", "nanoseconds", "fib", "main", "fib.py"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("Expected %q in the string table", want)
+		}
+	}
+}
+
+func TestProfilerDetaches(t *testing.T) {
+	code := compileFileSource(t, "fib.py", profilerSource)
+	machine := vm.NewVM()
+	machine.SetStdout(&bytes.Buffer{})
+	p := profiler.Start(machine)
+	p.Stop()
+	if _, err := machine.Run(code); err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := p.Total(); total != 0 {
+		t.Errorf("Expected a stopped profiler to record nothing, got %d instructions", total)
+	}
+}
+
+func benchmarkFib(b *testing.B, profile bool) {
+	source := "def fib(n):\n    if n < 2:\n        return n\n    return fib(n - 1) + fib(n - 2)\n\nfib(15)\n"
+	code := compileFileSource(b, "fib.py", source)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		machine := vm.NewVM()
+		var p *profiler.Profiler
+		if profile {
+			p = profiler.Start(machine)
+		}
+		if _, err := machine.Run(code); err != nil {
+			b.Fatal(err)
+		}
+		if p != nil {
+			p.Stop()
+		}
+	}
+}
+
+func BenchmarkFibNoProfiler(b *testing.B) { benchmarkFib(b, false) }
+func BenchmarkFibProfiler(b *testing.B)   { benchmarkFib(b, true) }
+
+// The module code of fib.py must not be merged with its function fib.
+func TestProfilerPprofModuleName(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go tool pprof")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	p := runProfiled(t)
+	path := filepath.Join(t.TempDir(), "fib.pb.gz")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WritePprof(out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	top, err := exec.Command(goTool, "tool", "pprof", "-top", "-sample_index=instructions", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool pprof failed: %v\n%s", err, top)
+	}
+	names := map[string]bool{}
+	for _, line := range strings.Split(string(top), "\n") {
+		if fields := strings.Fields(line); len(fields) == 6 {
+			names[fields[5]] = true
+		}
+	}
+	for _, want := range []string{"fib", "main", "fib.py:module"} {
+		if !names[want] {
+			t.Errorf("Expected a %s row in\n%s", want, top)
+		}
+	}
+}
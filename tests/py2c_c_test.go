@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/transpiler"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const cValuesSource = `a = 0.1
+b = 0.2
+print a + b, 1.0 / 3, 2.5 * 4, 1000000.0 * 1.0, 123456.0 + 0.5, 0.00001, -0.0 * 1
+print 7 / 2, -7 / 2, 7 % 3, -7 % 3, 7 / 2.0, 3 - 5.5, 9223372036854775807 + 1, -(-4)
+print 1 == 1.0, 1 < 1.5, "a" < "b", "ab" < "a", [1, 2] == [1, 2], {"a": 1} == {"a": 1}
+x = [1, "two", 3.0, None, True, [4, {"k": "v"}]]
+print x, len(x), type(x), type(len), str(x), len, x is x
+d = {1: "one", "1": "uno", 2.5: "x"}
+print d, d[1], "2.5" in d, 3 in d
+s = "h\xc3\xa9llo"
+for c in s:
+    print c
+print s[1], len(s), "ll" in s, "" in s
+def f(a, b):
+    return a * b
+print f, f(3, 4), f is f
+name = raw_input("name? ")
+print "hi", name, raw_input()
+`
+
+// cGarbageSource allocates far more than the collector lets the heap grow
+// while it keeps some values alive.
+const cGarbageSource = `def build(n):
+    out = []
+    for i in range(n):
+        out = [i, str(i) + "x", {"k": i}]
+    return out
+keep = {"a": [1, 2, 3]}
+total = 0
+i = 0
+while i < 300:
+    r = build(100)
+    total = total + r[0] + len(r[1])
+    i = i + 1
+print total, keep
+`
+
+type cRun struct {
+	stdout, stderr string
+	exit           int
+}
+
+func runOnVM(t *testing.T, name, source, input string) cRun {
+	code := compileWithBackend(t, name, source, compiler.BackendRegister)
+	var out bytes.Buffer
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	machine.SetStdin(strings.NewReader(input))
+	machine.SetSource(name, source)
+	if _, err := machine.Run(code); err != nil {
+		return cRun{out.String(), err.Error() + "\n", 1}
+	}
+	return cRun{out.String(), "", 0}
+}
+
+func TestCTargetMatchesVM(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds C programs")
+	}
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	// identity.py is left out: ints and floats are values in C, so is
+	// compares them by value.
+	sources := map[string]string{
+		"optimize.py": optimizeSource,
+		"fib.py":      fibonacciBench,
+		"loops.py":    loopBench,
+		"pyc.py":      pycSource,
+		"errors.py":   backendErrors,
+		"values.py":   cValuesSource,
+		"garbage.py":  cGarbageSource,
+		"deep.py":     "def f(n):\n    return f(n + 1)\nf(0)\n",
+		"args.py":     "def f(a):\n    return a\nprint f(1)\nf(1, 2)\n",
+		"key.py":      "d = {\"a\": 1}\nprint d[\"b\"]\n",
+		"eof.py":      "x = raw_input()\n",
+	}
+	files, _ := filepath.Glob("../examples/*.py")
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[filepath.Base(file)] = string(source)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, transpiler.CRuntimeHeader), []byte(transpiler.CRuntime), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, source := range sources {
+		name, source := name, source
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			input := "bob\r\nsecond"
+			if name == "eof.py" {
+				input = ""
+			}
+			want := runOnVM(t, name, source, input)
+
+			code := compileWithBackend(t, name, source, compiler.BackendRegister)
+			program, err := transpiler.GenerateC(code, transpiler.COptions{Source: source})
+			if err != nil {
+				t.Fatalf("GenerateC error: %v", err)
+			}
+			base := filepath.Join(dir, strings.TrimSuffix(name, ".py"))
+			if err := os.WriteFile(base+".c", program, 0644); err != nil {
+				t.Fatal(err)
+			}
+			// A small heap makes the collector run often.
+			build := exec.Command(cc, "-std=c99", "-pedantic", "-Wall", "-Wextra", "-Werror", "-DGP_MIN_HEAP=4096",
+				"-o", base, base+".c")
+			if out, err := build.CombinedOutput(); err != nil {
+				t.Fatalf("cc failed: %v\n%s", err, out)
+			}
+
+			var stdout, stderr bytes.Buffer
+			run := exec.Command(base)
+			run.Stdin = strings.NewReader(input)
+			run.Stdout = &stdout
+			run.Stderr = &stderr
+			got := cRun{exit: 0}
+			if err := run.Run(); err != nil {
+				var exit *exec.ExitError
+				if !errors.As(err, &exit) {
+					t.Fatal(err)
+				}
+				got.exit = exit.ExitCode()
+			}
+			got.stdout, got.stderr = stdout.String(), stderr.String()
+			if got != want {
+				t.Errorf("got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCTargetRejectsUnsupported(t *testing.T) {
+	tests := map[string]string{
+		"import sys\n":               "x.py:1: import is not supported by the C target",
+		"x = 1\nprint x.real\n":      "x.py:2: attribute access is not supported by the C target",
+		"print >> 1, 2\n":            "x.py:1: print >> is not supported by the C target",
+		"f = open(\"data\")\n":       "x.py:1: builtin open is not supported by the C target",
+		"def f():\n    import sys\n": "x.py:2: import is not supported by the C target",
+	}
+	for source, want := range tests {
+		code := compileWithBackend(t, "x.py", source, compiler.BackendRegister)
+		if _, err := transpiler.GenerateC(code, transpiler.COptions{}); err == nil || err.Error() != want {
+			t.Errorf("%q: got error %v, want %s", source, err, want)
+		}
+	}
+
+	code := compileWithBackend(t, "x.py", "open = len\nprint open(\"ab\")\n", compiler.BackendRegister)
+	if _, err := transpiler.GenerateC(code, transpiler.COptions{}); err != nil {
+		t.Errorf("Expected a global called open to be allowed, got %v", err)
+	}
+	stack := compileWithBackend(t, "x.py", "print 1\n", compiler.BackendStack)
+	if _, err := transpiler.GenerateC(stack, transpiler.COptions{}); err == nil {
+		t.Error("Expected an error without register code")
+	}
+}
@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/transpiler"
+)
+
+const featuresSource = `import sys
+
+def table(keys):
+    for k in keys:
+        print k, len(k)
+    return {"a": len(keys), "bb": keys[1] + "!"}
+
+t = table(["a", "bb"])
+print >> sys.stdout, t["bb"], "a" in t, -t["a"], not t
+x = [1, t["a"] * 3.5]
+print x, x is x, None is not None, {"k": x}, x[2]
+`
+
+// py2goMain runs each generated package in a fresh VM twice, once as the
+// VM runs its bytecode and once through its Run function, and prints what
+// both runs did.
+const py2goMain = `package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/vm"
+%s)
+
+type program struct {
+	code  *compiler.CodeObject
+	run   func(*vm.VM) (object.Object, error)
+	limit bool
+	trace bool
+}
+
+func describe(p program, native bool) string {
+	var out bytes.Buffer
+	var events []string
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	machine.SetStdin(strings.NewReader(""))
+	if p.limit {
+		machine.SetTimeout(50 * time.Millisecond)
+	}
+	if p.trace {
+		machine.AddHook(vm.HookFunc(func(event vm.Event, frame *vm.Frame, arg object.Object) error {
+			events = append(events, fmt.Sprintf("%%s %%s:%%d", event, frame.Code.Name, frame.Line()))
+			return nil
+		}))
+	}
+	var result object.Object
+	var err error
+	if native {
+		result, err = p.run(machine)
+	} else {
+		result, err = machine.Run(p.code)
+	}
+	if p.limit {
+		var timeout *vm.TimeoutError
+		return fmt.Sprintf("output %%q, timed out %%t", out.String(), errors.As(err, &timeout))
+	}
+	return fmt.Sprintf("output %%q, result %%v, error %%v\nevents %%s", out.String(), result, err, strings.Join(events, ", "))
+}
+
+func main() {
+	programs := []program{
+%s	}
+	var results [][2]string
+	for _, p := range programs {
+		results = append(results, [2]string{describe(p, false), describe(p, true)})
+	}
+	json.NewEncoder(os.Stdout).Encode(results)
+}
+`
+
+type py2goCase struct {
+	name   string
+	code   *compiler.CodeObject
+	limit  bool
+	trace  bool
+	result *transpiler.Result
+	run    [2]string // the runs of the bytecode and of the package
+}
+
+func TestPy2GoMatchesVM(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds generated packages")
+	}
+	sources := map[string]string{
+		"optimize.py": optimizeSource,
+		"identity.py": identitySource,
+		"fib.py":      fibonacciBench,
+		"loops.py":    loopBench,
+		"pyc.py":      pycSource,
+		"errors.py":   backendErrors,
+		"features.py": featuresSource,
+		"dead.py":     "def f():\n    return g()\n    x = 1\ndef g():\n    return x\nx = 5\nprint f()\n",
+		"deep.py":     "def f(n):\n    return f(n + 1)\nf(0)\n",
+	}
+	files, _ := filepath.Glob("../examples/*.py")
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[file] = string(source)
+	}
+
+	var cases []*py2goCase
+	for name, source := range sources {
+		cases = append(cases, &py2goCase{name: name, code: compileWithBackend(t, name, source, compiler.BackendRegister)})
+	}
+	traced := &py2goCase{name: "traced fib.py", code: compileWithBackend(t, "fib.py", fibonacciBench, compiler.BackendRegister), trace: true}
+	limited := &py2goCase{name: "loop.py", code: compileWithBackend(t, "loop.py", "x = 0\nwhile True:\n    x = x + 1\n", compiler.BackendRegister), limit: true}
+	optimized := &py2goCase{name: "optimized loops.py", code: compileWithBackend(t, "loops.py", loopBench, compiler.BackendRegister)}
+	if err := compiler.Optimize(optimized.code, compiler.MaxOptLevel); err != nil {
+		t.Fatal(err)
+	}
+	// fibonacci has no register code, so it runs from the bytecode.
+	mixed := &py2goCase{name: "mixed fib.py", code: compileWithBackend(t, "fib.py", fibonacciBench, compiler.BackendRegister)}
+	mixed.code.Consts[0].(*compiler.PyFunction).Code.Registers = nil
+	stack := &py2goCase{name: "stack fib.py", code: compileWithBackend(t, "fib.py", fibonacciBench, compiler.BackendStack)}
+	cases = append(cases, traced, limited, optimized, mixed, stack)
+
+	dir, err := os.MkdirTemp(".", "py2go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var imports, programs strings.Builder
+	for i, c := range cases {
+		pkg := fmt.Sprintf("p%d", i)
+		c.result, err = transpiler.Generate(c.code, transpiler.Options{Package: pkg})
+		if err != nil {
+			t.Fatalf("%s: Generate error: %v", c.name, err)
+		}
+		if err := os.Mkdir(filepath.Join(dir, pkg), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, pkg, pkg+".go"), c.result.Source, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&imports, "\t%q\n", "github.com/warriorguo/gopy/tests/"+filepath.Base(dir)+"/"+pkg)
+		fmt.Fprintf(&programs, "\t\t{%s.Code, %s.Run, %t, %t},\n", pkg, pkg, c.limit, c.trace)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "main"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mainSource := fmt.Sprintf(py2goMain, imports.String(), programs.String())
+	if err := os.WriteFile(filepath.Join(dir, "main", "main.go"), []byte(mainSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := exec.Command("go", "vet", "./"+dir+"/...").CombinedOutput(); err != nil {
+		t.Fatalf("go vet failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command("go", "run", "./"+filepath.Join(dir, "main")).Output()
+	if err != nil {
+		t.Fatalf("go run failed: %v", err)
+	}
+	var results [][2]string
+	if err := json.Unmarshal(out, &results); err != nil {
+		t.Fatalf("Bad output %q: %v", out, err)
+	}
+	for i, c := range cases {
+		c.run = results[i]
+		if want, got := c.run[0], c.run[1]; got != want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, want)
+		}
+	}
+
+	if !strings.Contains(limited.run[1], "timed out true") {
+		t.Errorf("Expected the loop to time out, got %s", limited.run[1])
+	}
+	if got := mixed.result.Interpreted; len(got) != 1 || !strings.HasPrefix(got[0], "fibonacci") {
+		t.Errorf("Expected fibonacci to be interpreted, got %q", got)
+	}
+	if got := stack.result.Native; len(got) != 0 {
+		t.Errorf("Expected nothing native without register code, got %q", got)
+	}
+}
+
+func TestPy2GoRejectsBadPackage(t *testing.T) {
+	code := compileWithBackend(t, "x.py", "print 1\n", compiler.BackendRegister)
+	for _, name := range []string{"", "func", "a-b"} {
+		if _, err := transpiler.Generate(code, transpiler.Options{Package: name}); err == nil {
+			t.Errorf("Expected an error for package %q", name)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const pycSource = `def scale(values, factor):
+    if factor > 1:
+        return [values[0] * factor, values[1] * factor, values[2] * factor]
+    return values
+
+config = {"name": "demo", "ratio": 1.5, "enabled": True, "missing": None}
+print scale([1, 2, 3], 2), config["name"], -7
+`
+
+func writePyc(t *testing.T) ([]byte, *compiler.CodeObject) {
+	t.Helper()
+	code := compileFileSource(t, "demo.py", pycSource)
+	var buf bytes.Buffer
+	header := compiler.NewFileHeader([]byte(pycSource), time.Unix(1700000000, 5))
+	if err := compiler.WriteBytecode(&buf, code, header); err != nil {
+		t.Fatalf("WriteBytecode error: %v", err)
+	}
+	return buf.Bytes(), code
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	data, code := writePyc(t)
+	if string(data[:4]) != "GPYC" {
+		t.Fatalf("Expected the GPYC magic, got %q", data[:4])
+	}
+
+	loaded, header, err := compiler.ReadBytecode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadBytecode error: %v", err)
+	}
+	if !reflect.DeepEqual(code, loaded) {
+		t.Errorf("Code object changed in the round trip:\n%s\n%s", code.Disassemble(), loaded.Disassemble())
+	}
+	if header.FormatVersion != compiler.FormatVersion || header.OpcodeVersion != compiler.OpcodeVersion {
+		t.Errorf("Unexpected versions %+v", header)
+	}
+	if !header.SourceModTime.Equal(time.Unix(1700000000, 5)) || header.SourceSize != int64(len(pycSource)) {
+		t.Errorf("Unexpected source information %+v", header)
+	}
+
+	var out bytes.Buffer
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	if _, err := machine.Run(loaded); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	if out.String() != "[2, 4, 6] demo -7\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
+
+func TestBytecodeStaleness(t *testing.T) {
+	data, _ := writePyc(t)
+	_, header, err := compiler.ReadBytecode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Matches([]byte(pycSource)) {
+		t.Errorf("Expected the header to match its source")
+	}
+	if header.Matches([]byte(pycSource + "print 1\n")) {
+		t.Errorf("Expected edited source to be detected")
+	}
+
+	// Serialize records no source, which matches nothing.
+	var buf bytes.Buffer
+	if err := compileSource(t, "x = 1\n").Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, header, err = compiler.ReadBytecode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.HasSource() || header.Matches([]byte("x = 1\n")) || !header.SourceModTime.IsZero() {
+		t.Errorf("Expected no source information, got %+v", header)
+	}
+}
+
+func TestBytecodeRejectsBadFiles(t *testing.T) {
+	data, _ := writePyc(t)
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), data...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "not a gopy bytecode file"},
+		{"source file", []byte(pycSource), "not a gopy bytecode file"},
+		{"format version", modify(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[4:], compiler.FormatVersion+1)
+			return b
+		}), "bytecode format version 3 is not supported (expected 2)"},
+		{"opcode version", modify(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[6:], compiler.OpcodeVersion+7)
+			return b
+		}), "opcode table version"},
+		{"flipped payload bit", modify(func(b []byte) []byte {
+			b[70] ^= 0x10
+			return b
+		}), "checksum mismatch"},
+		{"changed source hash", modify(func(b []byte) []byte {
+			b[40]++
+			return b
+		}), "checksum mismatch"},
+		{"truncated", data[:len(data)-10], "corrupted"},
+		{"header only", data[:64], "corrupted"},
+	}
+	for _, tt := range tests {
+		code, _, err := compiler.ReadBytecode(bytes.NewReader(tt.data))
+		if err == nil || code != nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q in error, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	_, _, err := compiler.ReadBytecode(bytes.NewReader(modify(func(b []byte) []byte {
+		b[6]++
+		return b
+	})))
+	var versionErr *compiler.VersionError
+	if !errors.As(err, &versionErr) || versionErr.Want != compiler.OpcodeVersion {
+		t.Errorf("Expected a *VersionError, got %v", err)
+	}
+	if _, err := compiler.DeserializeCodeObject(strings.NewReader("PK\x03\x04")); !errors.Is(err, compiler.ErrNotBytecode) {
+		t.Errorf("Expected ErrNotBytecode, got %v", err)
+	}
+}
+
+// Lists and dicts are never constants, so that code objects can be shared.
+func TestBytecodeRejectsMutableConstants(t *testing.T) {
+	code := compileSource(t, "x = \"q\"\n")
+	code.Consts = append(code.Consts, &runtime.PyList{}, runtime.NewPyDict())
+	if err := compiler.WriteBytecode(&bytes.Buffer{}, code, compiler.FileHeader{}); err == nil || !strings.Contains(err.Error(), "cannot serialize constant of type list") {
+		t.Errorf("Expected list constants to be rejected, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := compiler.WriteBytecode(&buf, compileSource(t, "x = \"q\"\n"), compiler.FileHeader{}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Turn the string constant "q" into a list holding None.
+	i := bytes.Index(data[64:], []byte{'s', 1, 'q'})
+	if i < 0 {
+		t.Fatal("string constant not found")
+	}
+	copy(data[64+i:], []byte{'l', 1, 'N'})
+	binary.LittleEndian.PutUint32(data[len(data)-4:], crc32.ChecksumIEEE(data[:len(data)-4]))
+	if _, _, err := compiler.ReadBytecode(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "unknown constant tag 'l'") {
+		t.Errorf("Expected the list tag to be rejected, got %v", err)
+	}
+}
+
+// TestOpcodeTableVersion fails when the opcode table changes without
+// OpcodeVersion being incremented. Update both together.
+func TestOpcodeTableVersion(t *testing.T) {
+	const version = 4
+	names := []string{
+		"LOAD_CONST", "LOAD_NAME", "STORE_NAME", "LOAD_GLOBAL", "STORE_GLOBAL", "LOAD_FAST", "STORE_FAST",
+		"BINARY_ADD", "BINARY_SUB", "BINARY_MUL", "BINARY_DIV", "BINARY_MOD",
+		"UNARY_POS", "UNARY_NEG", "UNARY_NOT",
+		"COMPARE_EQ", "COMPARE_NE", "COMPARE_LT", "COMPARE_LE", "COMPARE_GT", "COMPARE_GE", "COMPARE_IN",
+		"JUMP_FORWARD", "JUMP_IF_FALSE", "JUMP_IF_TRUE", "JUMP_ABSOLUTE", "POP_JUMP_IF_FALSE", "POP_JUMP_IF_TRUE",
+		"BUILD_LIST", "BUILD_DICT", "BUILD_TUPLE", "BINARY_SUBSCR", "STORE_SUBSCR",
+		"CALL_FUNCTION", "RETURN_VALUE", "PRINT_EXPR", "PRINT_NEWLINE",
+		"POP_TOP", "ROT_TWO", "ROT_THREE", "DUP_TOP",
+		"SETUP_LOOP", "BREAK_LOOP", "CONTINUE_LOOP", "GET_ITER", "FOR_ITER", "NOP",
+		"LOAD_ATTR", "IMPORT_NAME", "PRINT_ITEM_TO", "PRINT_NEWLINE_TO", "MAKE_FUNCTION",
+		"LOAD_FAST_LOAD_FAST", "LOAD_FAST_LOAD_CONST", "STORE_FAST_LOAD_FAST",
+		"BINARY_ADD_FAST_CONST", "BINARY_SUB_FAST_CONST",
+		"COMPARE_IS", "COMPARE_IS_NOT",
+	}
+
+	var got []string
+	for op := compiler.OpCode(0); !strings.HasPrefix(op.String(), "UNKNOWN_OP"); op++ {
+		got = append(got, op.String())
+	}
+	if !reflect.DeepEqual(got, names) || compiler.OpcodeVersion != version {
+		t.Errorf("The opcode table changed: increment compiler.OpcodeVersion and update this test\ngot (version %d): %v", compiler.OpcodeVersion, got)
+	}
+}
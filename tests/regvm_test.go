@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func compileWithBackend(t testing.TB, filename, source string, backend compiler.Backend) *compiler.CodeObject {
+	t.Helper()
+	module, err := parser.Parse(lexer.NewLexer(source).AllTokens())
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	c := compiler.NewCompiler()
+	c.SetFilename(filename)
+	c.SetBackend(backend)
+	code, err := c.Compile(module)
+	if err != nil {
+		t.Fatalf("%s: Compile error: %v", filename, err)
+	}
+	return code
+}
+
+// runWithBackend describes what running source compiled with backend does,
+// including the line events it produces. Optimization changes the line
+// events, so they are left out above OptNone.
+func runWithBackend(t *testing.T, filename, source string, backend compiler.Backend, level int) string {
+	t.Helper()
+	code := compileWithBackend(t, filename, source, backend)
+	if err := compiler.Optimize(code, level); err != nil {
+		t.Fatalf("%s: Optimize(%d) error: %v", filename, level, err)
+	}
+	var out bytes.Buffer
+	var events []string
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	machine.SetStdin(strings.NewReader(""))
+	machine.AddHook(vm.HookFunc(func(event vm.Event, frame *vm.Frame, arg object.Object) error {
+		events = append(events, fmt.Sprintf("%s %s:%d", event, frame.Code.Name, frame.Line()))
+		return nil
+	}))
+	result, err := machine.Run(code)
+	if level > compiler.OptNone {
+		events = nil
+	}
+	return fmt.Sprintf("output %q, result %v, error %v\nevents %s", out.String(), result, err, strings.Join(events, ", "))
+}
+
+const backendErrors = `def f(n):
+    if n > 2:
+        return missing
+    return f(n + 1) + 1
+
+print f(0)
+`
+
+func TestRegisterBackendMatchesStack(t *testing.T) {
+	sources := map[string]string{
+		"optimize.py": optimizeSource,
+		"identity.py": identitySource,
+		"fib.py":      fibonacciBench,
+		"pyc.py":      pycSource,
+		"errors.py":   backendErrors,
+		"bool.py":     "def f(a, b, c):\n    x = a < b < c\n    y = a and b or c\n    if not (a or b) or c == 3:\n        c = c - 1\n    return [x, y, c]\nprint f(1, 2, 3), f(0, 0, 3), f(3, 2, 1)\n",
+		"dead.py":     "def f():\n    return g()\n    x = 1\ndef g():\n    return x\nx = 5\nprint f()\n",
+	}
+	files, _ := filepath.Glob("../examples/*.py")
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[file] = string(source)
+	}
+	for name, source := range sources {
+		for level := compiler.OptNone; level <= compiler.MaxOptLevel; level++ {
+			want := runWithBackend(t, name, source, compiler.BackendStack, level)
+			if got := runWithBackend(t, name, source, compiler.BackendRegister, level); got != want {
+				t.Errorf("%s at level %d:\n got %s\nwant %s", name, level, got, want)
+			}
+		}
+	}
+}
+
+func TestRegisterBackendCallsStackCode(t *testing.T) {
+	source := "def inner(n):\n    return n * 2\n\ndef middle(n):\n    return inner(n) + 1\n\nprint middle(20)\n"
+	code := compileWithBackend(t, "mixed.py", source, compiler.BackendRegister)
+	// middle runs on the stack engine, between two register frames.
+	code.Consts[1].(*compiler.PyFunction).Code.Registers = nil
+	out, err := runCode(t, code)
+	if err != nil || out != "41\n" {
+		t.Errorf("Expected 41, got %q, %v", out, err)
+	}
+}
+
+func runCode(t *testing.T, code *compiler.CodeObject) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	_, err := machine.Run(code)
+	return out.String(), err
+}
+
+func TestRegisterCodeIsShorter(t *testing.T) {
+	code := compileWithBackend(t, "loops.py", loopBench, compiler.BackendRegister)
+	loops := code.Consts[0].(*compiler.PyFunction).Code
+	stack, registers := len(loops.Instructions), len(loops.Registers.Instructions)
+	if registers*2 > stack {
+		t.Errorf("Expected less than half the instructions, got %d register and %d stack instructions", registers, stack)
+	}
+	// total = total + i is a single instruction.
+	if !strings.Contains(code.Disassemble(), "ADD r1 r1 r2") {
+		t.Errorf("Expected a three-address add:\n%s", code.Disassemble())
+	}
+}
+
+func TestRegisterCodeRoundTrip(t *testing.T) {
+	code := compileWithBackend(t, "demo.py", pycSource, compiler.BackendRegister)
+	var buf bytes.Buffer
+	if err := compiler.WriteBytecode(&buf, code, compiler.NewFileHeader([]byte(pycSource), time.Time{})); err != nil {
+		t.Fatalf("WriteBytecode error: %v", err)
+	}
+	loaded, _, err := compiler.ReadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("ReadBytecode error: %v", err)
+	}
+	if !reflect.DeepEqual(code, loaded) {
+		t.Errorf("Round trip changed the code object:\n%s\n%s", code.Disassemble(), loaded.Disassemble())
+	}
+
+	assembled, err := compiler.Assemble(code.Disassemble())
+	if err != nil {
+		t.Fatalf("Assemble error: %v", err)
+	}
+	if !reflect.DeepEqual(code, assembled) {
+		t.Errorf("Assembling the listing changed the code object:\n%s", assembled.Disassemble())
+	}
+}
+
+func TestVerifyRejectsBadRegisterCode(t *testing.T) {
+	tests := []struct {
+		edit func(rc *compiler.RegisterCode)
+		want string
+	}{
+		{func(rc *compiler.RegisterCode) { rc.Instructions[1].A = int32(rc.NumRegisters) }, "register index"},
+		{func(rc *compiler.RegisterCode) { rc.Instructions[0].B = compiler.ConstOperand(99) }, "constant index"},
+		{func(rc *compiler.RegisterCode) { rc.Instructions = rc.Instructions[:1] }, "ends with"},
+		{func(rc *compiler.RegisterCode) { rc.NumRegisters = -1 }, "do not fit"},
+		{func(rc *compiler.RegisterCode) { rc.Instructions[1].Op = compiler.RegMakeFunction }, "not a function"},
+	}
+	for _, tt := range tests {
+		code := compileWithBackend(t, "bad.py", "x = 1\nprint x\n", compiler.BackendRegister)
+		tt.edit(code.Registers)
+		err := compiler.Verify(code)
+		var verr *compiler.VerifyError
+		if !errors.As(err, &verr) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Expected a VerifyError containing %q, got %v", tt.want, err)
+		}
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	for _, backend := range []compiler.Backend{compiler.BackendStack, compiler.BackendRegister} {
+		if got, err := compiler.ParseBackend(backend.String()); err != nil || got != backend {
+			t.Errorf("ParseBackend(%q) = %v, %v", backend, got, err)
+		}
+	}
+	if _, err := compiler.ParseBackend("tree"); err == nil {
+		t.Errorf("Expected an error for an unknown backend")
+	}
+}
+
+func benchmarkBackend(b *testing.B, source string, backend compiler.Backend) {
+	code := compileWithBackend(b, "bench.py", source, backend)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		machine := vm.NewVM()
+		machine.SetStdout(&bytes.Buffer{})
+		if _, err := machine.Run(code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBackendFibonacci(b *testing.B) {
+	b.Run("stack", func(b *testing.B) { benchmarkBackend(b, fibonacciBench, compiler.BackendStack) })
+	b.Run("register", func(b *testing.B) { benchmarkBackend(b, fibonacciBench, compiler.BackendRegister) })
+}
+
+func BenchmarkBackendLoops(b *testing.B) {
+	b.Run("stack", func(b *testing.B) { benchmarkBackend(b, loopBench, compiler.BackendStack) })
+	b.Run("register", func(b *testing.B) { benchmarkBackend(b, loopBench, compiler.BackendRegister) })
+}
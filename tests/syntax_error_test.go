@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/parser"
+)
+
+func TestSyntaxErrorPosition(t *testing.T) {
+	_, err := parser.ParseFile("bad.py", "x = 1\ny = (2 +\n")
+	if err == nil {
+		t.Fatal("expected a syntax error")
+	}
+
+	var syntaxErr *lexer.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("expected *lexer.SyntaxError, got %T: %v", err, err)
+	}
+	if syntaxErr.Filename != "bad.py" || syntaxErr.Line != 2 {
+		t.Errorf("unexpected position %s:%d:%d", syntaxErr.Filename, syntaxErr.Line, syntaxErr.Column)
+	}
+	if !strings.HasPrefix(err.Error(), "bad.py:2:") {
+		t.Errorf("error should start with file:line, got %q", err.Error())
+	}
+}
+
+func TestSyntaxErrorExcerpt(t *testing.T) {
+	_, err := parser.ParseFile("bad.py", "print x ! 3\n")
+	list, ok := err.(parser.ErrorList)
+	if !ok || len(list) == 0 {
+		t.Fatalf("expected ErrorList, got %T: %v", err, err)
+	}
+	syntaxErr, ok := list[0].(*lexer.SyntaxError)
+	if !ok {
+		t.Fatalf("expected *lexer.SyntaxError, got %T", list[0])
+	}
+	if syntaxErr.Column != 9 {
+		t.Errorf("expected column 9, got %d", syntaxErr.Column)
+	}
+	expected := "print x ! 3\n        ^"
+	if syntaxErr.Excerpt() != expected {
+		t.Errorf("excerpt mismatch\nexpected:\n%s\ngot:\n%s", expected, syntaxErr.Excerpt())
+	}
+	if !strings.Contains(syntaxErr.Detailed(), "File \"bad.py\", line 1") {
+		t.Errorf("detailed output missing location: %s", syntaxErr.Detailed())
+	}
+}
+
+func TestIndentationErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		msg    string
+	}{
+		{"mixed tabs and spaces", "if True:\n \tx = 1\n", "inconsistent use of tabs and spaces"},
+		{"tab after spaces", "if 1:\n    x = 1\n\ty = 2\n", "inconsistent use of tabs and spaces"},
+		{"spaces after tab", "if 1:\n\tx = 1\n        y = 2\n", "inconsistent use of tabs and spaces"},
+		{"tab at the same level", "if 1:\n    if 2:\n        x = 1\n\ty = 2\n", "inconsistent use of tabs and spaces"},
+		{"bad dedent", "if True:\n        x = 1\n    y = 2\n", "unindent does not match"},
+		{"missing block", "if True:\nx = 1\n", "expected an indented block"},
+		{"unexpected indent", "x = 1\n    y = 2\n", "unexpected indent"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parser.ParseFile("indent.py", test.source)
+			list, ok := err.(parser.ErrorList)
+			if !ok {
+				t.Fatalf("expected ErrorList, got %T: %v", err, err)
+			}
+			if len(list) != 1 {
+				t.Errorf("expected one error, got %v", []error(list))
+			}
+
+			var indentErr *lexer.IndentationError
+			for _, e := range list {
+				if errors.As(e, &indentErr) && strings.Contains(indentErr.Msg, test.msg) {
+					break
+				}
+				indentErr = nil
+			}
+			if indentErr == nil {
+				t.Fatalf("expected IndentationError %q, got %v", test.msg, list)
+			}
+
+			var syntaxErr *lexer.SyntaxError
+			if !errors.As(error(indentErr), &syntaxErr) {
+				t.Error("IndentationError should match SyntaxError with errors.As")
+			}
+			if !strings.Contains(indentErr.Error(), "IndentationError") {
+				t.Errorf("unexpected message %q", indentErr.Error())
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorRecovery(t *testing.T) {
+	source := `x = (1
+if x
+    y = 2
+def f(a):
+    return a +
+print f(1)
+z = "abc
+`
+	module, err := parser.ParseFile("multi.py", source)
+	list, ok := err.(parser.ErrorList)
+	if !ok {
+		t.Fatalf("expected ErrorList, got %T: %v", err, err)
+	}
+
+	lines := []int{}
+	for _, e := range list {
+		var syntaxErr *lexer.SyntaxError
+		if !errors.As(e, &syntaxErr) {
+			t.Fatalf("unexpected error type %T", e)
+		}
+		lines = append(lines, syntaxErr.Line)
+	}
+	expected := []int{1, 2, 5, 7}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected errors on lines %v, got %v", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Fatalf("expected errors on lines %v, got %v", expected, lines)
+		}
+	}
+
+	// Statements between the errors are still parsed.
+	if module == nil || len(module.Body) < 2 {
+		t.Fatalf("expected recovered statements, got %v", module)
+	}
+	if !strings.Contains(err.Error(), "(and 3 more errors)") {
+		t.Errorf("unexpected summary %q", err.Error())
+	}
+}
+
+func TestParserWithoutRecovery(t *testing.T) {
+	p := parser.NewParser(lexer.NewLexer("x = (1\ny = )\n").AllTokens())
+	_, err := p.Parse()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, ok := err.(parser.ErrorList); ok {
+		t.Error("parser without recovery should return the first error only")
+	}
+}
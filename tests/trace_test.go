@@ -0,0 +1,232 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// runTraced runs source and returns what it printed.
+func runTraced(t *testing.T, machine *vm.VM, source string) (string, error) {
+	t.Helper()
+	code := compileFileSource(t, "trace.py", source)
+	var out bytes.Buffer
+	machine.SetStdout(&out)
+	_, err := machine.Run(code)
+	return out.String(), err
+}
+
+const traceFunctions = `import sys
+
+def add(a, b):
+    c = a + b
+    return c
+
+def twice(n):
+    return add(n, n)
+`
+
+func TestSysSettrace(t *testing.T) {
+	out, err := runTraced(t, vm.NewVM(), traceFunctions+`
+def tracer(frame, event, arg):
+    print event, frame.f_code.co_name, frame.f_lineno, arg
+    return tracer
+
+sys.settrace(tracer)
+x = twice(2)
+sys.settrace(None)
+print x
+`)
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	want := `call twice 8 None
+line twice 8 None
+call add 4 None
+line add 4 None
+line add 5 None
+return add 5 4
+return twice 8 4
+4
+`
+	if out != want {
+		t.Errorf("Unexpected trace\nexpected:\n%s\ngot:\n%s", want, out)
+	}
+}
+
+func TestSysSettraceLocalTracer(t *testing.T) {
+	// Only frames of add get a local tracer, and it sees locals.
+	out, err := runTraced(t, vm.NewVM(), traceFunctions+`
+def local(frame, event, arg):
+    if event == "return":
+        print "locals", frame.f_locals
+    return local
+
+def tracer(frame, event, arg):
+    print "enter", frame.f_code.co_name, frame.f_code.co_varnames
+    if frame.f_code.co_name == "add":
+        return local
+    return None
+
+sys.settrace(tracer)
+twice(5)
+print sys.gettrace() == tracer
+sys.settrace(None)
+print sys.gettrace()
+`)
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	want := `enter twice [n]
+enter add [a, b, c]
+locals {a: 5, b: 5, c: 10}
+True
+None
+`
+	if out != want {
+		t.Errorf("Unexpected trace\nexpected:\n%s\ngot:\n%s", want, out)
+	}
+}
+
+func TestSysSetprofile(t *testing.T) {
+	out, err := runTraced(t, vm.NewVM(), traceFunctions+`
+def profile(frame, event, arg):
+    print event, frame.f_code.co_name, frame.f_back.f_code.co_name, arg
+
+sys.setprofile(profile)
+twice(1)
+sys.setprofile(None)
+`)
+	if err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	want := `call twice <module> None
+call add twice None
+return add twice 2
+return twice <module> 2
+`
+	if out != want {
+		t.Errorf("Unexpected profile\nexpected:\n%s\ngot:\n%s", want, out)
+	}
+}
+
+func TestSysSettraceErrors(t *testing.T) {
+	machine := vm.NewVM()
+	out, err := runTraced(t, machine, traceFunctions+`
+def tracer(frame, event, arg):
+    return undefined_name
+
+sys.settrace(tracer)
+twice(1)
+`)
+	var exc *vm.Exception
+	if !errors.As(err, &exc) || exc.Type != "NameError" {
+		t.Fatalf("Expected the trace function's NameError, got %v (output %q)", err, out)
+	}
+
+	// A failing trace function is uninstalled.
+	out, err = runTraced(t, machine, "import sys\nprint sys.gettrace()\n")
+	if err != nil || out != "None\n" {
+		t.Errorf("Expected no trace function after the error, got %q, %v", out, err)
+	}
+
+	if _, err := runTraced(t, machine, "import sys\nsys.settrace(1)\n"); err == nil || !strings.Contains(err.Error(), "TypeError") {
+		t.Errorf("Expected a TypeError for a non-callable, got %v", err)
+	}
+}
+
+func TestSysSettraceClearedOnReset(t *testing.T) {
+	pool := vm.NewPool(nil)
+	machine := pool.Get()
+	if _, err := runTraced(t, machine, traceFunctions+`
+def tracer(frame, event, arg):
+    print "traced"
+
+sys.settrace(tracer)
+`); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(machine)
+
+	machine = pool.Get()
+	out, err := runTraced(t, machine, traceFunctions+"print twice(3)\n")
+	if err != nil || out != "6\n" {
+		t.Errorf("Expected a reset VM to run untraced, got %q, %v", out, err)
+	}
+}
+
+func TestVMCallFunction(t *testing.T) {
+	machine := vm.NewVM()
+	if _, err := runTraced(t, machine, traceFunctions); err != nil {
+		t.Fatal(err)
+	}
+
+	// Python functions can be called from Go hooks while a program runs.
+	var calls []string
+	machine.AddHook(vm.HookFunc(func(event vm.Event, frame *vm.Frame, arg object.Object) error {
+		if event == vm.EventCall && frame.Code.Name == "twice" {
+			result, err := machine.CallFunction(machine.Globals()["add"], &runtime.PyInt{Value: 10}, &runtime.PyInt{Value: 1})
+			if err != nil {
+				return err
+			}
+			calls = append(calls, result.String())
+		}
+		return nil
+	}))
+	out, err := runTraced(t, machine, traceFunctions+"print twice(4)\n")
+	if err != nil || out != "8\n" {
+		t.Fatalf("Unexpected result %q, %v", out, err)
+	}
+	if strings.Join(calls, ",") != "11" {
+		t.Errorf("Expected one nested call returning 11, got %v", calls)
+	}
+
+	if _, err := machine.CallFunction(machine.Globals()["add"], &runtime.PyInt{Value: 1}); err == nil {
+		t.Errorf("Expected a TypeError for the wrong number of arguments")
+	}
+}
+
+func TestSysSettraceKeepsLimits(t *testing.T) {
+	source := `import sys
+
+def tracer(frame, event, arg):
+    while True:
+        pass
+
+def f():
+    return 1
+
+sys.settrace(tracer)
+f()
+`
+	machine := vm.NewVM()
+	machine.SetTimeout(50 * time.Millisecond)
+	_, err := machine.Run(compileFileSource(t, "trace.py", source))
+	var timeoutErr *vm.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected TimeoutError, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = vm.NewVM().RunContext(ctx, compileFileSource(t, "trace.py", source))
+	var cancelErr *vm.CancelledError
+	if !errors.As(err, &cancelErr) {
+		t.Fatalf("Expected CancelledError, got %v", err)
+	}
+
+	machine = vm.NewVM()
+	machine.SetMaxInstructions(10000)
+	_, err = machine.Run(compileFileSource(t, "trace.py", source))
+	var limitErr *vm.InstructionLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Expected InstructionLimitError, got %v", err)
+	}
+}
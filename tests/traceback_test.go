@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const tracebackSource = `def inner(x):
+    y = x + 1
+    return missing + y
+
+def outer():
+    return inner(1)
+
+print "start"
+outer()
+`
+
+func compileFileSource(t testing.TB, filename, source string) *compiler.CodeObject {
+	t.Helper()
+	module, err := parser.Parse(lexer.NewLexer(source).AllTokens())
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	code, err := compiler.CompileFile(module, filename)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	return code
+}
+
+func TestCompilerLineTable(t *testing.T) {
+	code := compileFileSource(t, "script.py", tracebackSource)
+
+	if code.Filename != "script.py" {
+		t.Errorf("Expected filename script.py, got %q", code.Filename)
+	}
+	if len(code.LineTable) == 0 {
+		t.Fatalf("Expected a line table")
+	}
+	for i := 1; i < len(code.LineTable); i++ {
+		if code.LineTable[i].Offset <= code.LineTable[i-1].Offset {
+			t.Errorf("Line table offsets not increasing: %v", code.LineTable)
+		}
+	}
+
+	var inner *compiler.CodeObject
+	for _, c := range code.Consts {
+		if fn, ok := c.(*compiler.PyFunction); ok && fn.Name == "inner" {
+			inner = fn.Code
+		}
+	}
+	if inner == nil {
+		t.Fatalf("inner function not found in constants")
+	}
+	if inner.Filename != "script.py" {
+		t.Errorf("Nested code should inherit filename, got %q", inner.Filename)
+	}
+	if line := inner.LineForOffset(0); line != 2 {
+		t.Errorf("Expected first instruction of inner on line 2, got %d", line)
+	}
+	if line := inner.LineForOffset(len(inner.Instructions) - 1); line != 3 {
+		t.Errorf("Expected last instruction of inner on line 3, got %d", line)
+	}
+}
+
+func TestRuntimeTraceback(t *testing.T) {
+	code := compileFileSource(t, "script.py", tracebackSource)
+
+	machine := vm.NewVM()
+	machine.SetStdout(&strings.Builder{})
+	machine.SetSource("script.py", tracebackSource)
+	_, err := machine.Run(code)
+
+	var tb *vm.Traceback
+	if !errors.As(err, &tb) {
+		t.Fatalf("Expected *vm.Traceback, got %T: %v", err, err)
+	}
+
+	expected := []vm.TracebackEntry{
+		{Filename: "script.py", Line: 9, Name: "<module>", Source: "outer()"},
+		{Filename: "script.py", Line: 6, Name: "outer", Source: "return inner(1)"},
+		{Filename: "script.py", Line: 3, Name: "inner", Source: "return missing + y"},
+	}
+	if len(tb.Entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d: %v", len(expected), len(tb.Entries), tb.Entries)
+	}
+	for i, entry := range expected {
+		if tb.Entries[i] != entry {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, entry, tb.Entries[i])
+		}
+	}
+
+	var exc *vm.Exception
+	if !errors.As(err, &exc) || exc.Type != "NameError" {
+		t.Errorf("Expected wrapped NameError, got %v", err)
+	}
+
+	want := `Traceback (most recent call last):
+  File "script.py", line 9, in <module>
+    outer()
+  File "script.py", line 6, in outer
+    return inner(1)
+  File "script.py", line 3, in inner
+    return missing + y
+NameError: global name 'missing' is not defined`
+	if err.Error() != want {
+		t.Errorf("Unexpected traceback text:\n%s\nwant:\n%s", err.Error(), want)
+	}
+}
+
+func TestTracebackRecursionSummary(t *testing.T) {
+	code := compileFileSource(t, "rec.py", "def f(n):\n    return f(n + 1)\nf(0)")
+
+	machine := vm.NewVM()
+	machine.SetMaxRecursionDepth(20)
+	_, err := machine.Run(code)
+	if err == nil {
+		t.Fatalf("Expected recursion error")
+	}
+	text := err.Error()
+	if !strings.Contains(text, "[Previous line repeated 16 more times]") {
+		t.Errorf("Expected repeated frames to be summarized:\n%s", text)
+	}
+	if !strings.HasSuffix(text, "RuntimeError: maximum recursion depth exceeded") {
+		t.Errorf("Unexpected final line:\n%s", text)
+	}
+}
@@ -0,0 +1,215 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/object"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const verifySource = `def classify(values):
+    total = 0
+    for v in values:
+        if v > 2:
+            total = total + v
+        else:
+            total = total - 1
+    return total
+
+def first_big(values):
+    for v in values:
+        for w in values:
+            if v * w > 6:
+                return [v, w]
+    return None
+
+print classify([1, 2, 3, 4]), classify([]), first_big([1, 2, 3]), first_big([1])
+`
+
+func TestVerifiedProgramRuns(t *testing.T) {
+	code := compileFileSource(t, "verify.py", verifySource)
+	if code.StackSize != 5 {
+		t.Errorf("Expected module stack size 5, got %d", code.StackSize)
+	}
+	classify := code.Consts[0].(*compiler.PyFunction).Code
+	if classify.StackSize != 3 {
+		t.Errorf("Expected classify() stack size 3, got %d", classify.StackSize)
+	}
+
+	var out bytes.Buffer
+	machine := vm.NewVM()
+	machine.SetStdout(&out)
+	if _, err := machine.Run(code); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	if out.String() != "5 0 [3, 3] None\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
+
+func instrs(ops ...interface{}) []compiler.Instruction {
+	var list []compiler.Instruction
+	for i := 0; i < len(ops); i += 2 {
+		list = append(list, compiler.Instruction{Op: ops[i].(compiler.OpCode), Arg: ops[i+1].(int)})
+	}
+	return list
+}
+
+func TestVerifyRejectsBadCode(t *testing.T) {
+	none := []object.Object{&runtime.PyNone{}}
+	tests := []struct {
+		name string
+		code *compiler.CodeObject
+		want string
+	}{
+		{"constant index", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 1, compiler.OpReturnValue, 0),
+			Consts:       none,
+		}, "at offset 0 (LOAD_CONST): constant index 1 out of range (1 constants)"},
+		{"name index", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadName, -1, compiler.OpReturnValue, 0),
+		}, "name index -1 out of range"},
+		{"local index", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpStoreFast, 0),
+			Consts:       none,
+		}, "local variable index 0 out of range"},
+		{"jump past end", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpJumpAbsolute, 3, compiler.OpNop, 0),
+		}, "jump target 3 out of range"},
+		{"relative jump past end", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpJumpForward, 2, compiler.OpNop, 0),
+		}, "jump target 3 out of range"},
+		{"underflow", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpBinaryAdd, 0),
+			Consts:       none,
+		}, "stack underflow: needs 2 values, has 1"},
+		{"call underflow", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpCallFunction, 1000000),
+			Consts:       none,
+		}, "needs 1000001 values"},
+		{"negative count", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpBuildList, -2),
+		}, "count -2 out of range"},
+		{"unbalanced loop", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpJumpAbsolute, 0),
+			Consts:       none,
+		}, "reached with stack depths 0 and 1"},
+		{"unsupported opcode", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpSetupLoop, 0),
+		}, "opcode is not supported"},
+		{"unknown opcode", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpCode(200), 0),
+		}, "UNKNOWN_OP_200"},
+		{"argument count", &compiler.CodeObject{Argcount: 1}, "argument count 1 does not fit 0 local variables"},
+		{"nested function", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpReturnValue, 0),
+			Consts: []object.Object{&compiler.PyFunction{Name: "f", Code: &compiler.CodeObject{
+				Name:         "f",
+				Instructions: instrs(compiler.OpPopTop, 0),
+			}}},
+		}, "invalid bytecode in f at offset 0 (POP_TOP)"},
+		{"list constant", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpReturnValue, 0),
+			Consts:       []object.Object{&runtime.PyList{}},
+		}, "list cannot be a constant"},
+		{"dict constant", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpReturnValue, 0),
+			Consts:       []object.Object{runtime.NewPyDict()},
+		}, "dict cannot be a constant"},
+		{"builtin constant", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpReturnValue, 0),
+			Consts:       []object.Object{&compiler.PyBuiltin{Name: "len"}},
+		}, "cannot be a constant"},
+		{"bound function", &compiler.CodeObject{
+			Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpReturnValue, 0),
+			Consts: []object.Object{&compiler.PyFunction{Name: "f", Globals: runtime.NewNamespace(), Code: &compiler.CodeObject{
+				Name:         "f",
+				Instructions: instrs(compiler.OpLoadConst, 0, compiler.OpReturnValue, 0),
+				Consts:       none,
+			}}},
+		}, "function f is bound to globals"},
+	}
+	for _, tt := range tests {
+		if tt.code.Name == "" {
+			tt.code.Name = "<module>"
+		}
+		err := compiler.Verify(tt.code)
+		var verr *compiler.VerifyError
+		if !errors.As(err, &verr) {
+			t.Errorf("%s: expected a *VerifyError, got %v", tt.name, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q in error, got %q", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestReadBytecodeVerifies(t *testing.T) {
+	bad := &compiler.CodeObject{Name: "<module>", Instructions: instrs(compiler.OpPopTop, 0)}
+	var buf bytes.Buffer
+	if err := bad.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, err := compiler.DeserializeCodeObject(&buf)
+	var verr *compiler.VerifyError
+	if !errors.As(err, &verr) || verr.Offset != 0 {
+		t.Errorf("Expected a *VerifyError at offset 0, got %v", err)
+	}
+}
+
+// TestVerifiedMutationsDoNotPanic runs randomly corrupted bytecode: either
+// Verify rejects it or the VM runs it without a Go panic.
+func TestVerifiedMutationsDoNotPanic(t *testing.T) {
+	original := compileFileSource(t, "verify.py", verifySource)
+	rng := rand.New(rand.NewSource(1))
+	accepted := 0
+	for i := 0; i < 2000; i++ {
+		var buf bytes.Buffer
+		if err := original.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		code, err := compiler.DeserializeCodeObject(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target := code
+		if rng.Intn(2) == 0 {
+			target = code.Consts[rng.Intn(2)].(*compiler.PyFunction).Code
+		}
+		for n := rng.Intn(3) + 1; n > 0; n-- {
+			instr := &target.Instructions[rng.Intn(len(target.Instructions))]
+			if rng.Intn(2) == 0 {
+				instr.Op = compiler.OpCode(rng.Intn(int(compiler.OpMakeFunction) + 2))
+			} else {
+				instr.Arg = rng.Intn(len(target.Instructions)+4) - 2
+			}
+		}
+		if compiler.Verify(code) != nil {
+			continue
+		}
+		accepted++
+
+		machine := vm.NewVM()
+		machine.SetStdout(&bytes.Buffer{})
+		machine.SetMaxInstructions(10000)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("VM panicked on verified code: %v\n%s", r, code.Disassemble())
+				}
+			}()
+			machine.Run(code)
+		}()
+	}
+	if accepted == 0 {
+		t.Errorf("Expected some mutations to pass verification")
+	}
+}
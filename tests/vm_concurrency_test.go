@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+// Run these with -race (see `make test-race`) to check that compiled code
+// can be shared between VMs.
+
+const sharedProgram = `def fib(n):
+    if n < 2:
+        return n
+    return fib(n - 1) + fib(n - 2)
+
+total = 0
+for i in range(10):
+    total += fib(i)
+counter = {"calls": total}
+print total
+total`
+
+func snapshotCode(code *compiler.CodeObject) *compiler.CodeObject {
+	var buf bytes.Buffer
+	if err := code.Serialize(&buf); err != nil {
+		panic(err)
+	}
+	copied, err := compiler.DeserializeCodeObject(&buf)
+	if err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+func TestSharedCodeConcurrentVMs(t *testing.T) {
+	code := compileSource(t, sharedProgram)
+	before := snapshotCode(code)
+
+	const workers = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var stdout bytes.Buffer
+			machine := vm.NewVM()
+			machine.SetStdout(&stdout)
+			for i := 0; i < 5; i++ {
+				stdout.Reset()
+				result, err := machine.Run(code)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if intObj, ok := result.(*runtime.PyInt); !ok || intObj.Value != 88 || stdout.String() != "88\n" {
+					errs <- fmt.Errorf("unexpected result %v / %q", result, stdout.String())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(before, snapshotCode(code)) {
+		t.Errorf("CodeObject was modified by execution")
+	}
+}
+
+func TestSharedCodeFreshFunctions(t *testing.T) {
+	code := compileSource(t, "def f():\n    return 1\nf")
+
+	first, err := vm.NewVM().Run(code)
+	if err != nil {
+		t.Fatalf("Execution error: %v", err)
+	}
+	second, err := vm.NewVM().Run(code)
+	if err != nil {
+		t.Fatalf("Execution error: %v", err)
+	}
+
+	f1, ok1 := first.(*compiler.PyFunction)
+	f2, ok2 := second.(*compiler.PyFunction)
+	if !ok1 || !ok2 {
+		t.Fatalf("Expected functions, got %T and %T", first, second)
+	}
+	if f1 == f2 {
+		t.Errorf("VMs share the same function object")
+	}
+	if f1.Globals == nil || reflect.ValueOf(f1.Globals).Pointer() == reflect.ValueOf(f2.Globals).Pointer() {
+		t.Errorf("Functions must be bound to their own VM's globals")
+	}
+	for _, c := range code.Consts {
+		if fn, ok := c.(*compiler.PyFunction); ok && fn.Globals != nil {
+			t.Errorf("Function template in Consts was bound to globals")
+		}
+	}
+}
+
+func TestVMPool(t *testing.T) {
+	pool := vm.NewPool(func() *vm.VM {
+		machine := vm.NewVM()
+		machine.SetMaxInstructions(100000)
+		return machine
+	})
+	code := compileSource(t, sharedProgram)
+	leak := compileSource(t, "secret = 42")
+	probe := compileSource(t, "secret")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for w := 0; w < 64; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			machine := pool.Get()
+			defer pool.Put(machine)
+
+			if _, err := machine.Run(probe); err == nil {
+				errs <- fmt.Errorf("globals leaked between pooled executions")
+				return
+			}
+			if _, err := machine.Run(leak); err != nil {
+				errs <- err
+				return
+			}
+			var stdout bytes.Buffer
+			machine.SetStdout(&stdout)
+			if _, err := machine.Run(code); err != nil {
+				errs <- err
+				return
+			}
+			if stdout.String() != "88\n" {
+				errs <- fmt.Errorf("unexpected output %q", stdout.String())
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
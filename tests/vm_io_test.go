@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/compiler"
+	"github.com/warriorguo/gopy/pkg/lexer"
+	"github.com/warriorguo/gopy/pkg/parser"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func compileSource(t *testing.T, source string) *compiler.CodeObject {
+	t.Helper()
+	module, err := parser.Parse(lexer.NewLexer(source).AllTokens())
+	if err != nil {
+		t.Fatalf("Parse error for %q: %v", source, err)
+	}
+	code, err := compiler.Compile(module)
+	if err != nil {
+		t.Fatalf("Compile error for %q: %v", source, err)
+	}
+	return code
+}
+
+func TestVMStreams(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		stdin  string
+		stdout string
+		stderr string
+	}{
+		{
+			name:   "print",
+			source: "print 1, \"two\"\nprint",
+			stdout: "1 two\n\n",
+		},
+		{
+			name:   "print_to_stderr",
+			source: "import sys\nprint >>sys.stderr, \"oops\", 42\nprint \"ok\"",
+			stdout: "ok\n",
+			stderr: "oops 42\n",
+		},
+		{
+			name:   "sys_write",
+			source: "import sys\nsys.stdout.write(\"a\")\nsys.stderr.write(\"b\")\nsys.stdout.write(\"c\\n\")",
+			stdout: "ac\n",
+			stderr: "b",
+		},
+		{
+			name:   "raw_input",
+			source: "name = raw_input(\"name? \")\nprint \"hello\", name\nprint raw_input()",
+			stdin:  "gopy\nsecond line\n",
+			stdout: "name? hello gopy\nsecond line\n",
+		},
+		{
+			name:   "stdin_readline",
+			source: "import sys\nprint len(sys.stdin.readline())\nprint len(sys.stdin.readline())",
+			stdin:  "abc\n",
+			stdout: "4\n0\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			machine := vm.NewVM()
+			machine.SetStdout(&stdout)
+			machine.SetStderr(&stderr)
+			machine.SetStdin(strings.NewReader(test.stdin))
+
+			if _, err := machine.Run(compileSource(t, test.source)); err != nil {
+				t.Fatalf("Execution error: %v", err)
+			}
+			if stdout.String() != test.stdout {
+				t.Errorf("stdout: expected %q, got %q", test.stdout, stdout.String())
+			}
+			if stderr.String() != test.stderr {
+				t.Errorf("stderr: expected %q, got %q", test.stderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestVMStreamErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		errMsg string
+	}{
+		{"raw_input()", "EOFError"},
+		{"import nosuchmodule", "ImportError"},
+		{"import sys\nsys.nothing", "AttributeError"},
+		{"print >>42, \"x\"", "AttributeError"},
+	}
+
+	for _, test := range tests {
+		machine := vm.NewVM()
+		machine.SetStdin(strings.NewReader(""))
+		_, err := machine.Run(compileSource(t, test.source))
+		if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("Expected %s for %q, got %v", test.errMsg, test.source, err)
+		}
+	}
+}
+
+func TestVMStreamsConcurrent(t *testing.T) {
+	code := compileSource(t, "import sys\nfor i in range(3):\n    print i\n    print >>sys.stderr, i * 10")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for n := 0; n < 16; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var stdout, stderr bytes.Buffer
+			machine := vm.NewVM()
+			machine.SetStdout(&stdout)
+			machine.SetStderr(&stderr)
+			if _, err := machine.Run(code); err != nil {
+				errs <- err
+				return
+			}
+			if stdout.String() != "0\n1\n2\n" || stderr.String() != "0\n10\n20\n" {
+				errs <- fmt.Errorf("unexpected output %q / %q", stdout.String(), stderr.String())
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+const infiniteLoop = "while True:\n    pass"
+
+func TestVMInstructionLimit(t *testing.T) {
+	machine := vm.NewVM()
+	machine.SetMaxInstructions(10000)
+
+	_, err := machine.Run(compileSource(t, infiniteLoop))
+	var limitErr *vm.InstructionLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Expected InstructionLimitError, got %v", err)
+	}
+	if limitErr.Limit != 10000 {
+		t.Errorf("Expected limit 10000, got %d", limitErr.Limit)
+	}
+
+	// A program under the budget is unaffected, and the VM stays usable.
+	result, err := machine.Run(compileSource(t, "x = 0\nfor i in range(10):\n    x += i\nx"))
+	if err != nil {
+		t.Fatalf("Execution error after limit: %v", err)
+	}
+	if intObj, ok := result.(*runtime.PyInt); !ok || intObj.Value != 45 {
+		t.Errorf("Expected 45, got %v", result)
+	}
+}
+
+func TestVMTimeout(t *testing.T) {
+	machine := vm.NewVM()
+	machine.SetTimeout(20 * time.Millisecond)
+
+	start := time.Now()
+	_, err := machine.Run(compileSource(t, infiniteLoop))
+	var timeoutErr *vm.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected TimeoutError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Timeout took too long to fire: %s", elapsed)
+	}
+}
+
+func TestVMRunContextCancel(t *testing.T) {
+	machine := vm.NewVM()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := machine.RunContext(ctx, compileSource(t, infiniteLoop))
+	var cancelErr *vm.CancelledError
+	if !errors.As(err, &cancelErr) {
+		t.Fatalf("Expected CancelledError, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error to wrap context.Canceled, got %v", err)
+	}
+}
+
+func TestVMRunContextDeadline(t *testing.T) {
+	machine := vm.NewVM()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := machine.RunContext(ctx, compileSource(t, "def spin():\n    while True:\n        pass\nspin()"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func TestVMRecursionLimit(t *testing.T) {
+	source := "def f(n):\n    return f(n + 1)\nf(0)"
+
+	machine := vm.NewVM()
+	_, err := machine.Run(compileSource(t, source))
+	var exc *vm.Exception
+	if !errors.As(err, &exc) {
+		t.Fatalf("Expected vm.Exception, got %v", err)
+	}
+	if exc.Type != "RuntimeError" || !strings.Contains(exc.Message, "maximum recursion depth exceeded") {
+		t.Errorf("Unexpected exception: %v", exc)
+	}
+
+	machine.SetMaxRecursionDepth(50)
+	_, err = machine.Run(compileSource(t, "def f(n):\n    if n == 0:\n        return 0\n    return f(n - 1)\nf(100)"))
+	if err == nil || !strings.Contains(err.Error(), "maximum recursion depth exceeded") {
+		t.Errorf("Expected recursion error with depth 50, got %v", err)
+	}
+
+	result, err := machine.Run(compileSource(t, "f(10)"))
+	if err != nil {
+		t.Fatalf("Execution error after recursion error: %v", err)
+	}
+	if intObj, ok := result.(*runtime.PyInt); !ok || intObj.Value != 0 {
+		t.Errorf("Expected 0, got %v", result)
+	}
+}
+
+func TestVMDeepRecursionAllowed(t *testing.T) {
+	machine := vm.NewVM()
+	machine.SetMaxRecursionDepth(5000)
+	result, err := machine.Run(compileSource(t, "def f(n):\n    if n == 0:\n        return 0\n    return 1 + f(n - 1)\nf(3000)"))
+	if err != nil {
+		t.Fatalf("Execution error: %v", err)
+	}
+	if intObj, ok := result.(*runtime.PyInt); !ok || intObj.Value != 3000 {
+		t.Errorf("Expected 3000, got %v", result)
+	}
+}
+
+func TestVMOperandStackLimit(t *testing.T) {
+	elements := strings.Repeat("1, ", 200)
+	source := "x = [" + elements + "1]"
+
+	machine := vm.NewVM()
+	if _, err := machine.Run(compileSource(t, source)); err != nil {
+		t.Fatalf("Execution error with default stack: %v", err)
+	}
+
+	machine.SetMaxStackSize(64)
+	_, err := machine.Run(compileSource(t, source))
+	var exc *vm.Exception
+	if !errors.As(err, &exc) || exc.Type != "RuntimeError" {
+		t.Errorf("Expected RuntimeError for stack overflow, got %v", err)
+	}
+}
+
+func TestVMMemoryLimit(t *testing.T) {
+	tests := []string{
+		"x = range(1000000)",
+		"s = \"x\"\nwhile True:\n    s = s + s",
+		"while True:\n    d = {1: [1, 2, 3], 2: \"two\"}",
+	}
+
+	for _, source := range tests {
+		machine := vm.NewVM()
+		machine.SetMemoryLimit(1 << 20)
+		_, err := machine.Run(compileSource(t, source))
+		var exc *vm.Exception
+		if !errors.As(err, &exc) || exc.Type != "MemoryError" {
+			t.Errorf("Expected MemoryError for %q, got %v", source, err)
+		}
+	}
+
+	machine := vm.NewVM()
+	machine.SetMemoryLimit(1 << 20)
+	if _, err := machine.Run(compileSource(t, "x = range(100)\ny = \"a\" + \"b\"")); err != nil {
+		t.Errorf("Unexpected error under memory limit: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/warriorguo/gopy/pkg/runtime"
+	"github.com/warriorguo/gopy/pkg/vm"
+)
+
+func expectSecurityError(t *testing.T, err error, source string) {
+	t.Helper()
+	var exc *vm.Exception
+	if !errors.As(err, &exc) || exc.Type != "SecurityError" {
+		t.Errorf("Expected SecurityError for %q, got %v", source, err)
+	}
+}
+
+func TestSandboxBuiltins(t *testing.T) {
+	machine := vm.NewVM()
+	machine.SetPolicy(&vm.Policy{Builtins: []string{"len", "range"}})
+
+	if _, err := machine.Run(compileSource(t, "len(range(3))")); err != nil {
+		t.Errorf("Allowed builtin failed: %v", err)
+	}
+
+	_, err := machine.Run(compileSource(t, "str(1)"))
+	if err == nil || !strings.Contains(err.Error(), "name 'str' is not defined") {
+		t.Errorf("Expected hidden builtin to be undefined, got %v", err)
+	}
+
+	machine.SetPolicy(nil)
+	if _, err := machine.Run(compileSource(t, "str(1)")); err != nil {
+		t.Errorf("Builtin not restored after clearing policy: %v", err)
+	}
+}
+
+func TestSandboxModules(t *testing.T) {
+	machine := vm.NewVM()
+	machine.SetPolicy(&vm.Policy{Modules: []string{"sys"}})
+
+	if _, err := machine.Run(compileSource(t, "import sys")); err != nil {
+		t.Errorf("Allowed module failed: %v", err)
+	}
+
+	_, err := machine.Run(compileSource(t, "import os"))
+	expectSecurityError(t, err, "import os")
+
+	// os is in the allow list but needs environment access.
+	machine.SetPolicy(&vm.Policy{Modules: []string{"os"}})
+	_, err = machine.Run(compileSource(t, "import os"))
+	expectSecurityError(t, err, "import os without CapEnv")
+
+	os.Setenv("GOPY_SANDBOX_TEST", "visible")
+	defer os.Unsetenv("GOPY_SANDBOX_TEST")
+	machine.SetPolicy(&vm.Policy{Modules: []string{"os"}, Capabilities: vm.CapEnv})
+	result, err := machine.Run(compileSource(t, "import os\nos.getenv(\"GOPY_SANDBOX_TEST\")"))
+	if err != nil {
+		t.Fatalf("os.getenv with CapEnv failed: %v", err)
+	}
+	if str, ok := result.(*runtime.PyString); !ok || str.Value != "visible" {
+		t.Errorf("Expected 'visible', got %v", result)
+	}
+}
+
+func TestSandboxHostModule(t *testing.T) {
+	machine := vm.NewVM()
+	machine.RegisterModule("net", vm.CapNetwork, func() *runtime.PyModule {
+		module := runtime.NewPyModule("net")
+		module.Dict["host"] = &runtime.PyString{Value: "example.invalid"}
+		return module
+	})
+
+	machine.SetPolicy(&vm.Policy{Capabilities: vm.CapFile})
+	_, err := machine.Run(compileSource(t, "import net"))
+	expectSecurityError(t, err, "import net")
+
+	machine.SetPolicy(&vm.Policy{Capabilities: vm.CapNetwork})
+	result, err := machine.Run(compileSource(t, "import net\nnet.host"))
+	if err != nil {
+		t.Fatalf("Host module with CapNetwork failed: %v", err)
+	}
+	if result.String() != "example.invalid" {
+		t.Errorf("Expected example.invalid, got %v", result)
+	}
+}
+
+func TestSandboxFileAccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	source := "f = open(\"" + path + "\", \"w\")\nprint >>f, \"hello\", 1\nf.close()\nf = open(\"" + path + "\")\ndata = f.read()\nf.close()\ndata"
+
+	machine := vm.NewVM()
+	machine.SetPolicy(&vm.Policy{})
+	_, err := machine.Run(compileSource(t, source))
+	expectSecurityError(t, err, "open")
+	if _, statErr := os.Stat(path); statErr == nil {
+		t.Errorf("File was created despite missing CapFile")
+	}
+
+	machine.SetPolicy(&vm.Policy{Capabilities: vm.CapFile})
+	result, err := machine.Run(compileSource(t, source))
+	if err != nil {
+		t.Fatalf("File access with CapFile failed: %v", err)
+	}
+	if result.String() != "hello 1\n" {
+		t.Errorf("Expected file contents %q, got %q", "hello 1\n", result.String())
+	}
+}
+
+func TestSandboxDunderAttributes(t *testing.T) {
+	var stdout bytes.Buffer
+	machine := vm.NewVM()
+	machine.SetStdout(&stdout)
+	machine.SetPolicy(&vm.Policy{})
+
+	_, err := machine.Run(compileSource(t, "import sys\nprint sys.__name__"))
+	expectSecurityError(t, err, "sys.__name__")
+
+	machine.SetPolicy(&vm.Policy{AllowDunder: true})
+	if _, err := machine.Run(compileSource(t, "import sys\nprint sys.__name__")); err != nil {
+		t.Fatalf("Dunder access with AllowDunder failed: %v", err)
+	}
+	if stdout.String() != "sys\n" {
+		t.Errorf("Expected %q, got %q", "sys\n", stdout.String())
+	}
+}
+
+func TestSandboxTracebackSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("root:x:0:0:secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The filename in the bytecode names a host file the script cannot open.
+	code := compileFileSource(t, path, "x = 1 / 0\n")
+
+	machine := vm.NewVM()
+	machine.SetPolicy(&vm.Policy{})
+	_, err := machine.Run(code)
+	if err == nil || strings.Contains(err.Error(), "root:x") {
+		t.Errorf("Expected a traceback without the file contents, got %v", err)
+	}
+
+	machine.SetSource(path, "x = 1 / 0\n")
+	_, err = machine.Run(code)
+	if err == nil || !strings.Contains(err.Error(), "    x = 1 / 0\n") {
+		t.Errorf("Expected the registered source in the traceback, got %v", err)
+	}
+
+	machine.Reset()
+	_, err = machine.Run(code)
+	if err == nil || strings.Contains(err.Error(), "x = 1 / 0") {
+		t.Errorf("Expected Reset to drop the registered source, got %v", err)
+	}
+
+	machine.SetPolicy(&vm.Policy{Capabilities: vm.CapFile})
+	_, err = machine.Run(code)
+	if err == nil || !strings.Contains(err.Error(), "root:x:0:0:secret") {
+		t.Errorf("Expected the file line with CapFile, got %v", err)
+	}
+}